@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL lists the clients allowed to use a feature such as zone transfers,
+// by network or by the TSIG key their requests are signed with. An empty
+// ACL allows nobody.
+type ACL struct {
+	networks []*net.IPNet
+	keys     []string
+}
+
+// ParseACL accepts single addresses, CIDR prefixes and "key <name>".
+func ParseACL(entries []string) (ACL, error) {
+	acl := ACL{}
+	for _, entry := range entries {
+		if name, ok := strings.CutPrefix(entry, "key "); ok {
+			key, err := lookupTSIGKey(strings.TrimSpace(name))
+			if err != nil {
+				return ACL{}, err
+			}
+			acl.keys = append(acl.keys, key.Name)
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return ACL{}, fmt.Errorf("Invalid ACL entry %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			acl.networks = append(acl.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return ACL{}, fmt.Errorf("Invalid ACL entry %q", entry)
+		}
+		acl.networks = append(acl.networks, network)
+	}
+	return acl, nil
+}
+
+// Allows reports whether a request from addr, signed with the TSIG key
+// named key ("" if unsigned), is allowed.
+func (acl ACL) Allows(addr net.Addr, key string) bool {
+	for _, name := range acl.keys {
+		if key != "" && name == key {
+			return true
+		}
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
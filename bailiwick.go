@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Response sanitization. A server is only believed about names in the
+// zone it was asked as a server for, its bailiwick; anything else in a
+// response is dropped before the response is followed or cached, so
+// that a server can't plant records for other zones (RFC 5452 section
+// 6, RFC 2181 section 5.4.1).
+
+// scrubResponse removes the records of a response to a question for
+// qname that a server for zone has no say over:
+//   - answers that are not about qname or the CNAMEs it leads to within
+//     the zone,
+//   - authority records other than the SOA and DS records of an ancestor
+//     of qname in the zone, the NS records of the closest one, and the
+//     zone's NSEC and NSEC3 records,
+//   - additional records other than the addresses of the name servers
+//     the response refers to, where they are in the zone.
+func scrubResponse(response *DnsPacket, qname string, zone string) {
+	qname = normalizeName(qname)
+
+	chain := map[string]bool{}
+	for name, i := qname, 0; isSubdomain(name, zone) && i <= maxCNAMEChain; i++ {
+		chain[name] = true
+		cnames := rrsetAt(response.Answers, name, CNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		name = normalizeName(cnames[0].(*CNAMERecord).Host)
+	}
+	response.Answers = keepRecords(response.Answers, func(owner string, qtype uint16) bool {
+		return chain[owner]
+	})
+
+	// Of the NS records only the deepest set counts: the zone's own, or
+	// those of the delegation it refers to.
+	cut, referral := "", false
+	for _, rec := range response.Authorities {
+		ns, ok := rec.(*NSRecord)
+		if !ok {
+			continue
+		}
+		owner := normalizeName(ns.Domain)
+		if isSubdomain(owner, zone) && isSubdomain(qname, owner) && (!referral || countLabels(owner) > countLabels(cut)) {
+			cut, referral = owner, true
+		}
+	}
+	response.Authorities = keepRecords(response.Authorities, func(owner string, qtype uint16) bool {
+		switch qtype {
+		case NS:
+			return referral && owner == cut
+		case SOA, DS:
+			return isSubdomain(owner, zone) && isSubdomain(qname, owner)
+		case NSEC, NSEC3:
+			return isSubdomain(owner, zone)
+		}
+		return false
+	})
+
+	hosts := map[string]bool{}
+	for _, rec := range response.Authorities {
+		if ns, ok := rec.(*NSRecord); ok {
+			hosts[normalizeName(ns.Host)] = true
+		}
+	}
+	response.Resources = keepRecords(response.Resources, func(owner string, qtype uint16) bool {
+		return (qtype == A || qtype == AAAA) && hosts[owner] && isSubdomain(owner, zone)
+	})
+}
+
+// keepRecords filters records by owner name and type; signatures go with
+// the RRset they cover.
+func keepRecords(records []DnsRecord, keep func(owner string, qtype uint16) bool) []DnsRecord {
+	kept := []DnsRecord{}
+	for _, rec := range records {
+		qtype := recordType(rec)
+		if sig, ok := rec.(*RRSIGRecord); ok {
+			qtype = sig.TypeCovered
+		}
+		if keep(normalizeName(recordDomain(rec)), qtype) {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// checkReferral makes sure that a referral from a server for zone leads
+// towards qname: to a zone below the current one, and above or at qname.
+// Anything else is a lame or malicious server.
+func checkReferral(cut string, zone string, qname string) error {
+	if cut == zone || !isSubdomain(cut, zone) || !isSubdomain(qname, cut) {
+		return fmt.Errorf("Referral from %s to %s doesn't lead to %s", fqdn(zone), fqdn(cut), fqdn(qname))
+	}
+	return nil
+}
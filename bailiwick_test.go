@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrubResponse(t *testing.T) {
+	cases := []struct {
+		name     string
+		qname    string
+		zone     string
+		response *DnsPacket
+		sections string
+	}{
+		{
+			"answer",
+			"www.example.com", "example.com",
+			testResponse(t, NOERROR, []string{
+				"www.example.com. 300 IN CNAME web.example.com.",
+				"web.example.com. 300 IN CNAME web.example.net.",
+				"web.example.net. 300 IN A 198.51.100.1",
+				"bank.example.org. 300 IN A 198.51.100.2",
+			},
+				"example.com. 3600 IN NS ns1.example.com.",
+				"example.net. 3600 IN NS ns1.example.com.",
+			),
+			"www.example.com. 300 IN CNAME web.example.com. | web.example.com. 300 IN CNAME web.example.net.\n" +
+				"example.com. 3600 IN NS ns1.example.com.\n",
+		},
+		{
+			"referral",
+			"www.sub.example.com", "example.com",
+			testResponse(t, NOERROR, nil,
+				"example.com. 3600 IN NS ns1.example.com.",
+				"sub.example.com. 3600 IN NS ns.sub.example.com.",
+				"sub.example.com. 3600 IN NS ns.example.net.",
+				"sub.example.com. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF",
+				"other.example.com. 3600 IN NS ns.other.example.com.",
+			),
+			"\nsub.example.com. 3600 IN NS ns.sub.example.com. | sub.example.com. 3600 IN NS ns.example.net. | " +
+				"sub.example.com. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF\n",
+		},
+		{
+			"negative answer",
+			"missing.example.com", "example.com",
+			testResponse(t, NXDOMAIN, nil,
+				"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+				"example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1 7200 3600 1209600 300",
+				"sub.example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+				"example.com. 300 IN NSEC www.example.com. NS SOA RRSIG NSEC",
+				"example.net. 300 IN NSEC www.example.net. NS SOA RRSIG NSEC",
+			),
+			"\nexample.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300 | " +
+				"example.com. 300 IN NSEC www.example.com. NS SOA RRSIG NSEC\n",
+		},
+		{
+			// Names are compared by label: badexample.com is not in
+			// example.com.
+			"labels",
+			"www.example.com", "example.com",
+			testResponse(t, NOERROR, []string{"www.example.com. 300 IN A 192.0.2.1", "wwwexample.com. 300 IN A 198.51.100.1"},
+				"badexample.com. 3600 IN NS ns.badexample.com.",
+				"example.com. 3600 IN NS ns.badexample.com.",
+			),
+			"www.example.com. 300 IN A 192.0.2.1\nexample.com. 3600 IN NS ns.badexample.com.\n",
+		},
+	}
+	for _, c := range cases {
+		scrubResponse(c.response, c.qname, c.zone)
+		if got := sections(c.response); got != c.sections {
+			t.Errorf("%s:\n%s\nwant:\n%s", c.name, got, c.sections)
+		}
+	}
+
+	// Addresses are kept for the name servers referred to, if they are in
+	// the zone.
+	response := testResponse(t, NOERROR, nil,
+		"sub.example.com. 3600 IN NS ns.sub.example.com.",
+		"sub.example.com. 3600 IN NS ns.example.net.",
+	)
+	response.Resources = testRecords(t,
+		"ns.sub.example.com. 3600 IN A 192.0.2.53",
+		"ns.sub.example.com. 3600 IN AAAA 2001:db8::53",
+		"ns.example.net. 3600 IN A 198.51.100.53",
+		"www.example.com. 3600 IN A 192.0.2.1",
+		"ns.sub.example.com. 3600 IN TXT \"glue\"",
+	)
+	scrubResponse(response, "www.sub.example.com", "example.com")
+	if got := strings.Join(recordStrings(response.Resources), " | "); got != "ns.sub.example.com. 3600 IN A 192.0.2.53 | ns.sub.example.com. 3600 IN AAAA 2001:db8::53" {
+		t.Errorf("additional records: %s", got)
+	}
+	var glue []string
+	for ip := range response.GetResolvedNs("www.sub.example.com") {
+		glue = append(glue, ip.String())
+	}
+	if strings.Join(glue, " ") != "192.0.2.53" {
+		t.Errorf("GetResolvedNs() = %v", glue)
+	}
+}
+
+func TestCheckReferral(t *testing.T) {
+	cases := []struct {
+		cut, zone, qname string
+		ok               bool
+	}{
+		{"com", "", "www.example.com", true},
+		{"example.com", "com", "www.example.com", true},
+		{"www.example.com", "example.com", "www.example.com", true},
+		// Up, sideways, or past the name.
+		{"com", "example.com", "www.example.com", false},
+		{"example.com", "example.com", "www.example.com", false},
+		{"example.net", "com", "www.example.com", false},
+		{"badexample.com", "com", "www.example.com", false},
+		{"a.www.example.com", "example.com", "www.example.com", false},
+	}
+	for _, c := range cases {
+		if err := checkReferral(c.cut, c.zone, c.qname); (err == nil) != c.ok {
+			t.Errorf("checkReferral(%q, %q, %q) = %v", c.cut, c.zone, c.qname, err)
+		}
+	}
+}
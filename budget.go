@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Resolution limits. One client query can make the resolver follow
+// referrals, look up the addresses of name servers without glue, chase
+// CNAMEs and fetch the keys of every zone on the way. Zones that delegate
+// to names in each other, or that are just badly set up, could keep it
+// busy forever, so every client query gets a budget and is answered with
+// SERVFAIL once the budget is used up.
+
+const (
+	maxReferrals       = 30
+	maxUpstreamQueries = 100
+	// maxQueryDepth bounds the nesting of name server address lookups.
+	maxQueryDepth     = 7
+	maxCNAMEHops      = maxCNAMEChain
+	maxResolutionTime = 10 * time.Second
+)
+
+// resolutionBudget is what is left of the work one client query may
+// cause. It is only used by the goroutine resolving the query.
+type resolutionBudget struct {
+	question  string
+	deadline  time.Time
+	referrals int
+	queries   int
+	cnames    int
+	depth     int
+	// pending are the questions being resolved, to catch lookups that
+	// depend on themselves.
+	pending map[string]bool
+}
+
+func newResolutionBudget(qname string, qtype QueryType) *resolutionBudget {
+	return &resolutionBudget{
+		question: fmt.Sprintf("%s %v", fqdn(qname), qtype),
+		deadline: time.Now().Add(maxResolutionTime),
+		pending:  map[string]bool{},
+	}
+}
+
+// budgetError is the reason a query was given up on.
+type budgetError struct {
+	reason string
+}
+
+func (e *budgetError) Error() string {
+	return e.reason
+}
+
+// overBudget reports whether err is the end of a query's budget, which
+// trying other servers won't help with.
+func overBudget(err error) bool {
+	var exceeded *budgetError
+	return errors.As(err, &exceeded)
+}
+
+func (b *resolutionBudget) exceeded(format string, args ...interface{}) error {
+	return &budgetError{reason: fmt.Sprintf("Resolving %s ", b.question) + fmt.Sprintf(format, args...)}
+}
+
+// query charges n upstream queries.
+func (b *resolutionBudget) query(n int) error {
+	if time.Now().After(b.deadline) {
+		return b.exceeded("took longer than %v", maxResolutionTime)
+	}
+	if b.queries+n > maxUpstreamQueries {
+		return b.exceeded("took more than %d upstream queries", maxUpstreamQueries)
+	}
+	b.queries += n
+	return nil
+}
+
+func (b *resolutionBudget) referral() error {
+	if b.referrals == maxReferrals {
+		return b.exceeded("followed more than %d referrals", maxReferrals)
+	}
+	b.referrals++
+	return nil
+}
+
+func (b *resolutionBudget) cname() error {
+	if b.cnames == maxCNAMEHops {
+		return b.exceeded("followed more than %d CNAMEs", maxCNAMEHops)
+	}
+	b.cnames++
+	return nil
+}
+
+// enter starts resolving a question on behalf of the client query;
+// every enter is paired with a leave.
+func (b *resolutionBudget) enter(qname string, qtype QueryType) error {
+	key := cacheKey(qname, qtype.ToNum())
+	if b.pending[key] {
+		return b.exceeded("needs %s %v, which it is already resolving", fqdn(qname), qtype)
+	}
+	if b.depth == maxQueryDepth {
+		return b.exceeded("nested more than %d lookups", maxQueryDepth)
+	}
+	b.pending[key] = true
+	b.depth++
+	return nil
+}
+
+func (b *resolutionBudget) leave(qname string, qtype QueryType) {
+	delete(b.pending, cacheKey(qname, qtype.ToNum()))
+	b.depth--
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolutionBudget(t *testing.T) {
+	qtype := QueryTypeFromNum(A)
+	cases := []struct {
+		name  string
+		limit int
+		spend func(b *resolutionBudget) error
+	}{
+		{"queries", maxUpstreamQueries, func(b *resolutionBudget) error { return b.query(1) }},
+		{"referrals", maxReferrals, (*resolutionBudget).referral},
+		{"CNAMEs", maxCNAMEHops, (*resolutionBudget).cname},
+	}
+	for _, c := range cases {
+		budget := newResolutionBudget("www.example.com", qtype)
+		for i := 0; i < c.limit; i++ {
+			if err := c.spend(budget); err != nil {
+				t.Fatalf("%s: %v after %d", c.name, err, i)
+			}
+		}
+		if err := c.spend(budget); !overBudget(err) {
+			t.Errorf("%s: %v past the limit", c.name, err)
+		}
+	}
+
+	// Racing charges both queries.
+	budget := newResolutionBudget("www.example.com", qtype)
+	budget.queries = maxUpstreamQueries - 1
+	if err := budget.query(2); !overBudget(err) {
+		t.Errorf("two queries with one left: %v", err)
+	}
+
+	budget = newResolutionBudget("www.example.com", qtype)
+	budget.deadline = time.Now().Add(-time.Second)
+	if err := budget.query(1); !overBudget(err) {
+		t.Errorf("query after the deadline: %v", err)
+	}
+}
+
+func TestNestedLookups(t *testing.T) {
+	budget := newResolutionBudget("www.example.com", QueryTypeFromNum(A))
+	if err := budget.enter("ns.example.net", QueryTypeFromNum(A)); err != nil {
+		t.Fatal(err)
+	}
+	// A lookup that needs itself is given up on.
+	if err := budget.enter("NS.example.net.", QueryTypeFromNum(A)); !overBudget(err) {
+		t.Errorf("lookup inside itself: %v", err)
+	}
+	if err := budget.enter("ns.example.net", QueryTypeFromNum(AAAA)); err != nil {
+		t.Errorf("lookup of another type: %v", err)
+	}
+	budget.leave("ns.example.net", QueryTypeFromNum(AAAA))
+	budget.leave("ns.example.net", QueryTypeFromNum(A))
+	if err := budget.enter("ns.example.net", QueryTypeFromNum(A)); err != nil {
+		t.Errorf("lookup after it finished: %v", err)
+	}
+
+	budget = newResolutionBudget("www.example.com", QueryTypeFromNum(A))
+	for i := 0; i < maxQueryDepth; i++ {
+		if err := budget.enter(string(rune('a'+i))+".example.com", QueryTypeFromNum(A)); err != nil {
+			t.Fatalf("lookup at depth %d: %v", i, err)
+		}
+	}
+	if err := budget.enter("z.example.com", QueryTypeFromNum(A)); !overBudget(err) {
+		t.Errorf("lookup past the depth limit: %v", err)
+	}
+}
+
+func TestDelegationLoop(t *testing.T) {
+	emptyCache(t)
+	emptyInfraCache(t)
+	// The name servers of a.test and b.test are in each other's zone, and
+	// there is no glue.
+	root := testZone(t, ".",
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 127.0.0.1",
+		"a.test. 3600 IN NS ns.b.test.",
+		"b.test. 3600 IN NS ns.a.test.",
+	)
+	rootAddr := serveZone(t, "127.0.0.1:0", root, nil)
+	savedRoots := rootServers
+	rootServers = []string{rootAddr.String()}
+	t.Cleanup(func() { rootServers = savedRoots })
+
+	start := time.Now()
+	if _, err := RecursiveLookup("www.a.test", QueryTypeFromNum(A)); !overBudget(err) {
+		t.Errorf("lookup through a delegation loop: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delegation loop noticed after %v", elapsed)
+	}
+}
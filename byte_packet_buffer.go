@@ -5,13 +5,36 @@ import (
 	"strings"
 )
 
+// Classic DNS over UDP is limited to 512 bytes, while the stream based
+// transports (TCP, TLS, HTTPS) allow messages of up to 65535 bytes.
+const (
+    MaxUDPMessageSize    = 512
+    MaxStreamMessageSize = 65535
+)
+
 type BytePacketBuffer struct {
-    buf [512]uint8
+    buf []uint8
     pos uint16
 }
 
 func NewBytePacketBuffer() *BytePacketBuffer {
-    return &BytePacketBuffer{}
+    return NewBytePacketBufferWithSize(MaxUDPMessageSize)
+}
+
+func NewBytePacketBufferWithSize(size int) *BytePacketBuffer {
+    return &BytePacketBuffer{buf: make([]uint8, size)}
+}
+
+// NewBytePacketBufferFromBytes wraps a received message so that reads past
+// its end fail instead of returning zero bytes.
+func NewBytePacketBufferFromBytes(data []byte) *BytePacketBuffer {
+    buf := make([]uint8, len(data))
+    copy(buf, data)
+    return &BytePacketBuffer{buf: buf}
+}
+
+func (b *BytePacketBuffer) Bytes() []byte {
+    return b.buf[:b.pos]
 }
 
 func (b *BytePacketBuffer) Pos() uint16 {
@@ -29,7 +52,7 @@ func (b *BytePacketBuffer) Seek(pos uint16) error {
 }
 
 func (b *BytePacketBuffer) Read() (uint8, error) {
-    if b.pos >= 512 {
+    if int(b.pos) >= len(b.buf) {
         return 0, errors.New("End of buffer")
     }
     res := b.buf[b.pos]
@@ -38,7 +61,7 @@ func (b *BytePacketBuffer) Read() (uint8, error) {
 }
 
 func (b *BytePacketBuffer) Write(val uint8) (error) {
-    if b.pos >= 512 {
+    if int(b.pos) >= len(b.buf) {
         return errors.New("End of buffer")
     }
     b.buf[b.pos] = val
@@ -46,27 +69,39 @@ func (b *BytePacketBuffer) Write(val uint8) (error) {
     return nil
 }
 
-func (b *BytePacketBuffer) Set(pos uint8, val uint8) (error) {
+func (b *BytePacketBuffer) WriteRange(data []byte) (error) {
+    for _, val := range data {
+        if err := b.Write(val); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (b *BytePacketBuffer) Set(pos uint16, val uint8) (error) {
+    if int(pos) >= len(b.buf) {
+        return errors.New("End of buffer")
+    }
     b.buf[pos] = val
     return nil
 }
 
 
-func (b *BytePacketBuffer) SetU16(pos uint8, val uint16) (error) {
+func (b *BytePacketBuffer) SetU16(pos uint16, val uint16) (error) {
     b.Set(pos, uint8(val >> 8))
     b.Set(pos + 1, uint8(val & 0xff))
     return nil
 }
 
 func (b *BytePacketBuffer) Get(pos uint16) (uint8, error) {
-    if pos >= 512 {
+    if int(pos) >= len(b.buf) {
         return 0, errors.New("End of buffer")
     }
     return b.buf[pos], nil
 }
 
 func (b *BytePacketBuffer) GetRange(start, length uint16) ([]uint8, error) {
-    if start+length >= 512 {
+    if int(start)+int(length) > len(b.buf) {
         return nil, errors.New("End of buffer")
     }
     return b.buf[start : start+length], nil
@@ -85,7 +120,7 @@ func (b *BytePacketBuffer) ReadU16() (uint16, error) {
 }
 
 func (b *BytePacketBuffer) WriteU16(val uint16) (error) {
-    if b.pos >= 512 {
+    if int(b.pos)+2 > len(b.buf) {
         return errors.New("End of buffer")
     }
     b.Write(uint8(val >> 8))
@@ -114,7 +149,7 @@ func (b *BytePacketBuffer) ReadU32() (uint32, error) {
 }
 
 func (b *BytePacketBuffer) WriteU32(val uint32) (error) {
-    if b.pos >= 512 {
+    if int(b.pos)+4 > len(b.buf) {
         return errors.New("End of buffer")
     }
     b.Write(uint8((val >> 24) & 0xff))
@@ -183,11 +218,15 @@ func (b *BytePacketBuffer) ReadQName(outstr *string) error {
 }
 
 func (buffer *BytePacketBuffer) WriteQName(qname *string) error {
-	labels := strings.Split(*qname, ".")
+	name := strings.TrimSuffix(*qname, ".")
+	labels := []string{}
+	if name != "" {
+		labels = strings.Split(name, ".")
+	}
 
 	for _, label := range labels {
 		length := len(label)
-		if length > 0x34 {
+		if length > 0x3f {
 			return errors.New("Single label exceeds 63 characters of length")
 		}
 
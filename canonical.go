@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Canonical form and order of names and records (RFC 4034 section 6),
+// which is what DNSSEC signatures are computed over.
+
+// canonicalNameLess orders names label by label starting from the root,
+// comparing each label as lowercase octets.
+func canonicalNameLess(a string, b string) bool {
+	return compareCanonicalNames(a, b) < 0
+}
+
+func compareCanonicalNames(a string, b string) int {
+	aLabels := reversedLabels(a)
+	bLabels := reversedLabels(b)
+	for i := 0; i < len(aLabels) && i < len(bLabels); i++ {
+		if c := bytes.Compare([]byte(aLabels[i]), []byte(bLabels[i])); c != 0 {
+			return c
+		}
+	}
+	return len(aLabels) - len(bLabels)
+}
+
+func reversedLabels(name string) []string {
+	name = normalizeName(name)
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// canonicalRecord returns a copy of the record with the domain names in
+// its RDATA lowercased. RFC 6840 section 5.1 keeps the case of the next
+// name in NSEC records.
+func canonicalRecord(rec DnsRecord) DnsRecord {
+	switch r := rec.(type) {
+	case *NSRecord:
+		c := *r
+		c.Host = strings.ToLower(r.Host)
+		return &c
+	case *CNAMERecord:
+		c := *r
+		c.Host = strings.ToLower(r.Host)
+		return &c
+	case *PTRRecord:
+		c := *r
+		c.Host = strings.ToLower(r.Host)
+		return &c
+	case *MXRecord:
+		c := *r
+		c.Host = strings.ToLower(r.Host)
+		return &c
+	case *SOARecord:
+		c := *r
+		c.MName = strings.ToLower(r.MName)
+		c.RName = strings.ToLower(r.RName)
+		return &c
+	case *RRSIGRecord:
+		c := *r
+		c.SignerName = strings.ToLower(r.SignerName)
+		return &c
+	}
+	return rec
+}
+
+// canonicalRdata returns the RDATA of a record in canonical form.
+func canonicalRdata(rec DnsRecord) ([]byte, error) {
+	_, _, _, data, err := splitRecord(canonicalRecord(rec))
+	return data, err
+}
+
+// canonicalWire returns a record in canonical wire format with the given
+// owner name and TTL.
+func canonicalWire(rec DnsRecord, owner string, ttl uint32) ([]byte, error) {
+	data, err := canonicalRdata(rec)
+	if err != nil {
+		return nil, err
+	}
+	wire, err := canonicalName(owner)
+	if err != nil {
+		return nil, err
+	}
+	wire = binary.BigEndian.AppendUint16(wire, recordType(rec))
+	wire = binary.BigEndian.AppendUint16(wire, ClassIN)
+	wire = binary.BigEndian.AppendUint32(wire, ttl)
+	wire = binary.BigEndian.AppendUint16(wire, uint16(len(data)))
+	return append(wire, data...), nil
+}
+
+// sortCanonical orders the records of an RRset by their canonical RDATA and
+// drops duplicates.
+func sortCanonical(rrset []DnsRecord) ([]DnsRecord, error) {
+	type entry struct {
+		rec  DnsRecord
+		data []byte
+	}
+	entries := []entry{}
+	for _, rec := range rrset {
+		data, err := canonicalRdata(rec)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{rec, data})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].data, entries[j].data) < 0
+	})
+
+	sorted := []DnsRecord{}
+	for i, e := range entries {
+		if i > 0 && bytes.Equal(e.data, entries[i-1].data) {
+			continue
+		}
+		sorted = append(sorted, e.rec)
+	}
+	return sorted, nil
+}
+
+// signedData builds the data an RRSIG signs (RFC 4034 section 3.1.8.1):
+// its own RDATA without the signature, followed by the RRset in canonical
+// form and order. Records expanded from a wildcard are put back under the
+// wildcard name, which the label count of the signature tells apart.
+func signedData(sig *RRSIGRecord, rrset []DnsRecord) ([]byte, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("Empty RRset")
+	}
+	canonicalSig := canonicalRecord(sig).(*RRSIGRecord)
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := canonicalSig.writeFields(buffer); err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), buffer.Bytes()...)
+
+	owner := normalizeName(recordDomain(rrset[0]))
+	switch ownerLabels := int(signatureLabels(owner)); {
+	case int(sig.Labels) > ownerLabels:
+		return nil, errors.New("RRSIG label count exceeds the owner name")
+	case int(sig.Labels) < ownerLabels:
+		labels := strings.Split(owner, ".")
+		owner = strings.Join(append([]string{"*"}, labels[len(labels)-int(sig.Labels):]...), ".")
+	}
+
+	sorted, err := sortCanonical(rrset)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range sorted {
+		wire, err := canonicalWire(rec, owner, sig.OriginalTTL)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, wire...)
+	}
+	return data, nil
+}
+
+// signatureLabels is the label count an RRSIG over records at owner
+// carries, which leaves out a leading wildcard label.
+func signatureLabels(owner string) uint8 {
+	owner = normalizeName(owner)
+	labels := countLabels(owner)
+	if strings.HasPrefix(owner, "*.") || owner == "*" {
+		labels--
+	}
+	return uint8(labels)
+}
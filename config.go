@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Config is read from the JSON file given with -config. Every section is
+// optional; without a file godns only listens on UDP port 2053 as before.
+type Config struct {
+	Listen   string          `json:"listen"`
+	DoH      *DoHConfig      `json:"doh,omitempty"`
+	DoT      *DoTConfig      `json:"dot,omitempty"`
+	Forward  *ForwardConfig  `json:"forward,omitempty"`
+	Resolver *ResolverConfig `json:"resolver,omitempty"`
+	Zones    []ZoneConfig    `json:"zones,omitempty"`
+	TSIGKeys []TSIGKeyConfig `json:"tsig_keys,omitempty"`
+}
+
+// DoHConfig is the DNS-over-HTTPS listener. PlainHTTP serves it without
+// TLS instead, for use behind a reverse proxy that terminates TLS.
+type DoHConfig struct {
+	Listen    string `json:"listen"`
+	Path      string `json:"path"`
+	CertFile  string `json:"cert_file"`
+	KeyFile   string `json:"key_file"`
+	PlainHTTP bool   `json:"plain_http,omitempty"`
+}
+
+type DoTConfig struct {
+	Listen   string `json:"listen"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type ForwardConfig struct {
+	Upstreams []UpstreamConfig `json:"upstreams"`
+}
+
+// UpstreamConfig describes a forwarding target. Protocol is one of "udp"
+// (the default), "tcp", "tls" or "https"; for "https" the address is the
+// full URL of the DoH endpoint. For TLS upstreams the certificate is
+// checked against ServerName (or the address) unless only SPKIPins, the
+// base64 SHA-256 digests of acceptable public keys, are given.
+type UpstreamConfig struct {
+	Protocol   string   `json:"protocol"`
+	Address    string   `json:"address"`
+	ServerName string   `json:"server_name,omitempty"`
+	CAFile     string   `json:"ca_file,omitempty"`
+	SPKIPins   []string `json:"spki_pins,omitempty"`
+}
+
+// ResolverConfig tunes the recursive resolver. RootHints are the addresses
+// resolution starts from. TrustAnchors are DS or DNSKEY records in
+// presentation format that answers are validated against; they default
+// to the root zone's key signing keys, and an empty list turns DNSSEC
+// validation off. The anchors follow key rollovers (RFC 5011); with a
+// TrustAnchorFile their state is kept there across restarts.
+// QNameMinimisation is "relaxed" (the default), "strict" or "off".
+// RaceQueries sends each query to the two fastest servers of a zone at
+// once. ServeStale is how many seconds expired answers are kept to be
+// served when a lookup fails (RFC 8767), or takes longer than
+// StaleAnswerClientTimeout milliseconds, 1800 by default.
+// Prefetch resolves popular answers again shortly before they expire.
+type ResolverConfig struct {
+	RootHints                []string `json:"root_hints,omitempty"`
+	TrustAnchors             []string `json:"trust_anchors"`
+	TrustAnchorFile          string   `json:"trust_anchor_file,omitempty"`
+	QNameMinimisation        string   `json:"qname_minimisation,omitempty"`
+	RaceQueries              bool     `json:"race_queries,omitempty"`
+	ServeStale               uint32   `json:"serve_stale,omitempty"`
+	StaleAnswerClientTimeout uint32   `json:"stale_answer_client_timeout,omitempty"`
+	Prefetch                 bool     `json:"prefetch,omitempty"`
+}
+
+// ZoneConfig is a zone godns answers authoritatively, either from a master
+// file or, for secondary zones, transferred from Primary. AlsoNotify lists
+// secondaries to notify of changes besides the zone's name servers.
+// AllowUpdate lists the clients that may send dynamic updates; the master
+// file is rewritten after every update. Besides addresses, the ACLs accept
+// "key <name>" for requests signed with that TSIG key. TSIGKey signs the
+// requests to the primary and outgoing NOTIFYs, and authenticates NOTIFYs
+// from the primary. DNSSEC turns on signing for primary zones.
+type ZoneConfig struct {
+	Origin        string         `json:"origin"`
+	File          string         `json:"file,omitempty"`
+	Primary       string         `json:"primary,omitempty"`
+	AllowTransfer []string       `json:"allow_transfer,omitempty"`
+	AlsoNotify    []string       `json:"also_notify,omitempty"`
+	AllowUpdate   []string       `json:"allow_update,omitempty"`
+	TSIGKey       string         `json:"tsig_key,omitempty"`
+	DNSSEC        *SigningConfig `json:"dnssec,omitempty"`
+}
+
+// SigningConfig has the keys a zone is signed with. Keys marked as KSK
+// sign the DNSKEY set and the others everything else; a single key may
+// do both. Without NSEC3 settings the zone is given an NSEC chain.
+// Signatures are valid for SignatureValidity seconds, 14 days by default,
+// and are renewed when a quarter of that remains.
+type SigningConfig struct {
+	Keys              []SigningKeyConfig `json:"keys"`
+	NSEC3             *NSEC3Config       `json:"nsec3,omitempty"`
+	SignatureValidity uint32             `json:"signature_validity,omitempty"`
+}
+
+// SigningKeyConfig is a PEM encoded PKCS #8 private key: ECDSA P-256 or
+// P-384, Ed25519 or RSA (used with RSASHA256). A missing file is created
+// with a new ECDSA P-256 key.
+type SigningKeyConfig struct {
+	File string `json:"file"`
+	KSK  bool   `json:"ksk,omitempty"`
+}
+
+// NSEC3Config sets the parameters of an NSEC3 chain (RFC 5155). Salt is
+// hex encoded; RFC 9276 recommends no salt and no extra iterations.
+// OptOut leaves unsigned delegations out of the chain.
+type NSEC3Config struct {
+	Iterations uint16 `json:"iterations,omitempty"`
+	Salt       string `json:"salt,omitempty"`
+	OptOut     bool   `json:"opt_out,omitempty"`
+}
+
+// TSIGKeyConfig is a shared secret for TSIG. Algorithm is "hmac-sha256"
+// (the default) or "hmac-sha512", and Secret is base64 encoded.
+type TSIGKeyConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen: "0.0.0.0:2053",
+	}
+}
+
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	if config.DoH != nil {
+		if config.DoH.Listen == "" {
+			config.DoH.Listen = "0.0.0.0:443"
+		}
+		if config.DoH.Path == "" {
+			config.DoH.Path = "/dns-query"
+		}
+		if !config.DoH.PlainHTTP && (config.DoH.CertFile == "" || config.DoH.KeyFile == "") {
+			return nil, errors.New("DoH needs cert_file and key_file unless plain_http is set")
+		}
+	}
+
+	if config.DoT != nil && config.DoT.Listen == "" {
+		config.DoT.Listen = "0.0.0.0:853"
+	}
+
+	return config, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Authenticated denial of existence. Negative answers from signed zones
+// carry NSEC (RFC 4035 section 5.4) or NSEC3 (RFC 5155 section 8) records
+// that prove the name or type doesn't exist; answers expanded from a
+// wildcard carry a proof that there was no closer match. The records
+// have to be verified before they are used here.
+
+// NSEC3 records with more iterations than this make the answer insecure
+// instead of costing us the hashing (RFC 9276 section 3.2).
+const maxNSEC3Iterations = 150
+
+const nsec3HashSHA1 uint8 = 1
+
+type denialProof struct {
+	zone   string
+	nsecs  []*NSECRecord
+	nsec3s []*NSEC3Record
+	// unusable is set when there are NSEC3 records we can't check.
+	unusable bool
+}
+
+func newDenialProof(records []DnsRecord, zone string) *denialProof {
+	p := &denialProof{zone: normalizeName(zone)}
+	for _, rec := range records {
+		switch r := rec.(type) {
+		case *NSECRecord:
+			p.nsecs = append(p.nsecs, r)
+		case *NSEC3Record:
+			if parentName(normalizeName(r.Domain)) != p.zone {
+				continue
+			}
+			if r.HashAlgorithm != nsec3HashSHA1 || r.Iterations > maxNSEC3Iterations {
+				p.unusable = true
+				continue
+			}
+			p.nsec3s = append(p.nsec3s, r)
+		}
+	}
+	return p
+}
+
+// proveNXDOMAIN checks that qname doesn't exist and that no wildcard
+// could have matched it.
+func (p *denialProof) proveNXDOMAIN(qname string) (SecurityStatus, error) {
+	qname = normalizeName(qname)
+	if len(p.nsec3s) > 0 {
+		ce, nc, cover, err := p.closestEncloserProof(qname)
+		if err != nil {
+			return Bogus, err
+		}
+		if nc == "" {
+			return Bogus, fmt.Errorf("NSEC3 records show that %s exists", fqdn(qname))
+		}
+		if p.coveringNSEC3(wildcardOf(ce)) == nil {
+			return Bogus, fmt.Errorf("No NSEC3 record denies the wildcard %s", fqdn(wildcardOf(ce)))
+		}
+		// An opt-out span may hide an unsigned delegation.
+		if cover.Flags&NSEC3OptOut != 0 {
+			return Insecure, nil
+		}
+		return Secure, nil
+	}
+
+	if len(p.nsecs) > 0 {
+		nsec := p.coveringNSEC(qname)
+		if nsec == nil {
+			return Bogus, fmt.Errorf("No NSEC record covers %s", fqdn(qname))
+		}
+		ce := nsecClosestEncloser(qname, nsec)
+		if p.coveringNSEC(wildcardOf(ce)) == nil {
+			return Bogus, fmt.Errorf("No NSEC record denies the wildcard %s", fqdn(wildcardOf(ce)))
+		}
+		return Secure, nil
+	}
+	return p.noRecords(qname)
+}
+
+// proveNoData checks that qname exists without records of qtype, possibly
+// as an empty non-terminal or through a wildcard. For DS it may instead
+// show an unsigned delegation in an NSEC3 opt-out span, which is insecure.
+func (p *denialProof) proveNoData(qname string, qtype uint16) (SecurityStatus, error) {
+	qname = normalizeName(qname)
+	if len(p.nsec3s) > 0 {
+		if match := p.matchingNSEC3(qname); match != nil {
+			if err := checkNoDataTypes(qname, qtype, match.Types); err != nil {
+				return Bogus, err
+			}
+			return Secure, nil
+		}
+		ce, nc, cover, err := p.closestEncloserProof(qname)
+		if err != nil {
+			return Bogus, err
+		}
+		if qtype == DS && cover != nil && cover.Flags&NSEC3OptOut != 0 {
+			return Insecure, nil
+		}
+		wildcard := p.matchingNSEC3(wildcardOf(ce))
+		if nc == "" || wildcard == nil {
+			return Bogus, fmt.Errorf("NSEC3 records don't prove that %s has no %s records", fqdn(qname), QueryTypeFromNum(qtype))
+		}
+		if err := checkNoDataTypes(wildcardOf(ce), qtype, wildcard.Types); err != nil {
+			return Bogus, err
+		}
+		return Secure, nil
+	}
+
+	if len(p.nsecs) > 0 {
+		for _, nsec := range p.nsecs {
+			if normalizeName(nsec.Domain) == qname {
+				if err := checkNoDataTypes(qname, qtype, nsec.Types); err != nil {
+					return Bogus, err
+				}
+				return Secure, nil
+			}
+		}
+		nsec := p.coveringNSEC(qname)
+		if nsec == nil {
+			return Bogus, fmt.Errorf("No NSEC record matches or covers %s", fqdn(qname))
+		}
+		// Names below qname make it an empty non-terminal.
+		if next := normalizeName(nsec.NextDomain); next != qname && isSubdomain(next, qname) {
+			return Secure, nil
+		}
+		wildcard := wildcardOf(nsecClosestEncloser(qname, nsec))
+		for _, rec := range p.nsecs {
+			if normalizeName(rec.Domain) == wildcard {
+				if err := checkNoDataTypes(wildcard, qtype, rec.Types); err != nil {
+					return Bogus, err
+				}
+				return Secure, nil
+			}
+		}
+		return Bogus, fmt.Errorf("NSEC records don't prove that %s has no %s records", fqdn(qname), QueryTypeFromNum(qtype))
+	}
+	return p.noRecords(qname)
+}
+
+// proveNoDS checks that zone is a delegation without DS records, which
+// makes it insecure.
+func (p *denialProof) proveNoDS(zone string) error {
+	status, err := p.proveNoData(zone, DS)
+	if err != nil || status == Insecure {
+		return err
+	}
+	var types []uint16
+	for _, nsec := range p.nsecs {
+		if normalizeName(nsec.Domain) == zone {
+			types = nsec.Types
+		}
+	}
+	if match := p.matchingNSEC3(zone); match != nil {
+		types = match.Types
+	}
+	if !hasType(types, NS) || hasType(types, SOA) {
+		return fmt.Errorf("%s is not a delegation", fqdn(zone))
+	}
+	return nil
+}
+
+// proveWildcard checks that an answer for qname that was expanded from
+// the wildcard at the closest encloser with the given number of labels
+// had no closer match.
+func (p *denialProof) proveWildcard(qname string, labels uint8) (SecurityStatus, error) {
+	qname = normalizeName(qname)
+	parts := strings.Split(qname, ".")
+	if int(labels) >= len(parts) {
+		return Bogus, fmt.Errorf("Invalid wildcard expansion of %s", fqdn(qname))
+	}
+	ce := strings.Join(parts[len(parts)-int(labels):], ".")
+	nc := strings.Join(parts[len(parts)-int(labels)-1:], ".")
+
+	if len(p.nsec3s) > 0 {
+		cover := p.coveringNSEC3(nc)
+		if cover == nil {
+			return Bogus, fmt.Errorf("No NSEC3 record covers %s", fqdn(nc))
+		}
+		if cover.Flags&NSEC3OptOut != 0 {
+			return Insecure, nil
+		}
+		return Secure, nil
+	}
+
+	if len(p.nsecs) > 0 {
+		nsec := p.coveringNSEC(qname)
+		if nsec == nil || nsecClosestEncloser(qname, nsec) != ce {
+			return Bogus, fmt.Errorf("No NSEC record proves that %s has no closer match", fqdn(qname))
+		}
+		return Secure, nil
+	}
+	return p.noRecords(qname)
+}
+
+// relevantTo returns the records that can take part in a proof about
+// qname: those matching or covering it, its ancestors in the zone or their
+// wildcards.
+func (p *denialProof) relevantTo(qname string) []DnsRecord {
+	records := []DnsRecord{}
+	seen := map[DnsRecord]bool{}
+	add := func(rec DnsRecord) {
+		if !seen[rec] {
+			seen[rec] = true
+			records = append(records, rec)
+		}
+	}
+	for name := normalizeName(qname); isSubdomain(name, p.zone); name = parentName(name) {
+		for _, n := range []string{name, wildcardOf(name)} {
+			for _, nsec := range p.nsecs {
+				if normalizeName(nsec.Domain) == n {
+					add(nsec)
+				}
+			}
+			if nsec := p.coveringNSEC(n); nsec != nil {
+				add(nsec)
+			}
+			if nsec3 := p.matchingNSEC3(n); nsec3 != nil {
+				add(nsec3)
+			}
+			if nsec3 := p.coveringNSEC3(n); nsec3 != nil {
+				add(nsec3)
+			}
+		}
+		if name == "" {
+			break
+		}
+	}
+	return records
+}
+
+func (p *denialProof) noRecords(qname string) (SecurityStatus, error) {
+	if p.unusable {
+		return Insecure, nil
+	}
+	return Bogus, fmt.Errorf("No NSEC or NSEC3 records for %s", fqdn(qname))
+}
+
+// checkNoDataTypes checks the type bitmap of the NSEC or NSEC3 record
+// matching name.
+func checkNoDataTypes(name string, qtype uint16, types []uint16) error {
+	if hasType(types, qtype) || hasType(types, CNAME) {
+		return fmt.Errorf("%s has %s or CNAME records", fqdn(name), QueryTypeFromNum(qtype))
+	}
+	// Records from the parent side of a delegation say nothing about
+	// the child zone, except for DS.
+	if qtype != DS && hasType(types, NS) && !hasType(types, SOA) {
+		return fmt.Errorf("Denial for %s comes from above a delegation", fqdn(name))
+	}
+	return nil
+}
+
+func wildcardOf(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// coveringNSEC returns the NSEC record whose span contains name.
+func (p *denialProof) coveringNSEC(name string) *NSECRecord {
+	for _, nsec := range p.nsecs {
+		owner := normalizeName(nsec.Domain)
+		if !nsecCovers(owner, normalizeName(nsec.NextDomain), name) {
+			continue
+		}
+		// An NSEC at a delegation or DNAME can't deny names below it
+		// (RFC 6840 section 4.1).
+		if isSubdomain(name, owner) && (hasType(nsec.Types, NS) && !hasType(nsec.Types, SOA) || hasType(nsec.Types, dnameType)) {
+			continue
+		}
+		return nsec
+	}
+	return nil
+}
+
+// dnameType is not otherwise supported.
+const dnameType = 39
+
+// nsecCovers reports whether name falls strictly between owner and next
+// in canonical order. The last NSEC of a zone points back to the apex.
+func nsecCovers(owner string, next string, name string) bool {
+	if compareCanonicalNames(owner, next) < 0 {
+		return compareCanonicalNames(owner, name) < 0 && compareCanonicalNames(name, next) < 0
+	}
+	return compareCanonicalNames(owner, name) < 0 || compareCanonicalNames(name, next) < 0
+}
+
+// nsecClosestEncloser derives the closest encloser of a name an NSEC
+// record covers: the longest ancestor it shares with either end of the
+// span.
+func nsecClosestEncloser(name string, nsec *NSECRecord) string {
+	a := commonAncestor(name, normalizeName(nsec.Domain))
+	b := commonAncestor(name, normalizeName(nsec.NextDomain))
+	if countLabels(a) > countLabels(b) {
+		return a
+	}
+	return b
+}
+
+func commonAncestor(a string, b string) string {
+	aLabels := reversedLabels(a)
+	bLabels := reversedLabels(b)
+	common := []string{}
+	for i := 0; i < len(aLabels) && i < len(bLabels) && aLabels[i] == bLabels[i]; i++ {
+		common = append([]string{aLabels[i]}, common...)
+	}
+	return strings.Join(common, ".")
+}
+
+// closestEncloserProof finds the closest encloser of qname (RFC 5155
+// section 8.3): the longest existing ancestor, matched by an NSEC3
+// record, whose child towards qname, the next closer name, is covered by
+// another. nc is empty when qname itself exists.
+func (p *denialProof) closestEncloserProof(qname string) (string, string, *NSEC3Record, error) {
+	nc := ""
+	for name := qname; isSubdomain(name, p.zone); name = parentName(name) {
+		if match := p.matchingNSEC3(name); match != nil {
+			if nc == "" {
+				return name, "", nil, nil
+			}
+			if hasType(match.Types, dnameType) || hasType(match.Types, NS) && !hasType(match.Types, SOA) {
+				return "", "", nil, fmt.Errorf("Closest encloser %s is a delegation", fqdn(name))
+			}
+			cover := p.coveringNSEC3(nc)
+			if cover == nil {
+				return "", "", nil, fmt.Errorf("No NSEC3 record covers %s", fqdn(nc))
+			}
+			return name, nc, cover, nil
+		}
+		nc = name
+		if name == "" {
+			break
+		}
+	}
+	return "", "", nil, fmt.Errorf("No closest encloser for %s", fqdn(qname))
+}
+
+func (p *denialProof) matchingNSEC3(name string) *NSEC3Record {
+	for _, nsec3 := range p.nsec3s {
+		hash, owner, err := nsec3Hashes(name, nsec3)
+		if err == nil && bytes.Equal(hash, owner) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) coveringNSEC3(name string) *NSEC3Record {
+	for _, nsec3 := range p.nsec3s {
+		hash, owner, err := nsec3Hashes(name, nsec3)
+		if err != nil {
+			continue
+		}
+		next := nsec3.NextHashed
+		if bytes.Compare(owner, next) < 0 {
+			if bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, next) < 0 {
+				return nsec3
+			}
+		} else if bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, next) < 0 {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// nsec3Hashes returns the hash of name with the parameters of an NSEC3
+// record, and the hash its owner name holds.
+func nsec3Hashes(name string, nsec3 *NSEC3Record) ([]byte, []byte, error) {
+	label := strings.SplitN(normalizeName(nsec3.Domain), ".", 2)[0]
+	owner, err := nsec3Encoding.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil, nil, errors.New("Invalid NSEC3 owner name")
+	}
+	hash, err := nsec3Hash(name, nsec3.Salt, nsec3.Iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hash, owner, nil
+}
+
+// nsec3Hash computes the hashed owner name of RFC 5155 section 5.
+func nsec3Hash(name string, salt []byte, iterations uint16) ([]byte, error) {
+	wire, err := canonicalName(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		sum = sha1.Sum(append(sum[:], salt...))
+	}
+	return sum[:], nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import "testing"
+
+// denialTestZone loads a zone signed with an NSEC chain, or with NSEC3
+// if nsec3 is set.
+func denialTestZone(t *testing.T, nsec3 *NSEC3Config) *Zone {
+	t.Helper()
+	return loadTestZone(t, "example.test", testKeyFile(t, AlgECDSAP256SHA256), nsec3, testRecords(t,
+		"example.test. 3600 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 300",
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 192.0.2.53",
+		"www.example.test. 300 IN A 192.0.2.1",
+		"a.b.example.test. 300 IN A 192.0.2.2",
+		"*.wild.example.test. 300 IN TXT \"wild\"",
+		"sub.example.test. 3600 IN NS ns.sub.example.test.",
+		"ns.sub.example.test. 3600 IN A 192.0.2.54",
+	))
+}
+
+var denialChains = []struct {
+	name  string
+	nsec3 *NSEC3Config
+	// optOut is the status of proofs that rest on a span that may hide
+	// unsigned delegations.
+	optOut SecurityStatus
+}{
+	{"NSEC", nil, Secure},
+	{"NSEC3", &NSEC3Config{Iterations: 1, Salt: "ab"}, Secure},
+	{"NSEC3 opt-out", &NSEC3Config{OptOut: true}, Insecure},
+}
+
+// denialFor answers a question from zone and collects the NSEC or NSEC3
+// records of the response.
+func denialFor(zone *Zone, qname string, qtype uint16) (*DnsPacket, *denialProof) {
+	response := NewDnsPacket()
+	zone.Answer(NewDnsQuestion(qname, QueryTypeFromNum(qtype)), response)
+	return response, newDenialProof(response.Authorities, zone.Origin)
+}
+
+// wildcardLabels returns the label count of the signature over the
+// answer, which tells where the wildcard it was expanded from is.
+func wildcardLabels(t *testing.T, response *DnsPacket, qtype uint16) uint8 {
+	t.Helper()
+	for _, rec := range response.Answers {
+		if sig, ok := rec.(*RRSIGRecord); ok && sig.TypeCovered == qtype {
+			return sig.Labels
+		}
+	}
+	t.Fatalf("no RRSIG over the answer:\n%v", response)
+	return 0
+}
+
+func TestDenialProofs(t *testing.T) {
+	cases := []struct {
+		proof  string
+		qname  string
+		qtype  uint16
+		optOut bool
+	}{
+		{"nxdomain", "missing.example.test", A, true},
+		{"nxdomain", "deep.missing.example.test", A, true},
+		{"nodata", "www.example.test", AAAA, false},
+		// b.example.test is an empty non-terminal.
+		{"nodata", "b.example.test", A, false},
+		{"nodata", "x.wild.example.test", A, false},
+		{"nodata", "sub.example.test", DS, true},
+		{"wildcard", "x.wild.example.test", TXT, true},
+		{"wildcard", "y.x.wild.example.test", TXT, true},
+	}
+
+	for _, chain := range denialChains {
+		zone := denialTestZone(t, chain.nsec3)
+		for _, c := range cases {
+			response, p := denialFor(zone, c.qname, c.qtype)
+			var status SecurityStatus
+			var err error
+			switch c.proof {
+			case "nxdomain":
+				status, err = p.proveNXDOMAIN(c.qname)
+			case "nodata":
+				status, err = p.proveNoData(c.qname, c.qtype)
+			case "wildcard":
+				status, err = p.proveWildcard(c.qname, wildcardLabels(t, response, c.qtype))
+			}
+			want := Secure
+			if c.optOut {
+				want = chain.optOut
+			}
+			if err != nil || status != want {
+				t.Errorf("%s: %s proof for %s %v: %v, %v; want %v", chain.name, c.proof,
+					c.qname, QueryTypeFromNum(c.qtype), status, err, want)
+			}
+		}
+
+		// The unsigned delegation proves to be one, whether or not it
+		// is in the chain.
+		_, p := denialFor(zone, "sub.example.test", DS)
+		if err := p.proveNoDS("sub.example.test"); err != nil {
+			t.Errorf("%s: proveNoDS(sub.example.test): %v", chain.name, err)
+		}
+	}
+}
+
+func TestDenialProofsDontCarryOver(t *testing.T) {
+	for _, chain := range denialChains {
+		zone := denialTestZone(t, chain.nsec3)
+
+		_, p := denialFor(zone, "missing.example.test", A)
+		if status, err := p.proveNXDOMAIN("www.example.test"); err == nil {
+			t.Errorf("%s: NXDOMAIN proof of missing.example.test denies www.example.test (%v)", chain.name, status)
+		}
+
+		_, p = denialFor(zone, "www.example.test", AAAA)
+		if status, err := p.proveNoData("www.example.test", A); err == nil {
+			t.Errorf("%s: NODATA proof for AAAA denies the A records of www.example.test (%v)", chain.name, status)
+		}
+		if err := p.proveNoDS("www.example.test"); err == nil {
+			t.Errorf("%s: www.example.test proved to be an unsigned delegation", chain.name)
+		}
+
+		response, p := denialFor(zone, "x.wild.example.test", TXT)
+		labels := wildcardLabels(t, response, TXT)
+		if status, err := p.proveWildcard("www.example.test", labels); err == nil {
+			t.Errorf("%s: wildcard proof for x.wild.example.test holds for www.example.test (%v)", chain.name, status)
+		}
+		if status, err := newDenialProof(nil, zone.Origin).proveWildcard("x.wild.example.test", labels); err == nil {
+			t.Errorf("%s: wildcard expansion accepted without a proof (%v)", chain.name, status)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type DnsHeader struct {
     ID                   uint16
     RecursionDesired     bool
@@ -145,3 +150,46 @@ func (header *DnsHeader) Write(buffer *BytePacketBuffer) error {
 
 	return nil
 }
+
+const (
+	QUERY  uint8 = 0
+	NOTIFY uint8 = 4
+	UPDATE uint8 = 5
+)
+
+var opcodeNames = map[uint8]string{
+	QUERY:  "QUERY",
+	1:      "IQUERY",
+	2:      "STATUS",
+	NOTIFY: "NOTIFY",
+	UPDATE: "UPDATE",
+}
+
+func (header *DnsHeader) String() string {
+	opcode, ok := opcodeNames[header.Opcode]
+	if !ok {
+		opcode = fmt.Sprintf("OPCODE%d", header.Opcode)
+	}
+
+	flags := []string{}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{header.Response, "qr"},
+		{header.AuthoritativeAnswer, "aa"},
+		{header.TruncatedMessage, "tc"},
+		{header.RecursionDesired, "rd"},
+		{header.RecursionAvailable, "ra"},
+		{header.AuthedData, "ad"},
+		{header.CheckingDisabled, "cd"},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	return fmt.Sprintf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n;; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d",
+		opcode, header.ResCode, header.ID, strings.Join(flags, " "),
+		header.Questions, header.Answers, header.AuthoritativeEntries, header.ResourceEntries)
+}
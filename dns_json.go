@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON representation of DNS messages following RFC 8427. Flags are
+// encoded as 0/1 integers, names in presentation format and every resource
+// record carries RDATAHEX so that types we don't model survive a round trip.
+
+type jsonHeader struct {
+	ID      uint16 `json:"ID"`
+	QR      int    `json:"QR"`
+	Opcode  uint8  `json:"Opcode"`
+	AA      int    `json:"AA"`
+	TC      int    `json:"TC"`
+	RD      int    `json:"RD"`
+	RA      int    `json:"RA"`
+	AD      int    `json:"AD"`
+	CD      int    `json:"CD"`
+	RCODE   int    `json:"RCODE"`
+	QDCOUNT uint16 `json:"QDCOUNT"`
+	ANCOUNT uint16 `json:"ANCOUNT"`
+	NSCOUNT uint16 `json:"NSCOUNT"`
+	ARCOUNT uint16 `json:"ARCOUNT"`
+}
+
+type jsonMessage struct {
+	jsonHeader
+	QNAME         *string           `json:"QNAME,omitempty"`
+	QTYPE         *uint16           `json:"QTYPE,omitempty"`
+	QTYPEname     string            `json:"QTYPEname,omitempty"`
+	QCLASS        *uint16           `json:"QCLASS,omitempty"`
+	QuestionRRs   []jsonQuestion    `json:"questionRRs,omitempty"`
+	AnswerRRs     []json.RawMessage `json:"answerRRs,omitempty"`
+	AuthorityRRs  []json.RawMessage `json:"authorityRRs,omitempty"`
+	AdditionalRRs []json.RawMessage `json:"additionalRRs,omitempty"`
+}
+
+type jsonQuestion struct {
+	NAME     string `json:"NAME"`
+	TYPE     uint16 `json:"TYPE"`
+	TYPEname string `json:"TYPEname,omitempty"`
+	CLASS    uint16 `json:"CLASS"`
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (header *DnsHeader) toJSON() jsonHeader {
+	return jsonHeader{
+		ID:      header.ID,
+		QR:      boolToInt(header.Response),
+		Opcode:  header.Opcode,
+		AA:      boolToInt(header.AuthoritativeAnswer),
+		TC:      boolToInt(header.TruncatedMessage),
+		RD:      boolToInt(header.RecursionDesired),
+		RA:      boolToInt(header.RecursionAvailable),
+		AD:      boolToInt(header.AuthedData),
+		CD:      boolToInt(header.CheckingDisabled),
+		RCODE:   int(header.ResCode),
+		QDCOUNT: header.Questions,
+		ANCOUNT: header.Answers,
+		NSCOUNT: header.AuthoritativeEntries,
+		ARCOUNT: header.ResourceEntries,
+	}
+}
+
+func (header *DnsHeader) fromJSON(j jsonHeader) {
+	header.ID = j.ID
+	header.Response = j.QR != 0
+	header.Opcode = j.Opcode & 0x0F
+	header.AuthoritativeAnswer = j.AA != 0
+	header.TruncatedMessage = j.TC != 0
+	header.RecursionDesired = j.RD != 0
+	header.RecursionAvailable = j.RA != 0
+	header.AuthedData = j.AD != 0
+	header.CheckingDisabled = j.CD != 0
+	header.ResCode = ResultCode(j.RCODE & 0x0F)
+	header.Questions = j.QDCOUNT
+	header.Answers = j.ANCOUNT
+	header.AuthoritativeEntries = j.NSCOUNT
+	header.ResourceEntries = j.ARCOUNT
+}
+
+func (header *DnsHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(header.toJSON())
+}
+
+func (header *DnsHeader) UnmarshalJSON(data []byte) error {
+	var j jsonHeader
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	header.fromJSON(j)
+	return nil
+}
+
+func (p *DnsPacket) MarshalJSON() ([]byte, error) {
+	msg := jsonMessage{jsonHeader: p.Header.toJSON()}
+	msg.QDCOUNT = uint16(len(p.Questions))
+	msg.ANCOUNT = uint16(len(p.Answers))
+	msg.NSCOUNT = uint16(len(p.Authorities))
+	msg.ARCOUNT = uint16(len(p.Resources))
+
+	if len(p.Questions) == 1 {
+		q := p.Questions[0]
+		name := fqdn(q.Name)
+		qtype := q.QType.ToNum()
+		qclass := q.Class()
+		msg.QNAME = &name
+		msg.QTYPE = &qtype
+		msg.QTYPEname = q.QType.String()
+		msg.QCLASS = &qclass
+	} else {
+		for _, q := range p.Questions {
+			msg.QuestionRRs = append(msg.QuestionRRs, jsonQuestion{
+				NAME:     fqdn(q.Name),
+				TYPE:     q.QType.ToNum(),
+				TYPEname: q.QType.String(),
+				CLASS:    q.Class(),
+			})
+		}
+	}
+
+	for _, section := range []struct {
+		records []DnsRecord
+		out     *[]json.RawMessage
+	}{
+		{p.Answers, &msg.AnswerRRs},
+		{p.Authorities, &msg.AuthorityRRs},
+		{p.Resources, &msg.AdditionalRRs},
+	} {
+		for _, rec := range section.records {
+			data, err := MarshalDnsRecordJSON(rec)
+			if err != nil {
+				return nil, err
+			}
+			*section.out = append(*section.out, data)
+		}
+	}
+
+	return json.Marshal(msg)
+}
+
+func (p *DnsPacket) UnmarshalJSON(data []byte) error {
+	var msg jsonMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	packet := NewDnsPacket()
+	packet.Header.fromJSON(msg.jsonHeader)
+
+	if msg.QNAME != nil {
+		q := jsonQuestion{NAME: *msg.QNAME, CLASS: 1}
+		if msg.QTYPE != nil {
+			q.TYPE = *msg.QTYPE
+		}
+		if msg.QCLASS != nil {
+			q.CLASS = *msg.QCLASS
+		}
+		msg.QuestionRRs = append([]jsonQuestion{q}, msg.QuestionRRs...)
+	}
+	for _, q := range msg.QuestionRRs {
+		name, err := parseName(q.NAME, "")
+		if err != nil {
+			return err
+		}
+		question := NewDnsQuestion(name, QueryTypeFromNum(q.TYPE))
+		question.QClass = q.CLASS
+		packet.Questions = append(packet.Questions, question)
+	}
+
+	for _, section := range []struct {
+		in  []json.RawMessage
+		out *[]DnsRecord
+	}{
+		{msg.AnswerRRs, &packet.Answers},
+		{msg.AuthorityRRs, &packet.Authorities},
+		{msg.AdditionalRRs, &packet.Resources},
+	} {
+		for _, raw := range section.in {
+			rec, err := UnmarshalDnsRecordJSON(raw)
+			if err != nil {
+				return err
+			}
+			*section.out = append(*section.out, rec)
+		}
+	}
+
+	*p = *packet
+	return nil
+}
+
+// recordRdataString returns the RDATA part of the presentation format.
+func recordRdataString(rec DnsRecord) string {
+	parts := strings.SplitN(rec.String(), " ", 5)
+	if len(parts) < 5 {
+		return ""
+	}
+	return parts[4]
+}
+
+func MarshalDnsRecordJSON(rec DnsRecord) ([]byte, error) {
+	domain, qtypeNum, ttl, rdata, err := splitRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+	qtype := QueryTypeFromNum(qtypeNum)
+
+	obj := map[string]interface{}{
+		"NAME":     fqdn(domain),
+		"TYPE":     qtypeNum,
+		"CLASS":    recordClass(rec),
+		"TTL":      ttl,
+		"RDATAHEX": strings.ToUpper(hex.EncodeToString(rdata)),
+	}
+	if _, ok := queryTypeNames[qtypeNum]; ok {
+		obj["TYPEname"] = qtype.String()
+		obj["rdata"+qtype.String()] = recordRdataString(rec)
+	}
+	return json.Marshal(obj)
+}
+
+func UnmarshalDnsRecordJSON(data []byte) (DnsRecord, error) {
+	var obj struct {
+		NAME     string  `json:"NAME"`
+		TYPE     *uint16 `json:"TYPE"`
+		TYPEname string  `json:"TYPEname"`
+		CLASS    *uint16 `json:"CLASS"`
+		TTL      uint32  `json:"TTL"`
+		RDATAHEX *string `json:"RDATAHEX"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	class := ClassIN
+	if obj.CLASS != nil {
+		class = *obj.CLASS
+	}
+
+	var qtype QueryType
+	switch {
+	case obj.TYPE != nil:
+		qtype = QueryTypeFromNum(*obj.TYPE)
+	case obj.TYPEname != "":
+		var err error
+		qtype, err = QueryTypeFromString(obj.TYPEname)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Record has neither TYPE nor TYPEname")
+	}
+
+	domain, err := parseName(obj.NAME, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Records of other classes, like OPT whose CLASS is the UDP payload
+	// size and TSIG of class ANY, are only read from RDATAHEX.
+	if obj.RDATAHEX != nil {
+		length := strconv.Itoa(len(*obj.RDATAHEX) / 2)
+		return parseGenericRdata(domain, qtype, class, obj.TTL, []string{length, *obj.RDATAHEX})
+	}
+	if class != ClassIN {
+		return nil, fmt.Errorf("Record of class %d for %s has no RDATAHEX", class, obj.NAME)
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+	raw, ok := members["rdata"+qtype.String()]
+	if !ok {
+		return nil, fmt.Errorf("Record for %s has no RDATA", obj.NAME)
+	}
+	var rdata string
+	if err := json.Unmarshal(raw, &rdata); err != nil {
+		return nil, err
+	}
+	fields, err := tokenizeRecord(rdata)
+	if err != nil {
+		return nil, err
+	}
+	ttlField := strconv.FormatUint(uint64(obj.TTL), 10)
+	return parseRecordFields(domain, append([]string{ttlField, qtype.String()}, fields...), "", 0)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONRoundTripKeepsClasses(t *testing.T) {
+	key, err := NewTSIGKey(TSIGKeyConfig{Name: "xfr-key", Secret: "c2VjcmV0c2VjcmV0c2VjcmV0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := NewDnsPacket()
+	packet.Header.ID = 0x1234
+	question := NewDnsQuestion("example.com", QueryTypeFromNum(SOA))
+	question.QClass = ClassANY
+	packet.Questions = append(packet.Questions, question)
+	packet.Resources = append(packet.Resources, &OPTRecord{UDPSize: ednsUDPSize, Flags: ednsFlagDO})
+	if err := newTSIGSession(key).Sign(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DnsPacket
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if got := decoded.Questions[0].Class(); got != ClassANY {
+		t.Errorf("QCLASS = %d, want %d", got, ClassANY)
+	}
+	if opt := findOPT(&decoded); opt == nil || opt.UDPSize != ednsUDPSize || !opt.DNSSECOK() {
+		t.Errorf("OPT record = %v", opt)
+	}
+
+	if want, got := wireFormat(t, packet), wireFormat(t, &decoded); !bytes.Equal(want, got) {
+		t.Errorf("wire format changed in the round trip:\n%x\n%x", want, got)
+	}
+}
+
+func wireFormat(t *testing.T, packet *DnsPacket) []byte {
+	t.Helper()
+	buffer := NewBytePacketBuffer()
+	if err := packet.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buffer.buf[:buffer.Pos()]...)
+}
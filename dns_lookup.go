@@ -3,23 +3,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-
-	"github.com/k0kubun/pp/v3"
+	"strings"
+	"time"
 )
 
-func Lookup(qname string, qtype QueryType, serverAddr *net.UDPAddr) (*DnsPacket, error) {
-	localAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:43210")
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := net.DialUDP("udp", localAddr, serverAddr)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
+const lookupTimeout = 5 * time.Second
 
+func Lookup(qname string, qtype QueryType, serverAddr *net.UDPAddr) (*DnsPacket, error) {
 	question := &DnsQuestion{
 		Name:  qname,
 		QType: qtype,
@@ -28,86 +20,444 @@ func Lookup(qname string, qtype QueryType, serverAddr *net.UDPAddr) (*DnsPacket,
 	packet := NewDnsPacket()
 
 	packet.Header = NewDnsHeader()
-	packet.Header.ID = 5555
+	packet.Header.ID = uint16(rand.Intn(0x10000))
 	packet.Header.Questions = 1
 	packet.Header.RecursionDesired = true
 
 	packet.Questions = append(packet.Questions, question)
 
+	resPacket, err := exchangeUDP(packet, serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The answer didn't fit into a UDP datagram, so ask again over TCP.
+	if resPacket.Header.TruncatedMessage {
+		resPacket, err = exchangeTCP(packet, serverAddr.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resPacket, nil
+}
+
+func exchangeUDP(packet *DnsPacket, serverAddr *net.UDPAddr) (*DnsPacket, error) {
+	_, response, err := exchangeUDPMessage(packet, serverAddr)
+	return response, err
+}
+
+// exchangeUDPMessage also returns the response as received, for callers
+// that need to verify a signature over it.
+func exchangeUDPMessage(packet *DnsPacket, serverAddr *net.UDPAddr) ([]byte, *DnsPacket, error) {
+	// Let the kernel pick the source port so that concurrent lookups
+	// (e.g. from DoH clients) don't collide.
+	conn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(lookupTimeout))
+
 	reqBuffer := NewBytePacketBuffer()
 	if err := packet.Write(reqBuffer); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	_, err = conn.Write(reqBuffer.buf[:reqBuffer.pos])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	resBuffer := NewBytePacketBuffer()
-	_, err = conn.Read(resBuffer.buf[:])
+	// Queries with EDNS may get answers larger than 512 bytes.
+	resBuffer := NewBytePacketBufferWithSize(ednsUDPSize)
+	n, err := conn.Read(resBuffer.buf[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resPacket, err := ReadDnsPacket(NewBytePacketBufferFromBytes(resBuffer.buf[:n]))
+	if err != nil {
+		// Truncated responses may end in the middle of a record; only
+		// the header matters for them.
+		header := NewDnsHeader()
+		if header.Read(NewBytePacketBufferFromBytes(resBuffer.buf[:n])) != nil || !header.TruncatedMessage {
+			return nil, nil, err
+		}
+		resPacket = NewDnsPacket()
+		resPacket.Header = header
+	}
+	if resPacket.Header.ID != packet.Header.ID {
+		return nil, nil, errors.New("Response ID does not match the query")
+	}
+
+	return resBuffer.buf[:n], resPacket, nil
+}
+
+// rootServers are the addresses iterative resolution starts from, and
+// nameServerPort the port of the name servers referrals lead to.
+var (
+	rootServers    = []string{"198.41.0.4:53"}
+	nameServerPort = 53
+)
+
+// ConfigureResolver applies the resolver section of the config.
+func ConfigureResolver(config *ResolverConfig) error {
+	if config == nil {
+		config = &ResolverConfig{}
+	}
+	switch mode := strings.ToLower(config.QNameMinimisation); mode {
+	case "":
+		qnameMinimisation = minimiseRelaxed
+	case minimiseRelaxed, minimiseStrict, minimiseOff:
+		qnameMinimisation = mode
+	default:
+		return fmt.Errorf("Unsupported QNAME minimisation mode %q", config.QNameMinimisation)
+	}
+	raceQueries = config.RaceQueries
+	prefetching = config.Prefetch
+	staleWindow = time.Duration(config.ServeStale) * time.Second
+	if config.StaleAnswerClientTimeout > 0 {
+		staleClientTimeout = time.Duration(config.StaleAnswerClientTimeout) * time.Millisecond
+	}
+	if len(config.RootHints) > 0 {
+		rootServers = nil
+		for _, hint := range config.RootHints {
+			rootServers = append(rootServers, withDefaultPort(hint, "53"))
+		}
+	}
+
+	anchors := config.TrustAnchors
+	if anchors == nil {
+		anchors = defaultTrustAnchors
+	}
+	if err := setTrustAnchors(anchors); err != nil {
+		return err
+	}
+	if !validating() {
+		return nil
+	}
+	return manageTrustAnchors(config.TrustAnchorFile)
+}
+
+// RecursiveLookup resolves a question starting from the root servers. When
+// trust anchors are configured the answer is validated: bogus answers are
+// an error, and secure ones have AuthedData set. Answers are cached, and
+// names that cached NSEC or NSEC3 records deny aren't looked up at all.
+// CNAMEs that lead out of the zone that answered are followed. The work
+// done for the question is limited by a resolutionBudget.
+func RecursiveLookup(qname string, qtype QueryType) (*DnsPacket, error) {
+	budget := newResolutionBudget(qname, qtype)
+	response, err := lookupAnswer(qname, qtype, budget)
 	if err != nil {
 		return nil, err
 	}
+	for {
+		target := danglingCNAME(response, qname, qtype.ToNum())
+		if target == "" {
+			return response, nil
+		}
+		if err := budget.cname(); err != nil {
+			return nil, err
+		}
+		chained, err := lookupAnswer(target, qtype, budget)
+		if err != nil {
+			return nil, err
+		}
+		response.Answers = append(response.Answers, chained.Answers...)
+		response.Authorities = chained.Authorities
+		response.Header.ResCode = chained.Header.ResCode
+		response.Header.AuthedData = response.Header.AuthedData && chained.Header.AuthedData
+		qname = target
+	}
+}
 
-	resPacket, err := ReadDnsPacket(resBuffer)
+// lookupAnswer answers a question from the cache or by iterating, without
+// following CNAMEs to other zones. Expired answers may stand in when the
+// lookup fails.
+func lookupAnswer(qname string, qtype QueryType, budget *resolutionBudget) (*DnsPacket, error) {
+	if cached := cachedResponse(qname, qtype.ToNum()); cached != nil {
+		return cached, nil
+	}
+	if validating() {
+		if synthesized := synthesizeDenial(qname, qtype.ToNum()); synthesized != nil {
+			fmt.Printf("%s %v is denied by cached records\n", fqdn(qname), qtype)
+			return synthesized, nil
+		}
+	}
+	if stale, refresh := staleResponse(qname, qtype.ToNum()); stale != nil {
+		return lookupStale(qname, qtype, stale, refresh)
+	}
+	return resolveAnswer(qname, qtype, budget)
+}
+
+// resolveAnswer looks a question up by iterating, validates the answer
+// and caches it.
+func resolveAnswer(qname string, qtype QueryType, budget *resolutionBudget) (*DnsPacket, error) {
+	response, zone, err := iterate(qname, qtype, budget)
 	if err != nil {
 		return nil, err
 	}
+	status := Insecure
+	if validating() {
+		status, err = validateResponse(response, qname, qtype.ToNum(), zone, budget)
+		if err != nil {
+			return nil, fmt.Errorf("DNSSEC validation of %s %v failed: %w", fqdn(qname), qtype, err)
+		}
+		fmt.Printf("%s %v is %s\n", fqdn(qname), qtype, status)
+		response.Header.AuthedData = status == Secure
+	}
+	cacheResponse(qname, qtype.ToNum(), response, status, zone)
+	return response, nil
+}
 
-	pp.Print(resPacket)
+// danglingCNAME returns the name the CNAMEs in a response for qname lead
+// to when the response has nothing more to say about it, because it's in
+// another zone.
+func danglingCNAME(response *DnsPacket, qname string, qtype uint16) string {
+	if qtype == CNAME || response.Header.ResCode != NOERROR {
+		return ""
+	}
+	target := normalizeName(qname)
+	for i := 0; i <= maxCNAMEChain; i++ {
+		cnames := rrsetAt(response.Answers, target, CNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		target = normalizeName(cnames[0].(*CNAMERecord).Host)
+	}
+	if target == normalizeName(qname) || len(rrsetAt(response.Answers, target, qtype)) > 0 {
+		return ""
+	}
+	// An SOA means the zone knows the target and it has no such records.
+	for _, rec := range response.Authorities {
+		if recordType(rec) == SOA {
+			return ""
+		}
+	}
+	return target
+}
 
-	return resPacket, nil
+// QNAME minimisation modes (RFC 9156). Strict takes an NXDOMAIN for a
+// shortened name as the answer; relaxed asks again with the full name,
+// since some servers wrongly deny empty non-terminals, and also does so
+// when a server fails to answer a shortened name.
+const (
+	minimiseRelaxed = "relaxed"
+	minimiseStrict  = "strict"
+	minimiseOff     = "off"
+)
+
+var qnameMinimisation = minimiseRelaxed
+
+// The first minimiseOneLab shortened names add a label at a time; after
+// that the remaining labels are spread so that a name takes at most
+// maxMinimiseCount queries (RFC 9156 section 2.3).
+const (
+	maxMinimiseCount = 10
+	minimiseOneLab   = 4
+)
+
+// iterate follows referrals from the root until a server answers the
+// question. It also returns the zone the answer came from, which is the
+// last delegation followed. With QNAME minimisation servers are asked
+// about ever longer ancestors of qname, so that they learn no more of it
+// than they need to refer us onwards.
+func iterate(qname string, qtype QueryType, budget *resolutionBudget) (*DnsPacket, string, error) {
+	if err := budget.enter(qname, qtype); err != nil {
+		return nil, "", err
+	}
+	defer budget.leave(qname, qtype)
+
+	servers := []*net.UDPAddr{}
+	for _, addr := range rootServers {
+		server, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		servers = append(servers, server)
+	}
+	zone := ""
+	// known is the longest ancestor of qname shown to exist so far.
+	known := ""
+	minimise := qnameMinimisation != minimiseOff
+	queries := 0
+
+	for {
+		name, t := qname, qtype
+		minimised := false
+		if minimise {
+			if shortened := minimisedName(normalizeName(qname), known, queries); shortened != normalizeName(qname) {
+				name, t, minimised = shortened, *NewQueryType(A, A), true
+				queries++
+			}
+		}
+
+		response, server, err := queryServers(name, t, zone, servers, budget)
+		if minimised && qnameMinimisation == minimiseRelaxed && !overBudget(err) {
+			if err != nil || response.Header.ResCode != NOERROR {
+				// Ask for the full name instead.
+				minimise = false
+				continue
+			}
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		// Referrals are checked before out-of-zone records are dropped,
+		// so that lame servers pointing elsewhere are noticed.
+		cut, referral := referralZone(response, name)
+		scrubResponse(response, name, zone)
+		if !minimised && len(response.Answers) > 0 && response.Header.ResCode == NOERROR {
+			return response, zone, nil
+		}
+		// In strict mode an NXDOMAIN for an ancestor covers qname as well
+		// (RFC 8020).
+		if minimised && response.Header.ResCode == NXDOMAIN {
+			return deniedBelow(response, qname, qtype), zone, nil
+		}
+		if response.Header.ResCode == NXDOMAIN || minimised && response.Header.ResCode != NOERROR {
+			return response, zone, nil
+		}
+
+		if !referral || response.Header.AuthoritativeAnswer {
+			if minimised {
+				known = name
+				continue
+			}
+			return response, zone, nil
+		}
+		// Only referrals further down the tree make progress; a server
+		// that refers elsewhere is lame, and the others are asked.
+		if err := checkReferral(cut, zone, name); err != nil {
+			noteLame(server, zone)
+			if servers = withoutServer(servers, server); len(servers) == 0 {
+				return nil, "", err
+			}
+			continue
+		}
+		if err := budget.referral(); err != nil {
+			return nil, "", err
+		}
+
+		next := []*net.UDPAddr{}
+		for ip := range response.GetResolvedNs(name) {
+			next = append(next, &net.UDPAddr{IP: ip, Port: nameServerPort})
+		}
+		if len(next) == 0 {
+			if next, err = lookupNameServers(response, name, budget); err != nil {
+				return nil, "", err
+			}
+		}
+		if len(next) == 0 {
+			return response, zone, nil
+		}
+		servers = next
+		zone, known = cut, cut
+	}
 }
 
-func RecursiveLookup(qname string, qtype QueryType) (*DnsPacket, error) {
-    ns := net.ParseIP("198.41.0.4").To4()
-    if ns == nil {
-        return nil, errors.New("Failed to parse root server IP address")
-    }
-
-    for {
-        fmt.Printf("attempting lookup of %v %s with ns %s\n", qtype, qname, ns.String())
-
-        server := &net.UDPAddr{
-            IP:   ns,
-            Port: 53,
-        }
-        response, err := Lookup(qname, qtype, server)
-
-        if err != nil {
-            return nil, err
-        }
-        if len(response.Answers) > 0 && response.Header.ResCode == NOERROR {
-            return response, nil
-        }
-
-        if response.Header.ResCode == NXDOMAIN {
-            return response, nil
-        }
-
-        newNs := <-response.GetResolvedNs(qname)
-        if newNs != nil {
-            ns = newNs
-            continue
-        }
-
-        newNsName := <-response.GetUnresolvedNs(qname)
-        if newNsName == "" {
-            return response, nil
-        }
-
-		AQueryType := NewQueryType(A,A)
-        recursiveResponse, err := RecursiveLookup(newNsName, *AQueryType)
-        if err != nil {
-            return nil, err
-        }
-
-        newNs = <-recursiveResponse.GetRandomA()
-        if newNs != nil {
-            ns = newNs.To4()
-        } else {
-            return response, nil
-        }
-    }
+// deniedBelow turns an NXDOMAIN for an ancestor of qname into one for
+// the question itself, with the ancestor's proof of non-existence.
+func deniedBelow(response *DnsPacket, qname string, qtype QueryType) *DnsPacket {
+	denial := NewDnsPacket()
+	header := *response.Header
+	denial.Header = &header
+	denial.Questions = append(denial.Questions, NewDnsQuestion(qname, qtype))
+	denial.Authorities = response.Authorities
+	denial.Resources = response.Resources
+	return denial
+}
+
+// lookupNameServers resolves the addresses of the name servers a referral
+// gave no glue for, up to the first one that has any.
+func lookupNameServers(response *DnsPacket, qname string, budget *resolutionBudget) ([]*net.UDPAddr, error) {
+	var err error
+	for _, host := range response.GetNs(qname) {
+		hostResponse, _, e := iterate(host, *NewQueryType(A, A), budget)
+		if overBudget(e) {
+			return nil, e
+		}
+		if e != nil {
+			err = e
+			continue
+		}
+		addrs := []*net.UDPAddr{}
+		for ip := range hostResponse.GetRandomA() {
+			addrs = append(addrs, &net.UDPAddr{IP: ip.To4(), Port: nameServerPort})
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, err
+}
+
+func withoutServer(servers []*net.UDPAddr, server *net.UDPAddr) []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	for _, s := range servers {
+		if s.String() != server.String() {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// minimisedName returns the name to ask about next on the way from known
+// to qname, after the given number of shortened queries.
+func minimisedName(qname string, known string, queries int) string {
+	left := countLabels(qname) - countLabels(known)
+	if left <= 0 {
+		return qname
+	}
+	step := 1
+	if queries >= minimiseOneLab {
+		if remaining := maxMinimiseCount - queries; remaining <= 1 {
+			step = left
+		} else {
+			step = (left + remaining - 1) / remaining
+		}
+	}
+	labels := strings.Split(qname, ".")
+	return strings.Join(labels[len(labels)-countLabels(known)-step:], ".")
+}
+
+// referralZone returns the owner of the NS records a referral for qname
+// points to, the closest one to qname if there are several.
+func referralZone(response *DnsPacket, qname string) (string, bool) {
+	cut, found := "", false
+	for _, rec := range response.Authorities {
+		if ns, ok := rec.(*NSRecord); ok && isSubdomain(qname, ns.Domain) {
+			if owner := normalizeName(ns.Domain); !found || countLabels(owner) > countLabels(cut) {
+				cut, found = owner, true
+			}
+		}
+	}
+	return cut, found
+}
+
+// queryServer sends an iterative query. It advertises EDNS, and asks for
+// DNSSEC records when validating.
+func queryServer(qname string, qtype QueryType, server *net.UDPAddr) (*DnsPacket, error) {
+	packet := NewDnsPacket()
+	packet.Header.ID = uint16(rand.Intn(0x10000))
+	packet.Questions = append(packet.Questions, NewDnsQuestion(qname, qtype))
+	opt := &OPTRecord{UDPSize: ednsUDPSize}
+	if validating() {
+		opt.Flags |= ednsFlagDO
+	}
+	packet.Resources = append(packet.Resources, opt)
+
+	response, err := exchangeUDP(packet, server)
+	if err != nil {
+		return nil, err
+	}
+	if response.Header.TruncatedMessage {
+		response, err = exchangeTCP(packet, server.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	removeOPT(response)
+	return response, nil
 }
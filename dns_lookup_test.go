@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMinimisedName(t *testing.T) {
+	cases := []struct {
+		qname   string
+		known   string
+		queries int
+		want    string
+	}{
+		{"www.example.com", "", 0, "com"},
+		{"www.example.com", "com", 1, "example.com"},
+		{"www.example.com", "example.com", 2, "www.example.com"},
+		{"www.example.com", "www.example.com", 3, "www.example.com"},
+		// After minimiseOneLab queries the remaining labels are spread
+		// over the queries that are left.
+		{"a.b.c.d.e.f.g.h.i.j.k.l.m.n.example.com", "example.com", 4, "l.m.n.example.com"},
+		{"a.b.c.d.e.f.g.h.i.j.k.l.m.n.example.com", "example.com", 9, "a.b.c.d.e.f.g.h.i.j.k.l.m.n.example.com"},
+	}
+	for _, c := range cases {
+		if got := minimisedName(c.qname, c.known, c.queries); got != c.want {
+			t.Errorf("minimisedName(%s, %s, %d) = %s, want %s", c.qname, c.known, c.queries, got, c.want)
+		}
+	}
+}
+
+// serveMinimisationHierarchy serves an unsigned root, test. and
+// example.test, points the resolver at them and returns the questions
+// each server was asked. The server of example.test wrongly answers
+// NXDOMAIN for the empty non-terminal b.example.test.
+func serveMinimisationHierarchy(t *testing.T) func(server string) string {
+	t.Helper()
+	example := testZone(t, "example.test",
+		"example.test. 3600 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 300",
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.0.3",
+		"www.example.test. 300 IN A 192.0.2.1",
+		"a.b.example.test. 300 IN A 192.0.2.2",
+	)
+	tld := testZone(t, "test",
+		"test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 300",
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2",
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.0.3",
+	)
+	root := testZone(t, ".",
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 127.0.0.1",
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2",
+	)
+
+	var mu sync.Mutex
+	asked := map[string][]string{}
+	record := func(server string, broken bool) func(*DnsPacket) {
+		return func(response *DnsPacket) {
+			question := response.Questions[0]
+			if broken && question.Name == "b.example.test" {
+				response.Header.ResCode = NXDOMAIN
+			}
+			mu.Lock()
+			asked[server] = append(asked[server], fmt.Sprintf("%s %v", question.Name, question.QType))
+			mu.Unlock()
+		}
+	}
+	rootAddr := serveZone(t, "127.0.0.1:0", root, record("root", false))
+	port := rootAddr.Port
+	serveZone(t, fmt.Sprintf("127.0.0.2:%d", port), tld, record("test", false))
+	serveZone(t, fmt.Sprintf("127.0.0.3:%d", port), example, record("example.test", true))
+
+	savedRoots, savedPort, savedMode := rootServers, nameServerPort, qnameMinimisation
+	rootServers, nameServerPort = []string{rootAddr.String()}, port
+	t.Cleanup(func() {
+		rootServers, nameServerPort, qnameMinimisation = savedRoots, savedPort, savedMode
+	})
+	return func(server string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		questions := strings.Join(asked[server], ", ")
+		delete(asked, server)
+		return questions
+	}
+}
+
+func TestQNameMinimisation(t *testing.T) {
+	emptyCache(t)
+	asked := serveMinimisationHierarchy(t)
+
+	cases := []struct {
+		mode, qname string
+		rcode       ResultCode
+		root, tld   string
+		example     string
+	}{
+		// Each server only learns the next label.
+		{minimiseRelaxed, "www.example.test", NOERROR, "test A", "example.test A", "www.example.test AAAA"},
+		// The NXDOMAIN for the empty non-terminal is ignored in relaxed
+		// mode, and believed in strict mode.
+		{minimiseRelaxed, "a.b.example.test", NOERROR, "test A", "example.test A", "b.example.test A, a.b.example.test AAAA"},
+		{minimiseStrict, "a.b.example.test", NXDOMAIN, "test A", "example.test A", "b.example.test A"},
+		{minimiseOff, "a.b.example.test", NOERROR, "a.b.example.test AAAA", "a.b.example.test AAAA", "a.b.example.test AAAA"},
+	}
+	for _, c := range cases {
+		emptyCache(t)
+		qnameMinimisation = c.mode
+		qtype := QueryTypeFromNum(AAAA)
+		response, err := RecursiveLookup(c.qname, qtype)
+		if err != nil {
+			t.Errorf("%s: %s: %v", c.mode, c.qname, err)
+			continue
+		}
+		// The answer is to the question asked, whatever name the denial
+		// was for.
+		if response.Header.ResCode != c.rcode || len(response.Questions) != 1 ||
+			response.Questions[0].Name != c.qname || response.Questions[0].QType.ToNum() != AAAA {
+			t.Errorf("%s: %s:\n%v", c.mode, c.qname, response)
+		}
+		for server, want := range map[string]string{"root": c.root, "test": c.tld, "example.test": c.example} {
+			if got := asked(server); got != want {
+				t.Errorf("%s: %s: %s was asked %q, want %q", c.mode, c.qname, server, got, want)
+			}
+		}
+	}
+
+	// An NXDOMAIN for an ancestor is cached for the question asked.
+	emptyCache(t)
+	qnameMinimisation = minimiseStrict
+	if _, err := RecursiveLookup("x.missing.example.test", QueryTypeFromNum(A)); err != nil {
+		t.Fatal(err)
+	}
+	cached := cachedResponse("x.missing.example.test", A)
+	if cached == nil || cached.Header.ResCode != NXDOMAIN || cached.Questions[0].Name != "x.missing.example.test" {
+		t.Errorf("cached NXDOMAIN:\n%v", cached)
+	}
+	if cachedResponse("missing.example.test", A) != nil {
+		t.Error("NXDOMAIN for the question cached for the ancestor")
+	}
+}
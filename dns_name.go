@@ -0,0 +1,36 @@
+package main
+
+import "strings"
+
+// Domain name helpers. Names are compared case-insensitively and label by
+// label, so "badexample.com" is not below "example.com".
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isSubdomain reports whether name is equal to or below zone.
+func isSubdomain(name string, zone string) bool {
+	name = normalizeName(name)
+	zone = normalizeName(zone)
+	if zone == "" {
+		return true
+	}
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// parentName strips the leftmost label; the parent of a TLD is the root.
+func parentName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func countLabels(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
@@ -123,8 +123,8 @@ func (p *DnsPacket) GetRandomA() <-chan net.IP {
 func (p *DnsPacket) GetNs(qname string) []string {
 	nsList := make([]string, 0)
 	for _, record := range p.Authorities {
-		if record.getType() == NS && strings.HasSuffix(qname, record.(*NSRecord).Domain){
-			nsList = append(nsList, record.(*NSRecord).Host)
+		if record.getType() == NS && isSubdomain(qname, record.(*NSRecord).Domain){
+			nsList = append(nsList, normalizeName(record.(*NSRecord).Host))
 		}
 	}
 	return nsList
@@ -138,7 +138,7 @@ func (p *DnsPacket) GetResolvedNs(qname string) <-chan net.IP {
 
 		nsList := p.GetNs(qname)
 		for _, record := range p.Resources {
-			if record.getType() == A && contains(nsList, record.(*ARecord).Domain) {
+			if record.getType() == A && contains(nsList, normalizeName(record.(*ARecord).Domain)) {
 				resultChan <- record.(*ARecord).Addr
 			}
 		}
@@ -170,3 +170,44 @@ func contains(slice []string, s string) bool {
 	}
 	return false
 }
+
+// String renders the packet the way dig prints a response.
+func (p *DnsPacket) String() string {
+	header := *p.Header
+	header.Questions = uint16(len(p.Questions))
+	header.Answers = uint16(len(p.Answers))
+	header.AuthoritativeEntries = uint16(len(p.Authorities))
+	header.ResourceEntries = uint16(len(p.Resources))
+
+	var sb strings.Builder
+	sb.WriteString(header.String())
+	sb.WriteString("\n")
+
+	if len(p.Questions) > 0 {
+		sb.WriteString("\n;; QUESTION SECTION:\n")
+		for _, question := range p.Questions {
+			sb.WriteString(question.String())
+			sb.WriteString("\n")
+		}
+	}
+
+	for _, section := range []struct {
+		name    string
+		records []DnsRecord
+	}{
+		{"ANSWER", p.Answers},
+		{"AUTHORITY", p.Authorities},
+		{"ADDITIONAL", p.Resources},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		sb.WriteString("\n;; " + section.name + " SECTION:\n")
+		for _, rec := range section.records {
+			sb.WriteString(rec.String())
+			sb.WriteString("\n")
+		}
+	}
+
+	return sb.String()
+}
@@ -1,8 +1,19 @@
 package main
 
+import "fmt"
+
 type DnsQuestion struct {
     Name  string
     QType QueryType
+    // QClass is the class asked for; zero means IN.
+    QClass uint16
+}
+
+func (q *DnsQuestion) Class() uint16 {
+	if q.QClass == 0 {
+		return ClassIN
+	}
+	return q.QClass
 }
 
 func NewDnsQuestion(name string, qType QueryType) *DnsQuestion {
@@ -22,7 +33,7 @@ func (q *DnsQuestion) Read(buffer *BytePacketBuffer) error {
     }
     q.QType = QueryTypeFromNum(qTypeNum)
 
-    _, err = buffer.ReadU16()
+    q.QClass, err = buffer.ReadU16()
     if err != nil {
         return err
     }
@@ -40,9 +51,12 @@ func (q *DnsQuestion) Write(buffer *BytePacketBuffer) error {
         return err
     }
 
-	if err :=  buffer.WriteU16(1); err != nil {
+	if err :=  buffer.WriteU16(q.Class()); err != nil {
         return err
     }
 
 	return nil
-}
\ No newline at end of file
+}
+func (q *DnsQuestion) String() string {
+	return fmt.Sprintf(";%s %s %s", fqdn(q.Name), className(q.Class()), q.QType)
+}
@@ -1,30 +1,112 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
 type DnsRecord interface {
 	getType() int
 	Write(*BytePacketBuffer)(int, error)
+	String() string
+	// header returns the owner name, without the trailing dot, and the
+	// TTL; withHeader returns a copy of the record with other ones.
+	header() (string, uint32)
+	withHeader(domain string, ttl uint32) DnsRecord
 }
 
+func ownerName(domain string) string {
+	return strings.TrimSuffix(domain, ".")
+}
+
+// Record classes. Only IN is served; NONE and ANY appear in the
+// prerequisite and update sections of dynamic updates (RFC 2136).
+const (
+	ClassIN   uint16 = 1
+	ClassCH   uint16 = 3
+	ClassHS   uint16 = 4
+	ClassNONE uint16 = 254
+	ClassANY  uint16 = 255
+)
+
+var classNames = map[uint16]string{
+	ClassIN:   "IN",
+	ClassCH:   "CH",
+	ClassHS:   "HS",
+	ClassNONE: "NONE",
+	ClassANY:  "ANY",
+}
+
+// UnknownRecord holds a record as opaque RDATA. Records of other classes
+// than IN are always kept this way; a zero Class means IN.
 type UnknownRecord struct {
 	Domain  string
 	QType   uint16
+	Class   uint16
 	DataLen uint16
 	TTL     uint32
+	Data    []byte
 }
 
 func (u *UnknownRecord) getType() int {
 	return Unknown
 }
 
+func (u *UnknownRecord) header() (string, uint32) {
+	return ownerName(u.Domain), u.TTL
+}
+
+func (u *UnknownRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *u
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+// Unknown records are written back as opaque rdata (RFC 3597).
 func (u *UnknownRecord) Write(buffer *BytePacketBuffer) (int, error) {
-	fmt.Println("Skipping record")
-	return 0, errors.New("Unsupported DNS record type")
+	startPos := buffer.pos
+
+	if err := buffer.WriteQName(&u.Domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(u.QType); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(recordClass(u)); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(u.TTL); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(uint16(len(u.Data))); err != nil {
+		return 0, err
+	}
+	for _, b := range u.Data {
+		if err := buffer.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (u *UnknownRecord) String() string {
+	rdata := fmt.Sprintf("\\# %d", len(u.Data))
+	if len(u.Data) > 0 {
+		rdata += " " + hex.EncodeToString(u.Data)
+	}
+	return fmt.Sprintf("%s %d %s %s %s", fqdn(u.Domain), u.TTL, className(recordClass(u)), QueryTypeFromNum(u.QType), rdata)
+}
+
+func className(class uint16) string {
+	if name, ok := classNames[class]; ok {
+		return name
+	}
+	return fmt.Sprintf("CLASS%d", class)
 }
 
 type ARecord struct {
@@ -37,6 +119,16 @@ func (a *ARecord) getType() int {
 	return A
 }
 
+func (a *ARecord) header() (string, uint32) {
+	return ownerName(a.Domain), a.TTL
+}
+
+func (a *ARecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *a
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
 func (a *ARecord) Write(buffer *BytePacketBuffer) (int, error) {
 		startPos := buffer.pos
 
@@ -77,6 +169,10 @@ func (a *ARecord) Write(buffer *BytePacketBuffer) (int, error) {
 	return int(buffer.pos - startPos), nil
 }
 
+func (a *ARecord) String() string {
+	return formatRecord(a.Domain, a.TTL, QueryTypeFromNum(A), a.Addr.String())
+}
+
 type NSRecord struct {
 	Domain string
 	Host   string
@@ -87,6 +183,16 @@ func (ns *NSRecord) getType() int {
 	return NS
 }
 
+func (ns *NSRecord) header() (string, uint32) {
+	return ownerName(ns.Domain), ns.TTL
+}
+
+func (ns *NSRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *ns
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
 func (ns *NSRecord) Write(buffer *BytePacketBuffer) (int, error) {
 	startPos := buffer.pos
 
@@ -111,11 +217,14 @@ func (ns *NSRecord) Write(buffer *BytePacketBuffer) (int, error) {
 	buffer.WriteQName(&ns.Host)
 
 	size := buffer.pos - (pos + 2)
-	buffer.SetU16(uint8(pos), uint16(size))
+	buffer.SetU16(pos, uint16(size))
 
 	return int(buffer.pos - startPos), nil
 }
 
+func (ns *NSRecord) String() string {
+	return formatRecord(ns.Domain, ns.TTL, QueryTypeFromNum(NS), fqdn(ns.Host))
+}
 
 type CNAMERecord struct {
 	Domain string
@@ -127,6 +236,16 @@ func (cname *CNAMERecord) getType() int {
 	return CNAME
 }
 
+func (cname *CNAMERecord) header() (string, uint32) {
+	return ownerName(cname.Domain), cname.TTL
+}
+
+func (cname *CNAMERecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *cname
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
 func (cname *CNAMERecord) Write(buffer *BytePacketBuffer) (int, error) {
 	startPos := buffer.pos
 
@@ -151,11 +270,14 @@ func (cname *CNAMERecord) Write(buffer *BytePacketBuffer) (int, error) {
 	buffer.WriteQName(&cname.Host)
 
 	size := buffer.pos - (pos + 2)
-	buffer.SetU16(uint8(pos), uint16(size))
+	buffer.SetU16(pos, uint16(size))
 
 	return int(buffer.pos - startPos), nil
 }
 
+func (cname *CNAMERecord) String() string {
+	return formatRecord(cname.Domain, cname.TTL, QueryTypeFromNum(CNAME), fqdn(cname.Host))
+}
 
 type MXRecord struct {
 	Domain string
@@ -168,6 +290,16 @@ func (mx *MXRecord) getType() int {
 	return MX
 }
 
+func (mx *MXRecord) header() (string, uint32) {
+	return ownerName(mx.Domain), mx.TTL
+}
+
+func (mx *MXRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *mx
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
 func (mx *MXRecord) Write(buffer *BytePacketBuffer) (int, error) {
 	startPos := buffer.pos
 
@@ -193,11 +325,15 @@ func (mx *MXRecord) Write(buffer *BytePacketBuffer) (int, error) {
 	buffer.WriteQName(&mx.Host)
 
 	size := buffer.pos - (pos + 2)
-	buffer.SetU16(uint8(pos), uint16(size))
+	buffer.SetU16(pos, uint16(size))
 
 	return int(buffer.pos - startPos), nil
 }
 
+func (mx *MXRecord) String() string {
+	return formatRecord(mx.Domain, mx.TTL, QueryTypeFromNum(MX), fmt.Sprintf("%d %s", mx.Priority, fqdn(mx.Host)))
+}
+
 type AAAARecord struct {
 	Domain string
 	Addr   net.IP
@@ -208,6 +344,16 @@ func (a4 *AAAARecord) getType() int {
 	return AAAA
 }
 
+func (a4 *AAAARecord) header() (string, uint32) {
+	return ownerName(a4.Domain), a4.TTL
+}
+
+func (a4 *AAAARecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *a4
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
 func (a4 *AAAARecord) Write(buffer *BytePacketBuffer) (int, error) {
 	startPos := buffer.pos
 
@@ -227,14 +373,433 @@ func (a4 *AAAARecord) Write(buffer *BytePacketBuffer) (int, error) {
 		return 0, err
 	}
 
-	for _, octet := range a4.Addr {
-		buffer.WriteU16(uint16(octet))
+	octets := a4.Addr.To16()
+	if octets == nil {
+		return 0, errors.New("Invalid IPv6 address")
+	}
+
+	for _, octet := range octets {
+		if err := buffer.Write(octet); err != nil {
+			return 0, err
+		}
 	}
 
 	return int(buffer.pos - startPos), nil
 }
 
+func (a4 *AAAARecord) String() string {
+	return formatRecord(a4.Domain, a4.TTL, QueryTypeFromNum(AAAA), a4.Addr.String())
+}
+
+type SOARecord struct {
+	Domain  string
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+	TTL     uint32
+}
+
+func (soa *SOARecord) getType() int {
+	return SOA
+}
+
+func (soa *SOARecord) header() (string, uint32) {
+	return ownerName(soa.Domain), soa.TTL
+}
+
+func (soa *SOARecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *soa
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (soa *SOARecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+
+	if err := buffer.WriteQName(&soa.Domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(SOA); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(1); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(soa.TTL); err != nil {
+		return 0, err
+	}
+
+	pos := buffer.pos
+	if err := buffer.WriteU16(0); err != nil {
+		return 0, err
+	}
+
+	if err := buffer.WriteQName(&soa.MName); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteQName(&soa.RName); err != nil {
+		return 0, err
+	}
+	for _, val := range []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum} {
+		if err := buffer.WriteU32(val); err != nil {
+			return 0, err
+		}
+	}
+
+	size := buffer.pos - (pos + 2)
+	buffer.SetU16(pos, uint16(size))
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (soa *SOARecord) String() string {
+	return formatRecord(soa.Domain, soa.TTL, QueryTypeFromNum(SOA), fmt.Sprintf("%s %s %d %d %d %d %d",
+		fqdn(soa.MName), fqdn(soa.RName), soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum))
+}
+
+type PTRRecord struct {
+	Domain string
+	Host   string
+	TTL    uint32
+}
+
+func (ptr *PTRRecord) getType() int {
+	return PTR
+}
+
+func (ptr *PTRRecord) header() (string, uint32) {
+	return ownerName(ptr.Domain), ptr.TTL
+}
+
+func (ptr *PTRRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *ptr
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (ptr *PTRRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+
+	if err := buffer.WriteQName(&ptr.Domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(PTR); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(1); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(ptr.TTL); err != nil {
+		return 0, err
+	}
+
+	pos := buffer.pos
+	if err := buffer.WriteU16(0); err != nil {
+		return 0, err
+	}
+
+	if err := buffer.WriteQName(&ptr.Host); err != nil {
+		return 0, err
+	}
+
+	size := buffer.pos - (pos + 2)
+	buffer.SetU16(pos, uint16(size))
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (ptr *PTRRecord) String() string {
+	return formatRecord(ptr.Domain, ptr.TTL, QueryTypeFromNum(PTR), fqdn(ptr.Host))
+}
+
+type TXTRecord struct {
+	Domain string
+	Data   []string
+	TTL    uint32
+}
+
+func (txt *TXTRecord) getType() int {
+	return TXT
+}
+
+func (txt *TXTRecord) header() (string, uint32) {
+	return ownerName(txt.Domain), txt.TTL
+}
+
+func (txt *TXTRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *txt
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (txt *TXTRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+
+	if err := buffer.WriteQName(&txt.Domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(TXT); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(1); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(txt.TTL); err != nil {
+		return 0, err
+	}
+
+	pos := buffer.pos
+	if err := buffer.WriteU16(0); err != nil {
+		return 0, err
+	}
+
+	for _, str := range txt.Data {
+		if len(str) > 255 {
+			return 0, errors.New("TXT string exceeds 255 characters of length")
+		}
+		if err := buffer.Write(uint8(len(str))); err != nil {
+			return 0, err
+		}
+		for _, b := range []byte(str) {
+			if err := buffer.Write(b); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	size := buffer.pos - (pos + 2)
+	buffer.SetU16(pos, uint16(size))
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (txt *TXTRecord) String() string {
+	strs := make([]string, 0, len(txt.Data))
+	for _, str := range txt.Data {
+		strs = append(strs, quoteText(str))
+	}
+	return formatRecord(txt.Domain, txt.TTL, QueryTypeFromNum(TXT), strings.Join(strs, " "))
+}
+
+// TSIGRecord is the transaction signature at the end of a signed message
+// (RFC 8945). It is never part of a zone.
+type TSIGRecord struct {
+	Domain     string
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	OtherData  []byte
+}
+
+func (tsig *TSIGRecord) getType() int {
+	return TSIG
+}
+
+func (tsig *TSIGRecord) header() (string, uint32) {
+	return ownerName(tsig.Domain), 0
+}
+
+// TSIG records always have a TTL of 0.
+func (tsig *TSIGRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *tsig
+	c.Domain = domain
+	return &c
+}
+
+func (tsig *TSIGRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+
+	if err := buffer.WriteQName(&tsig.Domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(TSIG); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(ClassANY); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(0); err != nil {
+		return 0, err
+	}
+
+	pos := buffer.pos
+	if err := buffer.WriteU16(0); err != nil {
+		return 0, err
+	}
+
+	if err := buffer.WriteQName(&tsig.Algorithm); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(uint16(tsig.TimeSigned >> 32)); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(uint32(tsig.TimeSigned)); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(tsig.Fudge); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(uint16(len(tsig.MAC))); err != nil {
+		return 0, err
+	}
+	for _, b := range tsig.MAC {
+		if err := buffer.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	if err := buffer.WriteU16(tsig.OriginalID); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(tsig.Error); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(uint16(len(tsig.OtherData))); err != nil {
+		return 0, err
+	}
+	for _, b := range tsig.OtherData {
+		if err := buffer.Write(b); err != nil {
+			return 0, err
+		}
+	}
+
+	size := buffer.pos - (pos + 2)
+	buffer.SetU16(pos, uint16(size))
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (tsig *TSIGRecord) String() string {
+	return fmt.Sprintf("%s 0 ANY TSIG %s %d %d %d %s %d %s %d %s", fqdn(tsig.Domain), fqdn(tsig.Algorithm),
+		tsig.TimeSigned, tsig.Fudge, len(tsig.MAC), base64.StdEncoding.EncodeToString(tsig.MAC),
+		tsig.OriginalID, tsigErrorName(tsig.Error), len(tsig.OtherData), hex.EncodeToString(tsig.OtherData))
+}
+
+// splitRecord returns the owner, numeric type, TTL and wire format RDATA of
+// any record by writing it out and reading the fixed fields back.
+func splitRecord(rec DnsRecord) (string, uint16, uint32, []byte, error) {
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if _, err := rec.Write(buffer); err != nil {
+		return "", 0, 0, nil, err
+	}
+	end := buffer.Pos()
+	buffer.Seek(0)
+
+	var domain string
+	if err := buffer.ReadQName(&domain); err != nil {
+		return "", 0, 0, nil, err
+	}
+	qtype, err := buffer.ReadU16()
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	if _, err := buffer.ReadU16(); err != nil {
+		return "", 0, 0, nil, err
+	}
+	ttl, err := buffer.ReadU32()
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	dataLen, err := buffer.ReadU16()
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	if buffer.Pos()+dataLen != end {
+		return "", 0, 0, nil, errors.New("Record length mismatch")
+	}
+	data, err := buffer.GetRange(buffer.Pos(), dataLen)
+	if err != nil {
+		return "", 0, 0, nil, err
+	}
+	return domain, qtype, ttl, append([]byte(nil), data...), nil
+}
+
+// recordType returns the numeric type of a record, including the ones
+// we only keep as opaque data.
+func recordType(rec DnsRecord) uint16 {
+	if unknown, ok := rec.(*UnknownRecord); ok {
+		return unknown.QType
+	}
+	return uint16(rec.getType())
+}
+
+func recordClass(rec DnsRecord) uint16 {
+	if unknown, ok := rec.(*UnknownRecord); ok && unknown.Class != 0 {
+		return unknown.Class
+	}
+	switch r := rec.(type) {
+	case *OPTRecord:
+		return r.UDPSize
+	case *TSIGRecord:
+		return ClassANY
+	}
+	return ClassIN
+}
+
+func recordDomain(rec DnsRecord) string {
+	domain, _ := rec.header()
+	return domain
+}
+
+func recordTTL(rec DnsRecord) uint32 {
+	_, ttl := rec.header()
+	return ttl
+}
+
+// withRecordHeader returns a copy of the record with a different owner
+// name and TTL, e.g. for synthesized or cached answers.
+func withRecordHeader(rec DnsRecord, domain string, ttl uint32) DnsRecord {
+	return rec.withHeader(domain, ttl)
+}
+
 func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
+	start := buffer.Pos()
+	rec, err := readDnsRecord(buffer, false)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := rec.(*UnknownRecord)
+	if !ok || len(raw.Data) == 0 || !compressibleType(raw.QType) {
+		return rec, nil
+	}
+
+	// The names in the RDATA of records of other classes, like the
+	// deletions of dynamic updates, may be compressed against the rest of
+	// the message. They are read by type and kept uncompressed.
+	end := buffer.Pos()
+	buffer.Seek(start)
+	typed, err := readDnsRecord(buffer, true)
+	if err != nil {
+		return nil, err
+	}
+	buffer.Seek(end)
+	_, _, _, data, err := splitRecord(typed)
+	if err != nil {
+		return nil, err
+	}
+	raw.Data, raw.DataLen = data, uint16(len(data))
+	return raw, nil
+}
+
+// compressibleType reports whether names in the RDATA of qtype may be
+// compressed (RFC 3597 section 4).
+func compressibleType(qtype uint16) bool {
+	switch qtype {
+	case NS, CNAME, SOA, PTR, MX:
+		return true
+	}
+	return false
+}
+
+// readDnsRecord reads a record, parsing the RDATA of records of other
+// classes than IN by type only if anyClass is set.
+func readDnsRecord(buffer *BytePacketBuffer, anyClass bool) (DnsRecord, error) {
 	var domain string
 	if err := buffer.ReadQName(&domain); err != nil {
 		return nil, err
@@ -246,7 +811,8 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 	}
 	qType := QueryTypeFromNum(qTypeNum)
 
-	if _, err := buffer.ReadU16(); err != nil {
+	class, err := buffer.ReadU16()
+	if err != nil {
 		return nil, err
 	}
 
@@ -260,7 +826,18 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 		return nil, err
 	}
 
-	switch qType.query_type {
+	// Records of other classes, and the empty RDATA of RFC 2136 deletions
+	// and prerequisites, are not parsed by type.
+	typ := qType.query_type
+	if typ == OPT {
+		// OPT reuses CLASS and TTL for its own fields.
+		return readOPTRecord(buffer, class, ttl, dataLen)
+	}
+	if (class != ClassIN && typ != TSIG && !anyClass) || dataLen == 0 {
+		typ = Unknown
+	}
+
+	switch typ {
 	case A:
 		rawAddr, err := buffer.ReadU32()
 		if err != nil {
@@ -295,13 +872,21 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			return nil, err
 		}
 		addr := net.IP{
+			byte(rawAddr1 >> 24),
 			byte(rawAddr1 >> 16),
+			byte(rawAddr1 >> 8),
 			byte(rawAddr1),
+			byte(rawAddr2 >> 24),
 			byte(rawAddr2 >> 16),
+			byte(rawAddr2 >> 8),
 			byte(rawAddr2),
+			byte(rawAddr3 >> 24),
 			byte(rawAddr3 >> 16),
+			byte(rawAddr3 >> 8),
 			byte(rawAddr3),
+			byte(rawAddr4 >> 24),
 			byte(rawAddr4 >> 16),
+			byte(rawAddr4 >> 8),
 			byte(rawAddr4),
 		}
 		return &AAAARecord{
@@ -327,6 +912,120 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			Host: cname,
 			TTL: ttl,
 		}, nil
+	case SOA:
+		var mname, rname string
+		if err := buffer.ReadQName(&mname); err != nil {
+			return nil, err
+		}
+		if err := buffer.ReadQName(&rname); err != nil {
+			return nil, err
+		}
+		vals := make([]uint32, 5)
+		for i := range vals {
+			if vals[i], err = buffer.ReadU32(); err != nil {
+				return nil, err
+			}
+		}
+
+		return &SOARecord{
+			Domain: domain,
+			MName: mname,
+			RName: rname,
+			Serial: vals[0],
+			Refresh: vals[1],
+			Retry: vals[2],
+			Expire: vals[3],
+			Minimum: vals[4],
+			TTL: ttl,
+		}, nil
+	case PTR:
+		var host string
+		if err := buffer.ReadQName(&host); err != nil {
+			return nil, err
+		}
+
+		return &PTRRecord{
+			Domain: domain,
+			Host: host,
+			TTL: ttl,
+		}, nil
+	case TXT:
+		data := []string{}
+		end := buffer.Pos() + dataLen
+		for buffer.Pos() < end {
+			length, err := buffer.Read()
+			if err != nil {
+				return nil, err
+			}
+			str, err := buffer.GetRange(buffer.Pos(), uint16(length))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, string(str))
+			buffer.Step(uint16(length))
+		}
+
+		return &TXTRecord{
+			Domain: domain,
+			Data: data,
+			TTL: ttl,
+		}, nil
+	case TSIG:
+		var algorithm string
+		if err := buffer.ReadQName(&algorithm); err != nil {
+			return nil, err
+		}
+		timeHigh, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		timeLow, err := buffer.ReadU32()
+		if err != nil {
+			return nil, err
+		}
+		fudge, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		macSize, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		mac, err := buffer.GetRange(buffer.Pos(), macSize)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Step(macSize)
+		originalID, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		tsigError, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		otherLen, err := buffer.ReadU16()
+		if err != nil {
+			return nil, err
+		}
+		other, err := buffer.GetRange(buffer.Pos(), otherLen)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Step(otherLen)
+
+		return &TSIGRecord{
+			Domain: domain,
+			Algorithm: algorithm,
+			TimeSigned: uint64(timeHigh)<<32 | uint64(timeLow),
+			Fudge: fudge,
+			MAC: append([]byte(nil), mac...),
+			OriginalID: originalID,
+			Error: tsigError,
+			OtherData: append([]byte(nil), other...),
+		}, nil
+	case DNSKEY, DS, RRSIG, NSEC, NSEC3, NSEC3PARAM:
+		return readDNSSECRecord(buffer, domain, typ, ttl, buffer.Pos()+dataLen)
 	case MX:
 		priority, err := buffer.ReadU16()
 		if err != nil {
@@ -342,14 +1041,20 @@ func ReadDnsRecord(buffer *BytePacketBuffer) (DnsRecord, error) {
 			TTL: ttl,
 		}, nil
 	default:
+		data, err := buffer.GetRange(buffer.Pos(), dataLen)
+		if err != nil {
+			return nil, err
+		}
 		if err := buffer.Step(uint16(dataLen)); err != nil {
 			return nil, err
 		}
 		return &UnknownRecord{
 			Domain:  domain,
 			QType:   qTypeNum,
+			Class:   class,
 			DataLen: dataLen,
 			TTL:     ttl,
+			Data:    append([]byte(nil), data...),
 		}, nil
 	}
 }
\ No newline at end of file
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream transports (TCP, and TLS on top of it) prefix every message with
+// its length as a two byte integer (RFC 1035 section 4.2.2).
+
+const streamIdleTimeout = 30 * time.Second
+
+// A connection has at most maxPipelinedQueries queries in flight; reading
+// stops until one of them is answered. A response that can't be written
+// within streamWriteTimeout is dropped.
+const (
+	maxPipelinedQueries = 16
+	streamWriteTimeout  = 10 * time.Second
+)
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, errors.New("Zero length message")
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, packet *DnsPacket) error {
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := packet.Write(buffer); err != nil {
+		return err
+	}
+
+	// Send prefix and message with a single write so that concurrent
+	// writers holding the same lock never interleave partial frames.
+	msg := make([]byte, 2+buffer.Pos())
+	binary.BigEndian.PutUint16(msg, buffer.Pos())
+	copy(msg[2:], buffer.Bytes())
+	_, err := w.Write(msg)
+	return err
+}
+
+func exchangeTCP(packet *DnsPacket, serverAddr string) (*DnsPacket, error) {
+	conn, err := net.DialTimeout("tcp", serverAddr, lookupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(lookupTimeout))
+
+	return exchangeStream(conn, packet)
+}
+
+func exchangeStream(conn net.Conn, packet *DnsPacket) (*DnsPacket, error) {
+	if err := writeTCPMessage(conn, packet); err != nil {
+		return nil, err
+	}
+	msg, err := readTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+	if err != nil {
+		return nil, err
+	}
+	if response.Header.ID != packet.Header.ID {
+		return nil, errors.New("Response ID does not match the query")
+	}
+	return response, nil
+}
+
+func ServeTCP(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Listening on TCP %s...\n", addr)
+	return serveStreamListener(listener)
+}
+
+func serveStreamListener(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go serveStreamConn(conn)
+	}
+}
+
+// serveStreamConn answers queries on a connection until the client closes
+// it or stays idle for too long. Queries are handled concurrently and the
+// responses written back as they complete, so clients may pipeline.
+func serveStreamConn(conn net.Conn) {
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, maxPipelinedQueries)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Closing stream connection", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+		if err != nil {
+			fmt.Println("Malformed stream query", err)
+			return
+		}
+
+		session, response := authenticate(msg, request)
+		if response == nil && isZoneTransfer(request) {
+			writeMu.Lock()
+			err := serveTransfer(conn.RemoteAddr(), session.KeyName(), request, func(response *DnsPacket) error {
+				if err := session.Sign(response); err != nil {
+					return err
+				}
+				conn.SetWriteDeadline(time.Now().Add(transferTimeout))
+				return writeTCPMessage(conn, response)
+			})
+			writeMu.Unlock()
+			if err != nil {
+				fmt.Println("Zone transfer failed", err)
+				return
+			}
+			continue
+		}
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			if response == nil {
+				response = handleRequest(request, conn.RemoteAddr(), session.KeyName())
+			}
+			if err := session.Sign(response); err != nil {
+				fmt.Println("Failed to sign stream response", err)
+				return
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := writeTCPMessage(conn, response); err != nil {
+				fmt.Println("Failed to write stream response", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSSEC record types (RFC 4034 and RFC 5155).
+
+// DNSKEY flags.
+const (
+	DNSKEYFlagZone   uint16 = 0x0100
+	DNSKEYFlagSEP    uint16 = 0x0001
+	DNSKEYFlagRevoke uint16 = 0x0080
+)
+
+// NSEC3OptOut is the only flag of NSEC3 records.
+const NSEC3OptOut uint8 = 0x01
+
+// base32hex without padding is used for NSEC3 hashes (RFC 5155 section 3.3).
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// rrsigTimeFormat is the presentation format of RRSIG validity times.
+const rrsigTimeFormat = "20060102150405"
+
+// writeRecordHeader writes the fields all records start with and a
+// placeholder for RDLENGTH, whose position it returns.
+func writeRecordHeader(buffer *BytePacketBuffer, domain string, qtype uint16, ttl uint32) (uint16, error) {
+	if err := buffer.WriteQName(&domain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(qtype); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(ClassIN); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(ttl); err != nil {
+		return 0, err
+	}
+	pos := buffer.pos
+	return pos, buffer.WriteU16(0)
+}
+
+// finishRecord fills in RDLENGTH and returns the size of the record.
+func finishRecord(buffer *BytePacketBuffer, startPos uint16, lengthPos uint16) int {
+	buffer.SetU16(lengthPos, buffer.pos-(lengthPos+2))
+	return int(buffer.pos - startPos)
+}
+
+type DNSKEYRecord struct {
+	Domain    string
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+	TTL       uint32
+}
+
+func (key *DNSKEYRecord) getType() int {
+	return DNSKEY
+}
+
+func (key *DNSKEYRecord) header() (string, uint32) {
+	return ownerName(key.Domain), key.TTL
+}
+
+func (key *DNSKEYRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *key
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (key *DNSKEYRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, key.Domain, DNSKEY, key.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(key.rdata()); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+func (key *DNSKEYRecord) rdata() []byte {
+	data := binary.BigEndian.AppendUint16(nil, key.Flags)
+	data = append(data, key.Protocol, key.Algorithm)
+	return append(data, key.PublicKey...)
+}
+
+func (key *DNSKEYRecord) String() string {
+	return formatRecord(key.Domain, key.TTL, QueryTypeFromNum(DNSKEY), fmt.Sprintf("%d %d %d %s",
+		key.Flags, key.Protocol, key.Algorithm, base64.StdEncoding.EncodeToString(key.PublicKey)))
+}
+
+// KeyTag computes the tag RRSIG and DS records use to refer to the key
+// (RFC 4034 appendix B).
+func (key *DNSKEYRecord) KeyTag() uint16 {
+	rdata := key.rdata()
+	if key.Algorithm == 1 {
+		// RSA/MD5 keys use the low bits of the modulus instead.
+		if len(rdata) < 4 {
+			return 0
+		}
+		return binary.BigEndian.Uint16(rdata[len(rdata)-3:])
+	}
+
+	var sum uint32
+	for i, b := range rdata {
+		if i%2 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16
+	return uint16(sum)
+}
+
+type DSRecord struct {
+	Domain     string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+	TTL        uint32
+}
+
+func (ds *DSRecord) getType() int {
+	return DS
+}
+
+func (ds *DSRecord) header() (string, uint32) {
+	return ownerName(ds.Domain), ds.TTL
+}
+
+func (ds *DSRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *ds
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (ds *DSRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, ds.Domain, DS, ds.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(ds.KeyTag); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange([]byte{ds.Algorithm, ds.DigestType}); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(ds.Digest); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+func (ds *DSRecord) String() string {
+	return formatRecord(ds.Domain, ds.TTL, QueryTypeFromNum(DS), fmt.Sprintf("%d %d %d %s",
+		ds.KeyTag, ds.Algorithm, ds.DigestType, strings.ToUpper(hex.EncodeToString(ds.Digest))))
+}
+
+type RRSIGRecord struct {
+	Domain      string
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+	TTL         uint32
+}
+
+func (sig *RRSIGRecord) getType() int {
+	return RRSIG
+}
+
+func (sig *RRSIGRecord) header() (string, uint32) {
+	return ownerName(sig.Domain), sig.TTL
+}
+
+func (sig *RRSIGRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *sig
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (sig *RRSIGRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, sig.Domain, RRSIG, sig.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := sig.writeFields(buffer); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(sig.Signature); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+// writeFields writes the RDATA up to the signature, which is also the
+// start of the data the signature covers.
+func (sig *RRSIGRecord) writeFields(buffer *BytePacketBuffer) error {
+	if err := buffer.WriteU16(sig.TypeCovered); err != nil {
+		return err
+	}
+	if err := buffer.WriteRange([]byte{sig.Algorithm, sig.Labels}); err != nil {
+		return err
+	}
+	for _, val := range []uint32{sig.OriginalTTL, sig.Expiration, sig.Inception} {
+		if err := buffer.WriteU32(val); err != nil {
+			return err
+		}
+	}
+	if err := buffer.WriteU16(sig.KeyTag); err != nil {
+		return err
+	}
+	return buffer.WriteQName(&sig.SignerName)
+}
+
+func (sig *RRSIGRecord) String() string {
+	return formatRecord(sig.Domain, sig.TTL, QueryTypeFromNum(RRSIG), fmt.Sprintf("%s %d %d %d %s %s %d %s %s",
+		QueryTypeFromNum(sig.TypeCovered), sig.Algorithm, sig.Labels, sig.OriginalTTL,
+		formatRRSIGTime(sig.Expiration), formatRRSIGTime(sig.Inception), sig.KeyTag,
+		fqdn(sig.SignerName), base64.StdEncoding.EncodeToString(sig.Signature)))
+}
+
+func formatRRSIGTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(rrsigTimeFormat)
+}
+
+// parseRRSIGTime accepts YYYYMMDDHHmmSS as well as seconds since the epoch.
+func parseRRSIGTime(s string) (uint32, error) {
+	if len(s) == len(rrsigTimeFormat) {
+		t, err := time.Parse(rrsigTimeFormat, s)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid RRSIG time %q", s)
+		}
+		return uint32(t.Unix()), nil
+	}
+	val, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid RRSIG time %q", s)
+	}
+	return uint32(val), nil
+}
+
+type NSECRecord struct {
+	Domain     string
+	NextDomain string
+	Types      []uint16
+	TTL        uint32
+}
+
+func (nsec *NSECRecord) getType() int {
+	return NSEC
+}
+
+func (nsec *NSECRecord) header() (string, uint32) {
+	return ownerName(nsec.Domain), nsec.TTL
+}
+
+func (nsec *NSECRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *nsec
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (nsec *NSECRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, nsec.Domain, NSEC, nsec.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteQName(&nsec.NextDomain); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(encodeTypeBitmap(nsec.Types)); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+func (nsec *NSECRecord) String() string {
+	return formatRecord(nsec.Domain, nsec.TTL, QueryTypeFromNum(NSEC),
+		strings.TrimSpace(fqdn(nsec.NextDomain)+" "+formatTypes(nsec.Types)))
+}
+
+type NSEC3Record struct {
+	Domain        string
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []uint16
+	TTL           uint32
+}
+
+func (nsec3 *NSEC3Record) getType() int {
+	return NSEC3
+}
+
+func (nsec3 *NSEC3Record) header() (string, uint32) {
+	return ownerName(nsec3.Domain), nsec3.TTL
+}
+
+func (nsec3 *NSEC3Record) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *nsec3
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (nsec3 *NSEC3Record) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, nsec3.Domain, NSEC3, nsec3.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange([]byte{nsec3.HashAlgorithm, nsec3.Flags}); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(nsec3.Iterations); err != nil {
+		return 0, err
+	}
+	if err := buffer.Write(uint8(len(nsec3.Salt))); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(nsec3.Salt); err != nil {
+		return 0, err
+	}
+	if err := buffer.Write(uint8(len(nsec3.NextHashed))); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(nsec3.NextHashed); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(encodeTypeBitmap(nsec3.Types)); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+func (nsec3 *NSEC3Record) String() string {
+	return formatRecord(nsec3.Domain, nsec3.TTL, QueryTypeFromNum(NSEC3), strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s",
+		nsec3.HashAlgorithm, nsec3.Flags, nsec3.Iterations, formatSalt(nsec3.Salt),
+		nsec3Encoding.EncodeToString(nsec3.NextHashed), formatTypes(nsec3.Types))))
+}
+
+type NSEC3PARAMRecord struct {
+	Domain        string
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	TTL           uint32
+}
+
+func (param *NSEC3PARAMRecord) getType() int {
+	return NSEC3PARAM
+}
+
+func (param *NSEC3PARAMRecord) header() (string, uint32) {
+	return ownerName(param.Domain), param.TTL
+}
+
+func (param *NSEC3PARAMRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *param
+	c.Domain, c.TTL = domain, ttl
+	return &c
+}
+
+func (param *NSEC3PARAMRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+	pos, err := writeRecordHeader(buffer, param.Domain, NSEC3PARAM, param.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange([]byte{param.HashAlgorithm, param.Flags}); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(param.Iterations); err != nil {
+		return 0, err
+	}
+	if err := buffer.Write(uint8(len(param.Salt))); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(param.Salt); err != nil {
+		return 0, err
+	}
+	return finishRecord(buffer, startPos, pos), nil
+}
+
+func (param *NSEC3PARAMRecord) String() string {
+	return formatRecord(param.Domain, param.TTL, QueryTypeFromNum(NSEC3PARAM), fmt.Sprintf("%d %d %d %s",
+		param.HashAlgorithm, param.Flags, param.Iterations, formatSalt(param.Salt)))
+}
+
+// A salt of zero length is written as "-".
+func formatSalt(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+func parseSalt(s string) ([]byte, error) {
+	if s == "-" {
+		return []byte{}, nil
+	}
+	salt, err := hex.DecodeString(s)
+	if err != nil || len(salt) > 255 {
+		return nil, fmt.Errorf("Invalid NSEC3 salt %q", s)
+	}
+	return salt, nil
+}
+
+// encodeTypeBitmap builds the window blocks listing the types that exist
+// at an NSEC or NSEC3 owner name (RFC 4034 section 4.1.2).
+func encodeTypeBitmap(types []uint16) []byte {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	data := []byte{}
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		bitmap := make([]byte, 32)
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		data = append(data, byte(window), byte(length))
+		data = append(data, bitmap[:length]...)
+	}
+	return data
+}
+
+func decodeTypeBitmap(data []byte) ([]uint16, error) {
+	types := []uint16{}
+	lastWindow := -1
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("Truncated type bitmap")
+		}
+		window, length := int(data[0]), int(data[1])
+		if window <= lastWindow || length == 0 || length > 32 || len(data) < 2+length {
+			return nil, errors.New("Invalid type bitmap")
+		}
+		for i, b := range data[2 : 2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, uint16(window<<8|i*8+bit))
+				}
+			}
+		}
+		lastWindow = window
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+func formatTypes(types []uint16) string {
+	names := []string{}
+	for _, t := range types {
+		names = append(names, QueryTypeFromNum(t).String())
+	}
+	return strings.Join(names, " ")
+}
+
+func parseTypes(fields []string) ([]uint16, error) {
+	types := []uint16{}
+	for _, field := range fields {
+		qtype, err := QueryTypeFromString(field)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, qtype.ToNum())
+	}
+	return types, nil
+}
+
+func hasType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// readDNSSECRecord decodes the RDATA of the DNSSEC types, which ends at
+// end.
+func readDNSSECRecord(buffer *BytePacketBuffer, domain string, qtype uint16, ttl uint32, end uint16) (DnsRecord, error) {
+	start := buffer.Pos()
+	if end < start {
+		return nil, errors.New("Invalid record length")
+	}
+	rdata, err := buffer.GetRange(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	rdata = append([]byte(nil), rdata...)
+	short := fmt.Errorf("%s record for %s is too short", QueryTypeFromNum(qtype), fqdn(domain))
+
+	switch qtype {
+	case DNSKEY:
+		if len(rdata) < 4 {
+			return nil, short
+		}
+		buffer.Seek(end)
+		return &DNSKEYRecord{
+			Domain:    domain,
+			Flags:     binary.BigEndian.Uint16(rdata),
+			Protocol:  rdata[2],
+			Algorithm: rdata[3],
+			PublicKey: rdata[4:],
+			TTL:       ttl,
+		}, nil
+	case DS:
+		if len(rdata) < 4 {
+			return nil, short
+		}
+		buffer.Seek(end)
+		return &DSRecord{
+			Domain:     domain,
+			KeyTag:     binary.BigEndian.Uint16(rdata),
+			Algorithm:  rdata[2],
+			DigestType: rdata[3],
+			Digest:     rdata[4:],
+			TTL:        ttl,
+		}, nil
+	case RRSIG:
+		if len(rdata) < 18 {
+			return nil, short
+		}
+		buffer.Seek(start + 18)
+		var signer string
+		if err := buffer.ReadQName(&signer); err != nil {
+			return nil, err
+		}
+		if buffer.Pos() > end {
+			return nil, short
+		}
+		signature := rdata[buffer.Pos()-start:]
+		buffer.Seek(end)
+		return &RRSIGRecord{
+			Domain:      domain,
+			TypeCovered: binary.BigEndian.Uint16(rdata),
+			Algorithm:   rdata[2],
+			Labels:      rdata[3],
+			OriginalTTL: binary.BigEndian.Uint32(rdata[4:]),
+			Expiration:  binary.BigEndian.Uint32(rdata[8:]),
+			Inception:   binary.BigEndian.Uint32(rdata[12:]),
+			KeyTag:      binary.BigEndian.Uint16(rdata[16:]),
+			SignerName:  signer,
+			Signature:   signature,
+			TTL:         ttl,
+		}, nil
+	case NSEC:
+		var next string
+		if err := buffer.ReadQName(&next); err != nil {
+			return nil, err
+		}
+		if buffer.Pos() > end {
+			return nil, short
+		}
+		types, err := decodeTypeBitmap(rdata[buffer.Pos()-start:])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Seek(end)
+		return &NSECRecord{Domain: domain, NextDomain: next, Types: types, TTL: ttl}, nil
+	case NSEC3, NSEC3PARAM:
+		if len(rdata) < 5 || len(rdata) < 5+int(rdata[4]) {
+			return nil, short
+		}
+		saltEnd := 5 + int(rdata[4])
+		buffer.Seek(end)
+		if qtype == NSEC3PARAM {
+			return &NSEC3PARAMRecord{
+				Domain:        domain,
+				HashAlgorithm: rdata[0],
+				Flags:         rdata[1],
+				Iterations:    binary.BigEndian.Uint16(rdata[2:]),
+				Salt:          rdata[5:saltEnd],
+				TTL:           ttl,
+			}, nil
+		}
+		if len(rdata) < saltEnd+1 || len(rdata) < saltEnd+1+int(rdata[saltEnd]) {
+			return nil, short
+		}
+		hashEnd := saltEnd + 1 + int(rdata[saltEnd])
+		types, err := decodeTypeBitmap(rdata[hashEnd:])
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC3Record{
+			Domain:        domain,
+			HashAlgorithm: rdata[0],
+			Flags:         rdata[1],
+			Iterations:    binary.BigEndian.Uint16(rdata[2:]),
+			Salt:          rdata[5:saltEnd],
+			NextHashed:    rdata[saltEnd+1 : hashEnd],
+			Types:         types,
+			TTL:           ttl,
+		}, nil
+	}
+	return nil, fmt.Errorf("Not a DNSSEC record type: %d", qtype)
+}
+
+// parseDNSSECFields parses the presentation format RDATA of the DNSSEC
+// types. Base64 and hex fields may be split into several words.
+func parseDNSSECFields(domain string, qtype uint16, ttl uint32, rdata []string, origin string) (DnsRecord, error) {
+	name := QueryTypeFromNum(qtype).String()
+	atLeast := func(n int) error {
+		if len(rdata) < n {
+			return fmt.Errorf("%s record for %s needs at least %d fields, got %d", name, fqdn(domain), n, len(rdata))
+		}
+		return nil
+	}
+	number := func(s string, bits int) (uint64, error) {
+		val, err := strconv.ParseUint(s, 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s field %q", name, s)
+		}
+		return val, nil
+	}
+
+	switch qtype {
+	case DNSKEY:
+		if err := atLeast(4); err != nil {
+			return nil, err
+		}
+		flags, err := number(rdata[0], 16)
+		if err != nil {
+			return nil, err
+		}
+		protocol, err := number(rdata[1], 8)
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := number(rdata[2], 8)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(rdata[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DNSKEY public key: %v", err)
+		}
+		return &DNSKEYRecord{Domain: domain, Flags: uint16(flags), Protocol: uint8(protocol),
+			Algorithm: uint8(algorithm), PublicKey: key, TTL: ttl}, nil
+	case DS:
+		if err := atLeast(4); err != nil {
+			return nil, err
+		}
+		tag, err := number(rdata[0], 16)
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := number(rdata[1], 8)
+		if err != nil {
+			return nil, err
+		}
+		digestType, err := number(rdata[2], 8)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(rdata[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DS digest: %v", err)
+		}
+		return &DSRecord{Domain: domain, KeyTag: uint16(tag), Algorithm: uint8(algorithm),
+			DigestType: uint8(digestType), Digest: digest, TTL: ttl}, nil
+	case RRSIG:
+		if err := atLeast(9); err != nil {
+			return nil, err
+		}
+		covered, err := QueryTypeFromString(rdata[0])
+		if err != nil {
+			return nil, err
+		}
+		vals := make([]uint64, 3)
+		for i, bits := range []int{8, 8, 32} {
+			if vals[i], err = number(rdata[1+i], bits); err != nil {
+				return nil, err
+			}
+		}
+		expiration, err := parseRRSIGTime(rdata[4])
+		if err != nil {
+			return nil, err
+		}
+		inception, err := parseRRSIGTime(rdata[5])
+		if err != nil {
+			return nil, err
+		}
+		tag, err := number(rdata[6], 16)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := parseName(rdata[7], origin)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(rdata[8:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RRSIG signature: %v", err)
+		}
+		return &RRSIGRecord{Domain: domain, TypeCovered: covered.ToNum(), Algorithm: uint8(vals[0]),
+			Labels: uint8(vals[1]), OriginalTTL: uint32(vals[2]), Expiration: expiration,
+			Inception: inception, KeyTag: uint16(tag), SignerName: signer, Signature: signature, TTL: ttl}, nil
+	case NSEC:
+		if err := atLeast(1); err != nil {
+			return nil, err
+		}
+		next, err := parseName(rdata[0], origin)
+		if err != nil {
+			return nil, err
+		}
+		types, err := parseTypes(rdata[1:])
+		if err != nil {
+			return nil, err
+		}
+		return &NSECRecord{Domain: domain, NextDomain: next, Types: types, TTL: ttl}, nil
+	case NSEC3, NSEC3PARAM:
+		if err := atLeast(4); err != nil {
+			return nil, err
+		}
+		vals := make([]uint64, 3)
+		var err error
+		for i, bits := range []int{8, 8, 16} {
+			if vals[i], err = number(rdata[i], bits); err != nil {
+				return nil, err
+			}
+		}
+		salt, err := parseSalt(rdata[3])
+		if err != nil {
+			return nil, err
+		}
+		if qtype == NSEC3PARAM {
+			if len(rdata) != 4 {
+				return nil, fmt.Errorf("NSEC3PARAM record for %s needs 4 fields, got %d", fqdn(domain), len(rdata))
+			}
+			return &NSEC3PARAMRecord{Domain: domain, HashAlgorithm: uint8(vals[0]), Flags: uint8(vals[1]),
+				Iterations: uint16(vals[2]), Salt: salt, TTL: ttl}, nil
+		}
+		if err := atLeast(5); err != nil {
+			return nil, err
+		}
+		next, err := nsec3Encoding.DecodeString(strings.ToUpper(rdata[4]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid NSEC3 next hashed owner %q", rdata[4])
+		}
+		types, err := parseTypes(rdata[5:])
+		if err != nil {
+			return nil, err
+		}
+		return &NSEC3Record{Domain: domain, HashAlgorithm: uint8(vals[0]), Flags: uint8(vals[1]),
+			Iterations: uint16(vals[2]), Salt: salt, NextHashed: next, Types: types, TTL: ttl}, nil
+	}
+	return nil, fmt.Errorf("Not a DNSSEC record type: %s", name)
+}
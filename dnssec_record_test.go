@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDNSSECRecordRoundTrip(t *testing.T) {
+	lines := []string{
+		"example.com. 3600 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==",
+		"example.com. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF",
+		"www.example.com. 300 IN RRSIG A 13 3 300 20240201000000 20240101000000 12345 example.com. c2lnbmF0dXJl",
+		"*.example.com. 300 IN RRSIG TXT 13 2 300 20240201000000 20240101000000 12345 example.com. c2lnbmF0dXJl",
+		"www.example.com. 300 IN NSEC zzz.example.com. A MX RRSIG NSEC TYPE1234",
+		"example.com. 300 IN NSEC www.example.com. NS SOA TXT AAAA RRSIG NSEC DNSKEY TYPE257",
+		"2vptu5timamqttgl4luu9kg21e0aor3s.example.com. 300 IN NSEC3 1 1 12 AABBCCDD 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A RRSIG",
+		"2vptu5timamqttgl4luu9kg21e0aor3s.example.com. 300 IN NSEC3 1 0 0 - 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR",
+		"example.com. 0 IN NSEC3PARAM 1 0 12 AABBCCDD",
+		"example.com. 0 IN NSEC3PARAM 1 0 0 -",
+	}
+	for _, line := range lines {
+		rec, err := ParseDnsRecord(line)
+		if err != nil {
+			t.Errorf("ParseDnsRecord(%q): %v", line, err)
+			continue
+		}
+		if got := rec.String(); got != line {
+			t.Errorf("ParseDnsRecord(%q).String() = %q", line, got)
+		}
+
+		buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+		if _, err := rec.Write(buffer); err != nil {
+			t.Errorf("%s: %v", line, err)
+			continue
+		}
+		buffer.Seek(0)
+		again, err := ReadDnsRecord(buffer)
+		if err != nil || again.String() != line {
+			t.Errorf("%s read back from the wire as %v: %v", line, again, err)
+		}
+	}
+}
+
+func TestTypeBitmap(t *testing.T) {
+	// The example of RFC 4034 section 4.3.
+	want := "0006400100000003" + "041b" + strings.Repeat("00", 26) + "20"
+	bitmap := encodeTypeBitmap([]uint16{A, MX, RRSIG, NSEC, 1234})
+	if got := hex.EncodeToString(bitmap); got != want {
+		t.Errorf("encodeTypeBitmap = %s, want %s", got, want)
+	}
+	types, err := decodeTypeBitmap(bitmap)
+	if err != nil || formatTypes(types) != "A MX RRSIG NSEC TYPE1234" {
+		t.Errorf("decodeTypeBitmap = %v, %v", types, err)
+	}
+
+	for _, bad := range []string{"00", "0000", "0021" + strings.Repeat("ff", 33), "0102ff"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := decodeTypeBitmap(data); err == nil {
+			t.Errorf("decodeTypeBitmap(%s) accepted a malformed bitmap", bad)
+		}
+	}
+}
+
+func TestKeyTagAndDigest(t *testing.T) {
+	// The example of RFC 4034 section 5.4.
+	key := testRecords(t, "dskey.example.com. 86400 IN DNSKEY 256 3 5 "+
+		"AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")[0].(*DNSKEYRecord)
+	ds := testRecords(t, "dskey.example.com. 86400 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118")[0].(*DSRecord)
+
+	if tag := key.KeyTag(); tag != 60485 {
+		t.Errorf("KeyTag() = %d, want 60485", tag)
+	}
+	digest, err := dsDigest(key, DigestSHA1)
+	if err != nil || !bytes.Equal(digest, ds.Digest) {
+		t.Errorf("dsDigest = %X, %v", digest, err)
+	}
+	if !matchesDS(ds, key) {
+		t.Error("key doesn't match its DS")
+	}
+
+	// Owner names are compared without case; anything else must match.
+	upper := *key
+	upper.Domain = "DSKEY.Example.COM"
+	if !matchesDS(ds, &upper) {
+		t.Error("DS doesn't match the key with its owner in upper case")
+	}
+	for _, change := range []func(*DSRecord){
+		func(d *DSRecord) { d.KeyTag++ },
+		func(d *DSRecord) { d.Algorithm = AlgRSASHA256 },
+		func(d *DSRecord) { d.Domain = "other.example.com" },
+		func(d *DSRecord) { d.Digest = append([]byte{0}, d.Digest[1:]...) },
+		func(d *DSRecord) { d.DigestType = 3 },
+	} {
+		other := *ds
+		change(&other)
+		if matchesDS(&other, key) {
+			t.Errorf("%v matches the key", &other)
+		}
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// Hashes from the example zone of RFC 5155 appendix A.
+	salt, _ := hex.DecodeString("aabbccdd")
+	cases := map[string]string{
+		"example":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example":   "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"ns1.example": "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+		"NS1.Example": "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+	}
+	for name, want := range cases {
+		hash, err := nsec3Hash(name, salt, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ToLower(nsec3Encoding.EncodeToString(hash)); got != want {
+			t.Errorf("nsec3Hash(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestCanonicalOrder(t *testing.T) {
+	// The example of RFC 4034 section 6.1, without the escaped labels.
+	want := []string{"example", "a.example", "yljkjljk.a.example", "Z.a.example", "zABC.a.EXAMPLE", "z.example", "*.z.example"}
+	names := append([]string(nil), want...)
+	rand.New(rand.NewSource(1)).Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	sort.Slice(names, func(i, j int) bool { return canonicalNameLess(names[i], names[j]) })
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("canonical order: %v", names)
+	}
+
+	// RRsets are sorted by RDATA and duplicates, including ones that only
+	// differ in case, are dropped.
+	rrset, err := sortCanonical(testRecords(t,
+		"example.com. 300 IN NS b.example.com.",
+		"example.com. 300 IN NS A.example.com.",
+		"example.com. 300 IN NS B.Example.com.",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(recordStrings(rrset), " | "); got != "example.com. 300 IN NS A.example.com. | example.com. 300 IN NS b.example.com." {
+		t.Errorf("sortCanonical: %s", got)
+	}
+	rrset, _ = sortCanonical(testRecords(t, "example.com. 300 IN A 192.0.2.10", "example.com. 300 IN A 192.0.2.9"))
+	if got := strings.Join(recordStrings(rrset), " | "); got != "example.com. 300 IN A 192.0.2.9 | example.com. 300 IN A 192.0.2.10" {
+		t.Errorf("sortCanonical: %s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// SigningKey is a private key godns signs a zone with, together with the
+// DNSKEY record that publishes it.
+type SigningKey struct {
+	DNSKEY *DNSKEYRecord
+	signer crypto.Signer
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8 private key for zone. A key
+// file that doesn't exist yet is created with a new ECDSA P-256 key.
+func LoadSigningKey(config SigningKeyConfig, zone string) (*SigningKey, error) {
+	data, err := os.ReadFile(config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = generateKeyFile(config.File)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", config.File)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.File, err)
+	}
+
+	key := &SigningKey{
+		DNSKEY: &DNSKEYRecord{Domain: normalizeName(zone), Flags: DNSKEYFlagZone, Protocol: 3},
+	}
+	if config.KSK {
+		key.DNSKEY.Flags |= DNSKEYFlagSEP
+	}
+	switch k := parsed.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key.DNSKEY.Algorithm = AlgECDSAP256SHA256
+		case elliptic.P384():
+			key.DNSKEY.Algorithm = AlgECDSAP384SHA384
+		default:
+			return nil, fmt.Errorf("%s: unsupported curve %s", config.File, k.Curve.Params().Name)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		key.DNSKEY.PublicKey = append(k.X.FillBytes(make([]byte, size)), k.Y.FillBytes(make([]byte, size))...)
+		key.signer = k
+	case ed25519.PrivateKey:
+		key.DNSKEY.Algorithm = AlgED25519
+		key.DNSKEY.PublicKey = append([]byte(nil), k.Public().(ed25519.PublicKey)...)
+		key.signer = k
+	case *rsa.PrivateKey:
+		key.DNSKEY.Algorithm = AlgRSASHA256
+		key.DNSKEY.PublicKey = rsaKeyData(&k.PublicKey)
+		key.signer = k
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", config.File, parsed)
+	}
+	return key, nil
+}
+
+func generateKeyFile(path string) ([]byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated signing key %s\n", path)
+	return data, nil
+}
+
+// rsaKeyData encodes an RSA public key in the format of RFC 3110.
+func rsaKeyData(key *rsa.PublicKey) []byte {
+	exponent := big.NewInt(int64(key.E)).Bytes()
+	data := []byte{}
+	if len(exponent) > 255 {
+		data = append(data, 0, byte(len(exponent)>>8), byte(len(exponent)))
+	} else {
+		data = append(data, byte(len(exponent)))
+	}
+	data = append(data, exponent...)
+	return append(data, key.N.Bytes()...)
+}
+
+// DS returns the DS record the parent zone should publish for the key.
+func (key *SigningKey) DS() (*DSRecord, error) {
+	digest, err := dsDigest(key.DNSKEY, DigestSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &DSRecord{
+		Domain:     key.DNSKEY.Domain,
+		KeyTag:     key.DNSKEY.KeyTag(),
+		Algorithm:  key.DNSKEY.Algorithm,
+		DigestType: DigestSHA256,
+		Digest:     digest,
+		TTL:        key.DNSKEY.TTL,
+	}, nil
+}
+
+// Sign makes an RRSIG over rrset, valid between inception and expiration.
+func (key *SigningKey) Sign(rrset []DnsRecord, inception uint32, expiration uint32) (*RRSIGRecord, error) {
+	if len(rrset) == 0 {
+		return nil, errors.New("Empty RRset")
+	}
+	owner := normalizeName(recordDomain(rrset[0]))
+	ttl := recordTTL(rrset[0])
+	sig := &RRSIGRecord{
+		Domain:      owner,
+		TypeCovered: recordType(rrset[0]),
+		Algorithm:   key.DNSKEY.Algorithm,
+		Labels:      signatureLabels(owner),
+		OriginalTTL: ttl,
+		Expiration:  expiration,
+		Inception:   inception,
+		KeyTag:      key.DNSKEY.KeyTag(),
+		SignerName:  key.DNSKEY.Domain,
+		TTL:         ttl,
+	}
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Signature, err = key.sign(data); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+func (key *SigningKey) sign(data []byte) ([]byte, error) {
+	switch k := key.signer.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, data), nil
+
+	case *ecdsa.PrivateKey:
+		hash := crypto.SHA256
+		if key.DNSKEY.Algorithm == AlgECDSAP384SHA384 {
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		h.Write(data)
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		// Signatures are the bare r and s (RFC 6605 section 4).
+		size := len(key.DNSKEY.PublicKey) / 2
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+
+	case *rsa.PrivateKey:
+		h := crypto.SHA256.New()
+		h.Write(data)
+		return rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h.Sum(nil))
+	}
+	return nil, fmt.Errorf("Unsupported algorithm %d", key.DNSKEY.Algorithm)
+}
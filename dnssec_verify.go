@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// DNSSEC algorithm numbers (RFC 8624 lists which ones to implement).
+const (
+	AlgRSASHA1          uint8 = 5
+	AlgRSASHA1NSEC3SHA1 uint8 = 7
+	AlgRSASHA256        uint8 = 8
+	AlgRSASHA512        uint8 = 10
+	AlgECDSAP256SHA256  uint8 = 13
+	AlgECDSAP384SHA384  uint8 = 14
+	AlgED25519          uint8 = 15
+)
+
+// DS digest types.
+const (
+	DigestSHA1   uint8 = 1
+	DigestSHA256 uint8 = 2
+	DigestSHA384 uint8 = 4
+)
+
+func algorithmSupported(algorithm uint8) bool {
+	switch algorithm {
+	case AlgRSASHA1, AlgRSASHA1NSEC3SHA1, AlgRSASHA256, AlgRSASHA512,
+		AlgECDSAP256SHA256, AlgECDSAP384SHA384, AlgED25519:
+		return true
+	}
+	return false
+}
+
+func digestSupported(digestType uint8) bool {
+	switch digestType {
+	case DigestSHA1, DigestSHA256, DigestSHA384:
+		return true
+	}
+	return false
+}
+
+// dsDigest computes the digest a DS record holds for key (RFC 4034 section
+// 5.1.4).
+func dsDigest(key *DNSKEYRecord, digestType uint8) ([]byte, error) {
+	data, err := canonicalName(key.Domain)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, key.rdata()...)
+
+	switch digestType {
+	case DigestSHA1:
+		sum := sha1.Sum(data)
+		return sum[:], nil
+	case DigestSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case DigestSHA384:
+		sum := sha512.Sum384(data)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("Unsupported DS digest type %d", digestType)
+}
+
+// matchesDS reports whether ds refers to key.
+func matchesDS(ds *DSRecord, key *DNSKEYRecord) bool {
+	if ds.KeyTag != key.KeyTag() || ds.Algorithm != key.Algorithm || normalizeName(ds.Domain) != normalizeName(key.Domain) {
+		return false
+	}
+	digest, err := dsDigest(key, ds.DigestType)
+	return err == nil && bytes.Equal(digest, ds.Digest)
+}
+
+// verifyRRSIG checks that sig is a currently valid signature by key over
+// rrset, which must all share owner name and type.
+func verifyRRSIG(sig *RRSIGRecord, key *DNSKEYRecord, rrset []DnsRecord, now time.Time) error {
+	if len(rrset) == 0 {
+		return errors.New("Empty RRset")
+	}
+	owner := normalizeName(recordDomain(rrset[0]))
+	switch {
+	case normalizeName(sig.SignerName) != normalizeName(key.Domain):
+		return fmt.Errorf("Signer %s does not match key owner %s", fqdn(sig.SignerName), fqdn(key.Domain))
+	case sig.Algorithm != key.Algorithm || sig.KeyTag != key.KeyTag():
+		return errors.New("Signature was made with a different key")
+	case key.Protocol != 3 || key.Flags&DNSKEYFlagZone == 0:
+		return errors.New("Key is not a zone key")
+	case sig.TypeCovered != recordType(rrset[0]):
+		return errors.New("Signature covers a different type")
+	case int(sig.Labels) > int(signatureLabels(owner)):
+		return errors.New("Signature has too many labels")
+	case !isSubdomain(owner, sig.SignerName):
+		return fmt.Errorf("%s cannot sign %s", fqdn(sig.SignerName), fqdn(owner))
+	}
+
+	// Validity times use serial number arithmetic (RFC 4034 section
+	// 3.1.5).
+	t := uint32(now.Unix())
+	if int32(t-sig.Inception) < 0 {
+		return errors.New("Signature is not yet valid")
+	}
+	if int32(sig.Expiration-t) < 0 {
+		return errors.New("Signature has expired")
+	}
+
+	data, err := signedData(sig, rrset)
+	if err != nil {
+		return err
+	}
+	return verifySignature(key.Algorithm, key.PublicKey, data, sig.Signature)
+}
+
+func verifySignature(algorithm uint8, publicKey []byte, data []byte, signature []byte) error {
+	switch algorithm {
+	case AlgRSASHA1, AlgRSASHA1NSEC3SHA1, AlgRSASHA256, AlgRSASHA512:
+		key, err := parseRSAKey(publicKey)
+		if err != nil {
+			return err
+		}
+		hash := crypto.SHA1
+		if algorithm == AlgRSASHA256 {
+			hash = crypto.SHA256
+		} else if algorithm == AlgRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature)
+
+	case AlgECDSAP256SHA256, AlgECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if algorithm == AlgECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		// Keys are the bare coordinates, signatures the bare r and s.
+		size := (curve.Params().BitSize + 7) / 8
+		if len(publicKey) != 2*size {
+			return errors.New("Invalid ECDSA key")
+		}
+		if len(signature) != 2*size {
+			return errors.New("Invalid ECDSA signature length")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("ECDSA signature does not verify")
+		}
+		return nil
+
+	case AlgED25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("Invalid Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(publicKey), data, signature) {
+			return errors.New("Ed25519 signature does not verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported algorithm %d", algorithm)
+}
+
+// parseRSAKey decodes an RSA public key in the format of RFC 3110: the
+// exponent length in one or three octets, the exponent and the modulus.
+func parseRSAKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 1 {
+		return nil, errors.New("Invalid RSA key")
+	}
+	expLen, data := int(data[0]), data[1:]
+	if expLen == 0 {
+		if len(data) < 2 {
+			return nil, errors.New("Invalid RSA key")
+		}
+		expLen, data = int(data[0])<<8|int(data[1]), data[2:]
+	}
+	if expLen == 0 || expLen > 4 || len(data) <= expLen {
+		return nil, errors.New("Invalid RSA key")
+	}
+	exponent := 0
+	for _, b := range data[:expLen] {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(data[expLen:]), E: exponent}, nil
+}
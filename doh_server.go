@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DNS-over-HTTPS (RFC 8484). Queries arrive either as a base64url encoded
+// "dns" parameter of a GET request or as the body of a POST request, both
+// in the regular wire format.
+
+const dnsMessageContentType = "application/dns-message"
+
+func ServeDoH(config *DoHConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, handleDoH)
+
+	server := &http.Server{
+		Addr:    config.Listen,
+		Handler: mux,
+	}
+
+	if config.PlainHTTP {
+		fmt.Printf("Serving DoH without TLS on %s%s\n", config.Listen, config.Path)
+		return server.ListenAndServe()
+	}
+
+	fmt.Printf("Serving DoH on %s%s\n", config.Listen, config.Path)
+	return server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+}
+
+func handleDoH(w http.ResponseWriter, r *http.Request) {
+	var msg []byte
+
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// RFC 8484 mandates unpadded base64url, but be lenient with padding.
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		msg = data
+	case http.MethodPost:
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != dnsMessageContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, MaxStreamMessageSize+1))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		msg = data
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(msg) == 0 || len(msg) > MaxStreamMessageSize {
+		http.Error(w, "invalid message size", http.StatusBadRequest)
+		return
+	}
+
+	request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+	if err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	// The remote address is an IP literal, so this doesn't resolve names.
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "invalid remote address", http.StatusBadRequest)
+		return
+	}
+	session, response := authenticate(msg, request)
+	if response == nil {
+		response = handleRequest(request, remote, session.KeyName())
+	}
+	if err := session.Sign(response); err != nil {
+		fmt.Println("Failed to sign DoH response", err)
+		http.Error(w, "failed to sign response", http.StatusInternalServerError)
+		return
+	}
+
+	resBuffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := response.Write(resBuffer); err != nil {
+		fmt.Println("Failed to write DoH response", err)
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", responseMaxAge(response)))
+	w.Write(resBuffer.Bytes())
+}
+
+// responseMaxAge is the lowest TTL in the answer section. Negative answers
+// fall back to the authority section (the SOA of RFC 2308), and responses
+// without any records are not cached.
+func responseMaxAge(packet *DnsPacket) uint32 {
+	records := packet.Answers
+	if len(records) == 0 {
+		records = packet.Authorities
+	}
+	if len(records) == 0 || packet.Header.ResCode == SERVFAIL {
+		return 0
+	}
+
+	minTTL := uint32(0xFFFFFFFF)
+	for _, rec := range records {
+		if ttl := recordTTL(rec); ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+	if minTTL == 0xFFFFFFFF {
+		return 0
+	}
+	return minTTL
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleDoH(t *testing.T) {
+	addTestZone(t, "doh-server.test",
+		"doh-server.test. 3600 IN SOA ns.doh-server.test. admin.doh-server.test. 1 3600 600 86400 300",
+		"doh-server.test. 3600 IN NS ns.doh-server.test.",
+		"ns.doh-server.test. 3600 IN A 192.0.2.53",
+		"www.doh-server.test. 30 IN A 192.0.2.1",
+	)
+	query := dohQuery(t, "www.doh-server.test", A)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "192.0.2.10:4321"
+		recorder := httptest.NewRecorder()
+		handleDoH(recorder, req)
+		return recorder
+	}
+	post := func(contentType string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"GET", httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil), http.StatusOK},
+		{"POST", post("application/dns-message"), http.StatusOK},
+		{"POST with parameters", post("application/dns-message; charset=utf-8"), http.StatusOK},
+		{"POST in upper case", post("Application/DNS-Message"), http.StatusOK},
+		{"POST without content type", post(""), http.StatusUnsupportedMediaType},
+		{"POST of another type", post("application/dns-json"), http.StatusUnsupportedMediaType},
+		{"DELETE", httptest.NewRequest(http.MethodDelete, "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		recorder := serve(c.req)
+		if recorder.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, recorder.Code, c.status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(recorder.Body.Bytes()))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(response.Answers) != 1 || recorder.Header().Get("Cache-Control") != "max-age=30" {
+			t.Errorf("%s: Cache-Control %q and answer:\n%v", c.name, recorder.Header().Get("Cache-Control"), response)
+		}
+	}
+}
+
+func TestDoHConfigNeedsCertificate(t *testing.T) {
+	load := func(doh string) error {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(`{"doh": `+doh+`}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadConfig(path)
+		return err
+	}
+
+	if err := load(`{"listen": "127.0.0.1:8443"}`); err == nil || !strings.Contains(err.Error(), "cert_file") {
+		t.Errorf("DoH without a certificate: %v, want an error", err)
+	}
+	if err := load(`{"cert_file": "server.crt"}`); err == nil {
+		t.Error("DoH without a key accepted")
+	}
+	if err := load(`{"cert_file": "server.crt", "key_file": "server.key"}`); err != nil {
+		t.Errorf("DoH with a certificate: %v", err)
+	}
+	if err := load(`{"plain_http": true}`); err != nil {
+		t.Errorf("DoH over plain HTTP: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dohUpstream forwards queries to a DNS-over-HTTPS server with POST
+// requests. The http.Client keeps a pool of HTTP/2 connections, so
+// concurrent queries are multiplexed over one TLS session.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(config UpstreamConfig) (*dohUpstream, error) {
+	u, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("DoH upstream %q must be an https URL", config.Address)
+	}
+
+	tlsConfig, err := upstreamTLSConfig(config, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: lookupTimeout,
+	}
+
+	return &dohUpstream{
+		url: u.String(),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   lookupTimeout,
+		},
+	}, nil
+}
+
+func (d *dohUpstream) String() string {
+	return d.url
+}
+
+func (d *dohUpstream) Exchange(request *DnsPacket) (*DnsPacket, error) {
+	// RFC 8484 asks for ID 0 so that identical queries are cacheable by
+	// HTTP caches; the caller's ID is restored on the response.
+	query := *request
+	query.Header = &DnsHeader{}
+	*query.Header = *request.Header
+	query.Header.ID = 0
+
+	reqBuffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := query.Write(reqBuffer); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(reqBuffer.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dnsMessageContentType {
+		return nil, fmt.Errorf("DoH upstream returned content type %q", ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxStreamMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxStreamMessageSize {
+		return nil, fmt.Errorf("DoH response of %d bytes is too large", len(body))
+	}
+
+	response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(body))
+	if err != nil {
+		return nil, err
+	}
+	response.Header.ID = request.Header.ID
+	return response, nil
+}
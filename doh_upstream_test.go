@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveDoH starts a DoH server for an authoritative test zone and returns
+// its URL together with an upstream that trusts its certificate.
+func serveDoH(t *testing.T) (string, *dohUpstream) {
+	t.Helper()
+	addTestZone(t, "doh.test",
+		"doh.test. 3600 IN SOA ns.doh.test. admin.doh.test. 1 3600 600 86400 300",
+		"doh.test. 3600 IN NS ns.doh.test.",
+		"ns.doh.test. 3600 IN A 192.0.2.53",
+		"www.doh.test. 120 IN A 192.0.2.1",
+		"www.doh.test. 60 IN A 192.0.2.2",
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", handleDoH)
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := newDoHUpstream(UpstreamConfig{Protocol: "https", Address: server.URL + "/dns-query", CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.URL + "/dns-query", upstream
+}
+
+// addTestZone serves a zone authoritatively for the duration of a test.
+func addTestZone(t *testing.T, origin string, lines ...string) *Zone {
+	t.Helper()
+	zone, err := NewZone(origin, testRecords(t, lines...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authZones.Add(zone); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		authZones.mu.Lock()
+		delete(authZones.zones, zone.Origin)
+		authZones.mu.Unlock()
+	})
+	return zone
+}
+
+func dohQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	packet := NewDnsPacket()
+	packet.Header.ID = 0
+	packet.Header.RecursionDesired = true
+	packet.Questions = append(packet.Questions, NewDnsQuestion(name, QueryTypeFromNum(qtype)))
+	return wireFormat(t, packet)
+}
+
+func TestDoHUpstreamExchange(t *testing.T) {
+	_, upstream := serveDoH(t)
+
+	request := NewDnsPacket()
+	request.Header.ID = 0xbeef
+	request.Header.RecursionDesired = true
+	request.Questions = append(request.Questions, NewDnsQuestion("www.doh.test", QueryTypeFromNum(A)))
+	response, err := upstream.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.ID != 0xbeef {
+		t.Errorf("response ID = %#x, want the request's %#x", response.Header.ID, 0xbeef)
+	}
+	if !response.Header.AuthoritativeAnswer || response.Header.ResCode != NOERROR || len(response.Answers) != 2 {
+		t.Errorf("unexpected response:\n%v", response)
+	}
+
+	request.Questions[0] = NewDnsQuestion("missing.doh.test", QueryTypeFromNum(A))
+	response, err = upstream.Exchange(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.ResCode != NXDOMAIN {
+		t.Errorf("rcode = %v, want NXDOMAIN", response.Header.ResCode)
+	}
+}
+
+func TestDoHUpstreamRejectsErrors(t *testing.T) {
+	url, upstream := serveDoH(t)
+
+	upstream.url = strings.TrimSuffix(url, "/dns-query") + "/elsewhere"
+	request := NewDnsPacket()
+	request.Questions = append(request.Questions, NewDnsQuestion("www.doh.test", QueryTypeFromNum(A)))
+	if _, err := upstream.Exchange(request); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Exchange with a missing path returned %v, want a 404 error", err)
+	}
+
+	if _, err := newDoHUpstream(UpstreamConfig{Protocol: "https", Address: "http://127.0.0.1/dns-query"}); err == nil {
+		t.Error("newDoHUpstream accepted a plain http URL")
+	}
+}
+
+func TestDoHServer(t *testing.T) {
+	url, upstream := serveDoH(t)
+	client := upstream.client
+	query := dohQuery(t, "www.doh.test", A)
+	negative := dohQuery(t, "missing.doh.test", A)
+
+	get := func(msg []byte) string {
+		return url + "?dns=" + base64.RawURLEncoding.EncodeToString(msg)
+	}
+	post := func(contentType string, body []byte) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	newRequest := func(method string, target string) *http.Request {
+		req, err := http.NewRequest(method, target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	cases := []struct {
+		name         string
+		request      *http.Request
+		status       int
+		cacheControl string
+		rcode        ResultCode
+	}{
+		{"GET", newRequest(http.MethodGet, get(query)), http.StatusOK, "max-age=60", NOERROR},
+		{"GET padded", newRequest(http.MethodGet, get(query)+"="), http.StatusOK, "max-age=60", NOERROR},
+		{"POST", post(dnsMessageContentType, query), http.StatusOK, "max-age=60", NOERROR},
+		{"negative", post(dnsMessageContentType, negative), http.StatusOK, "max-age=300", NXDOMAIN},
+		{"GET without dns", newRequest(http.MethodGet, url), http.StatusBadRequest, "", 0},
+		{"GET invalid base64", newRequest(http.MethodGet, url+"?dns=%21%21"), http.StatusBadRequest, "", 0},
+		{"GET malformed message", newRequest(http.MethodGet, get(query[:5])), http.StatusBadRequest, "", 0},
+		{"POST empty", post(dnsMessageContentType, nil), http.StatusBadRequest, "", 0},
+		{"POST wrong content type", post("application/json", query), http.StatusUnsupportedMediaType, "", 0},
+		{"PUT", newRequest(http.MethodPut, url), http.StatusMethodNotAllowed, "", 0},
+	}
+	for _, c := range cases {
+		resp, err := client.Do(c.request)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, resp.StatusCode, c.status)
+			continue
+		}
+		if c.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != "GET, POST" {
+			t.Errorf("%s: Allow = %q", c.name, resp.Header.Get("Allow"))
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != dnsMessageContentType {
+			t.Errorf("%s: Content-Type = %q", c.name, ct)
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != c.cacheControl {
+			t.Errorf("%s: Cache-Control = %q, want %q", c.name, cc, c.cacheControl)
+		}
+		response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(body.Bytes()))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if response.Header.ResCode != c.rcode {
+			t.Errorf("%s: rcode %v, want %v", c.name, response.Header.ResCode, c.rcode)
+		}
+	}
+}
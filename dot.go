@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DNS-over-TLS (RFC 7858): the TCP framing wrapped in TLS, usually on
+// port 853.
+
+func ServeDoT(config *DoTConfig) error {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", config.Listen, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Listening for DoT on %s...\n", config.Listen)
+	return serveStreamListener(listener)
+}
+
+// dotUpstream keeps a single TLS connection open to the upstream and
+// pipelines queries over it, matching responses to queries by ID.
+type dotUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	conn    *tls.Conn
+	pending map[uint16]chan *DnsPacket
+}
+
+func newDoTUpstream(config UpstreamConfig) (*dotUpstream, error) {
+	addr := withDefaultPort(config.Address, "853")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := upstreamTLSConfig(config, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dotUpstream{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		pending:   map[uint16]chan *DnsPacket{},
+	}, nil
+}
+
+// upstreamTLSConfig builds the client side TLS settings shared by DoT and
+// DoH upstreams.
+func upstreamTLSConfig(config UpstreamConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.SPKIPins) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range config.SPKIPins {
+			pins[pin] = true
+		}
+		// Without a server name to authenticate, the pin set alone
+		// identifies the server (the RFC 7858 out-of-band key profile).
+		// The other certificates the server sends prove nothing then,
+		// since anyone can send them, so only the key the server
+		// proved to hold may match a pin. Otherwise a pin may match
+		// any certificate of a verified chain.
+		verified := config.ServerName != "" || config.CAFile != ""
+		tlsConfig.InsecureSkipVerify = !verified
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if !verified {
+				if len(state.PeerCertificates) == 0 {
+					return errors.New("Upstream sent no certificate")
+				}
+				return verifySPKIPins(state.PeerCertificates[:1], pins)
+			}
+			for _, chain := range state.VerifiedChains {
+				if verifySPKIPins(chain, pins) == nil {
+					return nil
+				}
+			}
+			return errors.New("No certificate matches the configured SPKI pins")
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func verifySPKIPins(certs []*x509.Certificate, pins map[string]bool) error {
+	for _, cert := range certs {
+		if pins[spkiPin(cert)] {
+			return nil
+		}
+	}
+	return errors.New("No certificate matches the configured SPKI pins")
+}
+
+func (d *dotUpstream) String() string {
+	return "tls://" + d.addr
+}
+
+func (d *dotUpstream) Exchange(request *DnsPacket) (*DnsPacket, error) {
+	response, err := d.exchange(request)
+	if err != nil && errors.Is(err, errConnectionLost) {
+		// The server may have closed an idle connection we were about
+		// to reuse, so try once more on a fresh one.
+		response, err = d.exchange(request)
+	}
+	return response, err
+}
+
+var errConnectionLost = errors.New("Upstream connection lost")
+
+func (d *dotUpstream) exchange(request *DnsPacket) (*DnsPacket, error) {
+	d.mu.Lock()
+	conn, err := d.connect()
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+
+	// The connection is shared, so the ID has to be unique among the
+	// queries in flight on it.
+	query := *request
+	query.Header = &DnsHeader{}
+	*query.Header = *request.Header
+	for {
+		query.Header.ID = uint16(rand.Intn(0x10000))
+		if _, ok := d.pending[query.Header.ID]; !ok {
+			break
+		}
+	}
+	ch := make(chan *DnsPacket, 1)
+	d.pending[query.Header.ID] = ch
+
+	conn.SetWriteDeadline(time.Now().Add(lookupTimeout))
+	err = writeTCPMessage(conn, &query)
+	d.mu.Unlock()
+
+	if err != nil {
+		d.drop(conn)
+		return nil, errConnectionLost
+	}
+
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, errConnectionLost
+		}
+		response.Header.ID = request.Header.ID
+		return response, nil
+	case <-time.After(lookupTimeout):
+		d.mu.Lock()
+		delete(d.pending, query.Header.ID)
+		d.mu.Unlock()
+		return nil, errors.New("Upstream query timed out")
+	}
+}
+
+// connect must be called with d.mu held.
+func (d *dotUpstream) connect() (*tls.Conn, error) {
+	if d.conn != nil {
+		return d.conn, nil
+	}
+
+	dialer := &net.Dialer{Timeout: lookupTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", d.addr, d.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	go d.readLoop(conn)
+	return conn, nil
+}
+
+func (d *dotUpstream) readLoop(conn *tls.Conn) {
+	defer d.drop(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		ch, ok := d.pending[response.Header.ID]
+		delete(d.pending, response.Header.ID)
+		d.mu.Unlock()
+		if ok {
+			ch <- response
+		}
+	}
+}
+
+// drop closes the connection and fails every query still waiting on it.
+func (d *dotUpstream) drop(conn *tls.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != conn {
+		return
+	}
+	conn.Close()
+	d.conn = nil
+	for id, ch := range d.pending {
+		close(ch)
+		delete(d.pending, id)
+	}
+}
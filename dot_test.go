@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCertificate issues a certificate for name, signed by parent or
+// self-signed if parent is nil.
+func testCertificate(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !ca {
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeCertificate(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// serveTestDoT serves DNS over TLS on a local port, sending chain with
+// the leaf key, and returns the address.
+func serveTestDoT(t *testing.T, key *ecdsa.PrivateKey, chain ...*x509.Certificate) string {
+	t.Helper()
+	cert := tls.Certificate{PrivateKey: key}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveStreamListener(listener)
+	return listener.Addr().String()
+}
+
+func addStreamTestZone(t *testing.T) {
+	addTestZone(t, "stream.test",
+		"stream.test. 3600 IN SOA ns.stream.test. admin.stream.test. 1 3600 600 86400 300",
+		"stream.test. 3600 IN NS ns.stream.test.",
+		"ns.stream.test. 3600 IN A 192.0.2.53",
+		"www.stream.test. 300 IN A 192.0.2.1",
+	)
+}
+
+func streamQuery(id uint16) *DnsPacket {
+	query := NewDnsPacket()
+	query.Header.ID = id
+	query.Questions = append(query.Questions, NewDnsQuestion("www.stream.test", QueryTypeFromNum(A)))
+	return query
+}
+
+func TestSPKIPins(t *testing.T) {
+	addStreamTestZone(t)
+	root, rootKey := testCertificate(t, "Test Root", true, nil, nil)
+	intermediate, intermediateKey := testCertificate(t, "Test Intermediate", true, root, rootKey)
+	leaf, leafKey := testCertificate(t, "dot.test", false, intermediate, intermediateKey)
+	// The attacker has a key of their own, and the intermediate, which
+	// every client of the real server gets to see.
+	forged, forgedKey := testCertificate(t, "dot.test", false, nil, nil)
+	unrelated, _ := testCertificate(t, "Unrelated", true, nil, nil)
+
+	genuine := serveTestDoT(t, leafKey, leaf, intermediate)
+	attacker := serveTestDoT(t, forgedKey, forged, intermediate)
+	padded := serveTestDoT(t, leafKey, leaf, intermediate, unrelated)
+	caFile := writeCertificate(t, root)
+
+	cases := []struct {
+		name   string
+		config UpstreamConfig
+		ok     bool
+	}{
+		{"pinned leaf", UpstreamConfig{Address: genuine, SPKIPins: []string{spkiPin(leaf)}}, true},
+		{"pinned intermediate without a CA", UpstreamConfig{Address: genuine, SPKIPins: []string{spkiPin(intermediate)}}, false},
+		{"foreign leaf before the pinned intermediate", UpstreamConfig{Address: attacker, SPKIPins: []string{spkiPin(intermediate)}}, false},
+		{"pinned intermediate of a verified chain", UpstreamConfig{Address: genuine, CAFile: caFile, SPKIPins: []string{spkiPin(intermediate)}}, true},
+		{"pinned root of a verified chain", UpstreamConfig{Address: genuine, CAFile: caFile, SPKIPins: []string{spkiPin(root)}}, true},
+		{"foreign leaf with a CA", UpstreamConfig{Address: attacker, CAFile: caFile, SPKIPins: []string{spkiPin(intermediate)}}, false},
+		{"pinned certificate outside the verified chain", UpstreamConfig{Address: padded, CAFile: caFile, SPKIPins: []string{spkiPin(unrelated)}}, false},
+		{"CA without pins", UpstreamConfig{Address: genuine, CAFile: caFile}, true},
+	}
+	for _, c := range cases {
+		c.config.Protocol = "tls"
+		upstream, err := newDoTUpstream(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = upstream.Exchange(streamQuery(1))
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: connection accepted", c.name)
+		}
+	}
+}
+
+func TestDoTUpstreamPipelining(t *testing.T) {
+	addStreamTestZone(t)
+	cert, key := testCertificate(t, "dot.test", false, nil, nil)
+	upstream, err := newDoTUpstream(UpstreamConfig{Protocol: "tls", Address: serveTestDoT(t, key, cert), SPKIPins: []string{spkiPin(cert)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More queries than a connection may have in flight at the server.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*maxPipelinedQueries)
+	for i := 0; i < 4*maxPipelinedQueries; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			response, err := upstream.Exchange(streamQuery(id))
+			if err == nil && (response.Header.ID != id || len(response.Answers) != 1) {
+				t.Errorf("query %d got:\n%v", id, response)
+			}
+			errs <- err
+		}(uint16(1000 + i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTCPExchange(t *testing.T) {
+	addStreamTestZone(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveStreamListener(listener)
+
+	response, err := exchangeTCP(streamQuery(7), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.ID != 7 || !response.Header.AuthoritativeAnswer || len(response.Answers) != 1 {
+		t.Errorf("unexpected response:\n%v", response)
+	}
+
+	// Several queries on one connection are answered in turn.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for id := uint16(1); id <= 3; id++ {
+		response, err := exchangeStream(conn, streamQuery(id))
+		if err != nil || response.Header.ID != id {
+			t.Fatalf("query %d on a reused connection: %v, %v", id, response, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// EDNS (RFC 6891). The OPT pseudo-record in the additional section carries
+// the UDP payload size a client can receive in its CLASS field, and the
+// extended RCODE, version and flags such as DO (RFC 3225) in its TTL.
+
+// ednsUDPSize is the payload size advertised in our own queries, which
+// avoids IP fragmentation on common paths.
+const ednsUDPSize = 1232
+
+const ednsFlagDO uint16 = 0x8000
+
+// ednsOptionEDE is the Extended DNS Error option (RFC 8914), which tells
+// a client why its query failed. edeOther is the INFO-CODE for reasons
+// only the EXTRA-TEXT describes.
+const (
+	ednsOptionEDE = 15
+	edeOther      = 0
+)
+
+type OPTRecord struct {
+	UDPSize       uint16
+	ExtendedRcode uint8
+	Version       uint8
+	Flags         uint16
+	Options       []byte
+}
+
+func (opt *OPTRecord) getType() int {
+	return OPT
+}
+
+// OPT records are owned by the root, and their TTL carries the extended
+// RCODE, version and flags.
+func (opt *OPTRecord) header() (string, uint32) {
+	return "", opt.ttl()
+}
+
+func (opt *OPTRecord) withHeader(domain string, ttl uint32) DnsRecord {
+	c := *opt
+	c.ExtendedRcode = uint8(ttl >> 24)
+	c.Version = uint8(ttl >> 16)
+	c.Flags = uint16(ttl)
+	return &c
+}
+
+func (opt *OPTRecord) Write(buffer *BytePacketBuffer) (int, error) {
+	startPos := buffer.pos
+
+	root := ""
+	if err := buffer.WriteQName(&root); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(OPT); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(opt.UDPSize); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU32(opt.ttl()); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteU16(uint16(len(opt.Options))); err != nil {
+		return 0, err
+	}
+	if err := buffer.WriteRange(opt.Options); err != nil {
+		return 0, err
+	}
+
+	return int(buffer.pos - startPos), nil
+}
+
+func (opt *OPTRecord) ttl() uint32 {
+	return uint32(opt.ExtendedRcode)<<24 | uint32(opt.Version)<<16 | uint32(opt.Flags)
+}
+
+// OPT has no presentation format; the fields are shown the way RFC 3597
+// shows unknown records.
+func (opt *OPTRecord) String() string {
+	rdata := fmt.Sprintf("\\# %d", len(opt.Options))
+	if len(opt.Options) > 0 {
+		rdata += " " + hex.EncodeToString(opt.Options)
+	}
+	return fmt.Sprintf(". %d CLASS%d OPT %s", opt.ttl(), opt.UDPSize, rdata)
+}
+
+func (opt *OPTRecord) DNSSECOK() bool {
+	return opt.Flags&ednsFlagDO != 0
+}
+
+func readOPTRecord(buffer *BytePacketBuffer, class uint16, ttl uint32, dataLen uint16) (DnsRecord, error) {
+	options, err := buffer.GetRange(buffer.Pos(), dataLen)
+	if err != nil {
+		return nil, err
+	}
+	if err := buffer.Step(dataLen); err != nil {
+		return nil, err
+	}
+	return &OPTRecord{
+		UDPSize:       class,
+		ExtendedRcode: uint8(ttl >> 24),
+		Version:       uint8(ttl >> 16),
+		Flags:         uint16(ttl),
+		Options:       append([]byte(nil), options...),
+	}, nil
+}
+
+// findOPT returns the OPT record of a message, if it has one.
+func findOPT(packet *DnsPacket) *OPTRecord {
+	for _, rec := range packet.Resources {
+		if opt, ok := rec.(*OPTRecord); ok {
+			return opt
+		}
+	}
+	return nil
+}
+
+// dnssecOK reports whether the sender of a message wants DNSSEC records.
+func dnssecOK(packet *DnsPacket) bool {
+	opt := findOPT(packet)
+	return opt != nil && opt.DNSSECOK()
+}
+
+// removeOPT drops the OPT record, which only applies to a single hop.
+func removeOPT(packet *DnsPacket) {
+	resources := []DnsRecord{}
+	for _, rec := range packet.Resources {
+		if _, ok := rec.(*OPTRecord); !ok {
+			resources = append(resources, rec)
+		}
+	}
+	packet.Resources = resources
+}
+
+// addResponseOPT answers a request that had an OPT record with our own
+// (RFC 6891 section 6.1.1), echoing the DO bit.
+func addResponseOPT(request *DnsPacket, response *DnsPacket) {
+	opt := findOPT(request)
+	if opt == nil {
+		return
+	}
+	reply := &OPTRecord{UDPSize: ednsUDPSize}
+	if opt.DNSSECOK() {
+		reply.Flags = ednsFlagDO
+	}
+	response.Resources = append(response.Resources, reply)
+}
+
+// addExtendedError adds an Extended DNS Error to the OPT record of a
+// response. Responses to clients without EDNS get none.
+func addExtendedError(response *DnsPacket, infoCode uint16, text string) {
+	opt := findOPT(response)
+	if opt == nil {
+		return
+	}
+	option := binary.BigEndian.AppendUint16(nil, ednsOptionEDE)
+	option = binary.BigEndian.AppendUint16(option, uint16(2+len(text)))
+	option = binary.BigEndian.AppendUint16(option, infoCode)
+	opt.Options = append(append(opt.Options, option...), text...)
+}
+
+// maxUDPResponseSize is how large a UDP response to request may be: what
+// the client advertises in its OPT record, but no more than we advertise
+// ourselves.
+func maxUDPResponseSize(request *DnsPacket) int {
+	opt := findOPT(request)
+	if opt == nil {
+		return MaxUDPMessageSize
+	}
+	return min(max(int(opt.UDPSize), MaxUDPMessageSize), ednsUDPSize)
+}
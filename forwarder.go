@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// Upstream is a server queries can be forwarded to instead of resolving
+// them recursively from the root.
+type Upstream interface {
+	Exchange(request *DnsPacket) (*DnsPacket, error)
+	String() string
+}
+
+// upstreams is set from the "forward" section of the config. When it is
+// empty, queries are resolved with RecursiveLookup.
+var upstreams []Upstream
+
+func NewUpstream(config UpstreamConfig) (Upstream, error) {
+	switch strings.ToLower(config.Protocol) {
+	case "", "udp":
+		addr, err := net.ResolveUDPAddr("udp", withDefaultPort(config.Address, "53"))
+		if err != nil {
+			return nil, err
+		}
+		return &udpUpstream{addr: addr}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withDefaultPort(config.Address, "53")}, nil
+	case "tls":
+		return newDoTUpstream(config)
+	case "https":
+		return newDoHUpstream(config)
+	default:
+		return nil, fmt.Errorf("Unsupported upstream protocol %q", config.Protocol)
+	}
+}
+
+func withDefaultPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// ForwardLookup sends the question to the configured upstreams in order
+// and returns the first response.
+func ForwardLookup(qname string, qtype QueryType) (*DnsPacket, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("No upstreams configured")
+	}
+
+	var lastErr error
+	for _, upstream := range upstreams {
+		packet := NewDnsPacket()
+		packet.Header.ID = uint16(rand.Intn(0x10000))
+		packet.Header.RecursionDesired = true
+		packet.Questions = append(packet.Questions, NewDnsQuestion(qname, qtype))
+
+		fmt.Printf("forwarding %v %s to %s\n", qtype, qname, upstream)
+		response, err := upstream.Exchange(packet)
+		if err != nil {
+			fmt.Printf("upstream %s failed: %v\n", upstream, err)
+			lastErr = err
+			continue
+		}
+		// Forwarded answers aren't validated here, and the upstream's
+		// AD bit can't be trusted on its own.
+		response.Header.AuthedData = false
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+type udpUpstream struct {
+	addr *net.UDPAddr
+}
+
+func (u *udpUpstream) Exchange(request *DnsPacket) (*DnsPacket, error) {
+	response, err := exchangeUDP(request, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if response.Header.TruncatedMessage {
+		return exchangeTCP(request, u.addr.String())
+	}
+	return response, nil
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr.String()
+}
+
+type tcpUpstream struct {
+	addr string
+}
+
+func (t *tcpUpstream) Exchange(request *DnsPacket) (*DnsPacket, error) {
+	return exchangeTCP(request, t.addr)
+}
+
+func (t *tcpUpstream) String() string {
+	return "tcp://" + t.addr
+}
@@ -1,12 +1,3 @@
 module github.com/gorogoroumaru/godns
 
 go 1.21.1
-
-require github.com/k0kubun/pp/v3 v3.2.0
-
-require (
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.16 // indirect
-	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
-	golang.org/x/text v0.3.7 // indirect
-)
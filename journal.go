@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Journal keeps the differences between consecutive versions of a zone so
+// that secondaries can catch up with an incremental transfer (RFC 1995)
+// instead of pulling the whole zone again.
+
+const maxJournalEntries = 100
+
+// ZoneDiff turns the zone at OldSOA's serial into the zone at NewSOA's.
+// The SOA records themselves are not part of Deleted and Added.
+type ZoneDiff struct {
+	OldSOA  *SOARecord
+	NewSOA  *SOARecord
+	Deleted []DnsRecord
+	Added   []DnsRecord
+}
+
+type Journal struct {
+	diffs []ZoneDiff
+}
+
+func (j *Journal) Append(diff ZoneDiff) {
+	j.diffs = append(j.diffs, diff)
+	if len(j.diffs) > maxJournalEntries {
+		j.diffs = j.diffs[len(j.diffs)-maxJournalEntries:]
+	}
+}
+
+// Since returns the chain of diffs leading from serial to the newest
+// version, or false if the journal doesn't reach back that far.
+func (j *Journal) Since(serial uint32) ([]ZoneDiff, bool) {
+	for i, diff := range j.diffs {
+		if diff.OldSOA.Serial != serial {
+			continue
+		}
+		chain := j.diffs[i:]
+		for k := 1; k < len(chain); k++ {
+			if chain[k].OldSOA.Serial != chain[k-1].NewSOA.Serial {
+				return nil, false
+			}
+		}
+		return chain, true
+	}
+	return nil, false
+}
+
+// serialLess compares SOA serials with RFC 1982 sequence space arithmetic.
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// recordKey identifies a record by owner, type and RDATA; the TTL is not
+// part of a record's identity.
+func recordKey(rec DnsRecord) string {
+	domain, qtype, _, data, err := splitRecord(rec)
+	if err != nil {
+		return rec.String()
+	}
+	return fmt.Sprintf("%s/%d/%s", normalizeName(domain), qtype, hex.EncodeToString(data))
+}
+
+// diffRecords returns the non-SOA records only in old and only in new.
+func diffRecords(old []DnsRecord, new []DnsRecord) ([]DnsRecord, []DnsRecord) {
+	oldKeys := map[string]DnsRecord{}
+	for _, rec := range old {
+		if recordType(rec) != SOA {
+			oldKeys[recordKey(rec)] = rec
+		}
+	}
+	newKeys := map[string]DnsRecord{}
+	for _, rec := range new {
+		if recordType(rec) != SOA {
+			newKeys[recordKey(rec)] = rec
+		}
+	}
+
+	deleted := []DnsRecord{}
+	for key, rec := range oldKeys {
+		if _, ok := newKeys[key]; !ok {
+			deleted = append(deleted, rec)
+		}
+	}
+	added := []DnsRecord{}
+	for key, rec := range newKeys {
+		if _, ok := oldKeys[key]; !ok {
+			added = append(added, rec)
+		}
+	}
+
+	sortRecords(deleted)
+	sortRecords(added)
+	return deleted, added
+}
+
+func sortRecords(records []DnsRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return recordKey(records[i]) < recordKey(records[j])
+	})
+}
+
+// applyDiff returns records with the diff applied, including the new SOA.
+func applyDiff(records []DnsRecord, diff ZoneDiff) []DnsRecord {
+	deleted := map[string]bool{}
+	for _, rec := range diff.Deleted {
+		deleted[recordKey(rec)] = true
+	}
+
+	result := []DnsRecord{diff.NewSOA}
+	seen := map[string]bool{}
+	for _, rec := range records {
+		key := recordKey(rec)
+		if recordType(rec) == SOA || deleted[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, rec)
+	}
+	for _, rec := range diff.Added {
+		key := recordKey(rec)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, rec)
+		}
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testSOA(t *testing.T, serial string) *SOARecord {
+	t.Helper()
+	return testRecords(t, "ixfr.test. 3600 IN SOA ns.ixfr.test. admin.ixfr.test. "+serial+" 3600 600 86400 300")[0].(*SOARecord)
+}
+
+// zoneLines returns the records of ixfr.test at serial with the given
+// hosts.
+func zoneLines(serial string, hosts ...string) []string {
+	lines := []string{
+		"ixfr.test. 3600 IN SOA ns.ixfr.test. admin.ixfr.test. " + serial + " 3600 600 86400 300",
+		"ixfr.test. 3600 IN NS ns.ixfr.test.",
+		"ns.ixfr.test. 3600 IN A 192.0.2.53",
+	}
+	for _, host := range hosts {
+		lines = append(lines, host+".ixfr.test. 300 IN A 192.0.2.1")
+	}
+	return lines
+}
+
+func zoneVersion(t *testing.T, serial string, hosts ...string) []DnsRecord {
+	t.Helper()
+	return testRecords(t, zoneLines(serial, hosts...)...)
+}
+
+func sortedStrings(records []DnsRecord) string {
+	lines := recordStrings(records)
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestSerialLess(t *testing.T) {
+	cases := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		// Serials wrap around (RFC 1982).
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+		{1, 0x7fffffff, true},
+	}
+	for _, c := range cases {
+		if got := serialLess(c.a, c.b); got != c.less {
+			t.Errorf("serialLess(%d, %d) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestJournalSince(t *testing.T) {
+	var journal Journal
+	journal.Append(ZoneDiff{OldSOA: testSOA(t, "1"), NewSOA: testSOA(t, "2")})
+	journal.Append(ZoneDiff{OldSOA: testSOA(t, "2"), NewSOA: testSOA(t, "3")})
+
+	for serial, want := range map[uint32]int{1: 2, 2: 1, 3: 0, 0: 0} {
+		diffs, ok := journal.Since(serial)
+		if len(diffs) != want || ok != (want > 0) {
+			t.Errorf("Since(%d) = %d diffs, %v", serial, len(diffs), ok)
+		}
+	}
+
+	// A gap in the chain means the journal can't bring the client up to
+	// date.
+	journal.Append(ZoneDiff{OldSOA: testSOA(t, "5"), NewSOA: testSOA(t, "6")})
+	if _, ok := journal.Since(1); ok {
+		t.Error("Since(1) crossed a gap in the journal")
+	}
+
+	for i := 0; i < 2*maxJournalEntries; i++ {
+		journal.Append(ZoneDiff{OldSOA: testSOA(t, "6"), NewSOA: testSOA(t, "6")})
+	}
+	if len(journal.diffs) != maxJournalEntries {
+		t.Errorf("journal has %d entries", len(journal.diffs))
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+	old := zoneVersion(t, "1", "a", "b")
+	new := zoneVersion(t, "2", "b", "c")
+	// A TTL change isn't a change of the record.
+	new = append(new, testRecords(t, "ns.ixfr.test. 60 IN A 192.0.2.53")...)
+
+	deleted, added := diffRecords(old, new)
+	if got := strings.Join(recordStrings(deleted), "\n"); got != "a.ixfr.test. 300 IN A 192.0.2.1" {
+		t.Errorf("deleted:\n%s", got)
+	}
+	if got := strings.Join(recordStrings(added), "\n"); got != "c.ixfr.test. 300 IN A 192.0.2.1" {
+		t.Errorf("added:\n%s", got)
+	}
+
+	diff := ZoneDiff{OldSOA: testSOA(t, "1"), NewSOA: testSOA(t, "2"), Deleted: deleted, Added: added}
+	if got, want := sortedStrings(applyDiff(old, diff)), sortedStrings(zoneVersion(t, "2", "b", "c")); got != want {
+		t.Errorf("applyDiff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestIncrementalTransfer(t *testing.T) {
+	primary := addTestZone(t, "ixfr.test", zoneLines("1", "a", "b")...)
+	primary.AllowTransfer, _ = ParseACL([]string{"127.0.0.1"})
+	addr := serveTestTCP(t)
+
+	secondary, err := NewZone("ixfr.test", primary.Records())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range [][]DnsRecord{
+		zoneVersion(t, "2", "b", "c"),
+		zoneVersion(t, "3", "c", "d", "e"),
+	} {
+		if err := primary.Replace(version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The journal of the primary covers serials 1 to 3, so the secondary
+	// gets the two differences rather than the whole zone.
+	if records := primary.incrementalRecords(3); len(records) != 1 || recordType(records[0]) != SOA {
+		t.Errorf("IXFR from the current serial: %v", records)
+	}
+	changed, err := RefreshZone(secondary, addr)
+	if err != nil || !changed {
+		t.Fatalf("RefreshZone: %v, %v", changed, err)
+	}
+	if got, want := sortedStrings(secondary.Records()), sortedStrings(primary.Records()); got != want {
+		t.Errorf("secondary after IXFR:\n%s\nwant:\n%s", got, want)
+	}
+	if len(secondary.journal.diffs) != 2 {
+		t.Errorf("secondary journalled %d diffs, want the 2 it was sent", len(secondary.journal.diffs))
+	}
+	if changed, err := RefreshZone(secondary, addr); err != nil || changed {
+		t.Errorf("RefreshZone of an up to date zone: %v, %v", changed, err)
+	}
+
+	// Without a journal reaching back to serial 1 the primary falls back
+	// to sending the whole zone.
+	stale, err := NewZone("ixfr.test", zoneVersion(t, "1", "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary.mu.Lock()
+	primary.journal = Journal{}
+	primary.mu.Unlock()
+	if changed, err := RefreshZone(stale, addr); err != nil || !changed {
+		t.Fatalf("RefreshZone without a journal: %v, %v", changed, err)
+	}
+	if got, want := sortedStrings(stale.Records()), sortedStrings(primary.Records()); got != want {
+		t.Errorf("secondary after the AXFR fallback:\n%s\nwant:\n%s", got, want)
+	}
+}
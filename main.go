@@ -1,23 +1,23 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
-
-	"github.com/k0kubun/pp/v3"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-func handleQuery(socket *net.UDPConn) error {
-	reqBuffer := NewBytePacketBuffer()
-
-	_, src, err := socket.ReadFromUDP(reqBuffer.buf[:])
-	if err != nil {
-		return err
-	}
-
-	request, err := ReadDnsPacket(reqBuffer)
-	if err != nil {
-		return err
+// handleRequest runs a parsed request through the resolver and builds the
+// response. It is shared by all transports; remote is the client address
+// and key the name of the TSIG key the request was signed with, if any.
+func handleRequest(request *DnsPacket, remote net.Addr, key string) *DnsPacket {
+	switch request.Header.Opcode {
+	case NOTIFY:
+		return handleNotify(request, remote, key)
+	case UPDATE:
+		return handleUpdate(request, remote, key)
 	}
 
 	packet := &DnsPacket{
@@ -29,31 +29,66 @@ func handleQuery(socket *net.UDPConn) error {
 		},
 	}
 
-	if len(request.Questions) > 0 {
+	var failure error
+	if request.Header.Opcode != QUERY {
+		packet.Header.Opcode = request.Header.Opcode
+		packet.Header.ResCode = NOTIMP
+	} else if len(request.Questions) > 0 {
 		question := request.Questions[0]
-		fmt.Printf("Received query: %+v\n", question)
+		fmt.Printf("Received query: %s\n", question)
+
+		if isZoneTransfer(request) {
+			// Zone transfers are served over TCP. An IXFR over UDP gets
+			// the current SOA, which is either the complete answer or
+			// tells the client to retry over TCP (RFC 1995 section 2).
+			packet.Questions = append(packet.Questions, question)
+			zone := authZones.Get(question.Name)
+			if question.QType.ToNum() == IXFR && zone != nil && !zone.Expired() {
+				packet.Header.AuthoritativeAnswer = true
+				packet.Answers = append(packet.Answers, zone.SOA())
+			} else {
+				packet.Header.ResCode = NOTIMP
+			}
+			return packet
+		}
 
-		result, err := RecursiveLookup(question.Name, question.QType)
+		if zone := authZones.Find(question.Name); zone != nil {
+			packet.Header.RecursionDesired = request.Header.RecursionDesired
+			packet.Questions = append(packet.Questions, question)
+			zone.Answer(question, packet)
+			if !dnssecOK(request) {
+				stripDNSSEC(packet, question.QType.ToNum())
+			}
+			addResponseOPT(request, packet)
+			return packet
+		}
+
+		result, err := resolve(question.Name, question.QType)
 
 		if err != nil {
+			fmt.Printf("Failed to resolve %s: %v\n", question, err)
 			packet.Header.ResCode = SERVFAIL
+			failure = err
 		} else {
 			packet.Questions = append(packet.Questions, question)
 			packet.Header.ResCode = result.Header.ResCode
+			// AD is only set for clients that understand it (RFC 6840
+			// section 5.8).
+			packet.Header.AuthedData = result.Header.AuthedData && (request.Header.AuthedData || dnssecOK(request))
+			if !dnssecOK(request) {
+				stripDNSSEC(result, question.QType.ToNum())
+			}
 
 			for _, rec := range result.Answers {
-				fmt.Printf("Answer: ")
-				pp.Print(rec)
+				fmt.Printf("Answer: %s\n", rec)
 				packet.Answers = append(packet.Answers, rec)
 			}
 			for _, rec := range result.Authorities {
-				fmt.Printf("Authority: ")
-				pp.Print(rec)
+				fmt.Printf("Authority: %s\n", rec)
 				packet.Authorities = append(packet.Authorities, rec)
 			}
 			for _, rec := range result.Resources {
-				fmt.Printf("Resource: ")
-				pp.Print(rec)
+				fmt.Printf("Resource: %s\n", rec)
 				packet.Resources = append(packet.Resources, rec)
 			}
 		}
@@ -61,9 +96,79 @@ func handleQuery(socket *net.UDPConn) error {
 		packet.Header.ResCode = FORMERR
 	}
 
-	resBuffer := NewBytePacketBuffer()
+	addResponseOPT(request, packet)
+	if overBudget(failure) {
+		// Tell EDNS clients which limit the query ran into.
+		addExtendedError(packet, edeOther, failure.Error())
+	}
+	return packet
+}
+
+// stripDNSSEC removes the records a client that didn't set the DO bit
+// hasn't asked for (RFC 4035 section 3.2.1).
+func stripDNSSEC(packet *DnsPacket, qtype uint16) {
+	keep := func(records []DnsRecord) []DnsRecord {
+		kept := []DnsRecord{}
+		for _, rec := range records {
+			t := recordType(rec)
+			if (t == RRSIG || t == NSEC || t == NSEC3) && t != qtype {
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		return kept
+	}
+	packet.Answers = keep(packet.Answers)
+	packet.Authorities = keep(packet.Authorities)
+	packet.Resources = keep(packet.Resources)
+}
+
+func resolve(qname string, qtype QueryType) (*DnsPacket, error) {
+	if len(upstreams) > 0 {
+		return ForwardLookup(qname, qtype)
+	}
+	return RecursiveLookup(qname, qtype)
+}
+
+func handleQuery(socket *net.UDPConn) error {
+	reqBuffer := NewBytePacketBuffer()
+
+	n, src, err := socket.ReadFromUDP(reqBuffer.buf[:])
+	if err != nil {
+		return err
+	}
+
+	msg := reqBuffer.buf[:n]
+	request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+	if err != nil {
+		return err
+	}
+
+	session, packet := authenticate(msg, request)
+	if packet == nil {
+		packet = handleRequest(request, src, session.KeyName())
+	}
+
+	// Leave room for the TSIG record, which is added last.
+	size := maxUDPResponseSize(request)
+	resBuffer := NewBytePacketBufferWithSize(size - session.Overhead())
 	err = packet.Write(resBuffer)
 	if err != nil {
+		// Too large for UDP; send only the question with TC set so the
+		// client retries over TCP.
+		packet = &DnsPacket{
+			Header:    packet.Header,
+			Questions: packet.Questions,
+		}
+		packet.Header.TruncatedMessage = true
+		addResponseOPT(request, packet)
+	}
+
+	if err := session.Sign(packet); err != nil {
+		return err
+	}
+	resBuffer = NewBytePacketBufferWithSize(size)
+	if err := packet.Write(resBuffer); err != nil {
 		return err
 	}
 
@@ -72,14 +177,111 @@ func handleQuery(socket *net.UDPConn) error {
 }
 
 func main() {
-	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 2053})
+	configPath := flag.String("config", "", "path to the JSON configuration file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		return
+	}
+
+	if err := ConfigureResolver(config.Resolver); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, keyConfig := range config.TSIGKeys {
+		key, err := NewTSIGKey(keyConfig)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		tsigKeys[key.Name] = key
+	}
+
+	if config.Forward != nil {
+		for _, upstreamConfig := range config.Forward.Upstreams {
+			upstream, err := NewUpstream(upstreamConfig)
+			if err != nil {
+				fmt.Printf("Invalid upstream %s: %v\n", upstreamConfig.Address, err)
+				return
+			}
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	for _, zoneConfig := range config.Zones {
+		zone, err := LoadZone(zoneConfig)
+		if err != nil {
+			fmt.Printf("Failed to load zone %s: %v\n", zoneConfig.Origin, err)
+			return
+		}
+		if err := authZones.Add(zone); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Loaded zone %s\n", fqdn(zone.Origin))
+		if zone.signer != nil {
+			// The parent needs these to complete the chain of trust.
+			for _, key := range zone.signer.ksks {
+				if ds, err := key.DS(); err == nil {
+					fmt.Printf("DS record for %s: %s\n", fqdn(zone.Origin), ds)
+				}
+			}
+		}
+	}
+
+	// SIGHUP reloads zone files and refreshes secondary zones.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			for _, zoneConfig := range config.Zones {
+				zone := authZones.Get(zoneConfig.Origin)
+				if err := zone.Reload(); err != nil {
+					fmt.Printf("Failed to reload zone %s: %v\n", fqdn(zone.Origin), err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		if err := ServeTCP(config.Listen); err != nil {
+			fmt.Printf("TCP server stopped: %v\n", err)
+		}
+	}()
+
+	if config.DoT != nil {
+		go func() {
+			if err := ServeDoT(config.DoT); err != nil {
+				fmt.Printf("DoT server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	if config.DoH != nil {
+		go func() {
+			if err := ServeDoH(config.DoH); err != nil {
+				fmt.Printf("DoH server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", config.Listen)
+	if err != nil {
+		fmt.Printf("Invalid listen address: %v\n", err)
+		return
+	}
+
+	socket, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		fmt.Printf("Failed to bind UDP socket: %v\n", err)
 		return
 	}
 	defer socket.Close()
 
-	fmt.Println("Listening on UDP port 2053...")
+	fmt.Printf("Listening on UDP %s...\n", addr)
 
 	for {
 		err := handleQuery(socket)
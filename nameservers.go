@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Nameserver selection. Like the infrastructure caches of BIND and
+// Unbound, the resolver keeps a smoothed round-trip time for every server
+// address it has queried and asks the fastest server of a zone first.
+// Servers it hasn't heard from yet start out with a small random RTT so
+// that they get tried, the RTTs of servers passed over decay so that they
+// are measured again now and then, and a few queries go to a random
+// server. Servers that time out repeatedly, or that are lame for a zone,
+// are left alone for a while.
+
+const (
+	// rttWeight is the share of a new sample in the smoothed RTT.
+	rttWeight = 0.3
+	// rttDecay is applied to the RTTs of servers that weren't picked.
+	rttDecay = 0.98
+	// maxInitialRTT bounds the random RTT of servers not measured yet.
+	maxInitialRTT = 32 * time.Millisecond
+	// exploreRate is the share of queries sent to a random server.
+	exploreRate = 0.05
+
+	maxTimeouts    = 3
+	serverHoldDown = time.Minute
+	lameTTL        = 15 * time.Minute
+
+	maxKnownServers = 10000
+)
+
+// serverInfo is what the resolver knows about a server address.
+type serverInfo struct {
+	srtt     time.Duration
+	timeouts int
+	// downUntil is set after maxTimeouts timeouts in a row.
+	downUntil time.Time
+	// lame holds the zones the server gave bad answers for, and until
+	// when that is remembered.
+	lame map[string]time.Time
+}
+
+var infraCache = struct {
+	sync.Mutex
+	servers map[string]*serverInfo
+}{servers: map[string]*serverInfo{}}
+
+// raceQueries makes the resolver ask the two best servers of a zone at
+// once and take the first answer.
+var raceQueries bool
+
+// serverFor returns the entry of a server; the caller holds infraCache.
+func serverFor(server *net.UDPAddr) *serverInfo {
+	key := server.String()
+	info, ok := infraCache.servers[key]
+	if !ok {
+		if len(infraCache.servers) >= maxKnownServers {
+			for k := range infraCache.servers {
+				delete(infraCache.servers, k)
+				break
+			}
+		}
+		info = &serverInfo{srtt: time.Duration(rand.Int63n(int64(maxInitialRTT))), lame: map[string]time.Time{}}
+		infraCache.servers[key] = info
+	}
+	return info
+}
+
+// selectServers orders the servers of zone by preference. Servers that
+// are down or lame for the zone are only tried when no other is left.
+func selectServers(zone string, servers []*net.UDPAddr) []*net.UDPAddr {
+	now := time.Now()
+	infraCache.Lock()
+	defer infraCache.Unlock()
+
+	usable := []*net.UDPAddr{}
+	unusable := []*net.UDPAddr{}
+	for _, server := range servers {
+		info := serverFor(server)
+		if until, ok := info.lame[zone]; ok && now.After(until) {
+			delete(info.lame, zone)
+		}
+		if _, lame := info.lame[zone]; lame || now.Before(info.downUntil) {
+			unusable = append(unusable, server)
+		} else {
+			usable = append(usable, server)
+		}
+	}
+	byRTT := func(list []*net.UDPAddr) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return serverFor(list[i]).srtt < serverFor(list[j]).srtt
+		})
+	}
+	byRTT(usable)
+	byRTT(unusable)
+
+	if len(usable) > 1 && rand.Float64() < exploreRate {
+		i := 1 + rand.Intn(len(usable)-1)
+		usable[0], usable[i] = usable[i], usable[0]
+	}
+	for _, server := range usable[min(1, len(usable)):] {
+		info := serverFor(server)
+		info.srtt = time.Duration(float64(info.srtt) * rttDecay)
+	}
+	return append(usable, unusable...)
+}
+
+func noteRTT(server *net.UDPAddr, rtt time.Duration) {
+	infraCache.Lock()
+	defer infraCache.Unlock()
+	info := serverFor(server)
+	info.srtt = time.Duration((1-rttWeight)*float64(info.srtt) + rttWeight*float64(rtt))
+	info.timeouts = 0
+}
+
+// noteTimeout penalizes a server that didn't answer, and takes it out of
+// use for a while once it has done so maxTimeouts times in a row.
+func noteTimeout(server *net.UDPAddr) {
+	infraCache.Lock()
+	defer infraCache.Unlock()
+	info := serverFor(server)
+	info.srtt = min(max(2*info.srtt, 100*time.Millisecond), lookupTimeout)
+	info.timeouts++
+	if info.timeouts >= maxTimeouts {
+		info.downUntil = time.Now().Add(serverHoldDown)
+		info.timeouts = 0
+		fmt.Printf("Name server %s is not responding\n", server)
+	}
+}
+
+// noteLame remembers that a server can't be asked about zone.
+func noteLame(server *net.UDPAddr, zone string) {
+	infraCache.Lock()
+	defer infraCache.Unlock()
+	serverFor(server).lame[zone] = time.Now().Add(lameTTL)
+	fmt.Printf("Name server %s is lame for %s\n", server, fqdn(zone))
+}
+
+type serverResponse struct {
+	response *DnsPacket
+	server   *net.UDPAddr
+	err      error
+}
+
+// queryServers asks the servers of zone in order of preference until one
+// of them answers, or the two best at once when racing is enabled. Every
+// query sent is charged to budget.
+func queryServers(qname string, qtype QueryType, zone string, servers []*net.UDPAddr, budget *resolutionBudget) (*DnsPacket, *net.UDPAddr, error) {
+	candidates := selectServers(zone, servers)
+	err := fmt.Errorf("No name servers for %s", fqdn(zone))
+	for len(candidates) > 0 {
+		n := 1
+		if raceQueries && len(candidates) > 1 {
+			n = 2
+		}
+		if err := budget.query(n); err != nil {
+			return nil, nil, err
+		}
+		results := make(chan serverResponse, n)
+		for _, server := range candidates[:n] {
+			go func(server *net.UDPAddr) {
+				response, err := queryMeasured(qname, qtype, zone, server)
+				results <- serverResponse{response, server, err}
+			}(server)
+		}
+		for i := 0; i < n; i++ {
+			result := <-results
+			if result.err == nil {
+				return result.response, result.server, nil
+			}
+			err = result.err
+		}
+		candidates = candidates[n:]
+	}
+	return nil, nil, err
+}
+
+// queryMeasured sends a query to one server and keeps track of how it
+// did. Servers that fail to answer are lame for the zone.
+func queryMeasured(qname string, qtype QueryType, zone string, server *net.UDPAddr) (*DnsPacket, error) {
+	fmt.Printf("attempting lookup of %v %s with ns %s\n", qtype, qname, server.IP.String())
+	start := time.Now()
+	response, err := queryServer(qname, qtype, server)
+	if err != nil {
+		noteTimeout(server)
+		return nil, err
+	}
+	noteRTT(server, time.Since(start))
+	switch response.Header.ResCode {
+	case SERVFAIL, REFUSED, NOTIMP:
+		noteLame(server, zone)
+		return nil, fmt.Errorf("%s answered %v for %s", server, response.Header.ResCode, fqdn(qname))
+	}
+	return response, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// emptyInfraCache gives a test a server cache of its own.
+func emptyInfraCache(t *testing.T) {
+	t.Helper()
+	infraCache.Lock()
+	servers := infraCache.servers
+	infraCache.servers = map[string]*serverInfo{}
+	infraCache.Unlock()
+	t.Cleanup(func() {
+		infraCache.Lock()
+		infraCache.servers = servers
+		infraCache.Unlock()
+	})
+}
+
+func testServers(addrs ...string) []*net.UDPAddr {
+	servers := []*net.UDPAddr{}
+	for _, addr := range addrs {
+		servers = append(servers, &net.UDPAddr{IP: net.ParseIP(addr), Port: 53})
+	}
+	return servers
+}
+
+// setRTTs gives the servers the smoothed RTTs, in milliseconds.
+func setRTTs(servers []*net.UDPAddr, rtts ...int) {
+	infraCache.Lock()
+	defer infraCache.Unlock()
+	for i, server := range servers {
+		serverFor(server).srtt = time.Duration(rtts[i]) * time.Millisecond
+	}
+}
+
+func srtt(server *net.UDPAddr) time.Duration {
+	infraCache.Lock()
+	defer infraCache.Unlock()
+	return serverFor(server).srtt
+}
+
+func serverOrder(servers []*net.UDPAddr) string {
+	order := []string{}
+	for _, server := range servers {
+		order = append(order, server.IP.String())
+	}
+	return strings.Join(order, " ")
+}
+
+func TestSelectServers(t *testing.T) {
+	emptyInfraCache(t)
+	servers := testServers("192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	// The fastest server comes first, and now and then another one.
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		setRTTs(servers, 30, 10, 20)
+		selected := selectServers("example.com", servers)
+		first[selected[0].IP.String()]++
+	}
+	if first["192.0.2.2"] < 900 || first["192.0.2.2"] == 1000 {
+		t.Errorf("servers picked first: %v", first)
+	}
+
+	// The servers passed over look a little faster next time.
+	rtts := map[string]time.Duration{"192.0.2.1": 30 * time.Millisecond, "192.0.2.2": 10 * time.Millisecond, "192.0.2.3": 20 * time.Millisecond}
+	setRTTs(servers, 30, 10, 20)
+	for i, server := range selectServers("example.com", servers) {
+		want := rtts[server.IP.String()]
+		if i > 0 {
+			want = time.Duration(float64(want) * rttDecay)
+		}
+		if got := srtt(server); got != want {
+			t.Errorf("RTT of %s, selected as number %d: %v, want %v", server, i+1, got, want)
+		}
+	}
+
+	// Servers not measured yet get a small RTT, so that they are tried.
+	if rtt := srtt(&net.UDPAddr{IP: net.ParseIP("192.0.2.4"), Port: 53}); rtt >= maxInitialRTT {
+		t.Errorf("initial RTT %v", rtt)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	emptyInfraCache(t)
+	servers := testServers("192.0.2.1", "192.0.2.2")
+	setRTTs(servers, 10, 100)
+	info := func() serverInfo {
+		infraCache.Lock()
+		defer infraCache.Unlock()
+		return *serverFor(servers[0])
+	}
+
+	// Measurements are smoothed.
+	noteRTT(servers[0], 50*time.Millisecond)
+	if got := srtt(servers[0]); got != 22*time.Millisecond {
+		t.Errorf("smoothed RTT %v", got)
+	}
+
+	// Timeouts make a server look slower, and after maxTimeouts in a row
+	// it is put last for a while. An answer in between starts the count
+	// over.
+	noteTimeout(servers[0])
+	noteTimeout(servers[0])
+	if got := srtt(servers[0]); got != 200*time.Millisecond {
+		t.Errorf("RTT after timeouts: %v", got)
+	}
+	noteRTT(servers[0], 10*time.Millisecond)
+	noteTimeout(servers[0])
+	noteTimeout(servers[0])
+	if !info().downUntil.IsZero() {
+		t.Error("server down after an answer between timeouts")
+	}
+	noteTimeout(servers[0])
+	if until := info().downUntil; until.Before(time.Now().Add(serverHoldDown - time.Second)) {
+		t.Errorf("server down until %v", until)
+	}
+	setRTTs(servers, 10, 100)
+	if order := serverOrder(selectServers("example.com", servers)); order != "192.0.2.2 192.0.2.1" {
+		t.Errorf("server that is down selected first: %s", order)
+	}
+
+	// A server that is lame for a zone is only put last for that zone,
+	// and only for a while.
+	infraCache.Lock()
+	serverFor(servers[0]).downUntil = time.Time{}
+	infraCache.Unlock()
+	noteLame(servers[0], "example.com")
+	setRTTs(servers, 10, 100)
+	if order := serverOrder(selectServers("example.com", servers)); order != "192.0.2.2 192.0.2.1" {
+		t.Errorf("lame server selected first: %s", order)
+	}
+	if _, lame := info().lame["example.net"]; lame {
+		t.Error("server lame for another zone")
+	}
+	infraCache.Lock()
+	serverFor(servers[0]).lame["example.com"] = time.Now().Add(-time.Second)
+	infraCache.Unlock()
+	selectServers("example.com", servers)
+	if _, lame := info().lame["example.com"]; lame {
+		t.Error("server still lame after lameTTL")
+	}
+}
+
+func TestQueryServers(t *testing.T) {
+	emptyInfraCache(t)
+	zone := testZone(t, "example.test",
+		"example.test. 3600 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 300",
+		"example.test. 3600 IN NS ns.example.test.",
+		"www.example.test. 300 IN A 192.0.2.1",
+	)
+	good := serveZone(t, "127.0.0.1:0", zone, nil)
+	failing := serveZone(t, fmt.Sprintf("127.0.0.2:%d", good.Port), zone, func(response *DnsPacket) {
+		response.Header.ResCode = SERVFAIL
+	})
+	qtype := QueryTypeFromNum(A)
+
+	// A server that fails is lame for the zone, and the next one is asked.
+	if _, _, err := queryServers("www.example.test", qtype, "example.test", []*net.UDPAddr{failing}, newResolutionBudget("www.example.test", qtype)); err == nil {
+		t.Error("SERVFAIL accepted")
+	}
+	servers := []*net.UDPAddr{failing, good}
+	setRTTs(servers, 1, 100)
+	budget := newResolutionBudget("www.example.test", qtype)
+	response, server, err := queryServers("www.example.test", qtype, "example.test", servers, budget)
+	if err != nil || server != good || len(response.Answers) != 1 || budget.queries != 1 {
+		t.Errorf("answer from %v after %d queries: %v", server, budget.queries, err)
+	}
+
+	// Racing asks two servers at once, and takes the first answer.
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: good.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	raceQueries = true
+	defer func() { raceQueries = false }()
+	servers = []*net.UDPAddr{silent.LocalAddr().(*net.UDPAddr), good}
+	setRTTs(servers, 1, 100)
+	budget = newResolutionBudget("www.example.test", qtype)
+	start := time.Now()
+	_, server, err = queryServers("www.example.test", qtype, "example.test", servers, budget)
+	if err != nil || server != good || budget.queries != 2 || time.Since(start) >= lookupTimeout {
+		t.Errorf("raced answer from %v after %d queries and %v: %v", server, budget.queries, time.Since(start), err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Outgoing NOTIFY (RFC 1996). When a zone gets a new serial, its
+// secondaries are told so that they don't have to wait for the SOA refresh
+// interval. A NOTIFY is retried until the secondary answers it.
+
+const (
+	notifyAttempts     = 5
+	notifyRetryBackoff = 2 * time.Second
+)
+
+// notifyTargets returns the addresses to notify: the configured
+// also_notify servers, plus the name servers of a primary zone except the
+// one named in the SOA MNAME field, which is the primary itself.
+func (z *Zone) notifyTargets() []string {
+	targets := []string{}
+	seen := map[string]bool{}
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+
+	for _, addr := range z.config.AlsoNotify {
+		add(withDefaultPort(addr, "53"))
+	}
+	if z.config.Primary != "" {
+		return targets
+	}
+
+	z.mu.RLock()
+	mname := normalizeName(z.soa().MName)
+	hosts := []string{}
+	for _, rec := range filterRecords(z.records[z.Origin], NS) {
+		if host := normalizeName(rec.(*NSRecord).Host); host != mname {
+			hosts = append(hosts, host)
+		}
+	}
+	z.mu.RUnlock()
+
+	for _, host := range hosts {
+		for _, ip := range z.hostAddresses(host) {
+			add(net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+	return targets
+}
+
+// hostAddresses looks up a name server's addresses, in the zone if it is
+// below the origin and through the resolver otherwise.
+func (z *Zone) hostAddresses(host string) []net.IP {
+	var records []DnsRecord
+	if isSubdomain(host, z.Origin) {
+		z.mu.RLock()
+		records = z.addressRecords(host)
+		z.mu.RUnlock()
+	} else {
+		for _, qtype := range []uint16{A, AAAA} {
+			result, err := resolve(host, QueryTypeFromNum(qtype))
+			if err != nil {
+				fmt.Printf("Failed to look up %s: %v\n", fqdn(host), err)
+				continue
+			}
+			records = append(records, result.Answers...)
+		}
+	}
+
+	ips := []net.IP{}
+	for _, rec := range records {
+		switch r := rec.(type) {
+		case *ARecord:
+			ips = append(ips, r.Addr)
+		case *AAAARecord:
+			ips = append(ips, r.Addr)
+		}
+	}
+	return ips
+}
+
+// sendNotifies notifies every secondary of the zone concurrently.
+func (z *Zone) sendNotifies() {
+	soa := z.SOA()
+	for _, target := range z.notifyTargets() {
+		go sendNotify(z.Origin, soa, target, z.key)
+	}
+}
+
+// sendNotify notifies one secondary, signing the NOTIFY if key is set.
+func sendNotify(origin string, soa *SOARecord, target string, key *TSIGKey) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		fmt.Printf("Invalid NOTIFY target %s: %v\n", target, err)
+		return
+	}
+
+	wait := notifyRetryBackoff
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		request := NewDnsPacket()
+		request.Header.ID = uint16(rand.Intn(0x10000))
+		request.Header.Opcode = NOTIFY
+		request.Header.AuthoritativeAnswer = true
+		request.Questions = append(request.Questions, NewDnsQuestion(origin, QueryTypeFromNum(SOA)))
+		request.Answers = append(request.Answers, soa)
+		session := newTSIGSession(key)
+		if err := session.Sign(request); err != nil {
+			fmt.Printf("Failed to sign NOTIFY for %s: %v\n", fqdn(origin), err)
+			return
+		}
+
+		msg, response, err := exchangeUDPMessage(request, addr)
+		if err == nil {
+			err = session.Verify(msg, response)
+		}
+		if err == nil && response.Header.Opcode == NOTIFY {
+			if response.Header.ResCode != NOERROR {
+				fmt.Printf("%s rejected NOTIFY for %s: %s\n", target, fqdn(origin), response.Header.ResCode)
+			}
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("Unexpected response with opcode %d", response.Header.Opcode)
+		}
+		fmt.Printf("NOTIFY for %s to %s failed (attempt %d): %v\n", fqdn(origin), target, attempt, err)
+
+		if attempt < notifyAttempts {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	fmt.Printf("Giving up on NOTIFY for %s to %s\n", fqdn(origin), target)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotify answers the NOTIFYs sent to a local UDP port and passes
+// them on.
+func listenNotify(t *testing.T) (string, chan *DnsPacket) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	received := make(chan *DnsPacket, 10)
+	go func() {
+		buf := make([]byte, MaxStreamMessageSize)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(buf[:n]))
+			if err != nil {
+				continue
+			}
+			received <- request
+			response := errorResponse(request, NOERROR)
+			out := NewBytePacketBuffer()
+			if response.Write(out) == nil {
+				conn.WriteToUDP(out.buf[:out.Pos()], src)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), received
+}
+
+func TestNotifyTargets(t *testing.T) {
+	zone := testZone(t, "example.com",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 3600 IN NS ns2.example.com.",
+		"example.com. 3600 IN NS ns3.example.com.",
+		"ns1.example.com. 3600 IN A 192.0.2.1",
+		"ns2.example.com. 3600 IN A 192.0.2.2",
+		"ns2.example.com. 3600 IN AAAA 2001:db8::2",
+		"ns3.example.com. 3600 IN A 192.0.2.3",
+	)
+	zone.config.AlsoNotify = []string{"192.0.2.99", "192.0.2.100:5300", "192.0.2.3"}
+
+	// The MNAME server is the primary itself; the others are notified
+	// once each.
+	want := "192.0.2.99:53 192.0.2.100:5300 192.0.2.3:53 192.0.2.2:53 [2001:db8::2]:53"
+	if got := strings.Join(zone.notifyTargets(), " "); got != want {
+		t.Errorf("notifyTargets() = %s, want %s", got, want)
+	}
+
+	// A secondary only notifies the servers it is told to.
+	zone.config.Primary = "192.0.2.1"
+	if got := strings.Join(zone.notifyTargets(), " "); got != "192.0.2.99:53 192.0.2.100:5300 192.0.2.3:53" {
+		t.Errorf("notifyTargets() of a secondary = %s", got)
+	}
+}
+
+func TestSendNotify(t *testing.T) {
+	target, received := listenNotify(t)
+	zone := testZone(t, "notify.test",
+		"notify.test. 3600 IN SOA ns.notify.test. admin.notify.test. 1 3600 600 86400 300",
+		"notify.test. 3600 IN NS ns.notify.test.",
+		"ns.notify.test. 3600 IN A 192.0.2.53",
+	)
+	zone.config.AlsoNotify = []string{target}
+
+	// A new serial notifies the secondaries, with the new SOA.
+	err := zone.Replace(testRecords(t,
+		"notify.test. 3600 IN SOA ns.notify.test. admin.notify.test. 2 3600 600 86400 300",
+		"notify.test. 3600 IN NS ns.notify.test.",
+		"ns.notify.test. 3600 IN A 192.0.2.53",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request := <-received:
+		if request.Header.Opcode != NOTIFY || !request.Header.AuthoritativeAnswer || len(request.Questions) != 1 ||
+			request.Questions[0].Name != "notify.test" || request.Questions[0].QType.ToNum() != SOA {
+			t.Errorf("unexpected NOTIFY:\n%v", request)
+		}
+		if len(request.Answers) != 1 || request.Answers[0].(*SOARecord).Serial != 2 {
+			t.Errorf("NOTIFY doesn't carry the new SOA: %v", request.Answers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no NOTIFY sent after the serial changed")
+	}
+
+	// Changing the zone without a new serial doesn't.
+	err = zone.Replace(testRecords(t,
+		"notify.test. 3600 IN SOA ns.notify.test. admin.notify.test. 2 3600 600 86400 300",
+		"notify.test. 3600 IN NS ns.notify.test.",
+		"ns.notify.test. 3600 IN A 192.0.2.54",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case request := <-received:
+		t.Errorf("NOTIFY sent for an unchanged serial:\n%v", request)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
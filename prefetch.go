@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Prefetching. An answer that clients keep asking for is resolved again
+// in the background when it is hit in the last part of its TTL, so that
+// it doesn't expire and make the next client wait for the lookup.
+
+// prefetching turns prefetching on.
+var prefetching bool
+
+const (
+	// prefetchMinHits is how often an answer has to be asked for to be
+	// worth prefetching.
+	prefetchMinHits = 3
+	// Answers are prefetched in the last 1/prefetchShare of their TTL.
+	prefetchShare = 10
+	// Answers with shorter TTLs are left to expire.
+	minPrefetchTTL = 10 * time.Second
+)
+
+// shouldPrefetch reports whether a hit on a cached answer should refresh
+// it; the caller holds resolverCache.
+func shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	ttl := entry.expires.Sub(entry.stored)
+	return prefetching && entry.hits >= prefetchMinHits && ttl >= minPrefetchTTL &&
+		entry.expires.Sub(now) <= ttl/prefetchShare &&
+		!entry.refreshing && !now.Before(entry.recheck)
+}
+
+// prefetch resolves a cached question again.
+func prefetch(qname string, qtype uint16) {
+	t := QueryTypeFromNum(qtype)
+	fmt.Printf("Prefetching %s %v\n", fqdn(qname), t)
+	_, err := resolveAnswer(qname, t, newResolutionBudget(qname, t))
+	if err != nil {
+		fmt.Printf("Failed to prefetch %s %v: %v\n", fqdn(qname), t, err)
+	}
+	finishRefresh(qname, qtype, err)
+}
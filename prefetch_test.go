@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShouldPrefetch(t *testing.T) {
+	now := time.Now()
+	popular := func() *cacheEntry {
+		return &cacheEntry{stored: now.Add(-280 * time.Second), expires: now.Add(20 * time.Second), hits: prefetchMinHits}
+	}
+	cases := []struct {
+		name   string
+		change func(*cacheEntry)
+		want   bool
+	}{
+		{"popular and about to expire", func(*cacheEntry) {}, true},
+		{"not asked for often enough", func(e *cacheEntry) { e.hits = prefetchMinHits - 1 }, false},
+		{"far from expiring", func(e *cacheEntry) { e.expires = now.Add(40 * time.Second); e.stored = now.Add(-260 * time.Second) }, false},
+		{"short TTL", func(e *cacheEntry) { e.stored = now.Add(-8 * time.Second); e.expires = now.Add(time.Second) }, false},
+		{"being refreshed", func(e *cacheEntry) { e.refreshing = true }, false},
+		{"failed recently", func(e *cacheEntry) { e.recheck = now.Add(time.Second) }, false},
+	}
+	prefetching = true
+	defer func() { prefetching = false }()
+	for _, c := range cases {
+		entry := popular()
+		c.change(entry)
+		if got := shouldPrefetch(entry, now); got != c.want {
+			t.Errorf("%s: shouldPrefetch() = %v", c.name, got)
+		}
+	}
+	prefetching = false
+	if shouldPrefetch(popular(), now) {
+		t.Error("prefetching while it is off")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	emptyCache(t)
+	emptyInfraCache(t)
+	root := testZone(t, ".",
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 127.0.0.1",
+		"api.hot.test. 300 IN A 192.0.2.1",
+	)
+	var queries atomic.Int32
+	rootAddr := serveZone(t, "127.0.0.1:0", root, func(response *DnsPacket) {
+		if response.Questions[0].Name == "api.hot.test" {
+			queries.Add(1)
+		}
+	})
+	savedRoots := rootServers
+	rootServers = []string{rootAddr.String()}
+	prefetching = true
+	t.Cleanup(func() { rootServers, prefetching = savedRoots, false })
+
+	qtype := QueryTypeFromNum(A)
+	entry := func() cacheEntry {
+		resolverCache.Lock()
+		defer resolverCache.Unlock()
+		return *resolverCache.entries[cacheKey("api.hot.test", A)]
+	}
+	for i := 0; i <= prefetchMinHits; i++ {
+		if _, err := RecursiveLookup("api.hot.test", qtype); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queries.Load() != 1 || entry().hits != prefetchMinHits {
+		t.Fatalf("%d queries and %d hits", queries.Load(), entry().hits)
+	}
+
+	// A hit near the end of the TTL is answered from the cache, and the
+	// answer is resolved again in the background.
+	backdate("api.hot.test", A, 280*time.Second)
+	stored := entry().stored
+	response, err := RecursiveLookup("api.hot.test", qtype)
+	if err != nil || recordTTL(response.Answers[0]) > 20 {
+		t.Fatalf("answer near the end of its TTL: %v, %v", response, err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !entry().stored.After(stored) || entry().refreshing; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("answer wasn't prefetched")
+		}
+	}
+	if queries.Load() != 2 {
+		t.Errorf("%d queries after prefetching", queries.Load())
+	}
+
+	// The new answer keeps the hits of the old one, so that it is
+	// prefetched again when it is about to expire.
+	if hits := entry().hits; hits != prefetchMinHits+1 {
+		t.Errorf("%d hits after prefetching", hits)
+	}
+	if ttl := entry().expires.Sub(time.Now()); ttl < 290*time.Second {
+		t.Errorf("prefetched answer expires in %v", ttl)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Helpers for the RFC 1035 section 5 presentation format, as used in zone
+// files and dig output. Domain names are kept without the trailing dot
+// internally, so fqdn adds it back and parseName strips it.
+
+func fqdn(name string) string {
+	if name == "" || name == "." {
+		return "."
+	}
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '.':
+			sb.WriteByte(c)
+		case c == '\\' || c == '"' || c == ';' || c == '(' || c == ')' || c == '@' || c == '$':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	if !strings.HasSuffix(name, ".") {
+		sb.WriteByte('.')
+	}
+	return sb.String()
+}
+
+// parseName converts a presentation format name to the internal form.
+// Names without a trailing dot are relative to origin.
+func parseName(s string, origin string) (string, error) {
+	if s == "@" {
+		return origin, nil
+	}
+	if s == "." {
+		return "", nil
+	}
+	name, err := unescapeText(s)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(s, ".") && !strings.HasSuffix(s, "\\.") {
+		return strings.TrimSuffix(name, "."), nil
+	}
+	if origin == "" {
+		return name, nil
+	}
+	return name + "." + origin, nil
+}
+
+func unescapeText(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errors.New("Dangling escape character")
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			if n > 255 {
+				return "", fmt.Errorf("Invalid escape sequence \\%s", s[i+1:i+4])
+			}
+			sb.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		sb.WriteByte(s[i+1])
+		i++
+	}
+	return sb.String(), nil
+}
+
+// quoteText renders a character-string as a quoted presentation string.
+func quoteText(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// unquoteText accepts both quoted and bare character-strings.
+func unquoteText(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return unescapeText(s)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parseTTL accepts plain seconds as well as the BIND style unit suffixes
+// (1h30m, 2d, 1w).
+func parseTTL(s string) (uint32, error) {
+	if s == "" {
+		return 0, errors.New("Empty TTL")
+	}
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	var total, cur uint64
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			cur = cur*10 + uint64(c-'0')
+			digits = true
+			continue
+		}
+		if !digits {
+			return 0, fmt.Errorf("Invalid TTL %q", s)
+		}
+		switch c {
+		case 's':
+		case 'm':
+			cur *= 60
+		case 'h':
+			cur *= 3600
+		case 'd':
+			cur *= 86400
+		case 'w':
+			cur *= 604800
+		default:
+			return 0, fmt.Errorf("Invalid TTL %q", s)
+		}
+		total += cur
+		cur = 0
+		digits = false
+	}
+	total += cur
+	if total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return uint32(total), nil
+}
+
+// tokenizeRecord splits a line into whitespace separated fields. Quoted
+// strings are kept as single fields (including the quotes), parentheses are
+// dropped and everything after an unquoted ';' is treated as a comment.
+func tokenizeRecord(line string) ([]string, error) {
+	var fields []string
+	var cur strings.Builder
+	inQuote := false
+	flush := func() {
+		if cur.Len() > 0 {
+			fields = append(fields, cur.String())
+			cur.Reset()
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			cur.WriteByte(c)
+			cur.WriteByte(line[i+1])
+			i++
+		case c == '"':
+			if inQuote {
+				cur.WriteByte(c)
+				inQuote = false
+				flush()
+			} else {
+				flush()
+				cur.WriteByte(c)
+				inQuote = true
+			}
+		case inQuote:
+			cur.WriteByte(c)
+		case c == ';':
+			flush()
+			return fields, nil
+		case c == '(' || c == ')':
+			flush()
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			flush()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return nil, errors.New("Unterminated quoted string")
+	}
+	flush()
+	return fields, nil
+}
+
+// ParseDnsRecord parses a record in presentation format. The TTL and
+// class may be left out, in which case they are 0 and IN.
+func ParseDnsRecord(line string) (DnsRecord, error) {
+	fields, err := tokenizeRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("Empty record")
+	}
+	domain, err := parseName(fields[0], "")
+	if err != nil {
+		return nil, err
+	}
+	return parseRecordFields(domain, fields[1:], "", 0)
+}
+
+// parseClass reads a class mnemonic or the generic CLASSnn form of
+// RFC 3597.
+func parseClass(s string) (uint16, bool) {
+	upper := strings.ToUpper(s)
+	for class, name := range classNames {
+		if upper == name {
+			return class, true
+		}
+	}
+	if strings.HasPrefix(upper, "CLASS") {
+		if n, err := strconv.ParseUint(upper[len("CLASS"):], 10, 16); err == nil {
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+// parseRecordFields parses "[ttl] [class] type rdata..." for the given
+// owner; the TTL and class may come in either order. An omitted TTL is
+// defaultTTL.
+func parseRecordFields(domain string, fields []string, origin string, defaultTTL uint32) (DnsRecord, error) {
+	ttl := defaultTTL
+	class := ClassIN
+	ttlSet := false
+	classSet := false
+	for len(fields) > 0 {
+		if !ttlSet && isDigit(fields[0][0]) {
+			v, err := parseTTL(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			ttl = v
+			ttlSet = true
+			fields = fields[1:]
+			continue
+		}
+		if c, ok := parseClass(fields[0]); ok && !classSet {
+			class = c
+			classSet = true
+			fields = fields[1:]
+			continue
+		}
+		break
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Missing record type for %s", fqdn(domain))
+	}
+
+	qtype, err := QueryTypeFromString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	rdata := fields[1:]
+
+	if len(rdata) > 0 && rdata[0] == "\\#" {
+		return parseGenericRdata(domain, qtype, class, ttl, rdata[1:])
+	}
+	if class != ClassIN {
+		// Records of other classes are kept as opaque RDATA, which is
+		// the same for every class.
+		rec, err := parseRecordFields(domain, fields, origin, ttl)
+		if err != nil {
+			return nil, err
+		}
+		_, _, _, data, err := splitRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		return &UnknownRecord{
+			Domain:  domain,
+			QType:   qtype.ToNum(),
+			Class:   class,
+			DataLen: uint16(len(data)),
+			TTL:     ttl,
+			Data:    data,
+		}, nil
+	}
+
+	want := func(n int) error {
+		if len(rdata) != n {
+			return fmt.Errorf("%s record for %s needs %d fields, got %d", qtype, fqdn(domain), n, len(rdata))
+		}
+		return nil
+	}
+
+	switch qtype.query_type {
+	case A:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		addr := net.ParseIP(rdata[0]).To4()
+		if addr == nil {
+			return nil, fmt.Errorf("Invalid IPv4 address %q", rdata[0])
+		}
+		return &ARecord{Domain: domain, Addr: addr, TTL: ttl}, nil
+	case AAAA:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		addr := net.ParseIP(rdata[0])
+		if addr == nil || addr.To4() != nil {
+			return nil, fmt.Errorf("Invalid IPv6 address %q", rdata[0])
+		}
+		return &AAAARecord{Domain: domain, Addr: addr, TTL: ttl}, nil
+	case NS:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		host, err := parseName(rdata[0], origin)
+		if err != nil {
+			return nil, err
+		}
+		return &NSRecord{Domain: domain, Host: host, TTL: ttl}, nil
+	case CNAME:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		host, err := parseName(rdata[0], origin)
+		if err != nil {
+			return nil, err
+		}
+		return &CNAMERecord{Domain: domain, Host: host, TTL: ttl}, nil
+	case MX:
+		if err := want(2); err != nil {
+			return nil, err
+		}
+		priority, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid MX priority %q", rdata[0])
+		}
+		host, err := parseName(rdata[1], origin)
+		if err != nil {
+			return nil, err
+		}
+		return &MXRecord{Domain: domain, Priority: uint16(priority), Host: host, TTL: ttl}, nil
+	case SOA:
+		if err := want(7); err != nil {
+			return nil, err
+		}
+		mname, err := parseName(rdata[0], origin)
+		if err != nil {
+			return nil, err
+		}
+		rname, err := parseName(rdata[1], origin)
+		if err != nil {
+			return nil, err
+		}
+		vals := make([]uint32, 5)
+		for i := range vals {
+			// Serial is a plain number, the timers may use units.
+			if i == 0 {
+				serial, err := strconv.ParseUint(rdata[2], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid SOA serial %q", rdata[2])
+				}
+				vals[i] = uint32(serial)
+				continue
+			}
+			if vals[i], err = parseTTL(rdata[2+i]); err != nil {
+				return nil, err
+			}
+		}
+		return &SOARecord{
+			Domain:  domain,
+			MName:   mname,
+			RName:   rname,
+			Serial:  vals[0],
+			Refresh: vals[1],
+			Retry:   vals[2],
+			Expire:  vals[3],
+			Minimum: vals[4],
+			TTL:     ttl,
+		}, nil
+	case PTR:
+		if err := want(1); err != nil {
+			return nil, err
+		}
+		host, err := parseName(rdata[0], origin)
+		if err != nil {
+			return nil, err
+		}
+		return &PTRRecord{Domain: domain, Host: host, TTL: ttl}, nil
+	case TXT:
+		if len(rdata) == 0 {
+			return nil, fmt.Errorf("TXT record for %s needs at least one string", fqdn(domain))
+		}
+		data := []string{}
+		for _, field := range rdata {
+			str, err := unquoteText(field)
+			if err != nil {
+				return nil, err
+			}
+			if len(str) > 255 {
+				return nil, fmt.Errorf("TXT string for %s exceeds 255 characters", fqdn(domain))
+			}
+			data = append(data, str)
+		}
+		return &TXTRecord{Domain: domain, Data: data, TTL: ttl}, nil
+	case DNSKEY, DS, RRSIG, NSEC, NSEC3, NSEC3PARAM:
+		return parseDNSSECFields(domain, qtype.ToNum(), ttl, rdata, origin)
+	default:
+		return nil, fmt.Errorf("Record type %s must use the \\# generic format", qtype)
+	}
+}
+
+// parseGenericRdata handles the RFC 3597 "\# <length> <hex>" form, which is
+// valid for any type. Known types are decoded by running the wire format
+// through ReadDnsRecord.
+func parseGenericRdata(domain string, qtype QueryType, class uint16, ttl uint32, fields []string) (DnsRecord, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("Missing rdata length")
+	}
+	length, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rdata length %q", fields[0])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rdata hex: %v", err)
+	}
+	if len(data) != int(length) {
+		return nil, fmt.Errorf("Rdata length %d does not match %d bytes of data", length, len(data))
+	}
+
+	unknown := &UnknownRecord{
+		Domain:  domain,
+		QType:   qtype.ToNum(),
+		Class:   class,
+		DataLen: uint16(length),
+		TTL:     ttl,
+		Data:    data,
+	}
+	if qtype.query_type == Unknown {
+		return unknown, nil
+	}
+
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if _, err := unknown.Write(buffer); err != nil {
+		return nil, err
+	}
+	buffer.Seek(0)
+	return ReadDnsRecord(buffer)
+}
+
+func formatRecord(domain string, ttl uint32, qtype QueryType, rdata string) string {
+	return fmt.Sprintf("%s %d IN %s %s", fqdn(domain), ttl, qtype, rdata)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPresentationRoundTrip(t *testing.T) {
+	lines := []string{
+		"example.com. 300 IN A 192.0.2.1",
+		"example.com. 300 IN AAAA 2001:db8::1",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"www.example.com. 300 IN CNAME example.com.",
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+		"1.2.0.192.in-addr.arpa. 300 IN PTR example.com.",
+		`example.com. 300 IN TXT "v=spf1 -all" "second \"quoted\" string"`,
+		"example.com. 300 IN TYPE65534 \\# 3 abcdef",
+	}
+	for _, line := range lines {
+		rec, err := ParseDnsRecord(line)
+		if err != nil {
+			t.Errorf("ParseDnsRecord(%q): %v", line, err)
+			continue
+		}
+		if got := rec.String(); got != line {
+			t.Errorf("ParseDnsRecord(%q).String() = %q", line, got)
+		}
+	}
+}
+
+func TestParseOptionalTTLAndClass(t *testing.T) {
+	cases := []struct {
+		line  string
+		ttl   uint32
+		class uint16
+	}{
+		{"example.com. A 192.0.2.1", 0, ClassIN},
+		{"example.com. IN A 192.0.2.1", 0, ClassIN},
+		{"example.com. 1h A 192.0.2.1", 3600, ClassIN},
+		{"example.com. IN 300 A 192.0.2.1", 300, ClassIN},
+		{"example.com. in 300 a 192.0.2.1", 300, ClassIN},
+		{`version.bind. 0 CH TXT "godns"`, 0, ClassCH},
+		{`version.bind. CH 60 TXT "godns"`, 60, ClassCH},
+		{"example.com. HS A 192.0.2.1", 0, ClassHS},
+		{"example.com. 300 CLASS3 TYPE1 \\# 4 c0000201", 300, ClassCH},
+		{"example.com. 300 CLASS42 A 192.0.2.1", 300, 42},
+		{"example.com. 0 ANY A \\# 0", 0, ClassANY},
+		{"example.com. 0 NONE A 192.0.2.1", 0, ClassNONE},
+	}
+	for _, c := range cases {
+		rec, err := ParseDnsRecord(c.line)
+		if err != nil {
+			t.Errorf("ParseDnsRecord(%q): %v", c.line, err)
+			continue
+		}
+		if recordTTL(rec) != c.ttl || recordClass(rec) != c.class {
+			t.Errorf("ParseDnsRecord(%q): TTL %d and class %d, want %d and %d", c.line, recordTTL(rec), recordClass(rec), c.ttl, c.class)
+		}
+	}
+
+	// RDATA is the same in every class.
+	in, _ := ParseDnsRecord("example.com. 300 IN A 192.0.2.1")
+	ch, _ := ParseDnsRecord("example.com. 300 CH A 192.0.2.1")
+	_, _, _, inData, _ := splitRecord(in)
+	_, _, _, chData, _ := splitRecord(ch)
+	if !bytes.Equal(inData, chData) || recordType(ch) != A {
+		t.Errorf("CH record %v doesn't have the RDATA of %v", ch, in)
+	}
+	if got := ch.String(); got != "example.com. 300 CH A \\# 4 c0000201" {
+		t.Errorf("CH record prints as %q", got)
+	}
+	if again, err := ParseDnsRecord(ch.String()); err != nil || again.String() != ch.String() {
+		t.Errorf("CH record doesn't parse back: %v, %v", again, err)
+	}
+}
+
+func TestParseRecordErrors(t *testing.T) {
+	cases := map[string]string{
+		"example.com. 300 IN":                      "Missing record type",
+		"example.com. 300 IN A 2001:db8::":         "Invalid IPv4 address",
+		"example.com. 300 IN A":                    "needs 1 fields",
+		"example.com. 300 IN BOGUS x":              "",
+		"example.com. 300 IN TXT \"open":           "Unterminated",
+		"example.com. 300 IN TYPE1 \\# 5 c0000201": "does not match",
+	}
+	for line, want := range cases {
+		_, err := ParseDnsRecord(line)
+		if err == nil {
+			t.Errorf("ParseDnsRecord(%q) succeeded", line)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseDnsRecord(%q): %v, want an error containing %q", line, err, want)
+		}
+	}
+}
+
+func TestPacketString(t *testing.T) {
+	packet := NewDnsPacket()
+	packet.Header.ID = 42
+	packet.Header.Response = true
+	packet.Questions = append(packet.Questions, NewDnsQuestion("example.com", QueryTypeFromNum(A)))
+	packet.Answers = testRecords(t, "example.com. 300 IN A 192.0.2.1")
+	packet.Authorities = testRecords(t, "example.com. 3600 IN NS ns1.example.com.")
+
+	out := packet.String()
+	for _, want := range []string{
+		";; QUESTION SECTION:\n;example.com. IN A\n",
+		";; ANSWER SECTION:\nexample.com. 300 IN A 192.0.2.1\n",
+		";; AUTHORITY SECTION:\nexample.com. 3600 IN NS ns1.example.com.\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("packet string lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "ADDITIONAL SECTION") {
+		t.Errorf("empty additional section printed:\n%s", out)
+	}
+}
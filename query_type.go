@@ -1,12 +1,32 @@
 package main
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 const (
 	Unknown = iota
 	A = 1
     NS = 2
     CNAME = 5
+    SOA = 6
+    PTR = 12
     MX = 15
+    TXT = 16
     AAAA = 28
+    OPT = 41
+    DS = 43
+    RRSIG = 46
+    NSEC = 47
+    DNSKEY = 48
+    NSEC3 = 50
+    NSEC3PARAM = 51
+    TSIG = 250
+    IXFR = 251
+    AXFR = 252
+    ANY = 255
 )
 
 type QueryType struct {
@@ -26,10 +46,38 @@ func (qt QueryType) ToNum() uint16 {
         return 2
     case CNAME:
         return 5
+    case SOA:
+        return 6
+    case PTR:
+        return 12
     case MX:
         return 15
+    case TXT:
+        return 16
     case AAAA:
         return 28
+    case OPT:
+        return 41
+    case DS:
+        return 43
+    case RRSIG:
+        return 46
+    case NSEC:
+        return 47
+    case DNSKEY:
+        return 48
+    case NSEC3:
+        return 50
+    case NSEC3PARAM:
+        return 51
+    case TSIG:
+        return 250
+    case IXFR:
+        return 251
+    case AXFR:
+        return 252
+    case ANY:
+        return 255
     default:
         return uint16(qt.val)
     }
@@ -43,11 +91,85 @@ func QueryTypeFromNum(num uint16) QueryType {
         return *NewQueryType(NS, num)
     case 5:
         return *NewQueryType(CNAME, num)
+    case 6:
+        return *NewQueryType(SOA, num)
+    case 12:
+        return *NewQueryType(PTR, num)
     case 15:
         return *NewQueryType(MX, num)
+    case 16:
+        return *NewQueryType(TXT, num)
     case 28:
         return *NewQueryType(AAAA, num)
+    case 41:
+        return *NewQueryType(OPT, num)
+    case 43:
+        return *NewQueryType(DS, num)
+    case 46:
+        return *NewQueryType(RRSIG, num)
+    case 47:
+        return *NewQueryType(NSEC, num)
+    case 48:
+        return *NewQueryType(DNSKEY, num)
+    case 50:
+        return *NewQueryType(NSEC3, num)
+    case 51:
+        return *NewQueryType(NSEC3PARAM, num)
+    case 250:
+        return *NewQueryType(TSIG, num)
+    case 251:
+        return *NewQueryType(IXFR, num)
+    case 252:
+        return *NewQueryType(AXFR, num)
+    case 255:
+        return *NewQueryType(ANY, num)
     default:
         return *NewQueryType(Unknown, num)
     }
 }
+
+var queryTypeNames = map[uint16]string{
+	A:          "A",
+	NS:         "NS",
+	CNAME:      "CNAME",
+	SOA:        "SOA",
+	PTR:        "PTR",
+	MX:         "MX",
+	TXT:        "TXT",
+	AAAA:       "AAAA",
+	OPT:        "OPT",
+	DS:         "DS",
+	RRSIG:      "RRSIG",
+	NSEC:       "NSEC",
+	DNSKEY:     "DNSKEY",
+	NSEC3:      "NSEC3",
+	NSEC3PARAM: "NSEC3PARAM",
+	TSIG:       "TSIG",
+	IXFR:       "IXFR",
+	AXFR:       "AXFR",
+	ANY:        "ANY",
+}
+
+func (qt QueryType) String() string {
+	num := qt.ToNum()
+	if name, ok := queryTypeNames[num]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", num)
+}
+
+func QueryTypeFromString(s string) (QueryType, error) {
+	s = strings.ToUpper(s)
+	for num, name := range queryTypeNames {
+		if name == s {
+			return QueryTypeFromNum(num), nil
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		num, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return QueryTypeFromNum(uint16(num)), nil
+		}
+	}
+	return QueryType{}, fmt.Errorf("Unknown query type %q", s)
+}
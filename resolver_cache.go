@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The resolver's cache. Answers are kept for the smallest TTL of their
+// records, negative answers for the negative TTL of the zone's SOA (RFC
+// 2308 section 5), and longer when stale data is served. The NSEC and
+// NSEC3 records of validated answers are also kept by zone, so that names
+// and types they deny are answered without asking the zone's servers
+// again (RFC 8198).
+
+const (
+	maxCacheTTL         = 24 * time.Hour
+	maxNegativeCacheTTL = 3 * time.Hour
+	maxCacheEntries     = 10000
+	// Proofs are checked against all denial records cached for a zone,
+	// so only a few are kept.
+	maxCachedDenials = 256
+)
+
+type cacheEntry struct {
+	response *DnsPacket
+	stored   time.Time
+	expires  time.Time
+	// hits counts how often the answer was given out, for prefetching.
+	hits int
+	// Whether the answer is being resolved again, for prefetching or
+	// serving stale data, and when to try that after a failure.
+	refreshing bool
+	recheck    time.Time
+}
+
+// cachedRRset is an RRset together with its signatures.
+type cachedRRset struct {
+	records []DnsRecord
+	stored  time.Time
+	expires time.Time
+}
+
+// zoneDenials are the validated NSEC or NSEC3 records of a zone, by owner
+// name, and its SOA.
+type zoneDenials struct {
+	soa     *cachedRRset
+	records map[string]*cachedRRset
+}
+
+var resolverCache = struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+	denials map[string]*zoneDenials
+}{entries: map[string]*cacheEntry{}, denials: map[string]*zoneDenials{}}
+
+func cacheKey(qname string, qtype uint16) string {
+	return fmt.Sprintf("%s/%d", normalizeName(qname), qtype)
+}
+
+// cachedResponse returns a cached answer to the question with its TTLs
+// counted down, or nil. Popular answers that are about to expire are
+// prefetched.
+func cachedResponse(qname string, qtype uint16) *DnsPacket {
+	now := time.Now()
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+	entry, ok := resolverCache.entries[cacheKey(qname, qtype)]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	entry.hits++
+	if shouldPrefetch(entry, now) {
+		entry.refreshing = true
+		go prefetch(qname, qtype)
+	}
+	return agedResponse(entry.response, now.Sub(entry.stored), entry.expires.Sub(now))
+}
+
+// cacheResponse stores the answer to a question that came from zone. The
+// denial records of secure answers are kept for synthesizing answers.
+func cacheResponse(qname string, qtype uint16, response *DnsPacket, status SecurityStatus, zone string) {
+	if response.Header.ResCode != NOERROR && response.Header.ResCode != NXDOMAIN {
+		return
+	}
+	now := time.Now()
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+
+	if ttl := cacheTTL(response); ttl > 0 {
+		if len(resolverCache.entries) >= maxCacheEntries {
+			evictEntries(now)
+		}
+		key := cacheKey(qname, qtype)
+		entry := &cacheEntry{
+			response: agedResponse(response, 0, ttl),
+			stored:   now,
+			expires:  now.Add(ttl),
+		}
+		// A refreshed answer stays as popular as it was.
+		if old, ok := resolverCache.entries[key]; ok {
+			entry.hits = old.hits
+		}
+		resolverCache.entries[key] = entry
+	}
+	if status == Secure {
+		rememberDenials(normalizeName(zone), response.Authorities, now)
+	}
+}
+
+// cacheTTL is how long a response may be cached. Negative answers
+// without an SOA aren't cached at all.
+func cacheTTL(response *DnsPacket) time.Duration {
+	records, limit := response.Answers, maxCacheTTL
+	negative := response.Header.ResCode == NXDOMAIN || len(response.Answers) == 0
+	if negative {
+		records, limit = response.Authorities, maxNegativeCacheTTL
+	}
+	ttl, found, soa := uint32(0), false, false
+	for _, rec := range records {
+		t := recordTTL(rec)
+		if s, ok := rec.(*SOARecord); ok {
+			t = min(t, s.Minimum)
+			soa = true
+		}
+		if !found || t < ttl {
+			ttl, found = t, true
+		}
+	}
+	if !found || negative && !soa {
+		return 0
+	}
+	return min(time.Duration(ttl)*time.Second, limit)
+}
+
+// evictEntries makes room in the cache, dropping entries that are too old
+// to be served stale first; the caller holds resolverCache.
+func evictEntries(now time.Time) {
+	for key, entry := range resolverCache.entries {
+		if !now.Before(entry.expires.Add(staleWindow)) {
+			delete(resolverCache.entries, key)
+		}
+	}
+	for key := range resolverCache.entries {
+		if len(resolverCache.entries) < maxCacheEntries {
+			break
+		}
+		delete(resolverCache.entries, key)
+	}
+}
+
+// rememberDenials keeps the SOA, NSEC and NSEC3 RRsets of a secure
+// response from zone; the caller holds resolverCache.
+func rememberDenials(zone string, records []DnsRecord, now time.Time) {
+	denials := resolverCache.denials[zone]
+	for _, rrset := range groupRRsets(records) {
+		qtype := recordType(rrset[0])
+		owner := normalizeName(recordDomain(rrset[0]))
+		if qtype != SOA && qtype != NSEC && qtype != NSEC3 || !isSubdomain(owner, zone) {
+			continue
+		}
+		if qtype == SOA && owner != zone {
+			continue
+		}
+		sigs := signaturesFor(records, owner, qtype)
+		if len(sigs) == 0 {
+			continue
+		}
+		entry := &cachedRRset{records: append([]DnsRecord{}, rrset...), stored: now}
+		ttl := maxCacheTTL
+		for _, rec := range rrset {
+			ttl = min(ttl, time.Duration(recordTTL(rec))*time.Second)
+		}
+		for _, sig := range sigs {
+			entry.records = append(entry.records, sig)
+			ttl = min(ttl, time.Unix(int64(sig.Expiration), 0).Sub(now))
+		}
+		if ttl <= 0 {
+			continue
+		}
+		entry.expires = now.Add(ttl)
+
+		if denials == nil {
+			denials = &zoneDenials{records: map[string]*cachedRRset{}}
+			resolverCache.denials[zone] = denials
+		}
+		if qtype == SOA {
+			denials.soa = entry
+		} else {
+			denials.records[owner] = entry
+		}
+	}
+	if denials == nil || len(denials.records) <= maxCachedDenials {
+		return
+	}
+
+	// Drop the records that expire first.
+	owners := make([]string, 0, len(denials.records))
+	for owner := range denials.records {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return denials.records[owners[i]].expires.Before(denials.records[owners[j]].expires)
+	})
+	for _, owner := range owners[:len(owners)-maxCachedDenials] {
+		delete(denials.records, owner)
+	}
+}
+
+// synthesizeDenial answers a question from the cached denial records of
+// the closest zone above qname, if they prove that the name or type
+// doesn't exist (RFC 8198 section 5). Insecure proofs, such as NSEC3
+// opt-out spans, are not used.
+func synthesizeDenial(qname string, qtype uint16) *DnsPacket {
+	qname = normalizeName(qname)
+	now := time.Now()
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+
+	// The DS records of a zone are denied by its parent.
+	var zone string
+	var denials *zoneDenials
+	for name := qname; denials == nil; name = parentName(name) {
+		if d, ok := resolverCache.denials[name]; ok && (qtype != DS || name != qname) {
+			zone, denials = name, d
+		}
+		if name == "" {
+			break
+		}
+	}
+	if denials == nil || denials.soa == nil || !now.Before(denials.soa.expires) {
+		return nil
+	}
+
+	candidates := []DnsRecord{}
+	for _, entry := range denials.records {
+		if now.Before(entry.expires) {
+			candidates = append(candidates, entry.records...)
+		}
+	}
+	relevant := newDenialProof(candidates, zone).relevantTo(qname)
+	proof := newDenialProof(relevant, zone)
+	rescode := NXDOMAIN
+	if status, err := proof.proveNXDOMAIN(qname); err != nil || status != Secure {
+		if status, err := proof.proveNoData(qname, qtype); err != nil || status != Secure {
+			return nil
+		}
+		rescode = NOERROR
+	}
+
+	// The answer lives as long as the records it is made of, and no
+	// longer than the negative TTL.
+	used := []*cachedRRset{denials.soa}
+	for _, rec := range relevant {
+		used = append(used, denials.records[normalizeName(recordDomain(rec))])
+	}
+	soa := denials.soa.records[0].(*SOARecord)
+	remaining := time.Duration(soa.Minimum) * time.Second
+	for _, entry := range used {
+		remaining = min(remaining, entry.expires.Sub(now))
+	}
+
+	packet := NewDnsPacket()
+	packet.Header.Response = true
+	packet.Header.RecursionAvailable = true
+	packet.Header.AuthedData = true
+	packet.Header.ResCode = rescode
+	packet.Questions = append(packet.Questions, NewDnsQuestion(qname, QueryTypeFromNum(qtype)))
+	for _, entry := range used {
+		packet.Authorities = append(packet.Authorities, agedRecords(entry.records, now.Sub(entry.stored), remaining)...)
+	}
+	return packet
+}
+
+// agedResponse copies a cached response, counting its TTLs down by
+// elapsed and capping them at remaining.
+func agedResponse(response *DnsPacket, elapsed time.Duration, remaining time.Duration) *DnsPacket {
+	packet := NewDnsPacket()
+	header := *response.Header
+	packet.Header = &header
+	packet.Questions = append(packet.Questions, response.Questions...)
+	packet.Answers = agedRecords(response.Answers, elapsed, remaining)
+	packet.Authorities = agedRecords(response.Authorities, elapsed, remaining)
+	packet.Resources = agedRecords(response.Resources, elapsed, remaining)
+	return packet
+}
+
+func agedRecords(records []DnsRecord, elapsed time.Duration, remaining time.Duration) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range records {
+		ttl := time.Duration(recordTTL(rec)) * time.Second
+		ttl = max(min(ttl-elapsed, remaining), 0)
+		result = append(result, withRecordHeader(rec, recordDomain(rec), uint32(ttl/time.Second)))
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// emptyCache gives a test a resolver cache of its own.
+func emptyCache(t *testing.T) {
+	t.Helper()
+	resolverCache.Lock()
+	entries, denials := resolverCache.entries, resolverCache.denials
+	resolverCache.entries = map[string]*cacheEntry{}
+	resolverCache.denials = map[string]*zoneDenials{}
+	resolverCache.Unlock()
+	t.Cleanup(func() {
+		resolverCache.Lock()
+		resolverCache.entries, resolverCache.denials = entries, denials
+		resolverCache.Unlock()
+	})
+}
+
+// testResponse makes a response with the given answer and authority
+// records.
+func testResponse(t *testing.T, rcode ResultCode, answers []string, authorities ...string) *DnsPacket {
+	t.Helper()
+	response := NewDnsPacket()
+	response.Header.Response = true
+	response.Header.ResCode = rcode
+	response.Answers = testRecords(t, answers...)
+	response.Authorities = testRecords(t, authorities...)
+	return response
+}
+
+// backdate makes a cached answer look as if it had been stored age ago.
+func backdate(qname string, qtype uint16, age time.Duration) {
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+	entry := resolverCache.entries[cacheKey(qname, qtype)]
+	entry.stored = entry.stored.Add(-age)
+	entry.expires = entry.expires.Add(-age)
+}
+
+func TestCacheTTL(t *testing.T) {
+	soa := "example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+	cases := []struct {
+		name     string
+		response *DnsPacket
+		ttl      time.Duration
+	}{
+		{"answer", testResponse(t, NOERROR, []string{"www.example.com. 300 IN A 192.0.2.1", "www.example.com. 60 IN A 192.0.2.2"}), 60 * time.Second},
+		{"long TTL", testResponse(t, NOERROR, []string{"www.example.com. 604800 IN A 192.0.2.1"}), maxCacheTTL},
+		{"NXDOMAIN", testResponse(t, NXDOMAIN, nil, soa), 300 * time.Second},
+		{"NODATA", testResponse(t, NOERROR, nil, strings.Replace(soa, "3600", "120", 1)), 120 * time.Second},
+		{"long negative TTL", testResponse(t, NXDOMAIN, nil, "example.com. 86400 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 86400"), maxNegativeCacheTTL},
+		{"NXDOMAIN without SOA", testResponse(t, NXDOMAIN, nil, "example.com. 3600 IN NS ns1.example.com."), 0},
+	}
+	for _, c := range cases {
+		if ttl := cacheTTL(c.response); ttl != c.ttl {
+			t.Errorf("%s: cacheTTL() = %v, want %v", c.name, ttl, c.ttl)
+		}
+	}
+}
+
+func TestCachedResponse(t *testing.T) {
+	emptyCache(t)
+	response := testResponse(t, NOERROR, []string{"www.example.com. 300 IN A 192.0.2.1", "www.example.com. 60 IN AAAA 2001:db8::1"})
+	cacheResponse("www.example.com", A, response, Insecure, "example.com")
+	cacheResponse("www.example.com", MX, testResponse(t, SERVFAIL, nil), Insecure, "example.com")
+
+	if cachedResponse("WWW.example.com", A) == nil {
+		t.Fatal("answer wasn't cached")
+	}
+	if cachedResponse("www.example.com", AAAA) != nil || cachedResponse("www.example.com", MX) != nil {
+		t.Error("answer cached for another question or failure cached")
+	}
+
+	// TTLs count down and end with the answer's.
+	backdate("www.example.com", A, 50*time.Second)
+	for _, rec := range cachedResponse("www.example.com", A).Answers {
+		if ttl := recordTTL(rec); ttl != 9 && ttl != 10 {
+			t.Errorf("aged answer: %v", rec)
+		}
+	}
+	backdate("www.example.com", A, 10*time.Second)
+	if response := cachedResponse("www.example.com", A); response != nil {
+		t.Errorf("expired answer given out:\n%v", response)
+	}
+}
+
+// cacheDenial resolves a question against zone and caches the response
+// as a validating resolver would.
+func cacheDenial(t *testing.T, zone *Zone, qname string, qtype uint16, status SecurityStatus) {
+	t.Helper()
+	response, _ := denialFor(zone, qname, qtype)
+	cacheResponse(qname, qtype, response, status, zone.Origin)
+}
+
+func TestSynthesizedDenial(t *testing.T) {
+	for _, chain := range denialChains {
+		emptyCache(t)
+		zone := denialTestZone(t, chain.nsec3)
+		cacheDenial(t, zone, "missing.example.test", A, Secure)
+		cacheDenial(t, zone, "www.example.test", AAAA, Secure)
+
+		cases := []struct {
+			qname string
+			qtype uint16
+			rcode ResultCode
+		}{
+			// Other types at a name that doesn't exist or has no data.
+			{"missing.example.test", MX, NXDOMAIN},
+			{"below.missing.example.test", A, NXDOMAIN},
+			{"www.example.test", TXT, NOERROR},
+		}
+		for _, c := range cases {
+			response := synthesizeDenial(c.qname, c.qtype)
+			if chain.optOut != Secure && c.rcode == NXDOMAIN {
+				// An opt-out span may hide a delegation.
+				if response != nil {
+					t.Errorf("%s: %s %v synthesized from an opt-out span", chain.name, c.qname, QueryTypeFromNum(c.qtype))
+				}
+				continue
+			}
+			if response == nil {
+				t.Errorf("%s: no answer synthesized for %s %v", chain.name, c.qname, QueryTypeFromNum(c.qtype))
+				continue
+			}
+			if response.Header.ResCode != c.rcode || !response.Header.AuthedData || len(filterRecords(response.Authorities, SOA)) != 1 {
+				t.Errorf("%s: %s %v:\n%v", chain.name, c.qname, QueryTypeFromNum(c.qtype), response)
+			}
+			for _, rec := range response.Authorities {
+				if recordTTL(rec) > 300 {
+					t.Errorf("%s: %v lives longer than the negative TTL", chain.name, rec)
+				}
+			}
+		}
+
+		// Types that are there, and names that do exist, are looked up.
+		for _, q := range []struct {
+			qname string
+			qtype uint16
+		}{{"www.example.test", A}, {"ns.example.test", A}, {"sub.example.test", NS}} {
+			if response := synthesizeDenial(q.qname, q.qtype); response != nil {
+				t.Errorf("%s: %s %v denied:\n%v", chain.name, q.qname, QueryTypeFromNum(q.qtype), response)
+			}
+		}
+	}
+
+	// A name in an NSEC span seen before is denied too.
+	emptyCache(t)
+	zone := denialTestZone(t, nil)
+	cacheDenial(t, zone, "missing.example.test", A, Secure)
+	if response := synthesizeDenial("mmm.example.test", A); response == nil || response.Header.ResCode != NXDOMAIN {
+		t.Errorf("name in a cached span: %v", response)
+	}
+
+	// Only the records of secure answers are used.
+	emptyCache(t)
+	cacheDenial(t, zone, "missing.example.test", A, Insecure)
+	if response := synthesizeDenial("missing.example.test", MX); response != nil {
+		t.Errorf("denial synthesized from an insecure answer:\n%v", response)
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "fmt"
+
 type ResultCode int
 
 const (
@@ -9,6 +11,11 @@ const (
     NXDOMAIN ResultCode = 3
     NOTIMP   ResultCode = 4
     REFUSED  ResultCode = 5
+    YXDOMAIN ResultCode = 6
+    YXRRSET  ResultCode = 7
+    NXRRSET  ResultCode = 8
+    NOTAUTH  ResultCode = 9
+    NOTZONE  ResultCode = 10
 )
 
 func ResultCodeFromNum(num uint8) ResultCode {
@@ -23,7 +30,46 @@ func ResultCodeFromNum(num uint8) ResultCode {
         return NOTIMP
     case 5:
         return REFUSED
+    case 6:
+        return YXDOMAIN
+    case 7:
+        return YXRRSET
+    case 8:
+        return NXRRSET
+    case 9:
+        return NOTAUTH
+    case 10:
+        return NOTZONE
     default:
         return NOERROR
     }
 }
+
+func (r ResultCode) String() string {
+    switch r {
+    case NOERROR:
+        return "NOERROR"
+    case FORMERR:
+        return "FORMERR"
+    case SERVFAIL:
+        return "SERVFAIL"
+    case NXDOMAIN:
+        return "NXDOMAIN"
+    case NOTIMP:
+        return "NOTIMP"
+    case REFUSED:
+        return "REFUSED"
+    case YXDOMAIN:
+        return "YXDOMAIN"
+    case YXRRSET:
+        return "YXRRSET"
+    case NXRRSET:
+        return "NXRRSET"
+    case NOTAUTH:
+        return "NOTAUTH"
+    case NOTZONE:
+        return "NOTZONE"
+    default:
+        return fmt.Sprintf("RCODE%d", int(r))
+    }
+}
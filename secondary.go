@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Secondary zones are kept in sync with their primary as described in
+// RFC 1034 section 4.3.5: the primary's serial is checked every SOA
+// refresh interval, failed checks are retried after the retry interval,
+// and the zone stops being served once the expire interval has passed
+// without reaching the primary. A NOTIFY from the primary (RFC 1996)
+// triggers a check right away.
+
+// The timers never fire more often than this, whatever the SOA says.
+// It is also the retry interval of a zone that hasn't been transferred
+// yet, which has no SOA to take it from.
+const minRefreshInterval = 30 * time.Second
+
+// newEmptyZone returns a secondary zone that has no copy from its primary
+// yet. It is expired until the first transfer.
+func newEmptyZone(origin string) *Zone {
+	return &Zone{
+		Origin:  normalizeName(origin),
+		records: map[string][]DnsRecord{},
+		nodes:   map[string]bool{},
+		expired: true,
+	}
+}
+
+// maintainSecondary runs for the lifetime of a secondary zone.
+func (z *Zone) maintainSecondary() {
+	lastSuccess := time.Now()
+	wait := minRefreshInterval
+	if soa := z.SOA(); soa != nil {
+		wait = soaInterval(soa.Refresh)
+	}
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-z.refreshNow:
+			timer.Stop()
+		}
+
+		z.resolvePrimary()
+		soa := z.SOA()
+		if err := z.checkPrimary(); err != nil {
+			fmt.Printf("Failed to refresh zone %s from %s: %v\n", fqdn(z.Origin), z.config.Primary, err)
+			if soa == nil {
+				wait = minRefreshInterval
+				continue
+			}
+
+			remaining := soaInterval(soa.Expire) - time.Since(lastSuccess)
+			if remaining <= 0 {
+				if !z.Expired() {
+					fmt.Printf("Zone %s expired\n", fqdn(z.Origin))
+				}
+				z.setExpired(true)
+				remaining = soaInterval(soa.Retry)
+			}
+			wait = min(soaInterval(soa.Retry), remaining)
+			continue
+		}
+
+		lastSuccess = time.Now()
+		z.setExpired(false)
+		wait = soaInterval(z.SOA().Refresh)
+	}
+}
+
+func soaInterval(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, minRefreshInterval)
+}
+
+// checkPrimary asks the primary for its SOA and transfers the zone if the
+// serial is newer than ours. With a TSIG key the check is a signed IXFR
+// instead, which is answered with just the SOA if nothing changed. A zone
+// without a copy yet is transferred in full.
+func (z *Zone) checkPrimary() error {
+	if z.SOA() == nil {
+		records, err := TransferZone(z.Origin, z.config.Primary, z.key)
+		if err != nil {
+			return err
+		}
+		return z.Replace(records)
+	}
+	if z.key != nil {
+		_, err := RefreshZone(z, z.config.Primary)
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", withDefaultPort(z.config.Primary, "53"))
+	if err != nil {
+		return err
+	}
+	response, err := Lookup(z.Origin, QueryTypeFromNum(SOA), addr)
+	if err != nil {
+		return err
+	}
+	if response.Header.ResCode != NOERROR || !response.Header.AuthoritativeAnswer {
+		return fmt.Errorf("Primary answered the SOA query with %s", response.Header.ResCode)
+	}
+
+	var primarySOA *SOARecord
+	for _, rec := range response.Answers {
+		if soa, ok := rec.(*SOARecord); ok && normalizeName(soa.Domain) == z.Origin {
+			primarySOA = soa
+		}
+	}
+	if primarySOA == nil {
+		return fmt.Errorf("Primary sent no SOA record for %s", fqdn(z.Origin))
+	}
+
+	if !serialLess(z.SOA().Serial, primarySOA.Serial) {
+		return nil
+	}
+	_, err = RefreshZone(z, z.config.Primary)
+	return err
+}
+
+// requestRefresh makes the maintenance loop check the primary now.
+func (z *Zone) requestRefresh() {
+	select {
+	case z.refreshNow <- struct{}{}:
+	default:
+		// A check is already pending.
+	}
+}
+
+func (z *Zone) Expired() bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.expired
+}
+
+func (z *Zone) setExpired(expired bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.expired = expired
+}
+
+// resolvePrimary looks up the addresses of the primary server of a
+// secondary zone. It runs on every refresh rather than for every NOTIFY;
+// if the lookup fails the addresses found last time are kept.
+func (z *Zone) resolvePrimary() {
+	host, _, err := net.SplitHostPort(withDefaultPort(z.config.Primary, "53"))
+	if err != nil {
+		return
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		fmt.Printf("Failed to look up primary %s of %s: %v\n", host, fqdn(z.Origin), err)
+		return
+	}
+	entries := []string{}
+	for _, ip := range ips {
+		entries = append(entries, ip.String())
+	}
+	acl, err := ParseACL(entries)
+	if err != nil {
+		return
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.primaryAddrs = acl
+}
+
+// isPrimary reports whether addr is one of the addresses of the primary
+// server of a secondary zone.
+func (z *Zone) isPrimary(addr net.Addr) bool {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.primaryAddrs.Allows(addr, "")
+}
+
+// handleNotify answers a NOTIFY (RFC 1996) and schedules a check of the
+// primary if it came from there or is signed with the zone's key.
+func handleNotify(request *DnsPacket, remote net.Addr, key string) *DnsPacket {
+	response := NewDnsPacket()
+	response.Header.ID = request.Header.ID
+	response.Header.Response = true
+	response.Header.Opcode = NOTIFY
+
+	if len(request.Questions) == 0 {
+		response.Header.ResCode = FORMERR
+		return response
+	}
+	question := request.Questions[0]
+	response.Questions = append(response.Questions, question)
+
+	zone := authZones.Get(question.Name)
+	signed := zone != nil && zone.key != nil && key == zone.key.Name
+	if zone == nil || zone.config.Primary == "" || !(signed || zone.isPrimary(remote)) {
+		fmt.Printf("Ignoring NOTIFY for %s from %s\n", fqdn(question.Name), remote)
+		response.Header.ResCode = REFUSED
+		return response
+	}
+
+	fmt.Printf("Received NOTIFY for %s from %s\n", fqdn(zone.Origin), remote)
+	response.Header.AuthoritativeAnswer = true
+	zone.requestRefresh()
+	return response
+}
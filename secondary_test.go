@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTestDNS serves DNS over UDP and TCP on the same local port and
+// returns the address.
+func serveTestDNS(t *testing.T) string {
+	t.Helper()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	go serveStreamListener(tcp)
+	go func() {
+		for {
+			if err := handleQuery(udp); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}()
+	return udp.LocalAddr().String()
+}
+
+func TestSoaInterval(t *testing.T) {
+	if got := soaInterval(3600); got != time.Hour {
+		t.Errorf("soaInterval(3600) = %v", got)
+	}
+	if got := soaInterval(1); got != minRefreshInterval {
+		t.Errorf("soaInterval(1) = %v", got)
+	}
+}
+
+func TestSecondaryRefresh(t *testing.T) {
+	lines := func(serial string, hosts ...string) []string {
+		lines := []string{
+			"refresh.test. 3600 IN SOA ns.refresh.test. admin.refresh.test. " + serial + " 3600 600 86400 300",
+			"refresh.test. 3600 IN NS ns.refresh.test.",
+			"ns.refresh.test. 3600 IN A 192.0.2.53",
+		}
+		for _, host := range hosts {
+			lines = append(lines, host+".refresh.test. 300 IN A 192.0.2.1")
+		}
+		return lines
+	}
+	primary := addTestZone(t, "refresh.test", lines("1", "a")...)
+	primary.AllowTransfer, _ = ParseACL([]string{"127.0.0.1"})
+	addr := serveTestDNS(t)
+
+	// The secondary is transferred when it is loaded.
+	secondary, err := LoadZone(ZoneConfig{Origin: "refresh.test", Primary: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondary.Expired() || secondary.SOA() == nil || secondary.SOA().Serial != 1 {
+		t.Fatalf("secondary after loading: expired %v, SOA %v", secondary.Expired(), secondary.SOA())
+	}
+
+	// A NOTIFY wakes up the maintenance loop, which sees the new serial
+	// and pulls the change.
+	if err := primary.Replace(testRecords(t, lines("2", "a", "b")...)); err != nil {
+		t.Fatal(err)
+	}
+	secondary.requestRefresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for secondary.SOA().Serial != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("secondary didn't refresh after NOTIFY")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := sortedStrings(secondary.Records()), sortedStrings(primary.Records()); got != want {
+		t.Errorf("secondary after refresh:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHandleNotify(t *testing.T) {
+	zone := addTestZone(t, "notify.test",
+		"notify.test. 3600 IN SOA ns.notify.test. admin.notify.test. 1 3600 600 86400 300",
+		"notify.test. 3600 IN NS ns.notify.test.",
+	)
+	zone.config.Primary = "127.0.0.1"
+	zone.key = &TSIGKey{Name: "notify-key"}
+	zone.refreshNow = make(chan struct{}, 1)
+	zone.resolvePrimary()
+	addTestZone(t, "primary.test", "primary.test. 3600 IN SOA ns.primary.test. admin.primary.test. 1 3600 600 86400 300")
+
+	notify := func(name string) *DnsPacket {
+		request := NewDnsPacket()
+		request.Header.ID = 5
+		request.Header.Opcode = NOTIFY
+		if name != "" {
+			request.Questions = append(request.Questions, NewDnsQuestion(name, QueryTypeFromNum(SOA)))
+		}
+		return request
+	}
+	fromPrimary := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	fromElsewhere := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 53}
+
+	cases := []struct {
+		name    string
+		request *DnsPacket
+		remote  net.Addr
+		key     string
+		rcode   ResultCode
+	}{
+		{"from the primary", notify("notify.test"), fromPrimary, "", NOERROR},
+		{"signed with the zone's key", notify("notify.test"), fromElsewhere, "notify-key", NOERROR},
+		{"from elsewhere", notify("notify.test"), fromElsewhere, "", REFUSED},
+		{"signed with another key", notify("notify.test"), fromElsewhere, "other-key", REFUSED},
+		{"for a primary zone", notify("primary.test"), fromPrimary, "", REFUSED},
+		{"for an unknown zone", notify("unknown.test"), fromPrimary, "", REFUSED},
+		{"without a question", notify(""), fromPrimary, "", FORMERR},
+	}
+	for _, c := range cases {
+		response := handleNotify(c.request, c.remote, c.key)
+		if response.Header.ResCode != c.rcode || response.Header.Opcode != NOTIFY || response.Header.ID != 5 {
+			t.Errorf("NOTIFY %s: %v", c.name, response)
+		}
+		select {
+		case <-zone.refreshNow:
+			if c.rcode != NOERROR {
+				t.Errorf("NOTIFY %s scheduled a refresh", c.name)
+			}
+		default:
+			if c.rcode == NOERROR && c.request.Questions[0].Name == "notify.test" {
+				t.Errorf("NOTIFY %s didn't schedule a refresh", c.name)
+			}
+		}
+	}
+
+	// The addresses of the primary are looked up on refresh, not for
+	// every NOTIFY.
+	zone.config.Primary = "192.0.2.77"
+	if response := handleNotify(notify("notify.test"), fromPrimary, ""); response.Header.ResCode != NOERROR {
+		t.Errorf("NOTIFY looked up the primary again: %v", response)
+	}
+	zone.resolvePrimary()
+	if response := handleNotify(notify("notify.test"), fromPrimary, ""); response.Header.ResCode != REFUSED {
+		t.Errorf("NOTIFY from the old primary: %v", response)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Serving stale data (RFC 8767). Cached answers are kept for a while
+// after they expire. When their names can't be resolved again, because
+// the servers don't answer or answer badly, or not within the time a
+// client is willing to wait, the expired answer is given out with a short
+// TTL instead of SERVFAIL. A lookup that outlasts the client goes on in
+// the background and refreshes the cache.
+
+// staleWindow is how long answers are kept after they expire; zero turns
+// serving stale data off. Clients get a stale answer when a lookup takes
+// longer than staleClientTimeout.
+var (
+	staleWindow        time.Duration
+	staleClientTimeout = 1800 * time.Millisecond
+)
+
+const (
+	// staleAnswerTTL is the largest TTL of a stale answer.
+	staleAnswerTTL = 30 * time.Second
+	// staleRecheck is how long stale answers are given out without trying
+	// to resolve them after a failure (RFC 8767 section 5).
+	staleRecheck = 30 * time.Second
+)
+
+type answerResult struct {
+	response *DnsPacket
+	err      error
+}
+
+// staleResponse returns an expired cached answer to the question, or nil.
+// It also reports whether the caller should try to refresh the answer,
+// which it then has to report back to finishRefresh.
+func staleResponse(qname string, qtype uint16) (*DnsPacket, bool) {
+	now := time.Now()
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+	entry, ok := resolverCache.entries[cacheKey(qname, qtype)]
+	if !ok || !now.Before(entry.expires.Add(staleWindow)) {
+		return nil, false
+	}
+	refresh := !entry.refreshing && !now.Before(entry.recheck)
+	if refresh {
+		entry.refreshing = true
+	}
+	return agedResponse(entry.response, 0, staleAnswerTTL), refresh
+}
+
+// finishRefresh ends the refresh of a cached answer, stale or prefetched.
+// A refresh that failed isn't tried again for staleRecheck.
+func finishRefresh(qname string, qtype uint16, err error) {
+	resolverCache.Lock()
+	defer resolverCache.Unlock()
+	entry, ok := resolverCache.entries[cacheKey(qname, qtype)]
+	if !ok || !entry.refreshing {
+		return
+	}
+	entry.refreshing = false
+	if err != nil {
+		entry.recheck = time.Now().Add(staleRecheck)
+	}
+}
+
+// lookupStale resolves a question that has a stale answer, and falls back
+// to it when the lookup fails or takes too long. The lookup runs with a
+// budget of its own, since it may go on after the client has its answer.
+func lookupStale(qname string, qtype QueryType, stale *DnsPacket, refresh bool) (*DnsPacket, error) {
+	if !refresh {
+		fmt.Printf("Answering %s %v with stale data\n", fqdn(qname), qtype)
+		return stale, nil
+	}
+
+	results := make(chan answerResult, 1)
+	go func() {
+		response, err := resolveAnswer(qname, qtype, newResolutionBudget(qname, qtype))
+		finishRefresh(qname, qtype.ToNum(), err)
+		results <- answerResult{response, err}
+	}()
+
+	timer := time.NewTimer(staleClientTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		if result.err == nil {
+			return result.response, nil
+		}
+		fmt.Printf("Answering %s %v with stale data: %v\n", fqdn(qname), qtype, result.err)
+	case <-timer.C:
+		fmt.Printf("Answering %s %v with stale data while it is being resolved\n", fqdn(qname), qtype)
+	}
+	return stale, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveStale turns serving stale data on for the duration of a test.
+func serveStale(t *testing.T, window time.Duration, clientTimeout time.Duration) {
+	t.Helper()
+	savedWindow, savedTimeout := staleWindow, staleClientTimeout
+	staleWindow, staleClientTimeout = window, clientTimeout
+	t.Cleanup(func() { staleWindow, staleClientTimeout = savedWindow, savedTimeout })
+}
+
+func TestStaleResponse(t *testing.T) {
+	emptyCache(t)
+	cacheResponse("www.example.com", A, testResponse(t, NOERROR, []string{"www.example.com. 300 IN A 192.0.2.1"}), Insecure, "example.com")
+	backdate("www.example.com", A, 301*time.Second)
+	if stale, _ := staleResponse("www.example.com", A); stale != nil {
+		t.Error("stale answer with serving stale data off")
+	}
+
+	serveStale(t, time.Hour, staleClientTimeout)
+	stale, refresh := staleResponse("www.example.com", A)
+	if stale == nil || !refresh {
+		t.Fatalf("stale answer %v, refresh %v", stale, refresh)
+	}
+	if ttl := recordTTL(stale.Answers[0]); ttl > uint32(staleAnswerTTL/time.Second) {
+		t.Errorf("stale answer with TTL %d", ttl)
+	}
+
+	// Only one lookup refreshes the answer at a time, and one that failed
+	// isn't tried again for a while.
+	if _, refresh := staleResponse("www.example.com", A); refresh {
+		t.Error("answer refreshed twice at once")
+	}
+	finishRefresh("www.example.com", A, errors.New("No answer"))
+	if _, refresh := staleResponse("www.example.com", A); refresh {
+		t.Error("answer refreshed right after a failure")
+	}
+	resolverCache.Lock()
+	resolverCache.entries[cacheKey("www.example.com", A)].recheck = time.Now().Add(-time.Second)
+	resolverCache.Unlock()
+	if _, refresh := staleResponse("www.example.com", A); !refresh {
+		t.Error("answer not refreshed after staleRecheck")
+	}
+
+	// Answers older than the window are dropped first to make room.
+	backdate("www.example.com", A, time.Hour)
+	if stale, _ := staleResponse("www.example.com", A); stale != nil {
+		t.Error("stale answer past the window")
+	}
+	cacheResponse("mail.example.com", A, testResponse(t, NOERROR, []string{"mail.example.com. 300 IN A 192.0.2.2"}), Insecure, "example.com")
+	resolverCache.Lock()
+	evictEntries(time.Now())
+	_, old := resolverCache.entries[cacheKey("www.example.com", A)]
+	_, fresh := resolverCache.entries[cacheKey("mail.example.com", A)]
+	resolverCache.Unlock()
+	if old || !fresh {
+		t.Errorf("after eviction: old answer kept %v, fresh answer kept %v", old, fresh)
+	}
+}
+
+func TestLookupStale(t *testing.T) {
+	emptyCache(t)
+	emptyInfraCache(t)
+	serveStale(t, time.Hour, 100*time.Millisecond)
+
+	// The root zone itself has the answer; how its server behaves is up
+	// to the test.
+	root := testZone(t, ".",
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 127.0.0.1",
+		"www.stale.test. 300 IN A 192.0.2.2",
+	)
+	var failing, slow atomic.Bool
+	rootAddr := serveZone(t, "127.0.0.1:0", root, func(response *DnsPacket) {
+		if failing.Load() {
+			response.Header.ResCode = SERVFAIL
+		}
+		if slow.Load() {
+			time.Sleep(300 * time.Millisecond)
+		}
+	})
+	savedRoots := rootServers
+	rootServers = []string{rootAddr.String()}
+	t.Cleanup(func() { rootServers = savedRoots })
+
+	qtype := QueryTypeFromNum(A)
+	staleAnswer := func() {
+		t.Helper()
+		cacheResponse("www.stale.test", A, testResponse(t, NOERROR, []string{"www.stale.test. 300 IN A 192.0.2.1"}), Insecure, "")
+		backdate("www.stale.test", A, 400*time.Second)
+	}
+	lookup := func() string {
+		t.Helper()
+		response, err := RecursiveLookup("www.stale.test", qtype)
+		if err != nil || len(response.Answers) != 1 {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		return response.Answers[0].(*ARecord).Addr.String()
+	}
+
+	// A failed lookup falls back to the stale answer.
+	staleAnswer()
+	failing.Store(true)
+	if got := lookup(); got != "192.0.2.1" {
+		t.Errorf("answer while the server fails: %s", got)
+	}
+	failing.Store(false)
+
+	// So does one that takes too long, and the answer is refreshed in the
+	// background.
+	emptyCache(t)
+	staleAnswer()
+	slow.Store(true)
+	if got := lookup(); got != "192.0.2.1" {
+		t.Errorf("answer while the server is slow: %s", got)
+	}
+	slow.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); cachedResponse("www.stale.test", A) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stale answer wasn't refreshed in the background")
+		}
+	}
+	if got := lookup(); got != "192.0.2.2" {
+		t.Errorf("answer after the refresh: %s", got)
+	}
+
+	// A working server replaces the stale answer right away.
+	emptyCache(t)
+	staleAnswer()
+	if got := lookup(); got != "192.0.2.2" {
+		t.Errorf("answer from a working server: %s", got)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Automated updates of DNSSEC trust anchors (RFC 5011). The DNSKEY set of
+// every zone with a trust anchor is fetched regularly and checked against
+// the keys trusted so far. A new key signing key is only trusted after it
+// has been published for the add hold-down time, so that a stolen key
+// can't quietly introduce a successor; a trusted key that shows up with
+// the REVOKE bit, signed by itself, is dropped. The state is kept in the
+// anchor file so that it survives restarts.
+
+const (
+	addHoldDown    = 30 * 24 * time.Hour
+	removeHoldDown = 30 * 24 * time.Hour
+
+	minAnchorRefresh = time.Hour
+	maxAnchorRefresh = 15 * 24 * time.Hour
+)
+
+// The states of a managed key (RFC 5011 section 4). Keys that are
+// removed or were never trusted are not kept.
+const (
+	anchorAddPend = "addpend"
+	anchorValid   = "valid"
+	anchorMissing = "missing"
+	anchorRevoked = "revoked"
+)
+
+// managedKey is a trust anchor as stored in the anchor file. Since is
+// when it entered its state.
+type managedKey struct {
+	Record string    `json:"record"`
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+
+	rec DnsRecord
+}
+
+func (k *managedKey) trusted() bool {
+	return k.State == anchorValid || k.State == anchorMissing
+}
+
+// sameKey reports whether the anchor is key, ignoring the REVOKE bit.
+func (k *managedKey) sameKey(key *DNSKEYRecord) bool {
+	dnskey, ok := k.rec.(*DNSKEYRecord)
+	return ok && anchoredBy(key, dnskey)
+}
+
+var managedAnchors = struct {
+	sync.Mutex
+	path  string
+	zones map[string][]*managedKey
+}{zones: map[string][]*managedKey{}}
+
+// manageTrustAnchors starts keeping the trust anchors up to date. The
+// state in the anchor file at path takes precedence over the configured
+// anchors of the same zone; without a path it is only kept in memory.
+func manageTrustAnchors(path string) error {
+	trustAnchors.RLock()
+	zones := map[string][]*managedKey{}
+	for zone, anchors := range trustAnchors.zones {
+		for _, rec := range anchors {
+			zones[zone] = append(zones[zone], &managedKey{Record: rec.String(), State: anchorValid, Since: time.Now(), rec: rec})
+		}
+	}
+	trustAnchors.RUnlock()
+
+	if path != "" {
+		stored, err := loadManagedKeys(path)
+		if err != nil {
+			return err
+		}
+		for zone, keys := range stored {
+			zones[zone] = keys
+		}
+	}
+
+	managedAnchors.Lock()
+	managedAnchors.path = path
+	managedAnchors.zones = zones
+	managedAnchors.Unlock()
+
+	for zone := range zones {
+		publishAnchors(zone)
+		go maintainAnchors(zone)
+	}
+	return nil
+}
+
+func loadManagedKeys(path string) (map[string][]*managedKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*managedKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	zones := map[string][]*managedKey{}
+	for _, key := range keys {
+		rec, err := ParseDnsRecord(key.Record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid trust anchor %q: %v", path, key.Record, err)
+		}
+		switch rec.(type) {
+		case *DSRecord, *DNSKEYRecord:
+		default:
+			return nil, fmt.Errorf("%s: trust anchor %q is neither DS nor DNSKEY", path, key.Record)
+		}
+		key.rec = rec
+		zone := normalizeName(recordDomain(rec))
+		zones[zone] = append(zones[zone], key)
+	}
+	return zones, nil
+}
+
+// saveManagedKeys writes the anchor file; the caller holds managedAnchors.
+func saveManagedKeys() error {
+	path := managedAnchors.path
+	if path == "" {
+		return nil
+	}
+	zones := make([]string, 0, len(managedAnchors.zones))
+	for zone := range managedAnchors.zones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	keys := []*managedKey{}
+	for _, zone := range zones {
+		keys = append(keys, managedAnchors.zones[zone]...)
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// publishAnchors hands the trusted keys of zone to the validator.
+func publishAnchors(zone string) {
+	managedAnchors.Lock()
+	anchors := []DnsRecord{}
+	for _, key := range managedAnchors.zones[zone] {
+		if key.trusted() {
+			anchors = append(anchors, key.rec)
+		}
+	}
+	managedAnchors.Unlock()
+	replaceTrustAnchors(zone, anchors)
+}
+
+// maintainAnchors refreshes the anchors of zone for the lifetime of the
+// resolver.
+func maintainAnchors(zone string) {
+	for {
+		wait, err := refreshAnchors(zone, time.Now())
+		if err != nil {
+			fmt.Printf("Failed to refresh trust anchors for %s: %v\n", fqdn(zone), err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// refreshAnchors fetches the DNSKEY set of zone, updates the anchors and
+// returns when to look again (RFC 5011 section 2.3).
+func refreshAnchors(zone string, now time.Time) (time.Duration, error) {
+	response, _, err := iterate(zone, QueryTypeFromNum(DNSKEY), newResolutionBudget(zone, QueryTypeFromNum(DNSKEY)))
+	if err != nil {
+		return minAnchorRefresh, err
+	}
+	keySet := rrsetAt(response.Answers, zone, DNSKEY)
+	sigs := signaturesFor(response.Answers, zone, DNSKEY)
+	if len(keySet) == 0 {
+		return minAnchorRefresh, fmt.Errorf("%s has no DNSKEY records", fqdn(zone))
+	}
+
+	managedAnchors.Lock()
+	changed, err := updateManagedKeys(zone, keySet, sigs, now)
+	if changed {
+		if saveErr := saveManagedKeys(); saveErr != nil {
+			fmt.Printf("Failed to save trust anchors: %v\n", saveErr)
+		}
+	}
+	managedAnchors.Unlock()
+	if err != nil {
+		return minAnchorRefresh, err
+	}
+	if changed {
+		publishAnchors(zone)
+	}
+
+	// Half the TTL or half the time the signatures have left.
+	wait := time.Duration(recordTTL(keySet[0])) * time.Second / 2
+	for _, sig := range sigs {
+		if left := time.Unix(int64(sig.Expiration), 0).Sub(now) / 2; left < wait {
+			wait = left
+		}
+	}
+	return min(max(wait, minAnchorRefresh), maxAnchorRefresh), nil
+}
+
+// updateManagedKeys runs the state machine of RFC 5011 section 4 over a
+// DNSKEY set of zone, which has to be signed by a trusted key. It reports
+// whether anything changed; the caller holds managedAnchors.
+func updateManagedKeys(zone string, keySet []DnsRecord, sigs []*RRSIGRecord, now time.Time) (bool, error) {
+	keys := managedAnchors.zones[zone]
+	trusted := []*DNSKEYRecord{}
+	for _, rec := range keySet {
+		key := rec.(*DNSKEYRecord)
+		if key.Flags&DNSKEYFlagRevoke != 0 {
+			continue
+		}
+		for _, managed := range keys {
+			if managed.trusted() && anchoredBy(key, managed.rec) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return false, fmt.Errorf("No trusted key in the DNSKEY set of %s", fqdn(zone))
+	}
+	if _, err := verifyRRset(keySet, sigs, trusted); err != nil {
+		return false, fmt.Errorf("DNSKEY set of %s: %v", fqdn(zone), err)
+	}
+
+	holdDown := max(addHoldDown, time.Duration(recordTTL(keySet[0]))*time.Second)
+	changed := false
+	transition := func(managed *managedKey, state string) {
+		fmt.Printf("Trust anchor %s: %s -> %s\n", managed.Record, managed.State, state)
+		managed.State = state
+		managed.Since = now
+		changed = true
+	}
+
+	seen := map[*managedKey]bool{}
+	for _, rec := range keySet {
+		key := rec.(*DNSKEYRecord)
+		var managed *managedKey
+		for _, k := range keys {
+			if k.sameKey(key) {
+				managed = k
+			}
+		}
+
+		if key.Flags&DNSKEYFlagRevoke != 0 {
+			// Only the key itself can revoke it (RFC 5011 section 2.1).
+			if managed == nil {
+				continue
+			}
+			seen[managed] = true
+			if managed.State == anchorRevoked {
+				continue
+			}
+			if _, err := verifyRRset(keySet, sigs, []*DNSKEYRecord{key}); err == nil {
+				transition(managed, anchorRevoked)
+			}
+			continue
+		}
+
+		if managed == nil {
+			if key.Flags&DNSKEYFlagSEP == 0 {
+				continue
+			}
+			// A key a DS anchor refers to is trusted right away; the DS
+			// record is replaced by the key itself.
+			for i, k := range keys {
+				if ds, ok := k.rec.(*DSRecord); ok && k.trusted() && matchesDS(ds, key) {
+					clean := *key
+					managed = &managedKey{Record: clean.String(), State: anchorValid, Since: now, rec: &clean}
+					keys[i] = managed
+					changed = true
+					break
+				}
+			}
+			if managed == nil {
+				clean := *key
+				managed = &managedKey{Record: clean.String(), State: anchorAddPend, Since: now, rec: &clean}
+				fmt.Printf("Trust anchor %s: new key, trusted after %v\n", managed.Record, holdDown)
+				keys = append(keys, managed)
+				changed = true
+			}
+		}
+		seen[managed] = true
+
+		switch {
+		case managed.State == anchorAddPend && now.Sub(managed.Since) >= holdDown:
+			transition(managed, anchorValid)
+		case managed.State == anchorMissing:
+			transition(managed, anchorValid)
+		}
+	}
+
+	kept := []*managedKey{}
+	for _, managed := range keys {
+		_, isKey := managed.rec.(*DNSKEYRecord)
+		switch {
+		case !isKey || seen[managed]:
+		case managed.State == anchorAddPend:
+			// Keys that disappear during the hold-down start over.
+			fmt.Printf("Trust anchor %s: no longer published\n", managed.Record)
+			changed = true
+			continue
+		case managed.State == anchorValid:
+			transition(managed, anchorMissing)
+		}
+		if managed.State == anchorRevoked && now.Sub(managed.Since) >= removeHoldDown {
+			fmt.Printf("Trust anchor %s: removed\n", managed.Record)
+			changed = true
+			continue
+		}
+		kept = append(kept, managed)
+	}
+	managedAnchors.zones[zone] = kept
+	return changed, nil
+}
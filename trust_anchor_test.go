@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKSK(t *testing.T, zone string) *SigningKey {
+	t.Helper()
+	key, err := LoadSigningKey(SigningKeyConfig{File: testKeyFile(t, AlgED25519), KSK: true}, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.DNSKEY.TTL = 3600
+	return key
+}
+
+// revoked returns key with the REVOKE bit set, which changes its key tag.
+func revoked(key *SigningKey) *SigningKey {
+	dnskey := *key.DNSKEY
+	dnskey.Flags |= DNSKEYFlagRevoke
+	return &SigningKey{DNSKEY: &dnskey, signer: key.signer}
+}
+
+// keySet publishes the keys as a DNSKEY set, signed by each of them.
+func keySet(t *testing.T, keys ...*SigningKey) ([]DnsRecord, []*RRSIGRecord) {
+	t.Helper()
+	rrset := []DnsRecord{}
+	for _, key := range keys {
+		rrset = append(rrset, key.DNSKEY)
+	}
+	now := time.Now()
+	sigs := []*RRSIGRecord{}
+	for _, key := range keys {
+		sig, err := key.Sign(rrset, uint32(now.Add(-time.Hour).Unix()), uint32(now.Add(24*time.Hour).Unix()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return rrset, sigs
+}
+
+// manageTestAnchors starts managing zone with the given anchors, in
+// memory only.
+func manageTestAnchors(t *testing.T, zone string, anchors ...DnsRecord) {
+	t.Helper()
+	managedAnchors.Lock()
+	saved, path := managedAnchors.zones, managedAnchors.path
+	managedAnchors.zones = map[string][]*managedKey{}
+	managedAnchors.path = ""
+	for _, rec := range anchors {
+		managedAnchors.zones[zone] = append(managedAnchors.zones[zone], &managedKey{Record: rec.String(), State: anchorValid, rec: rec})
+	}
+	managedAnchors.Unlock()
+	t.Cleanup(func() {
+		managedAnchors.Lock()
+		managedAnchors.zones, managedAnchors.path = saved, path
+		managedAnchors.Unlock()
+	})
+}
+
+// anchorStates lists the states of keys, named A, B, ... in order.
+func anchorStates(zone string, keys ...*SigningKey) string {
+	states := []string{}
+	for i, key := range keys {
+		state := "none"
+		for _, managed := range managedAnchors.zones[zone] {
+			if managed.sameKey(key.DNSKEY) {
+				state = managed.State
+			}
+		}
+		states = append(states, string(rune('A'+i))+"="+state)
+	}
+	return strings.Join(states, " ")
+}
+
+func refreshTestAnchors(t *testing.T, zone string, at time.Time, keys []DnsRecord, sigs []*RRSIGRecord) bool {
+	t.Helper()
+	changed, err := updateManagedKeys(zone, keys, sigs, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func TestKeyRollover(t *testing.T) {
+	a, b := testKSK(t, "example.com"), testKSK(t, "example.com")
+	manageTestAnchors(t, "example.com", a.DNSKEY)
+	start := time.Now()
+
+	// The new key is published and has to wait out the hold-down time.
+	keys, sigs := keySet(t, a, b)
+	if !refreshTestAnchors(t, "example.com", start, keys, sigs) {
+		t.Error("new key made no change")
+	}
+	if got := anchorStates("example.com", a, b); got != "A=valid B=addpend" {
+		t.Errorf("after the new key: %s", got)
+	}
+	if refreshTestAnchors(t, "example.com", start.Add(addHoldDown-time.Hour), keys, sigs) {
+		t.Errorf("changed before the hold-down time: %s", anchorStates("example.com", a, b))
+	}
+	refreshTestAnchors(t, "example.com", start.Add(addHoldDown), keys, sigs)
+	if got := anchorStates("example.com", a, b); got != "A=valid B=valid" {
+		t.Errorf("after the hold-down time: %s", got)
+	}
+
+	// The old key is revoked, and removed once the remove hold-down time
+	// has passed.
+	keys, sigs = keySet(t, revoked(a), b)
+	refreshTestAnchors(t, "example.com", start.Add(addHoldDown+time.Hour), keys, sigs)
+	if got := anchorStates("example.com", a, b); got != "A=revoked B=valid" {
+		t.Errorf("after the revocation: %s", got)
+	}
+	keys, sigs = keySet(t, b)
+	refreshTestAnchors(t, "example.com", start.Add(addHoldDown+removeHoldDown+time.Hour), keys, sigs)
+	if got := anchorStates("example.com", a, b); got != "A=none B=valid" {
+		t.Errorf("after the remove hold-down time: %s", got)
+	}
+}
+
+func TestKeyRevocation(t *testing.T) {
+	a, b := testKSK(t, "example.com"), testKSK(t, "example.com")
+	manageTestAnchors(t, "example.com", a.DNSKEY, b.DNSKEY)
+	now := time.Now()
+
+	// Only the key itself can revoke it.
+	keys, sigs := keySet(t, revoked(a), b)
+	refreshTestAnchors(t, "example.com", now, keys, sigs[1:])
+	if got := anchorStates("example.com", a, b); got != "A=valid B=valid" {
+		t.Errorf("revocation not signed by the key: %s", got)
+	}
+	refreshTestAnchors(t, "example.com", now, keys, sigs)
+	if got := anchorStates("example.com", a, b); got != "A=revoked B=valid" {
+		t.Errorf("revocation signed by the key: %s", got)
+	}
+
+	// A revoked key is no longer trusted, even if it signs the set.
+	keys, sigs = keySet(t, a)
+	if _, err := updateManagedKeys("example.com", keys, sigs, now); err == nil {
+		t.Error("DNSKEY set signed by a revoked key accepted")
+	}
+}
+
+func TestMissingKeys(t *testing.T) {
+	a, b, c := testKSK(t, "example.com"), testKSK(t, "example.com"), testKSK(t, "example.com")
+	manageTestAnchors(t, "example.com", a.DNSKEY, b.DNSKEY)
+	now := time.Now()
+	keys, sigs := keySet(t, a, c)
+	refreshTestAnchors(t, "example.com", now, keys, sigs)
+
+	// A trusted key that is no longer published stays trusted; a new key
+	// that disappears during its hold-down time is forgotten.
+	keys, sigs = keySet(t, a)
+	refreshTestAnchors(t, "example.com", now.Add(time.Hour), keys, sigs)
+	if got := anchorStates("example.com", a, b, c); got != "A=valid B=missing C=none" {
+		t.Errorf("after keys disappeared: %s", got)
+	}
+	keys, sigs = keySet(t, b)
+	refreshTestAnchors(t, "example.com", now.Add(2*time.Hour), keys, sigs)
+	if got := anchorStates("example.com", a, b, c); got != "A=missing B=valid C=none" {
+		t.Errorf("after the missing key came back: %s", got)
+	}
+}
+
+func TestUntrustedKeySet(t *testing.T) {
+	a, b := testKSK(t, "example.com"), testKSK(t, "example.com")
+	manageTestAnchors(t, "example.com", a.DNSKEY)
+	now := time.Now()
+
+	// A set without a trusted key, or not signed by one, changes nothing.
+	keys, sigs := keySet(t, b)
+	if _, err := updateManagedKeys("example.com", keys, sigs, now); err == nil {
+		t.Error("DNSKEY set without a trusted key accepted")
+	}
+	keys, _ = keySet(t, a, b)
+	_, sigs = keySet(t, b)
+	if _, err := updateManagedKeys("example.com", keys, sigs, now); err == nil {
+		t.Error("DNSKEY set not signed by a trusted key accepted")
+	}
+	if got := anchorStates("example.com", a, b); got != "A=valid B=none" {
+		t.Errorf("after untrusted DNSKEY sets: %s", got)
+	}
+
+	// A key a DS anchor refers to replaces the DS record right away.
+	ds, err := b.DS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manageTestAnchors(t, "example.com", ds)
+	keys, sigs = keySet(t, b)
+	refreshTestAnchors(t, "example.com", now, keys, sigs)
+	anchors := managedAnchors.zones["example.com"]
+	if len(anchors) != 1 || anchors[0].State != anchorValid || !anchors[0].sameKey(b.DNSKEY) {
+		t.Errorf("DS anchor wasn't replaced by its key: %v", anchors)
+	}
+}
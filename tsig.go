@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Transaction signatures (TSIG, RFC 8945). A message is signed with an
+// HMAC keyed with a secret shared by both ends, and the signature is sent
+// as the last record of the additional section. The MAC of a response
+// covers the MAC of the request, and in a zone transfer every message
+// covers the one before, so messages can't be replayed or reordered.
+
+// tsigFudge is the clock skew in seconds accepted between the two ends.
+const tsigFudge = 300
+
+// TSIG errors are reported in the TSIG record, with NOTAUTH in the header.
+const (
+	BADSIG  uint16 = 16
+	BADKEY  uint16 = 17
+	BADTIME uint16 = 18
+)
+
+var tsigErrorNames = map[uint16]string{
+	0:       "NOERROR",
+	BADSIG:  "BADSIG",
+	BADKEY:  "BADKEY",
+	BADTIME: "BADTIME",
+}
+
+func tsigErrorName(code uint16) string {
+	if name, ok := tsigErrorNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("TSIGERR%d", code)
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+type TSIGKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// tsigKeys holds the configured keys by name.
+var tsigKeys = map[string]*TSIGKey{}
+
+func NewTSIGKey(config TSIGKeyConfig) (*TSIGKey, error) {
+	algorithm := normalizeName(config.Algorithm)
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	if _, ok := tsigAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("Unsupported TSIG algorithm %q", config.Algorithm)
+	}
+	secret, err := base64.StdEncoding.DecodeString(config.Secret)
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("Invalid secret for TSIG key %s", config.Name)
+	}
+	return &TSIGKey{Name: normalizeName(config.Name), Algorithm: algorithm, Secret: secret}, nil
+}
+
+// lookupTSIGKey returns the configured key with the given name; an empty
+// name means no key.
+func lookupTSIGKey(name string) (*TSIGKey, error) {
+	if name == "" {
+		return nil, nil
+	}
+	key, ok := tsigKeys[normalizeName(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown TSIG key %s", name)
+	}
+	return key, nil
+}
+
+func (k *TSIGKey) sum(data []byte) []byte {
+	mac := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// tsigSession signs and verifies the messages of one exchange: a request
+// and its response, or the request and all messages of a zone transfer.
+// Methods on a nil session do nothing, which stands for an unsigned
+// exchange.
+type tsigSession struct {
+	key *TSIGKey
+	// keyName and algorithm come from the request, so that errors can be
+	// reported for keys we don't know.
+	keyName   string
+	algorithm string
+	// mac is the MAC of the previous message, which the next one covers.
+	mac      []byte
+	messages int
+	// Up to 99 messages of a transfer may come without a TSIG; they are
+	// covered by the next signed one.
+	pending  []byte
+	unsigned int
+
+	// err is the TSIG error of the request, answered instead of the query.
+	err        uint16
+	timeSigned uint64
+}
+
+func newTSIGSession(key *TSIGKey) *tsigSession {
+	if key == nil {
+		return nil
+	}
+	return &tsigSession{key: key, keyName: key.Name, algorithm: key.Algorithm}
+}
+
+// KeyName is the name of the key a request was verified with, or "" if it
+// wasn't signed.
+func (s *tsigSession) KeyName() string {
+	if s == nil || s.err != 0 {
+		return ""
+	}
+	return s.key.Name
+}
+
+// authenticate verifies the TSIG of a request. The session is nil for
+// unsigned requests. If verification fails, the response to send instead
+// of answering the request is returned as well.
+func authenticate(msg []byte, request *DnsPacket) (*tsigSession, *DnsPacket) {
+	rec, signed, err := splitTSIG(msg, request)
+	if err != nil {
+		return nil, errorResponse(request, FORMERR)
+	}
+	if rec == nil {
+		return nil, nil
+	}
+
+	session := &tsigSession{keyName: rec.Domain, algorithm: rec.Algorithm, timeSigned: rec.TimeSigned}
+	key, ok := tsigKeys[normalizeName(rec.Domain)]
+	if !ok || key.Algorithm != normalizeName(rec.Algorithm) {
+		session.err = BADKEY
+	} else {
+		session.key = key
+		session.err = session.verify(signed, rec)
+	}
+	if session.err != 0 {
+		fmt.Printf("TSIG verification with key %s failed: %s\n", fqdn(rec.Domain), tsigErrorName(session.err))
+		return session, errorResponse(request, NOTAUTH)
+	}
+	return session, nil
+}
+
+func errorResponse(request *DnsPacket, rcode ResultCode) *DnsPacket {
+	response := NewDnsPacket()
+	response.Header.ID = request.Header.ID
+	response.Header.Response = true
+	response.Header.Opcode = request.Header.Opcode
+	response.Header.ResCode = rcode
+	response.Questions = request.Questions
+	return response
+}
+
+// Sign appends a TSIG record to a message.
+func (s *tsigSession) Sign(packet *DnsPacket) error {
+	if s == nil {
+		return nil
+	}
+
+	rec := &TSIGRecord{
+		Domain:     s.keyName,
+		Algorithm:  s.algorithm,
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      tsigFudge,
+		OriginalID: packet.Header.ID,
+		Error:      s.err,
+	}
+	switch s.err {
+	case BADKEY, BADSIG:
+		// The client couldn't verify a MAC made with this key.
+		packet.Resources = append(packet.Resources, rec)
+		return nil
+	case BADTIME:
+		// Tell the client our time so it can see the skew.
+		rec.OtherData = binary.BigEndian.AppendUint16(nil, uint16(rec.TimeSigned>>32))
+		rec.OtherData = binary.BigEndian.AppendUint32(rec.OtherData, uint32(rec.TimeSigned))
+		rec.TimeSigned = s.timeSigned
+	}
+
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := packet.Write(buffer); err != nil {
+		return err
+	}
+	data, err := s.signingData(buffer.Bytes(), rec)
+	if err != nil {
+		return err
+	}
+	rec.MAC = s.key.sum(data)
+	s.next(rec.MAC)
+
+	packet.Resources = append(packet.Resources, rec)
+	return nil
+}
+
+// Verify checks the TSIG of a message received in the session and removes
+// it from the parsed packet.
+func (s *tsigSession) Verify(msg []byte, packet *DnsPacket) error {
+	if s == nil {
+		return nil
+	}
+
+	rec, signed, err := splitTSIG(msg, packet)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		if s.messages < 2 || s.unsigned >= 99 {
+			return errors.New("Message is not signed")
+		}
+		s.pending = append(s.pending, msg...)
+		s.unsigned++
+		return nil
+	}
+
+	if rec.Error != 0 {
+		return fmt.Errorf("TSIG error %s", tsigErrorName(rec.Error))
+	}
+	if normalizeName(rec.Domain) != s.key.Name || normalizeName(rec.Algorithm) != s.key.Algorithm {
+		return fmt.Errorf("Message is signed with the wrong key %s", fqdn(rec.Domain))
+	}
+	if code := s.verify(signed, rec); code != 0 {
+		return fmt.Errorf("TSIG error %s", tsigErrorName(code))
+	}
+	return nil
+}
+
+// Finish reports an error if the last message of a transfer wasn't signed.
+func (s *tsigSession) Finish() error {
+	if s != nil && s.unsigned > 0 {
+		return errors.New("Last message is not signed")
+	}
+	return nil
+}
+
+// verify checks the MAC and then the time of a message.
+func (s *tsigSession) verify(signed []byte, rec *TSIGRecord) uint16 {
+	data, err := s.signingData(signed, rec)
+	if err != nil {
+		return BADSIG
+	}
+	expected := s.key.sum(data)
+	// Truncated MACs are allowed down to half the hash, but not below
+	// 10 bytes (RFC 8945 section 5.2.2.1).
+	if len(rec.MAC) > len(expected) || len(rec.MAC) < max(10, len(expected)/2) ||
+		!hmac.Equal(expected[:len(rec.MAC)], rec.MAC) {
+		return BADSIG
+	}
+	s.next(rec.MAC)
+
+	now := time.Now().Unix()
+	if now-int64(rec.TimeSigned) > int64(rec.Fudge) || int64(rec.TimeSigned)-now > int64(rec.Fudge) {
+		return BADTIME
+	}
+	return 0
+}
+
+func (s *tsigSession) next(mac []byte) {
+	s.mac = mac
+	s.messages++
+	s.pending = nil
+	s.unsigned = 0
+}
+
+// signingData is the input to the MAC: the previous MAC, if any, the
+// message, and the TSIG variables. Messages after the first response of a
+// transfer only include the timers (RFC 8945 section 5.3.1).
+func (s *tsigSession) signingData(message []byte, rec *TSIGRecord) ([]byte, error) {
+	data := []byte{}
+	if s.mac != nil {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(s.mac)))
+		data = append(data, s.mac...)
+	}
+	data = append(data, s.pending...)
+	data = append(data, message...)
+
+	if s.messages < 2 {
+		name, err := canonicalName(rec.Domain)
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := canonicalName(rec.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, name...)
+		data = binary.BigEndian.AppendUint16(data, ClassANY)
+		data = binary.BigEndian.AppendUint32(data, 0)
+		data = append(data, algorithm...)
+	}
+	data = binary.BigEndian.AppendUint16(data, uint16(rec.TimeSigned>>32))
+	data = binary.BigEndian.AppendUint32(data, uint32(rec.TimeSigned))
+	data = binary.BigEndian.AppendUint16(data, rec.Fudge)
+	if s.messages < 2 {
+		data = binary.BigEndian.AppendUint16(data, rec.Error)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rec.OtherData)))
+		data = append(data, rec.OtherData...)
+	}
+	return data, nil
+}
+
+// canonicalName returns a name in uncompressed, lowercase wire format.
+func canonicalName(name string) ([]byte, error) {
+	name = strings.ToLower(name)
+	buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+	if err := buffer.WriteQName(&name); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// splitTSIG removes the TSIG record from a parsed message and returns it
+// with the message as it was before signing: without the record, and with
+// the original ID. A TSIG record anywhere but at the end of the additional
+// section makes the message malformed (RFC 8945 section 5.1).
+func splitTSIG(msg []byte, packet *DnsPacket) (*TSIGRecord, []byte, error) {
+	last := len(packet.Resources) - 1
+	for _, section := range [][]DnsRecord{packet.Answers, packet.Authorities, packet.Resources[:max(last, 0)]} {
+		for _, rec := range section {
+			if _, ok := rec.(*TSIGRecord); ok {
+				return nil, nil, errors.New("TSIG record is not the last record of the message")
+			}
+		}
+	}
+	if last < 0 {
+		return nil, msg, nil
+	}
+	rec, ok := packet.Resources[last].(*TSIGRecord)
+	if !ok {
+		return nil, msg, nil
+	}
+
+	offset, err := lastRecordOffset(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := append([]byte(nil), msg[:offset]...)
+	binary.BigEndian.PutUint16(signed[0:], rec.OriginalID)
+	binary.BigEndian.PutUint16(signed[10:], uint16(last))
+
+	packet.Resources = packet.Resources[:last]
+	return rec, signed, nil
+}
+
+// lastRecordOffset finds where the last record of a message starts.
+func lastRecordOffset(msg []byte) (int, error) {
+	buffer := NewBytePacketBufferFromBytes(msg)
+	header := NewDnsHeader()
+	if err := header.Read(buffer); err != nil {
+		return 0, err
+	}
+	for i := 0; i < int(header.Questions); i++ {
+		if err := (&DnsQuestion{}).Read(buffer); err != nil {
+			return 0, err
+		}
+	}
+
+	count := int(header.Answers) + int(header.AuthoritativeEntries) + int(header.ResourceEntries)
+	offset := 0
+	for i := 0; i < count; i++ {
+		offset = int(buffer.Pos())
+		if _, err := ReadDnsRecord(buffer); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// Overhead is the room to leave in a message for the TSIG record.
+func (s *tsigSession) Overhead() int {
+	if s == nil {
+		return 0
+	}
+	// Owner and algorithm names, fixed fields, the MAC and the other
+	// data of a BADTIME response.
+	return len(s.keyName) + 2 + len(s.algorithm) + 2 + 10 + 16 + sha512.Size + 6
+}
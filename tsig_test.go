@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTSIGKey configures a key for the duration of a test.
+func testTSIGKey(t *testing.T, name string, secret string) *TSIGKey {
+	t.Helper()
+	key, err := NewTSIGKey(TSIGKeyConfig{Name: name, Secret: base64.StdEncoding.EncodeToString([]byte(secret))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsigKeys[key.Name] = key
+	t.Cleanup(func() { delete(tsigKeys, key.Name) })
+	return key
+}
+
+func tsigQuery() *DnsPacket {
+	query := NewDnsPacket()
+	query.Header.ID = 1234
+	query.Questions = append(query.Questions, NewDnsQuestion("www.example.com", QueryTypeFromNum(A)))
+	return query
+}
+
+// parseMessage reads a message back as the receiving end would.
+func parseMessage(t *testing.T, msg []byte) *DnsPacket {
+	t.Helper()
+	packet, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// signAt signs a message as if the clock showed at.
+func signAt(t *testing.T, key *TSIGKey, packet *DnsPacket, at time.Time) {
+	t.Helper()
+	session := newTSIGSession(key)
+	rec := &TSIGRecord{Domain: key.Name, Algorithm: key.Algorithm, TimeSigned: uint64(at.Unix()), Fudge: tsigFudge, OriginalID: packet.Header.ID}
+	data, err := session.signingData(wireFormat(t, packet), rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.MAC = key.sum(data)
+	packet.Resources = append(packet.Resources, rec)
+}
+
+func TestTSIGSignAndVerify(t *testing.T) {
+	key := testTSIGKey(t, "transfer-key", "a shared secret")
+
+	client := newTSIGSession(key)
+	query := tsigQuery()
+	if err := client.Sign(query); err != nil {
+		t.Fatal(err)
+	}
+	msg := wireFormat(t, query)
+	request := parseMessage(t, msg)
+	server, failure := authenticate(msg, request)
+	if failure != nil || server.KeyName() != "transfer-key" {
+		t.Fatalf("signed request rejected: %v", failure)
+	}
+	if len(request.Resources) != 0 {
+		t.Errorf("TSIG record left in the request: %v", request.Resources)
+	}
+
+	// The response is signed over the request's MAC, and only verifies in
+	// the session that sent the request.
+	response := errorResponse(request, NOERROR)
+	if err := server.Sign(response); err != nil {
+		t.Fatal(err)
+	}
+	msg = wireFormat(t, response)
+	if err := newTSIGSession(key).Verify(msg, parseMessage(t, msg)); err == nil {
+		t.Error("response verified without the request MAC")
+	}
+	if err := client.Verify(msg, parseMessage(t, msg)); err != nil {
+		t.Errorf("response didn't verify: %v", err)
+	}
+
+	// A request forwarded with a new ID still verifies.
+	query = tsigQuery()
+	newTSIGSession(key).Sign(query)
+	query.Header.ID = 4321
+	msg = wireFormat(t, query)
+	if _, failure := authenticate(msg, parseMessage(t, msg)); failure != nil {
+		t.Errorf("request with a new ID rejected: %v", failure)
+	}
+}
+
+func TestTSIGFailures(t *testing.T) {
+	key := testTSIGKey(t, "transfer-key", "a shared secret")
+	other := &TSIGKey{Name: "transfer-key", Algorithm: "hmac-sha256", Secret: []byte("another secret")}
+	unknown := &TSIGKey{Name: "unknown-key", Algorithm: "hmac-sha256", Secret: []byte("a shared secret")}
+
+	cases := []struct {
+		name string
+		sign func(*DnsPacket)
+		code uint16
+	}{
+		{"wrong secret", func(p *DnsPacket) { newTSIGSession(other).Sign(p) }, BADSIG},
+		{"unknown key", func(p *DnsPacket) { newTSIGSession(unknown).Sign(p) }, BADKEY},
+		{"changed after signing", func(p *DnsPacket) {
+			newTSIGSession(key).Sign(p)
+			p.Questions[0].Name = "mail.example.com"
+		}, BADSIG},
+		{"truncated MAC", func(p *DnsPacket) {
+			newTSIGSession(key).Sign(p)
+			tsig := p.Resources[0].(*TSIGRecord)
+			tsig.MAC = tsig.MAC[:8]
+		}, BADSIG},
+		{"signed too long ago", func(p *DnsPacket) { signAt(t, key, p, time.Now().Add(-2*tsigFudge*time.Second)) }, BADTIME},
+		{"signed in the future", func(p *DnsPacket) { signAt(t, key, p, time.Now().Add(2*tsigFudge*time.Second)) }, BADTIME},
+		{"signed within the fudge", func(p *DnsPacket) { signAt(t, key, p, time.Now().Add(-tsigFudge/2*time.Second)) }, 0},
+	}
+	for _, c := range cases {
+		query := tsigQuery()
+		c.sign(query)
+		msg := wireFormat(t, query)
+		session, response := authenticate(msg, parseMessage(t, msg))
+		if c.code == 0 {
+			if response != nil {
+				t.Errorf("%s: rejected with %v", c.name, response.Header.ResCode)
+			}
+			continue
+		}
+		if response == nil || response.Header.ResCode != NOTAUTH || session.err != c.code || session.KeyName() != "" {
+			t.Errorf("%s: response %v, TSIG error %s", c.name, response, tsigErrorName(session.err))
+			continue
+		}
+
+		// The error goes back to the client in the TSIG record.
+		if err := session.Sign(response); err != nil {
+			t.Fatal(err)
+		}
+		msg = wireFormat(t, response)
+		err := newTSIGSession(key).Verify(msg, parseMessage(t, msg))
+		if err == nil || !strings.Contains(err.Error(), tsigErrorName(c.code)) {
+			t.Errorf("%s: client saw %v", c.name, err)
+		}
+	}
+}
+
+func TestTSIGNotLast(t *testing.T) {
+	key := testTSIGKey(t, "transfer-key", "a shared secret")
+
+	// A record after the TSIG.
+	query := tsigQuery()
+	newTSIGSession(key).Sign(query)
+	query.Resources = append(query.Resources, testRecords(t, "www.example.com. 300 IN A 192.0.2.1")...)
+	msg := wireFormat(t, query)
+	if _, response := authenticate(msg, parseMessage(t, msg)); response == nil || response.Header.ResCode != FORMERR {
+		t.Errorf("TSIG before another additional record: %v", response)
+	}
+
+	// A TSIG in another section, followed by a valid one.
+	query = tsigQuery()
+	signAt(t, key, query, time.Now())
+	query.Answers, query.Resources = query.Resources, nil
+	newTSIGSession(key).Sign(query)
+	msg = wireFormat(t, query)
+	if _, response := authenticate(msg, parseMessage(t, msg)); response == nil || response.Header.ResCode != FORMERR {
+		t.Errorf("TSIG in the answer section: %v", response)
+	}
+	if err := newTSIGSession(key).Verify(msg, parseMessage(t, msg)); err == nil {
+		t.Error("client accepted a TSIG in the answer section")
+	}
+}
+
+func TestSignedTransfer(t *testing.T) {
+	key := testTSIGKey(t, "transfer-key", "a shared secret")
+	zone := transferTestZone(t, "signed-axfr.test", 1000)
+	zone.AllowTransfer, _ = ParseACL([]string{"key transfer-key"})
+	primary := serveTestTCP(t)
+
+	// Every message of the transfer is signed and verified in turn.
+	records, err := TransferZone("signed-axfr.test", primary, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(zone.Records()) {
+		t.Errorf("transferred %d records, want %d", len(records), len(zone.Records()))
+	}
+
+	// The ACL asks for the key; local clients without it are refused.
+	if _, err := TransferZone("signed-axfr.test", primary, nil); err == nil {
+		t.Error("unsigned transfer accepted")
+	}
+	other := &TSIGKey{Name: "transfer-key", Algorithm: "hmac-sha256", Secret: []byte("another secret")}
+	if _, err := TransferZone("signed-axfr.test", primary, other); err == nil {
+		t.Error("transfer signed with the wrong secret accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// Dynamic updates (RFC 2136). An UPDATE message reuses the sections of a
+// DnsPacket: Questions holds the zone, Answers the prerequisites and
+// Authorities the changes. Deletions and most prerequisites are encoded
+// with the classes ANY and NONE, so they arrive as UnknownRecords.
+
+// handleUpdate checks that the client may update the zone and applies the
+// changes. key is the TSIG key the request was signed with, if any.
+func handleUpdate(request *DnsPacket, remote net.Addr, key string) *DnsPacket {
+	response := NewDnsPacket()
+	response.Header.ID = request.Header.ID
+	response.Header.Response = true
+	response.Header.Opcode = UPDATE
+
+	// The zone section is checked before the other sections are looked
+	// at (RFC 2136 section 3.1). All zones are of class IN.
+	if len(request.Questions) != 1 || request.Questions[0].QType.ToNum() != SOA {
+		response.Header.ResCode = FORMERR
+		return response
+	}
+	question := request.Questions[0]
+	response.Questions = append(response.Questions, question)
+
+	zone := authZones.Get(question.Name)
+	if zone == nil || question.Class() != ClassIN {
+		response.Header.ResCode = NOTAUTH
+		return response
+	}
+	if zone.config.Primary != "" || !zone.AllowUpdate.Allows(remote, key) {
+		fmt.Printf("Refusing update of %s from %s\n", fqdn(zone.Origin), remote)
+		response.Header.ResCode = REFUSED
+		return response
+	}
+
+	response.Header.ResCode = zone.Update(request.Answers, request.Authorities)
+	fmt.Printf("Update of %s from %s: %s\n", fqdn(zone.Origin), remote, response.Header.ResCode)
+	return response
+}
+
+// Update checks the prerequisites and applies the changes as a whole. A
+// change that doesn't set a newer SOA increments the serial, and the
+// master file is rewritten before the new version is served. Signed zones
+// are signed again, but their master file is kept free of signatures.
+func (z *Zone) Update(prerequisites []DnsRecord, updates []DnsRecord) ResultCode {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if rcode := z.checkPrerequisites(prerequisites); rcode != NOERROR {
+		return rcode
+	}
+	if rcode := z.prescanUpdates(updates); rcode != NOERROR {
+		return rcode
+	}
+
+	byName := make(map[string][]DnsRecord, len(z.records))
+	for name, records := range z.records {
+		byName[name] = records
+	}
+	changed := false
+	for _, rec := range updates {
+		if applyUpdate(z.Origin, byName, rec) {
+			changed = true
+		}
+	}
+	if !changed {
+		return NOERROR
+	}
+
+	oldSOA := z.soa()
+	newSOA := filterRecords(byName[z.Origin], SOA)[0].(*SOARecord)
+	if !serialLess(oldSOA.Serial, newSOA.Serial) {
+		bumped := *newSOA
+		bumped.Serial = oldSOA.Serial + 1
+		replaceRecords(byName, z.Origin, SOA, []DnsRecord{&bumped})
+	}
+
+	records := listRecords(z.Origin, byName)
+	saved := records
+	if z.signer != nil {
+		saved = z.signer.unsigned(records)
+		signed, err := z.signer.Sign(records, z.allRecords())
+		if err != nil {
+			fmt.Printf("Signing %s after an update failed: %v\n", fqdn(z.Origin), err)
+			return SERVFAIL
+		}
+		records = signed
+	}
+	byName, nodes, err := indexRecords(z.Origin, records)
+	if err != nil {
+		fmt.Printf("Update of %s failed: %v\n", fqdn(z.Origin), err)
+		return SERVFAIL
+	}
+	if z.config.File != "" {
+		if err := WriteZoneFile(z.config.File, z.Origin, saved); err != nil {
+			fmt.Printf("Failed to save zone %s: %v\n", fqdn(z.Origin), err)
+			return SERVFAIL
+		}
+	}
+	z.replace(records, byName, nodes)
+	return NOERROR
+}
+
+// checkPrerequisites evaluates the prerequisite section (RFC 2136 section
+// 3.2) against the current zone.
+func (z *Zone) checkPrerequisites(prerequisites []DnsRecord) ResultCode {
+	// Prerequisites of class IN require RRsets to match exactly.
+	rrsets := map[string][]DnsRecord{}
+
+	for _, rec := range prerequisites {
+		domain, qtype, ttl, data, err := splitRecord(rec)
+		if err != nil || ttl != 0 {
+			return FORMERR
+		}
+		name := normalizeName(domain)
+		if !isSubdomain(name, z.Origin) {
+			return NOTZONE
+		}
+		existing := z.records[name]
+
+		switch recordClass(rec) {
+		case ClassANY:
+			if len(data) != 0 {
+				return FORMERR
+			}
+			if qtype == ANY && len(existing) == 0 {
+				return NXDOMAIN
+			}
+			if qtype != ANY && len(filterRecords(existing, qtype)) == 0 {
+				return NXRRSET
+			}
+		case ClassNONE:
+			if len(data) != 0 {
+				return FORMERR
+			}
+			if qtype == ANY && len(existing) > 0 {
+				return YXDOMAIN
+			}
+			if qtype != ANY && len(filterRecords(existing, qtype)) > 0 {
+				return YXRRSET
+			}
+		case ClassIN:
+			if qtype == ANY {
+				return FORMERR
+			}
+			key := fmt.Sprintf("%s/%d", name, qtype)
+			rrsets[key] = append(rrsets[key], rec)
+		default:
+			return FORMERR
+		}
+	}
+
+	for _, rrset := range rrsets {
+		name := normalizeName(recordDomain(rrset[0]))
+		if !sameRecords(filterRecords(z.records[name], recordType(rrset[0])), rrset) {
+			return NXRRSET
+		}
+	}
+	return NOERROR
+}
+
+// prescanUpdates rejects malformed changes before any is applied (RFC 2136
+// section 3.4.1).
+func (z *Zone) prescanUpdates(updates []DnsRecord) ResultCode {
+	for _, rec := range updates {
+		domain, qtype, ttl, data, err := splitRecord(rec)
+		if err != nil {
+			return FORMERR
+		}
+		if !isSubdomain(domain, z.Origin) {
+			return NOTZONE
+		}
+		if z.signer != nil && isSignerType(qtype) {
+			// The signer maintains these (RFC 3007 section 4.3).
+			return REFUSED
+		}
+
+		switch recordClass(rec) {
+		case ClassIN:
+			if isMetaType(qtype) {
+				return FORMERR
+			}
+		case ClassANY:
+			if ttl != 0 || len(data) != 0 || (isMetaType(qtype) && qtype != ANY) {
+				return FORMERR
+			}
+		case ClassNONE:
+			if ttl != 0 || isMetaType(qtype) {
+				return FORMERR
+			}
+		default:
+			return FORMERR
+		}
+	}
+	return NOERROR
+}
+
+// isMetaType reports whether qtype only makes sense in questions, like
+// AXFR or ANY.
+func isMetaType(qtype uint16) bool {
+	return qtype >= 128 && qtype <= 255
+}
+
+func sameRecords(a []DnsRecord, b []DnsRecord) bool {
+	keys := map[string]bool{}
+	for _, rec := range a {
+		keys[updateKey(rec)] = true
+	}
+	other := map[string]bool{}
+	for _, rec := range b {
+		if !keys[updateKey(rec)] {
+			return false
+		}
+		other[updateKey(rec)] = true
+	}
+	return len(keys) == len(other)
+}
+
+// updateKey identifies a record for the comparisons of dynamic updates,
+// which ignore the case of domain names, also those in the RDATA (RFC
+// 2136 section 1.1.1). The RDATA of deletions, which have class NONE, is
+// read by type first.
+func updateKey(rec DnsRecord) string {
+	if raw, ok := rec.(*UnknownRecord); ok && recordClass(raw) != ClassIN && len(raw.Data) > 0 {
+		in := *raw
+		in.Class = ClassIN
+		buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+		if _, err := in.Write(buffer); err == nil {
+			buffer.Seek(0)
+			if typed, err := ReadDnsRecord(buffer); err == nil {
+				rec = typed
+			}
+		}
+	}
+	data, err := canonicalRdata(rec)
+	if err != nil {
+		return rec.String()
+	}
+	return fmt.Sprintf("%s/%d/%s", normalizeName(recordDomain(rec)), recordType(rec), hex.EncodeToString(data))
+}
+
+// applyUpdate carries out a single change (RFC 2136 section 3.4.2) on
+// records indexed by owner name and reports whether anything changed.
+func applyUpdate(origin string, byName map[string][]DnsRecord, rec DnsRecord) bool {
+	name := normalizeName(recordDomain(rec))
+	qtype := recordType(rec)
+	existing := byName[name]
+
+	switch recordClass(rec) {
+	case ClassIN:
+		if qtype == SOA {
+			soa, ok := rec.(*SOARecord)
+			current := filterRecords(existing, SOA)
+			if !ok || len(current) == 0 || !serialLess(current[0].(*SOARecord).Serial, soa.Serial) {
+				return false
+			}
+			replaceRecords(byName, name, SOA, []DnsRecord{rec})
+			return true
+		}
+
+		// A CNAME can't coexist with other data, but DNSSEC records
+		// don't count (RFC 4035 section 2.5).
+		cnames, others := 0, 0
+		for _, old := range existing {
+			switch oldType := recordType(old); {
+			case oldType == CNAME:
+				cnames++
+			case !isSignerType(oldType):
+				others++
+			}
+		}
+		if qtype == CNAME && others > 0 || qtype != CNAME && !isSignerType(qtype) && cnames > 0 {
+			return false
+		}
+		if qtype == CNAME {
+			replaceRecords(byName, name, CNAME, []DnsRecord{rec})
+			return true
+		}
+
+		key := updateKey(rec)
+		for i, old := range existing {
+			if updateKey(old) != key {
+				continue
+			}
+			if recordTTL(old) == recordTTL(rec) {
+				return false
+			}
+			updated := append([]DnsRecord(nil), existing...)
+			updated[i] = rec
+			byName[name] = updated
+			return true
+		}
+		byName[name] = append(append([]DnsRecord(nil), existing...), rec)
+		return true
+
+	case ClassANY:
+		return removeRecords(byName, name, func(old DnsRecord) bool {
+			oldType := recordType(old)
+			if name == origin && (oldType == SOA || oldType == NS) {
+				return false
+			}
+			return qtype == ANY || oldType == qtype
+		})
+
+	case ClassNONE:
+		if qtype == SOA {
+			return false
+		}
+		if name == origin && qtype == NS && len(filterRecords(existing, NS)) == 1 {
+			// The apex keeps at least one name server.
+			return false
+		}
+		key := updateKey(rec)
+		return removeRecords(byName, name, func(old DnsRecord) bool {
+			return updateKey(old) == key
+		})
+	}
+	return false
+}
+
+// replaceRecords swaps the RRset of the given type at name.
+func replaceRecords(byName map[string][]DnsRecord, name string, qtype uint16, records []DnsRecord) {
+	updated := []DnsRecord{}
+	for _, rec := range byName[name] {
+		if recordType(rec) != qtype {
+			updated = append(updated, rec)
+		}
+	}
+	byName[name] = append(updated, records...)
+}
+
+// removeRecords deletes the records at name that match and reports whether
+// there were any.
+func removeRecords(byName map[string][]DnsRecord, name string, match func(DnsRecord) bool) bool {
+	kept := []DnsRecord{}
+	for _, rec := range byName[name] {
+		if !match(rec) {
+			kept = append(kept, rec)
+		}
+	}
+	if len(kept) == len(byName[name]) {
+		return false
+	}
+	if len(kept) == 0 {
+		delete(byName, name)
+	} else {
+		byName[name] = kept
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdatePrerequisites(t *testing.T) {
+	cases := []struct {
+		prerequisite string
+		rcode        ResultCode
+	}{
+		// RRset exists (value independent).
+		{"www.example.com. 0 ANY A \\# 0", NOERROR},
+		{"www.example.com. 0 ANY AAAA \\# 0", NXRRSET},
+		// RRset does not exist.
+		{"www.example.com. 0 NONE AAAA \\# 0", NOERROR},
+		{"www.example.com. 0 NONE A \\# 0", YXRRSET},
+		// Name is in use.
+		{"www.example.com. 0 ANY ANY \\# 0", NOERROR},
+		{"b.example.com. 0 ANY ANY \\# 0", NXDOMAIN},
+		{"missing.example.com. 0 ANY ANY \\# 0", NXDOMAIN},
+		// Name is not in use.
+		{"missing.example.com. 0 NONE ANY \\# 0", NOERROR},
+		{"www.example.com. 0 NONE ANY \\# 0", YXDOMAIN},
+		// RRset exists (value dependent), names compared without case.
+		{"example.com. 0 IN MX 10 MAIL.example.com.", NOERROR},
+		{"www.example.com. 0 IN A 192.0.2.9", NXRRSET},
+		// Malformed or outside the zone.
+		{"www.example.com. 300 ANY A \\# 0", FORMERR},
+		{"www.example.com. 0 ANY A \\# 1 00", FORMERR},
+		{"www.example.com. 0 IN ANY \\# 0", FORMERR},
+		{"www.example.com. 0 CH A \\# 0", FORMERR},
+		{"www.example.net. 0 ANY A \\# 0", NOTZONE},
+	}
+	for _, c := range cases {
+		zone := exampleZone(t)
+		if rcode := zone.Update(testRecords(t, c.prerequisite), nil); rcode != c.rcode {
+			t.Errorf("prerequisite %q: %v, want %v", c.prerequisite, rcode, c.rcode)
+		}
+	}
+
+	// Several records of class IN must match the whole RRset.
+	zone := testZone(t, "example.com",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2",
+	)
+	if rcode := zone.Update(testRecords(t, "www.example.com. 0 IN A 192.0.2.1"), nil); rcode != NXRRSET {
+		t.Errorf("part of an RRset matched: %v", rcode)
+	}
+	if rcode := zone.Update(testRecords(t, "www.example.com. 0 IN A 192.0.2.2", "www.example.com. 0 IN A 192.0.2.1"), nil); rcode != NOERROR {
+		t.Errorf("whole RRset didn't match: %v", rcode)
+	}
+}
+
+func TestUpdateChanges(t *testing.T) {
+	cases := []struct {
+		name    string
+		updates []string
+		qname   string
+		qtype   uint16
+		answers string
+	}{
+		{"add", []string{"new.example.com. 300 IN A 192.0.2.9"}, "new.example.com", A, "new.example.com. 300 IN A 192.0.2.9"},
+		{"add a duplicate with a new TTL", []string{"www.example.com. 60 IN A 192.0.2.2"}, "www.example.com", A, "www.example.com. 60 IN A 192.0.2.2"},
+		{"delete an RRset", []string{"example.com. 0 ANY MX \\# 0"}, "example.com", MX, ""},
+		{"delete a record", []string{"www.example.com. 0 NONE A 192.0.2.2"}, "www.example.com", A, ""},
+		{"delete a name", []string{"a.b.example.com. 0 ANY ANY \\# 0"}, "a.b.example.com", A, ""},
+		// The apex keeps its SOA and at least one NS.
+		{"delete the apex", []string{"example.com. 0 ANY ANY \\# 0"}, "example.com", NS, "example.com. 3600 IN NS ns1.example.com."},
+		{"delete the last NS", []string{"example.com. 0 NONE NS ns1.example.com."}, "example.com", NS, "example.com. 3600 IN NS ns1.example.com."},
+		// CNAMEs replace each other but don't mix with other data.
+		{"replace a CNAME", []string{"alias.example.com. 300 IN CNAME mail.example.com."}, "alias.example.com", CNAME, "alias.example.com. 300 IN CNAME mail.example.com."},
+		{"add a CNAME to data", []string{"www.example.com. 300 IN CNAME mail.example.com."}, "www.example.com", CNAME, ""},
+		{"add data to a CNAME", []string{"alias.example.com. 300 IN TXT \"x\""}, "alias.example.com", CNAME, "alias.example.com. 300 IN CNAME www.example.com."},
+	}
+	for _, c := range cases {
+		zone := exampleZone(t)
+		if rcode := zone.Update(nil, testRecords(t, c.updates...)); rcode != NOERROR {
+			t.Errorf("%s: %v", c.name, rcode)
+			continue
+		}
+		if got := strings.Join(recordStrings(answer(zone, c.qname, c.qtype).Answers), " | "); got != c.answers {
+			t.Errorf("%s: %s %v answers %q, want %q", c.name, c.qname, QueryTypeFromNum(c.qtype), got, c.answers)
+		}
+	}
+
+	// A change bumps the serial; no change keeps it.
+	zone := exampleZone(t)
+	zone.Update(nil, testRecords(t, "new.example.com. 300 IN A 192.0.2.9"))
+	if zone.SOA().Serial != 2 {
+		t.Errorf("serial after an update: %d", zone.SOA().Serial)
+	}
+	zone.Update(nil, testRecords(t, "missing.example.com. 0 ANY ANY \\# 0"))
+	if zone.SOA().Serial != 2 {
+		t.Errorf("serial after an update that changed nothing: %d", zone.SOA().Serial)
+	}
+}
+
+func TestUpdateIsAtomic(t *testing.T) {
+	cases := map[string][]string{
+		"outside the zone": {"new.example.com. 300 IN A 192.0.2.9", "www.example.net. 300 IN A 192.0.2.1"},
+		"meta type":        {"new.example.com. 300 IN A 192.0.2.9", "www.example.com. 300 IN TYPE255 \\# 0"},
+		"TTL on a delete":  {"new.example.com. 300 IN A 192.0.2.9", "www.example.com. 300 ANY A \\# 0"},
+	}
+	for name, updates := range cases {
+		zone := exampleZone(t)
+		before := strings.Join(recordStrings(zone.Records()), "\n")
+		if rcode := zone.Update(nil, testRecords(t, updates...)); rcode == NOERROR {
+			t.Errorf("%s: update accepted", name)
+		}
+		if after := strings.Join(recordStrings(zone.Records()), "\n"); after != before {
+			t.Errorf("%s: failed update changed the zone:\n%s", name, after)
+		}
+	}
+
+	// A failed prerequisite stops the whole update.
+	zone := exampleZone(t)
+	rcode := zone.Update(testRecords(t, "www.example.com. 0 NONE A \\# 0"), testRecords(t, "new.example.com. 300 IN A 192.0.2.9"))
+	if rcode != YXRRSET || len(answer(zone, "new.example.com", A).Answers) != 0 {
+		t.Errorf("update applied despite its prerequisite: %v", rcode)
+	}
+}
+
+func TestUpdateSavesZoneFile(t *testing.T) {
+	zone := exampleZone(t)
+	zone.config.File = filepath.Join(t.TempDir(), "example.com.zone")
+	if rcode := zone.Update(nil, testRecords(t, "new.example.com. 300 IN A 192.0.2.9")); rcode != NOERROR {
+		t.Fatal(rcode)
+	}
+	records, err := ParseZoneFile(zone.config.File, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedStrings(records), sortedStrings(zone.Records()); got != want {
+		t.Errorf("saved zone:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUpdateSignedZone(t *testing.T) {
+	zone := loadTestZone(t, "example.com", testKeyFile(t, AlgED25519), nil, testRecords(t,
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 3600 IN A 192.0.2.1",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"alias.example.com. 300 IN CNAME www.example.com.",
+	))
+
+	// The RRSIG and NSEC records at alias don't stop the CNAME from
+	// being replaced.
+	if rcode := zone.Update(nil, testRecords(t, "alias.example.com. 300 IN CNAME ns1.example.com.")); rcode != NOERROR {
+		t.Fatal(rcode)
+	}
+	response := answer(zone, "alias.example.com", CNAME)
+	cnames := filterRecords(response.Answers, CNAME)
+	if len(cnames) != 1 || cnames[0].(*CNAMERecord).Host != "ns1.example.com" || len(filterRecords(response.Answers, RRSIG)) != 1 {
+		t.Errorf("CNAME after the update:\n%s", sections(response))
+	}
+	if rcode := zone.Update(nil, testRecords(t, "alias.example.com. 300 IN TXT \"x\"")); rcode != NOERROR ||
+		len(filterRecords(answer(zone, "alias.example.com", TXT).Answers, TXT)) != 0 {
+		t.Errorf("data added next to a CNAME: %v", rcode)
+	}
+
+	// The signer's records can't be changed by updates.
+	if rcode := zone.Update(nil, testRecords(t, "www.example.com. 0 ANY RRSIG \\# 0")); rcode != REFUSED {
+		t.Errorf("deleting RRSIGs: %v", rcode)
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	zone := addTestZone(t, "update.test",
+		"update.test. 3600 IN SOA ns.update.test. admin.update.test. 1 3600 600 86400 300",
+		"update.test. 3600 IN NS ns.update.test.",
+	)
+	zone.AllowUpdate, _ = ParseACL([]string{"127.0.0.1"})
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+
+	update := func(questions ...*DnsQuestion) *DnsPacket {
+		request := NewDnsPacket()
+		request.Header.ID = 7
+		request.Header.Opcode = UPDATE
+		request.Questions = questions
+		request.Authorities = testRecords(t, "new.update.test. 300 IN A 192.0.2.9")
+		return request
+	}
+	soa := NewDnsQuestion("update.test", QueryTypeFromNum(SOA))
+	chaos := NewDnsQuestion("update.test", QueryTypeFromNum(SOA))
+	chaos.QClass = ClassCH
+
+	cases := []struct {
+		name    string
+		request *DnsPacket
+		remote  net.Addr
+		rcode   ResultCode
+	}{
+		{"without a zone", update(), local, FORMERR},
+		{"with two zones", update(soa, soa), local, FORMERR},
+		{"with a zone type other than SOA", update(NewDnsQuestion("update.test", QueryTypeFromNum(A))), local, FORMERR},
+		{"in class CH", update(chaos), local, NOTAUTH},
+		{"of an unknown zone", update(NewDnsQuestion("other.test", QueryTypeFromNum(SOA))), local, NOTAUTH},
+		{"from outside the ACL", update(soa), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 53}, REFUSED},
+	}
+	for _, c := range cases {
+		response := handleUpdate(c.request, c.remote, "")
+		if response.Header.ResCode != c.rcode || response.Header.Opcode != UPDATE || response.Header.ID != 7 {
+			t.Errorf("update %s: %v", c.name, response)
+		}
+		if len(answer(zone, "new.update.test", A).Answers) != 0 {
+			t.Fatalf("update %s was applied", c.name)
+		}
+	}
+
+	if response := handleUpdate(update(soa), local, ""); response.Header.ResCode != NOERROR {
+		t.Errorf("update: %v", response)
+	}
+	if len(answer(zone, "new.update.test", A).Answers) != 1 {
+		t.Error("update wasn't applied")
+	}
+}
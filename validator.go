@@ -0,0 +1,483 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DNSSEC validation (RFC 4035 section 5). A chain of trust is built from
+// a trust anchor down to the zone an answer came from: each zone's DNSKEY
+// set has to be signed by a key that a DS record in the parent, or the
+// trust anchor itself, vouches for. A delegation the parent proves to
+// have no DS records starts an insecure subtree.
+
+type SecurityStatus int
+
+const (
+	Insecure SecurityStatus = iota
+	Secure
+	Bogus
+)
+
+func (s SecurityStatus) String() string {
+	switch s {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// The root zone's key signing keys, KSK-2017 and KSK-2024.
+var defaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// trustAnchors holds DS or DNSKEY records by zone. Validation is off when
+// it is empty.
+var trustAnchors = struct {
+	sync.RWMutex
+	zones map[string][]DnsRecord
+}{zones: map[string][]DnsRecord{}}
+
+func validating() bool {
+	trustAnchors.RLock()
+	defer trustAnchors.RUnlock()
+	return len(trustAnchors.zones) > 0
+}
+
+func anchorsFor(zone string) ([]DnsRecord, bool) {
+	trustAnchors.RLock()
+	defer trustAnchors.RUnlock()
+	anchors, ok := trustAnchors.zones[zone]
+	return anchors, ok
+}
+
+func setTrustAnchors(lines []string) error {
+	anchors := map[string][]DnsRecord{}
+	for _, line := range lines {
+		rec, err := ParseDnsRecord(line)
+		if err != nil {
+			return fmt.Errorf("Invalid trust anchor %q: %v", line, err)
+		}
+		switch rec.(type) {
+		case *DSRecord, *DNSKEYRecord:
+		default:
+			return fmt.Errorf("Trust anchor %q is neither DS nor DNSKEY", line)
+		}
+		zone := normalizeName(recordDomain(rec))
+		anchors[zone] = append(anchors[zone], rec)
+	}
+	trustAnchors.Lock()
+	trustAnchors.zones = anchors
+	trustAnchors.Unlock()
+	flushKeyCache()
+	return nil
+}
+
+// replaceTrustAnchors changes the anchors of a single zone.
+func replaceTrustAnchors(zone string, anchors []DnsRecord) {
+	trustAnchors.Lock()
+	trustAnchors.zones[zone] = anchors
+	trustAnchors.Unlock()
+	flushKeyCache()
+}
+
+// flushKeyCache forgets all chains of trust, which may have been built on
+// anchors that changed.
+func flushKeyCache() {
+	keyCache.Lock()
+	keyCache.zones = map[string]*zoneKeys{}
+	keyCache.Unlock()
+}
+
+// zoneKeys is the outcome of building the chain of trust to a zone; keys
+// are the zone's DNSKEYs when it is secure.
+type zoneKeys struct {
+	status  SecurityStatus
+	keys    []*DNSKEYRecord
+	reason  string
+	expires time.Time
+}
+
+// Validated keys are kept for their TTL, up to maxKeyCacheTTL. Failures
+// are retried after bogusCacheTTL.
+const (
+	maxKeyCacheTTL = time.Hour
+	bogusCacheTTL  = time.Minute
+)
+
+var keyCache = struct {
+	sync.Mutex
+	zones map[string]*zoneKeys
+}{zones: map[string]*zoneKeys{}}
+
+func cacheDuration(ttl uint32) time.Duration {
+	return min(time.Duration(ttl)*time.Second, maxKeyCacheTTL)
+}
+
+func bogus(format string, args ...interface{}) *zoneKeys {
+	return &zoneKeys{status: Bogus, reason: fmt.Sprintf(format, args...), expires: time.Now().Add(bogusCacheTTL)}
+}
+
+// zoneSecurity returns the security status and keys of a zone. Errors
+// are failures to reach the servers or the end of the query's budget,
+// which are not remembered.
+func zoneSecurity(zone string, budget *resolutionBudget) (*zoneKeys, error) {
+	zone = normalizeName(zone)
+	keyCache.Lock()
+	cached := keyCache.zones[zone]
+	keyCache.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	var result *zoneKeys
+	var err error
+	if anchors, ok := anchorsFor(zone); ok {
+		result, err = fetchKeys(zone, anchors, budget)
+	} else if zone == "" {
+		result = &zoneKeys{status: Insecure, reason: "no trust anchor", expires: time.Now().Add(maxKeyCacheTTL)}
+	} else {
+		result, err = delegationSecurity(zone, budget)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.status == Bogus {
+		fmt.Printf("Zone %s is bogus: %s\n", fqdn(zone), result.reason)
+	}
+
+	keyCache.Lock()
+	keyCache.zones[zone] = result
+	keyCache.Unlock()
+	return result, nil
+}
+
+// delegationSecurity follows the chain of trust from the parent of zone,
+// which holds its DS records.
+func delegationSecurity(zone string, budget *resolutionBudget) (*zoneKeys, error) {
+	response, parent, err := iterate(zone, QueryTypeFromNum(DS), budget)
+	if err != nil {
+		return nil, err
+	}
+	if parent == zone || !isSubdomain(zone, parent) {
+		return bogus("DS records for %s came from %s", fqdn(zone), fqdn(parent)), nil
+	}
+
+	parentKeys, err := zoneSecurity(parent, budget)
+	if err != nil {
+		return nil, err
+	}
+	if parentKeys.status != Secure {
+		return &zoneKeys{status: parentKeys.status, reason: parentKeys.reason, expires: parentKeys.expires}, nil
+	}
+
+	dsSet := rrsetAt(response.Answers, zone, DS)
+	if len(dsSet) == 0 {
+		ttl, err := validateNoDS(response, parent, parentKeys, zone)
+		if err != nil {
+			return bogus("%v", err), nil
+		}
+		return &zoneKeys{status: Insecure, reason: "no DS records", expires: time.Now().Add(cacheDuration(ttl))}, nil
+	}
+	if _, err := verifyRRset(dsSet, signaturesFor(response.Answers, zone, DS), parentKeys.keys); err != nil {
+		return bogus("DS records of %s: %v", fqdn(zone), err), nil
+	}
+
+	// A zone signed only with algorithms we don't know is treated as
+	// insecure (RFC 4035 section 5.2).
+	supported := []DnsRecord{}
+	for _, rec := range dsSet {
+		ds := rec.(*DSRecord)
+		if algorithmSupported(ds.Algorithm) && digestSupported(ds.DigestType) {
+			supported = append(supported, ds)
+		}
+	}
+	if len(supported) == 0 {
+		return &zoneKeys{status: Insecure, reason: "unsupported algorithms", expires: time.Now().Add(cacheDuration(recordTTL(dsSet[0])))}, nil
+	}
+	return fetchKeys(zone, supported, budget)
+}
+
+// validateNoDS checks a response without DS records for zone and returns
+// how long the answer may be remembered.
+func validateNoDS(response *DnsPacket, parent string, parentKeys *zoneKeys, zone string) (uint32, error) {
+	if response.Header.ResCode != NOERROR {
+		return 0, fmt.Errorf("DS query for %s failed with %s", fqdn(zone), response.Header.ResCode)
+	}
+	if _, err := validateAuthority(response, parent, parentKeys); err != nil {
+		return 0, err
+	}
+	if err := newDenialProof(response.Authorities, parent).proveNoDS(zone); err != nil {
+		return 0, err
+	}
+	ttl := uint32(maxKeyCacheTTL / time.Second)
+	for _, rec := range response.Authorities {
+		if soa, ok := rec.(*SOARecord); ok {
+			ttl = min(ttl, soa.TTL, soa.Minimum)
+		}
+	}
+	return ttl, nil
+}
+
+// fetchKeys looks up the DNSKEY set of zone and checks that it is signed
+// by a key one of the anchors, DS or DNSKEY records, refers to.
+func fetchKeys(zone string, anchors []DnsRecord, budget *resolutionBudget) (*zoneKeys, error) {
+	response, _, err := iterate(zone, QueryTypeFromNum(DNSKEY), budget)
+	if err != nil {
+		return nil, err
+	}
+	keySet := rrsetAt(response.Answers, zone, DNSKEY)
+	if len(keySet) == 0 {
+		return bogus("%s has no DNSKEY records", fqdn(zone)), nil
+	}
+	sigs := signaturesFor(response.Answers, zone, DNSKEY)
+
+	keys := []*DNSKEYRecord{}
+	trusted := []*DNSKEYRecord{}
+	for _, rec := range keySet {
+		key := rec.(*DNSKEYRecord)
+		keys = append(keys, key)
+		if key.Flags&DNSKEYFlagRevoke != 0 {
+			continue
+		}
+		for _, anchor := range anchors {
+			if anchoredBy(key, anchor) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return bogus("No DNSKEY of %s matches its DS records or trust anchor", fqdn(zone)), nil
+	}
+	if _, err := verifyRRset(keySet, sigs, trusted); err != nil {
+		return bogus("DNSKEY set of %s: %v", fqdn(zone), err), nil
+	}
+	return &zoneKeys{status: Secure, keys: keys, expires: time.Now().Add(cacheDuration(recordTTL(keySet[0])))}, nil
+}
+
+func anchoredBy(key *DNSKEYRecord, anchor DnsRecord) bool {
+	switch a := anchor.(type) {
+	case *DSRecord:
+		return matchesDS(a, key)
+	case *DNSKEYRecord:
+		return a.Algorithm == key.Algorithm && a.Protocol == key.Protocol && string(a.PublicKey) == string(key.PublicKey)
+	}
+	return false
+}
+
+// verifyRRset succeeds if one of the signatures is valid and made by one
+// of the keys, and returns that signature.
+func verifyRRset(rrset []DnsRecord, sigs []*RRSIGRecord, keys []*DNSKEYRecord) (*RRSIGRecord, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("No signatures")
+	}
+	err := errors.New("No signature by a known key")
+	now := time.Now()
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err = verifyRRSIG(sig, key, rrset, now); err == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// validateResponse checks a response from zone to a query for qname and
+// qtype: the signatures of the answer and authority sections, and the
+// proofs for negative and wildcard answers. An error means the response
+// is bogus.
+func validateResponse(response *DnsPacket, qname string, qtype uint16, zone string, budget *resolutionBudget) (SecurityStatus, error) {
+	zk, err := zoneSecurity(zone, budget)
+	if err != nil {
+		return Bogus, err
+	}
+	switch zk.status {
+	case Insecure:
+		return Insecure, nil
+	case Bogus:
+		return Bogus, errors.New(zk.reason)
+	}
+
+	status := Secure
+	downgrade := func(s SecurityStatus) {
+		if s != Secure {
+			status = Insecure
+		}
+	}
+	if _, err := validateAuthority(response, zone, zk); err != nil {
+		return Bogus, err
+	}
+	proof := newDenialProof(response.Authorities, zone)
+
+	for _, rrset := range groupRRsets(response.Answers) {
+		owner := normalizeName(recordDomain(rrset[0]))
+		s, sig, err := validateRRset(rrset, signaturesFor(response.Answers, owner, recordType(rrset[0])), zone, zk, budget)
+		if err != nil {
+			return Bogus, err
+		}
+		downgrade(s)
+		if sig != nil && sig.Labels < signatureLabels(owner) {
+			if s, err = proof.proveWildcard(owner, sig.Labels); err != nil {
+				return Bogus, err
+			}
+			downgrade(s)
+		}
+	}
+
+	// Follow CNAMEs to the name the answer is about.
+	target := normalizeName(qname)
+	for i := 0; i < maxCNAMEChain && qtype != CNAME; i++ {
+		cnames := rrsetAt(response.Answers, target, CNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		target = normalizeName(cnames[0].(*CNAMERecord).Host)
+	}
+	if len(rrsetAt(response.Answers, target, qtype)) > 0 || qtype == ANY && len(response.Answers) > 0 {
+		return status, nil
+	}
+	if danglingCNAME(response, qname, qtype) != "" {
+		// The rest of the chain is looked up and validated on its own.
+		return status, nil
+	}
+	if !isSubdomain(target, zone) {
+		// The negative answer is about another zone.
+		return Insecure, nil
+	}
+
+	var s SecurityStatus
+	if response.Header.ResCode == NXDOMAIN {
+		s, err = proof.proveNXDOMAIN(target)
+	} else {
+		s, err = proof.proveNoData(target, qtype)
+	}
+	if err != nil {
+		return Bogus, err
+	}
+	downgrade(s)
+	return status, nil
+}
+
+// validateAuthority verifies the SOA, NSEC and NSEC3 records in the
+// authority section and returns how many RRsets there were.
+func validateAuthority(response *DnsPacket, zone string, zk *zoneKeys) (int, error) {
+	verified := 0
+	for _, rrset := range groupRRsets(response.Authorities) {
+		qtype := recordType(rrset[0])
+		if qtype != SOA && qtype != NSEC && qtype != NSEC3 {
+			continue
+		}
+		owner := normalizeName(recordDomain(rrset[0]))
+		if !isSubdomain(owner, zone) {
+			return 0, fmt.Errorf("%s record for %s is outside of %s", QueryTypeFromNum(qtype), fqdn(owner), fqdn(zone))
+		}
+		if _, err := verifyRRset(rrset, signaturesFor(response.Authorities, owner, qtype), zk.keys); err != nil {
+			return 0, fmt.Errorf("%s %s: %v", fqdn(owner), QueryTypeFromNum(qtype), err)
+		}
+		verified++
+	}
+	return verified, nil
+}
+
+// validateRRset checks one RRset of an answer from zone and returns the
+// signature that proved it secure. Records below zone must be signed by
+// it; records from other zones, like the target of a CNAME, are checked
+// against their signer's chain of trust.
+func validateRRset(rrset []DnsRecord, sigs []*RRSIGRecord, zone string, zk *zoneKeys, budget *resolutionBudget) (SecurityStatus, *RRSIGRecord, error) {
+	owner := normalizeName(recordDomain(rrset[0]))
+	inZone := isSubdomain(owner, zone)
+	name := fmt.Sprintf("%s %s", fqdn(owner), QueryTypeFromNum(recordType(rrset[0])))
+	if len(sigs) == 0 {
+		if inZone {
+			return Bogus, nil, fmt.Errorf("%s is not signed", name)
+		}
+		return Insecure, nil, nil
+	}
+
+	status := Bogus
+	err := fmt.Errorf("%s has no valid signature", name)
+	for _, sig := range sigs {
+		signer := normalizeName(sig.SignerName)
+		// The signer must be the zone containing the RRset (RFC 4035
+		// section 5.3.1), so neither a zone below the owner nor a
+		// sibling can vouch for it.
+		if !isSubdomain(owner, signer) || inZone && !isSubdomain(signer, zone) {
+			err = fmt.Errorf("%s is signed by %s", name, fqdn(signer))
+			continue
+		}
+		keys := zk
+		if signer != zone {
+			if keys, err = zoneSecurity(signer, budget); err != nil {
+				return Bogus, nil, err
+			}
+		}
+		switch keys.status {
+		case Insecure:
+			status = Insecure
+		case Secure:
+			if _, err = verifyRRset(rrset, []*RRSIGRecord{sig}, keys.keys); err == nil {
+				return Secure, sig, nil
+			}
+		}
+	}
+	if status == Insecure {
+		return Insecure, nil, nil
+	}
+	return Bogus, nil, fmt.Errorf("%s: %v", name, err)
+}
+
+// groupRRsets splits records into RRsets, leaving out signatures.
+func groupRRsets(records []DnsRecord) [][]DnsRecord {
+	index := map[string]int{}
+	rrsets := [][]DnsRecord{}
+	for _, rec := range records {
+		qtype := recordType(rec)
+		if qtype == RRSIG || qtype == OPT {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", normalizeName(recordDomain(rec)), qtype)
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rec)
+			continue
+		}
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []DnsRecord{rec})
+	}
+	return rrsets
+}
+
+// rrsetAt returns the records of the given type at name.
+func rrsetAt(records []DnsRecord, name string, qtype uint16) []DnsRecord {
+	rrset := []DnsRecord{}
+	for _, rec := range records {
+		if recordType(rec) == qtype && normalizeName(recordDomain(rec)) == normalizeName(name) {
+			rrset = append(rrset, rec)
+		}
+	}
+	return rrset
+}
+
+// signaturesFor returns the RRSIGs covering the RRset of the given type at
+// name.
+func signaturesFor(records []DnsRecord, name string, qtype uint16) []*RRSIGRecord {
+	sigs := []*RRSIGRecord{}
+	for _, rec := range records {
+		sig, ok := rec.(*RRSIGRecord)
+		if ok && sig.TypeCovered == qtype && normalizeName(sig.Domain) == normalizeName(name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testRecords(t *testing.T, lines ...string) []DnsRecord {
+	t.Helper()
+	var records []DnsRecord
+	for _, line := range lines {
+		rec, err := ParseDnsRecord(line)
+		if err != nil {
+			t.Fatalf("ParseDnsRecord(%q): %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// testKeyFile writes a new private key for algorithm alg to a key file.
+func testKeyFile(t *testing.T, alg uint8) string {
+	t.Helper()
+	var key interface{}
+	var err error
+	switch alg {
+	case AlgECDSAP256SHA256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgECDSAP384SHA384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgED25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRSASHA256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		t.Fatalf("no test keys for algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("alg%d.pem", alg))
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testDS returns the DS record for the key in keyFile.
+func testDS(t *testing.T, keyFile string, zone string) *DSRecord {
+	t.Helper()
+	key, err := LoadSigningKey(SigningKeyConfig{File: keyFile, KSK: true}, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := key.DS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.TTL = 3600
+	return ds
+}
+
+// loadTestZone loads a zone from a master file with records, signed with
+// the key in keyFile unless it is empty.
+func loadTestZone(t *testing.T, origin string, keyFile string, nsec3 *NSEC3Config, records []DnsRecord) *Zone {
+	t.Helper()
+	config := ZoneConfig{Origin: origin, File: filepath.Join(t.TempDir(), "zone")}
+	if err := WriteZoneFile(config.File, origin, records); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		config.DNSSEC = &SigningConfig{Keys: []SigningKeyConfig{{File: keyFile, KSK: true}}, NSEC3: nsec3}
+	}
+	zone, err := LoadZone(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+// serveZone answers queries for zone over UDP and TCP on addr, the way an
+// authoritative server would, and returns the UDP address it listens on.
+// tamper, if not nil, may change responses before they are sent.
+func serveZone(t *testing.T, addr string, zone *Zone, tamper func(*DnsPacket)) *net.UDPAddr {
+	t.Helper()
+	answer := func(request *DnsPacket) *DnsPacket {
+		response := NewDnsPacket()
+		response.Header.ID = request.Header.ID
+		response.Header.Response = true
+		if len(request.Questions) == 0 {
+			response.Header.ResCode = FORMERR
+			return response
+		}
+		question := request.Questions[0]
+		response.Questions = append(response.Questions, question)
+		zone.Answer(question, response)
+		if !dnssecOK(request) {
+			stripDNSSEC(response, question.QType.ToNum())
+		}
+		if tamper != nil {
+			tamper(response)
+		}
+		addResponseOPT(request, response)
+		return response
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	local := udp.LocalAddr().(*net.UDPAddr)
+	tcp, err := net.Listen("tcp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	go func() {
+		buf := make([]byte, MaxStreamMessageSize)
+		for {
+			n, src, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(buf[:n]))
+			if err != nil {
+				continue
+			}
+			response := answer(request)
+			out := NewBytePacketBufferWithSize(maxUDPResponseSize(request))
+			if response.Write(out) != nil {
+				response = &DnsPacket{Header: response.Header, Questions: response.Questions}
+				response.Header.TruncatedMessage = true
+				addResponseOPT(request, response)
+				out = NewBytePacketBufferWithSize(maxUDPResponseSize(request))
+				if response.Write(out) != nil {
+					continue
+				}
+			}
+			udp.WriteToUDP(out.buf[:out.Pos()], src)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					msg, err := readTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					request, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+					if err != nil || writeTCPMessage(conn, answer(request)) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return local
+}
+
+// serveTestHierarchy serves a signed root zone delegating to test., which
+// delegates to a secure, an insecure and a bogus zone, and points the
+// resolver at it. The zones are signed with ECDSA, RSA and Ed25519 keys.
+func serveTestHierarchy(t *testing.T) {
+	t.Helper()
+	exampleKey := testKeyFile(t, AlgED25519)
+	example := loadTestZone(t, "example.test", exampleKey, nil, testRecords(t,
+		"example.test. 3600 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 300",
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.0.3",
+		"www.example.test. 300 IN A 192.0.2.1",
+		"tampered.example.test. 300 IN A 192.0.2.2",
+		"resigned.example.test. 300 IN A 192.0.2.3",
+		"*.wild.example.test. 300 IN TXT \"wild\"",
+		"unsigned.example.test. 3600 IN NS ns.unsigned.example.test.",
+		"ns.unsigned.example.test. 3600 IN A 127.0.0.6",
+	))
+	insecure := loadTestZone(t, "insecure.test", "", nil, testRecords(t,
+		"insecure.test. 3600 IN SOA ns.insecure.test. admin.insecure.test. 1 3600 600 86400 300",
+		"insecure.test. 3600 IN NS ns.insecure.test.",
+		"ns.insecure.test. 3600 IN A 127.0.0.4",
+		"www.insecure.test. 300 IN A 192.0.2.4",
+	))
+	// The parent publishes the DS of a key bogus.test isn't signed with.
+	bogusDS := testDS(t, testKeyFile(t, AlgECDSAP256SHA256), "bogus.test")
+	bogus := loadTestZone(t, "bogus.test", testKeyFile(t, AlgECDSAP256SHA256), nil, testRecords(t,
+		"bogus.test. 3600 IN SOA ns.bogus.test. admin.bogus.test. 1 3600 600 86400 300",
+		"bogus.test. 3600 IN NS ns.bogus.test.",
+		"ns.bogus.test. 3600 IN A 127.0.0.5",
+		"www.bogus.test. 300 IN A 192.0.2.5",
+	))
+
+	tldKey := testKeyFile(t, AlgRSASHA256)
+	tld := loadTestZone(t, "test", tldKey, &NSEC3Config{Iterations: 1, Salt: "ab", OptOut: true}, append(testRecords(t,
+		"test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 300",
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2",
+		"example.test. 3600 IN NS ns.example.test.",
+		"ns.example.test. 3600 IN A 127.0.0.3",
+		"insecure.test. 3600 IN NS ns.insecure.test.",
+		"ns.insecure.test. 3600 IN A 127.0.0.4",
+		"bogus.test. 3600 IN NS ns.bogus.test.",
+		"ns.bogus.test. 3600 IN A 127.0.0.5",
+	), testDS(t, exampleKey, "example.test"), bogusDS))
+
+	rootKey := testKeyFile(t, AlgECDSAP256SHA256)
+	root := loadTestZone(t, ".", rootKey, nil, append(testRecords(t,
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 127.0.0.1",
+		"test. 3600 IN NS ns.test.",
+		"ns.test. 3600 IN A 127.0.0.2",
+	), testDS(t, tldKey, "test")))
+
+	rootAddr := serveZone(t, "127.0.0.1:0", root, nil)
+	port := rootAddr.Port
+	serveZone(t, fmt.Sprintf("127.0.0.2:%d", port), tld, nil)
+	serveZone(t, fmt.Sprintf("127.0.0.3:%d", port), example, func(response *DnsPacket) {
+		for i, rec := range response.Answers {
+			switch r := rec.(type) {
+			case *ARecord:
+				if r.Domain == "tampered.example.test" || r.Domain == "resigned.example.test" {
+					forged := *r
+					forged.Addr = net.IPv4(198, 51, 100, 1)
+					response.Answers[i] = &forged
+				}
+			case *RRSIGRecord:
+				// A signature claiming to come from the unsigned zone
+				// below, which isn't an ancestor of the owner.
+				if r.Domain == "resigned.example.test" {
+					forged := *r
+					forged.SignerName = "unsigned.example.test"
+					response.Answers[i] = &forged
+				}
+			}
+		}
+	})
+	serveZone(t, fmt.Sprintf("127.0.0.4:%d", port), insecure, nil)
+	serveZone(t, fmt.Sprintf("127.0.0.5:%d", port), bogus, nil)
+
+	savedRoots, savedPort := rootServers, nameServerPort
+	rootServers, nameServerPort = []string{rootAddr.String()}, port
+	if err := setTrustAnchors([]string{testDS(t, rootKey, ".").String()}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rootServers, nameServerPort = savedRoots, savedPort
+		setTrustAnchors(nil)
+	})
+}
+
+func TestValidatingResolver(t *testing.T) {
+	serveTestHierarchy(t)
+
+	cases := []struct {
+		name    string
+		qtype   uint16
+		bogus   bool
+		secure  bool
+		rcode   ResultCode
+		answers int
+	}{
+		{"test", SOA, false, true, NOERROR, 1},
+		{"www.example.test", A, false, true, NOERROR, 1},
+		{"x.wild.example.test", TXT, false, true, NOERROR, 1},
+		{"missing.example.test", A, false, true, NXDOMAIN, 0},
+		{"www.example.test", AAAA, false, true, NOERROR, 0},
+		// The covering NSEC3 record has opt-out set, so the name might be
+		// an unsigned delegation (RFC 5155 section 9.2).
+		{"missing.test", A, false, false, NXDOMAIN, 0},
+		{"www.insecure.test", A, false, false, NOERROR, 1},
+		{"missing.insecure.test", A, false, false, NXDOMAIN, 0},
+		{"www.bogus.test", A, true, false, 0, 0},
+		{"tampered.example.test", A, true, false, 0, 0},
+		{"resigned.example.test", A, true, false, 0, 0},
+	}
+	for _, c := range cases {
+		qtype := QueryTypeFromNum(c.qtype)
+		response, err := RecursiveLookup(c.name, qtype)
+		if c.bogus {
+			if err == nil {
+				t.Errorf("%s %v: bogus answer accepted:\n%v", c.name, qtype, response)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %v", c.name, qtype, err)
+			continue
+		}
+		if response.Header.AuthedData != c.secure || response.Header.ResCode != c.rcode {
+			t.Errorf("%s %v: AD %v and rcode %v, want %v and %v", c.name, qtype,
+				response.Header.AuthedData, response.Header.ResCode, c.secure, c.rcode)
+		}
+		if n := len(filterRecords(response.Answers, c.qtype)); n != c.answers {
+			t.Errorf("%s %v: %d answers, want %d:\n%v", c.name, qtype, n, c.answers, response)
+		}
+	}
+}
+
+func TestValidatedClientResponses(t *testing.T) {
+	serveTestHierarchy(t)
+
+	query := func(name string, do bool) *DnsPacket {
+		request := NewDnsPacket()
+		request.Header.RecursionDesired = true
+		request.Questions = append(request.Questions, NewDnsQuestion(name, QueryTypeFromNum(A)))
+		if do {
+			request.Resources = append(request.Resources, &OPTRecord{UDPSize: ednsUDPSize, Flags: ednsFlagDO})
+		}
+		return handleRequest(request, nil, "")
+	}
+
+	// Only clients that set DO get the signatures and the AD bit.
+	if response := query("www.example.test", true); !response.Header.AuthedData || len(filterRecords(response.Answers, RRSIG)) == 0 {
+		t.Errorf("DO query: AD or RRSIG missing:\n%v", response)
+	}
+	if response := query("www.example.test", false); response.Header.AuthedData || len(response.Answers) != 1 {
+		t.Errorf("plain query: unexpected answer:\n%v", response)
+	}
+	if response := query("www.insecure.test", true); response.Header.AuthedData || response.Header.ResCode != NOERROR {
+		t.Errorf("insecure query: unexpected answer:\n%v", response)
+	}
+	if response := query("www.bogus.test", true); response.Header.ResCode != SERVFAIL {
+		t.Errorf("bogus query: rcode %v, want SERVFAIL", response.Header.ResCode)
+	}
+}
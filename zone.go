@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Zone holds the records of a zone godns is authoritative for.
+type Zone struct {
+	Origin string
+	// AllowTransfer lists the clients that may pull the zone with AXFR.
+	AllowTransfer ACL
+	// AllowUpdate lists the clients that may send dynamic updates.
+	AllowUpdate ACL
+
+	config ZoneConfig
+	key    *TSIGKey
+	// signer is set for zones godns signs itself.
+	signer *zoneSigner
+
+	mu      sync.RWMutex
+	records map[string][]DnsRecord
+	// nodes contains every owner name and all of their ancestors up to
+	// the origin, so empty non-terminals can be told apart from names
+	// that don't exist.
+	nodes   map[string]bool
+	chain   *denialChain
+	journal Journal
+
+	// Secondary zones only: refreshNow wakes up the maintenance loop,
+	// expired is set once the primary has been unreachable for longer
+	// than the SOA expire interval, and primaryAddrs holds the addresses
+	// NOTIFYs are accepted from.
+	refreshNow   chan struct{}
+	expired      bool
+	primaryAddrs ACL
+}
+
+func NewZone(origin string, records []DnsRecord) (*Zone, error) {
+	zone := &Zone{Origin: normalizeName(origin)}
+	if err := zone.setRecords(records); err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// LoadZone reads a zone from its master file, or transfers it from the
+// primary for secondary zones. A secondary whose primary can't be reached
+// starts out empty, answering SERVFAIL, and keeps trying in the
+// background.
+func LoadZone(config ZoneConfig) (*Zone, error) {
+	acl, err := ParseACL(config.AllowTransfer)
+	if err != nil {
+		return nil, err
+	}
+	updateACL, err := ParseACL(config.AllowUpdate)
+	if err != nil {
+		return nil, err
+	}
+	key, err := lookupTSIGKey(config.TSIGKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DnsRecord
+	if config.Primary != "" {
+		records, err = TransferZone(config.Origin, config.Primary, key)
+		if err != nil {
+			fmt.Printf("Failed to transfer zone %s from %s: %v\n", fqdn(config.Origin), config.Primary, err)
+			records, err = nil, nil
+		}
+	} else {
+		records, err = ParseZoneFile(config.File, config.Origin)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *zoneSigner
+	if config.DNSSEC != nil {
+		if config.Primary != "" {
+			return nil, errors.New("Secondary zones can't be signed")
+		}
+		if signer, err = newZoneSigner(config.Origin, config.DNSSEC); err != nil {
+			return nil, err
+		}
+		if records, err = signer.Sign(records, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var zone *Zone
+	if records == nil {
+		zone = newEmptyZone(config.Origin)
+	} else if zone, err = NewZone(config.Origin, records); err != nil {
+		return nil, err
+	}
+	zone.AllowTransfer = acl
+	zone.AllowUpdate = updateACL
+	zone.config = config
+	zone.key = key
+	if config.Primary != "" {
+		zone.refreshNow = make(chan struct{}, 1)
+		zone.resolvePrimary()
+		go zone.maintainSecondary()
+	}
+	if signer != nil {
+		zone.signer = signer
+		go zone.maintainSignatures()
+	}
+	return zone, nil
+}
+
+// Reload re-reads the master file, or schedules a check of the primary
+// for secondary zones.
+func (z *Zone) Reload() error {
+	if z.config.Primary != "" {
+		z.requestRefresh()
+		return nil
+	}
+	if z.config.File == "" {
+		return nil
+	}
+
+	records, err := ParseZoneFile(z.config.File, z.Origin)
+	if err != nil {
+		return err
+	}
+	return z.Replace(records)
+}
+
+func (z *Zone) setRecords(records []DnsRecord) error {
+	byName, nodes, err := indexRecords(z.Origin, records)
+	if err != nil {
+		return err
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.setIndex(byName, nodes)
+	return nil
+}
+
+// setIndex installs the records of a new version; the caller holds mu.
+func (z *Zone) setIndex(byName map[string][]DnsRecord, nodes map[string]bool) {
+	z.records = byName
+	z.nodes = nodes
+	z.chain = newDenialChain(z.Origin, byName)
+}
+
+func indexRecords(origin string, records []DnsRecord) (map[string][]DnsRecord, map[string]bool, error) {
+	byName := map[string][]DnsRecord{}
+	nodes := map[string]bool{}
+	soaCount := 0
+
+	for _, rec := range records {
+		owner := normalizeName(recordDomain(rec))
+		if !isSubdomain(owner, origin) {
+			return nil, nil, fmt.Errorf("%s is outside of zone %s", fqdn(owner), fqdn(origin))
+		}
+		if recordType(rec) == SOA {
+			if owner != origin {
+				return nil, nil, fmt.Errorf("SOA record for %s is not at the zone apex", fqdn(owner))
+			}
+			soaCount++
+		}
+		byName[owner] = append(byName[owner], rec)
+
+		for name := owner; ; name = parentName(name) {
+			nodes[name] = true
+			if name == origin || name == "" {
+				break
+			}
+		}
+	}
+
+	if soaCount != 1 {
+		return nil, nil, fmt.Errorf("Zone %s needs exactly one SOA record, found %d", fqdn(origin), soaCount)
+	}
+	return byName, nodes, nil
+}
+
+// Replace swaps in a new version of the zone and journals the difference.
+// Signed zones are signed again first.
+func (z *Zone) Replace(records []DnsRecord) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.signer != nil {
+		signed, err := z.signer.Sign(records, z.allRecords())
+		if err != nil {
+			return err
+		}
+		records = signed
+	}
+	byName, nodes, err := indexRecords(z.Origin, records)
+	if err != nil {
+		return err
+	}
+	z.replace(records, byName, nodes)
+	return nil
+}
+
+// replace installs an indexed version of the zone; the caller holds mu.
+func (z *Zone) replace(records []DnsRecord, byName map[string][]DnsRecord, nodes map[string]bool) {
+	oldSOA := z.soa()
+	old := z.allRecords()
+	z.setIndex(byName, nodes)
+	newSOA := z.soa()
+	if oldSOA == nil {
+		// The first copy of a secondary zone.
+		return
+	}
+
+	deleted, added := diffRecords(old, records)
+	switch {
+	case serialLess(oldSOA.Serial, newSOA.Serial):
+		z.journal.Append(ZoneDiff{OldSOA: oldSOA, NewSOA: newSOA, Deleted: deleted, Added: added})
+		go z.sendNotifies()
+	case len(deleted) > 0 || len(added) > 0:
+		// Secondaries can't notice a change without a new serial, and
+		// the journal no longer describes the zone.
+		fmt.Printf("Zone %s changed without increasing the serial %d\n", fqdn(z.Origin), newSOA.Serial)
+		z.journal = Journal{}
+	}
+}
+
+// ApplyDiff applies an incremental change on top of the current version.
+func (z *Zone) ApplyDiff(diff ZoneDiff) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	current := z.soa()
+	if current.Serial != diff.OldSOA.Serial {
+		return fmt.Errorf("Diff for serial %d does not apply to %s at serial %d", diff.OldSOA.Serial, fqdn(z.Origin), current.Serial)
+	}
+
+	byName, nodes, err := indexRecords(z.Origin, applyDiff(z.allRecords(), diff))
+	if err != nil {
+		return err
+	}
+	z.setIndex(byName, nodes)
+	z.journal.Append(diff)
+	go z.sendNotifies()
+	return nil
+}
+
+func (z *Zone) SOA() *SOARecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.soa()
+}
+
+func (z *Zone) soa() *SOARecord {
+	for _, rec := range z.records[z.Origin] {
+		if soa, ok := rec.(*SOARecord); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// Records returns all records of the zone, the SOA first.
+func (z *Zone) Records() []DnsRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.allRecords()
+}
+
+func (z *Zone) allRecords() []DnsRecord {
+	return listRecords(z.Origin, z.records)
+}
+
+// listRecords flattens records indexed by owner name, the SOA first and
+// the rest sorted by name.
+func listRecords(origin string, byName map[string][]DnsRecord) []DnsRecord {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := filterRecords(byName[origin], SOA)
+	for _, name := range names {
+		for _, rec := range byName[name] {
+			if recordType(rec) != SOA {
+				records = append(records, rec)
+			}
+		}
+	}
+	return records
+}
+
+func filterRecords(records []DnsRecord, qtype uint16) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range records {
+		if qtype == ANY || recordType(rec) == qtype {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// negativeSOA is the SOA put into the authority section of NXDOMAIN and
+// NODATA responses, with the TTL capped by the minimum field (RFC 2308).
+func (z *Zone) negativeSOA() DnsRecord {
+	soa := *z.soa()
+	if soa.Minimum < soa.TTL {
+		soa.TTL = soa.Minimum
+	}
+	return &soa
+}
+
+// findCut returns the name of the closest delegation between the apex
+// and qname, if any.
+func (z *Zone) findCut(qname string) (string, []DnsRecord) {
+	names := []string{}
+	for name := qname; name != z.Origin; name = parentName(name) {
+		names = append(names, name)
+		if name == "" {
+			break
+		}
+	}
+
+	// Walk downwards from the apex; the topmost cut wins.
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		ns := filterRecords(z.records[name], NS)
+		if len(ns) == 0 {
+			continue
+		}
+		return name, ns
+	}
+	return "", nil
+}
+
+// addressRecords returns the A and AAAA records the zone has for host.
+func (z *Zone) addressRecords(host string) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range z.records[normalizeName(host)] {
+		if t := recordType(rec); t == A || t == AAAA {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+const maxCNAMEChain = 8
+
+// Answer fills in the response to a query for a name within the zone.
+// Signed zones add their RRSIGs and NSEC or NSEC3 proofs, which are left
+// to the caller to remove for clients that didn't ask for them.
+func (z *Zone) Answer(question *DnsQuestion, response *DnsPacket) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	if z.expired {
+		response.Header.ResCode = SERVFAIL
+		return
+	}
+
+	qtype := question.QType.ToNum()
+	owner := strings.TrimSuffix(question.Name, ".")
+	response.Header.AuthoritativeAnswer = true
+	signed := z.signed()
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		qname := normalizeName(owner)
+		cut, ns := z.findCut(qname)
+		if cut == qname && qtype == DS {
+			// The DS records of a delegation live on the parent side.
+			cut = ""
+		}
+		if cut != "" {
+			// Referrals are only authoritative for the CNAMEs that led
+			// to them.
+			response.Header.AuthoritativeAnswer = len(response.Answers) > 0
+			response.Authorities = append(response.Authorities, ns...)
+			if signed {
+				response.Authorities = append(response.Authorities, z.delegationProof(cut)...)
+			}
+			for _, rec := range ns {
+				response.Resources = append(response.Resources, z.addressRecords(rec.(*NSRecord).Host)...)
+			}
+			return
+		}
+
+		records := z.records[qname]
+		// source is where the records come from, the wildcard if they are
+		// synthesized.
+		source := qname
+		if len(records) == 0 && !z.nodes[qname] {
+			source = wildcardOf(z.closestEncloser(qname))
+			wildcard := z.records[source]
+			if len(wildcard) == 0 {
+				response.Header.ResCode = NXDOMAIN
+				response.Authorities = append(response.Authorities, z.negativeSOA())
+				if signed {
+					response.Authorities = append(response.Authorities, z.signatures(z.Origin, SOA, z.negativeSOA())...)
+					response.Authorities = append(response.Authorities, z.nxdomainProof(qname)...)
+				}
+				return
+			}
+			records = synthesize(wildcard, owner)
+		}
+		matches := filterRecords(records, qtype)
+		if len(matches) > 0 {
+			if signed {
+				matches = z.withSignatures(matches, source)
+				if source != qname {
+					response.Authorities = append(response.Authorities, z.wildcardProof(qname, source)...)
+				}
+			}
+			response.Answers = append(response.Answers, matches...)
+			z.addAdditional(matches, response)
+			return
+		}
+
+		cnames := filterRecords(records, CNAME)
+		if len(cnames) == 0 {
+			response.Authorities = append(response.Authorities, z.negativeSOA())
+			if signed {
+				response.Authorities = append(response.Authorities, z.signatures(z.Origin, SOA, z.negativeSOA())...)
+				response.Authorities = append(response.Authorities, z.noDataProof(qname, source)...)
+			}
+			return
+		}
+
+		if signed {
+			response.Answers = append(response.Answers, z.withSignatures(cnames[:1], source)...)
+			if source != qname {
+				response.Authorities = append(response.Authorities, z.wildcardProof(qname, source)...)
+			}
+		} else {
+			response.Answers = append(response.Answers, cnames[0])
+		}
+		owner = cnames[0].(*CNAMERecord).Host
+		if !isSubdomain(owner, z.Origin) {
+			// Leave it to the client to chase names outside the zone.
+			return
+		}
+	}
+}
+
+// closestEncloser returns the longest existing ancestor of a name that
+// doesn't exist in the zone. Empty non-terminals count as existing, so a
+// wildcard only covers names directly below its parent (RFC 4592).
+func (z *Zone) closestEncloser(qname string) string {
+	for name := parentName(qname); ; name = parentName(name) {
+		if z.nodes[name] || name == z.Origin || name == "" {
+			return name
+		}
+	}
+}
+
+// synthesize expands wildcard records to the query name.
+func synthesize(records []DnsRecord, owner string) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range records {
+		result = append(result, withRecordHeader(rec, owner, recordTTL(rec)))
+	}
+	return result
+}
+
+// addAdditional adds the addresses of in-zone NS and MX targets.
+func (z *Zone) addAdditional(records []DnsRecord, response *DnsPacket) {
+	for _, rec := range records {
+		var host string
+		switch r := rec.(type) {
+		case *NSRecord:
+			host = r.Host
+		case *MXRecord:
+			host = r.Host
+		default:
+			continue
+		}
+		if isSubdomain(host, z.Origin) {
+			response.Resources = append(response.Resources, z.addressRecords(host)...)
+		}
+	}
+}
+
+// ZoneStore is the set of zones godns is authoritative for.
+type ZoneStore struct {
+	mu    sync.RWMutex
+	zones map[string]*Zone
+}
+
+var authZones = NewZoneStore()
+
+func NewZoneStore() *ZoneStore {
+	return &ZoneStore{zones: map[string]*Zone{}}
+}
+
+func (s *ZoneStore) Add(zone *Zone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.zones[zone.Origin]; ok {
+		return errors.New("Zone " + fqdn(zone.Origin) + " is already loaded")
+	}
+	s.zones[zone.Origin] = zone
+	return nil
+}
+
+func (s *ZoneStore) Get(origin string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zones[normalizeName(origin)]
+}
+
+// Find returns the most specific zone containing qname.
+func (s *ZoneStore) Find(qname string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.zones) == 0 {
+		return nil
+	}
+	for name := normalizeName(qname); ; name = parentName(name) {
+		if zone, ok := s.zones[name]; ok {
+			return zone
+		}
+		if name == "" {
+			return nil
+		}
+	}
+}
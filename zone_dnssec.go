@@ -0,0 +1,212 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Answers from signed zones, whether signed by godns or loaded with their
+// DNSSEC records: RRsets come with their RRSIGs, and negative answers,
+// wildcard expansions and referrals to unsigned delegations with the NSEC
+// or NSEC3 records that prove them (RFC 4035 section 3.1, RFC 5155
+// section 7.2).
+
+// denialChain holds the NSEC records of a zone in canonical order, or its
+// NSEC3 records in hash order.
+type denialChain struct {
+	nsecs  []*NSECRecord
+	nsec3s []*NSEC3Record
+}
+
+func newDenialChain(origin string, byName map[string][]DnsRecord) *denialChain {
+	chain := &denialChain{}
+	for _, records := range byName {
+		for _, rec := range records {
+			switch r := rec.(type) {
+			case *NSECRecord:
+				chain.nsecs = append(chain.nsecs, r)
+			case *NSEC3Record:
+				if parentName(normalizeName(r.Domain)) == origin {
+					chain.nsec3s = append(chain.nsec3s, r)
+				}
+			}
+		}
+	}
+	sort.Slice(chain.nsecs, func(i, j int) bool {
+		return canonicalNameLess(chain.nsecs[i].Domain, chain.nsecs[j].Domain)
+	})
+	sort.Slice(chain.nsec3s, func(i, j int) bool {
+		return normalizeName(chain.nsec3s[i].Domain) < normalizeName(chain.nsec3s[j].Domain)
+	})
+	return chain
+}
+
+// signed reports whether the zone has signatures to serve.
+func (z *Zone) signed() bool {
+	return len(signaturesFor(z.records[z.Origin], z.Origin, SOA)) > 0
+}
+
+// signatures returns the RRSIGs at source over its records of qtype, made
+// out for rec, which may have been synthesized from them.
+func (z *Zone) signatures(source string, qtype uint16, rec DnsRecord) []DnsRecord {
+	result := []DnsRecord{}
+	for _, sig := range signaturesFor(z.records[source], source, qtype) {
+		c := *sig
+		c.Domain = recordDomain(rec)
+		c.TTL = recordTTL(rec)
+		result = append(result, &c)
+	}
+	return result
+}
+
+// withSignatures returns the RRsets among records, found at source, each
+// followed by its RRSIGs.
+func (z *Zone) withSignatures(records []DnsRecord, source string) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rrset := range groupRRsets(records) {
+		result = append(result, rrset...)
+		result = append(result, z.signatures(source, recordType(rrset[0]), rrset[0])...)
+	}
+	return result
+}
+
+// proof returns the NSEC or NSEC3 records with their signatures, leaving
+// out missing and repeated ones.
+func (z *Zone) proof(records ...DnsRecord) []DnsRecord {
+	result := []DnsRecord{}
+	seen := map[string]bool{}
+	for _, rec := range records {
+		if rec == nil {
+			continue
+		}
+		owner := normalizeName(recordDomain(rec))
+		if seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		result = append(result, z.withSignatures([]DnsRecord{rec}, owner)...)
+	}
+	return result
+}
+
+// nxdomainProof shows that qname doesn't exist and that the wildcard at
+// its closest encloser doesn't either.
+func (z *Zone) nxdomainProof(qname string) []DnsRecord {
+	ce := z.closestEncloser(qname)
+	if len(z.chain.nsec3s) > 0 {
+		return z.proof(z.matchingNSEC3(ce), z.coveringNSEC3(nextCloser(qname, ce)), z.coveringNSEC3(wildcardOf(ce)))
+	}
+	return z.proof(z.coveringNSEC(qname), z.coveringNSEC(wildcardOf(ce)))
+}
+
+// noDataProof shows that qname has no records of the type asked for.
+// source is the wildcard the answer was synthesized from, or qname.
+func (z *Zone) noDataProof(qname string, source string) []DnsRecord {
+	if source != qname {
+		ce := parentName(source)
+		if len(z.chain.nsec3s) > 0 {
+			return z.proof(z.matchingNSEC3(ce), z.coveringNSEC3(nextCloser(qname, ce)), z.matchingNSEC3(source))
+		}
+		return z.proof(z.coveringNSEC(qname), z.matchingNSEC(source))
+	}
+
+	if len(z.chain.nsec3s) > 0 {
+		if match := z.matchingNSEC3(qname); match != nil {
+			return z.proof(match)
+		}
+		// A delegation left out of an opt-out chain.
+		for ce := parentName(qname); isSubdomain(ce, z.Origin); ce = parentName(ce) {
+			if match := z.matchingNSEC3(ce); match != nil {
+				return z.proof(match, z.coveringNSEC3(nextCloser(qname, ce)))
+			}
+			if ce == "" {
+				break
+			}
+		}
+		return nil
+	}
+	if match := z.matchingNSEC(qname); match != nil {
+		return z.proof(match)
+	}
+	// An empty non-terminal lies between two NSEC records.
+	return z.proof(z.coveringNSEC(qname))
+}
+
+// wildcardProof shows that there was no closer match for qname than the
+// wildcard source.
+func (z *Zone) wildcardProof(qname string, source string) []DnsRecord {
+	if len(z.chain.nsec3s) > 0 {
+		return z.proof(z.coveringNSEC3(nextCloser(qname, parentName(source))))
+	}
+	return z.proof(z.coveringNSEC(qname))
+}
+
+// delegationProof returns the signed DS records of a delegation, or the
+// proof that it has none.
+func (z *Zone) delegationProof(cut string) []DnsRecord {
+	if ds := filterRecords(z.records[cut], DS); len(ds) > 0 {
+		return z.withSignatures(ds, cut)
+	}
+	return z.noDataProof(cut, cut)
+}
+
+// nextCloser is the name one label longer than its closest encloser ce on
+// the way to qname.
+func nextCloser(qname string, ce string) string {
+	labels := strings.Split(qname, ".")
+	return strings.Join(labels[len(labels)-countLabels(ce)-1:], ".")
+}
+
+func (z *Zone) matchingNSEC(name string) DnsRecord {
+	if nsecs := filterRecords(z.records[name], NSEC); len(nsecs) > 0 {
+		return nsecs[0]
+	}
+	return nil
+}
+
+// coveringNSEC returns the NSEC record of the name before name in
+// canonical order, which wraps around to the last one.
+func (z *Zone) coveringNSEC(name string) DnsRecord {
+	nsecs := z.chain.nsecs
+	if len(nsecs) == 0 {
+		return nil
+	}
+	i := sort.Search(len(nsecs), func(i int) bool {
+		return compareCanonicalNames(nsecs[i].Domain, name) >= 0
+	})
+	if i == 0 {
+		i = len(nsecs)
+	}
+	return nsecs[i-1]
+}
+
+// nsec3Name is the owner name the NSEC3 record for name has in the chain.
+func (z *Zone) nsec3Name(name string) string {
+	params := z.chain.nsec3s[0]
+	hash, err := nsec3Hash(name, params.Salt, params.Iterations)
+	if err != nil {
+		return ""
+	}
+	return nsec3Owner(hash, z.Origin)
+}
+
+func (z *Zone) matchingNSEC3(name string) DnsRecord {
+	if nsec3s := filterRecords(z.records[z.nsec3Name(name)], NSEC3); len(nsec3s) > 0 {
+		return nsec3s[0]
+	}
+	return nil
+}
+
+// coveringNSEC3 returns the NSEC3 record whose span contains the hash of
+// name. Hashes encoded in base32hex sort like the hashes themselves.
+func (z *Zone) coveringNSEC3(name string) DnsRecord {
+	nsec3s := z.chain.nsec3s
+	owner := z.nsec3Name(name)
+	i := sort.Search(len(nsec3s), func(i int) bool {
+		return normalizeName(nsec3s[i].Domain) >= owner
+	})
+	if i == 0 {
+		i = len(nsec3s)
+	}
+	return nsec3s[i-1]
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Parser for RFC 1035 master files. Supported are the $ORIGIN, $TTL and
+// $INCLUDE directives, relative names and "@", omitted owners, TTLs and
+// classes, parentheses spanning several lines and ';' comments.
+
+const maxIncludeDepth = 8
+
+type zoneParser struct {
+	origin     string
+	ttl        uint32
+	hasTTL     bool
+	lastTTL    uint32
+	hasLastTTL bool
+	lastOwner  string
+	records    []DnsRecord
+}
+
+// ParseZoneFile reads the master file at path and returns its records.
+// Names are relative to origin until the file sets its own $ORIGIN.
+func ParseZoneFile(path string, origin string) ([]DnsRecord, error) {
+	parser := &zoneParser{
+		origin: strings.TrimSuffix(origin, "."),
+	}
+	if err := parser.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return parser.records, nil
+}
+
+func (p *zoneParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: $INCLUDE nested too deeply", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for {
+		entry, start, err := readZoneEntry(scanner, &lineNum)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		if entry == "" && start == 0 {
+			break
+		}
+		if err := p.parseEntry(entry, path, depth); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, start, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readZoneEntry joins physical lines until all parentheses are closed and
+// strips comments. It returns the logical line and the number of the line
+// it started on, or an empty entry and zero at the end of the file.
+func readZoneEntry(scanner *bufio.Scanner, lineNum *int) (string, int, error) {
+	var entry strings.Builder
+	depth := 0
+	start := 0
+
+	for scanner.Scan() {
+		*lineNum++
+		line, delta, err := stripZoneComment(scanner.Text())
+		if err != nil {
+			return "", 0, err
+		}
+		if start == 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			start = *lineNum
+		} else {
+			entry.WriteByte(' ')
+		}
+		entry.WriteString(line)
+
+		depth += delta
+		if depth < 0 {
+			return "", 0, errors.New("Unbalanced closing parenthesis")
+		}
+		if depth == 0 {
+			return entry.String(), start, nil
+		}
+	}
+
+	if depth > 0 {
+		return "", 0, errors.New("Unclosed parenthesis at end of file")
+	}
+	return entry.String(), start, nil
+}
+
+// stripZoneComment removes a trailing comment and reports how the line
+// changes the parenthesis depth, ignoring quoted and escaped characters.
+func stripZoneComment(line string) (string, int, error) {
+	inQuote := false
+	delta := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case c == ';':
+			return line[:i], delta, nil
+		case c == '(':
+			delta++
+		case c == ')':
+			delta--
+		}
+	}
+	if inQuote {
+		return "", 0, errors.New("Unterminated quoted string")
+	}
+	return line, delta, nil
+}
+
+func (p *zoneParser) parseEntry(entry string, path string, depth int) error {
+	fields, err := tokenizeRecord(entry)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "$ORIGIN":
+		if len(fields) != 2 {
+			return errors.New("$ORIGIN needs exactly one name")
+		}
+		origin, err := parseName(fields[1], p.origin)
+		if err != nil {
+			return err
+		}
+		p.origin = origin
+		return nil
+	case "$TTL":
+		if len(fields) != 2 {
+			return errors.New("$TTL needs exactly one value")
+		}
+		ttl, err := parseTTL(fields[1])
+		if err != nil {
+			return err
+		}
+		p.ttl = ttl
+		p.hasTTL = true
+		return nil
+	case "$INCLUDE":
+		if len(fields) < 2 || len(fields) > 3 {
+			return errors.New("$INCLUDE needs a file name and an optional origin")
+		}
+		includePath := fields[1]
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+		// The included file may set its own origin, but that must not
+		// leak back into this file (RFC 1035 section 5.1).
+		savedOrigin, savedOwner := p.origin, p.lastOwner
+		if len(fields) == 3 {
+			origin, err := parseName(fields[2], p.origin)
+			if err != nil {
+				return err
+			}
+			p.origin = origin
+		}
+		err := p.parseFile(includePath, depth+1)
+		p.origin, p.lastOwner = savedOrigin, savedOwner
+		return err
+	}
+
+	var owner string
+	if entry[0] == ' ' || entry[0] == '\t' {
+		if p.lastOwner == "" && len(p.records) == 0 {
+			return errors.New("Record without an owner name")
+		}
+		owner = p.lastOwner
+	} else {
+		owner, err = parseName(fields[0], p.origin)
+		if err != nil {
+			return err
+		}
+		fields = fields[1:]
+	}
+
+	// An omitted TTL is taken from $TTL, or else repeats the last one
+	// given (RFC 1035). Without either, only an SOA can fall back to its
+	// minimum field, which is what BIND does.
+	defaultTTL, hasDefault := p.ttl, p.hasTTL
+	if !hasDefault {
+		defaultTTL, hasDefault = p.lastTTL, p.hasLastTTL
+	}
+	explicit := hasExplicitTTL(fields)
+
+	rec, err := parseRecordFields(owner, fields, p.origin, defaultTTL)
+	if err != nil {
+		return err
+	}
+	if class := recordClass(rec); class != ClassIN {
+		return fmt.Errorf("Record for %s is of class %s; zones are of class IN", fqdn(owner), className(class))
+	}
+	if !explicit && !hasDefault {
+		soa, ok := rec.(*SOARecord)
+		if !ok {
+			return fmt.Errorf("Missing TTL for %s", fqdn(owner))
+		}
+		soa.TTL = soa.Minimum
+	}
+	if explicit || !hasDefault {
+		p.lastTTL = recordTTL(rec)
+		p.hasLastTTL = true
+	}
+
+	p.lastOwner = owner
+	p.records = append(p.records, rec)
+	return nil
+}
+
+func hasExplicitTTL(fields []string) bool {
+	for _, field := range fields {
+		if isDigit(field[0]) {
+			return true
+		}
+		if _, ok := parseClass(field); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+// WriteZoneFile saves records to path in master file format. The file is
+// replaced atomically, so a crash never leaves half a zone behind.
+func WriteZoneFile(path string, origin string, records []DnsRecord) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	fmt.Fprintf(writer, "; Zone %s, written by godns after a dynamic update.\n", fqdn(origin))
+	fmt.Fprintf(writer, "$ORIGIN %s\n", fqdn(origin))
+	for _, rec := range records {
+		fmt.Fprintln(writer, rec)
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
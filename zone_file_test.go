@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func recordStrings(records []DnsRecord) []string {
+	lines := []string{}
+	for _, rec := range records {
+		lines = append(lines, rec.String())
+	}
+	return lines
+}
+
+func TestParseZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "hosts.inc", `
+host1   A 192.0.2.11
+host2   A 192.0.2.12
+`)
+	path := writeTestFile(t, dir, "example.com.zone", `
+$TTL 1h
+@   IN  SOA ns1 hostmaster (
+        2024010101 ; serial
+        7200       ; refresh
+        3600 1209600
+        300 )
+    IN  NS  ns1
+    IN  NS  ns2.example.net.
+ns1 300 IN A 192.0.2.1
+www IN 60 A 192.0.2.2
+        AAAA 2001:db8::2     ; owner and TTL of the line above
+mail    MX 10 @
+txt     TXT "semicolon; inside" "and \"quotes\""
+$ORIGIN sub.example.com.
+deep    A 192.0.2.3
+$INCLUDE hosts.inc lan.example.com.
+after   A 192.0.2.4
+`)
+	records, err := ParseZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 3600 IN NS ns2.example.net.",
+		"ns1.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 60 IN A 192.0.2.2",
+		"www.example.com. 3600 IN AAAA 2001:db8::2",
+		"mail.example.com. 3600 IN MX 10 example.com.",
+		`txt.example.com. 3600 IN TXT "semicolon; inside" "and \"quotes\""`,
+		"deep.sub.example.com. 3600 IN A 192.0.2.3",
+		"host1.lan.example.com. 3600 IN A 192.0.2.11",
+		"host2.lan.example.com. 3600 IN A 192.0.2.12",
+		// The origin set for the included file doesn't leak out of it.
+		"after.sub.example.com. 3600 IN A 192.0.2.4",
+	}
+	if got := recordStrings(records); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ParseZoneFile:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseZoneFileTTLs(t *testing.T) {
+	// Without $TTL an omitted TTL repeats the last one, and the SOA falls
+	// back to its minimum field.
+	path := writeTestFile(t, t.TempDir(), "zone", `
+@ IN SOA ns1 hostmaster 1 7200 3600 1209600 300
+ns1 600 A 192.0.2.1
+ns2 A 192.0.2.2
+`)
+	records, err := ParseZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ttl := range []uint32{300, 600, 600} {
+		if recordTTL(records[i]) != ttl {
+			t.Errorf("%v: TTL %d, want %d", records[i], recordTTL(records[i]), ttl)
+		}
+	}
+}
+
+func TestParseZoneFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"www A 192.0.2.1\n":                         "Missing TTL",
+		"$TTL 60\nwww A 192.0.2.1 (\n":              "Unclosed parenthesis",
+		"$TTL 60\nwww A 192.0.2.1 )\n":              "Unbalanced",
+		"$TTL 60\nwww CH TXT \"x\"\n":               "class CH",
+		"$TTL 60\n$INCLUDE missing.inc\n":           "missing.inc",
+		"$TTL 60\n$ORIGIN\n":                        "$ORIGIN",
+		"$TTL 60\nwww A 192.0.2.1\nbad A 999.0.0.1": ":3:",
+	}
+	for content, want := range cases {
+		path := writeTestFile(t, t.TempDir(), "zone", content)
+		_, err := ParseZoneFile(path, "example.com")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseZoneFile(%q): %v, want an error containing %q", content, err, want)
+		}
+	}
+
+	// A file that includes itself stops at the nesting limit.
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "loop.zone", "$TTL 60\n$INCLUDE loop.zone\n")
+	if _, err := ParseZoneFile(path, "example.com"); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+		t.Errorf("self-including file: %v", err)
+	}
+}
+
+func TestWriteZoneFileRoundTrip(t *testing.T) {
+	records := testRecords(t,
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 5 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 60 IN AAAA 2001:db8::2",
+		`txt.example.com. 60 IN TXT "a ; b" "c\"d"`,
+		"*.wild.example.com. 60 IN MX 10 mail.example.com.",
+		"other.example.com. 60 IN TYPE65280 \\# 2 beef",
+	)
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	if err := WriteZoneFile(path, "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseZoneFile(path, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(recordStrings(again), "\n"), strings.Join(recordStrings(records), "\n"); got != want {
+		t.Errorf("round trip changed the zone:\n%s\nwant:\n%s", got, want)
+	}
+	if matches, _ := filepath.Glob(path + ".tmp*"); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
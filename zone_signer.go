@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Online signing of primary zones (RFC 4035 section 2). Whenever a zone
+// is loaded or changed, its DNSKEY set is put at the apex, every RRset
+// godns is authoritative for gets an RRSIG, and an NSEC or NSEC3 chain is
+// built for authenticated denial of existence. Signatures of unchanged
+// RRsets are kept until a quarter of their validity remains; renewing
+// them is a change like any other and increments the serial, so that
+// secondaries pick up the new signatures.
+
+const defaultSignatureValidity = 14 * 24 * 60 * 60
+
+// Signatures are dated back this far to allow for clocks running behind.
+const signatureInceptionOffset = time.Hour
+
+// The signing loop never runs more often than this.
+const minResignInterval = time.Minute
+
+type zoneSigner struct {
+	origin   string
+	ksks     []*SigningKey
+	zsks     []*SigningKey
+	nsec3    *NSEC3Config
+	salt     []byte
+	validity time.Duration
+
+	// signatures keeps the RRSIGs of the last run by owner name and type,
+	// with the RRset they were made for.
+	signatures map[string]signedRRset
+	// next is when the first of the current signatures needs renewing.
+	next time.Time
+}
+
+type signedRRset struct {
+	data string
+	sigs []DnsRecord
+}
+
+func newZoneSigner(origin string, config *SigningConfig) (*zoneSigner, error) {
+	if len(config.Keys) == 0 {
+		return nil, errors.New("DNSSEC signing needs at least one key")
+	}
+	s := &zoneSigner{
+		origin:     normalizeName(origin),
+		nsec3:      config.NSEC3,
+		validity:   time.Duration(config.SignatureValidity) * time.Second,
+		signatures: map[string]signedRRset{},
+	}
+	if config.SignatureValidity == 0 {
+		s.validity = defaultSignatureValidity * time.Second
+	}
+	if s.validity <= 4*signatureInceptionOffset {
+		return nil, fmt.Errorf("Signature validity of %d seconds is too short", config.SignatureValidity)
+	}
+	if s.nsec3 != nil {
+		salt, err := hex.DecodeString(s.nsec3.Salt)
+		if err != nil || len(salt) > 255 {
+			return nil, fmt.Errorf("Invalid NSEC3 salt %q", s.nsec3.Salt)
+		}
+		if s.nsec3.Iterations > maxNSEC3Iterations {
+			return nil, fmt.Errorf("NSEC3 iterations must be at most %d", maxNSEC3Iterations)
+		}
+		s.salt = salt
+	}
+
+	for _, keyConfig := range config.Keys {
+		key, err := LoadSigningKey(keyConfig, s.origin)
+		if err != nil {
+			return nil, err
+		}
+		if keyConfig.KSK {
+			s.ksks = append(s.ksks, key)
+		} else {
+			s.zsks = append(s.zsks, key)
+		}
+	}
+	// A lone kind of key signs everything.
+	if len(s.ksks) == 0 {
+		s.ksks = s.zsks
+	}
+	if len(s.zsks) == 0 {
+		s.zsks = s.ksks
+	}
+	return s, nil
+}
+
+// keys returns every key once.
+func (s *zoneSigner) keys() []*SigningKey {
+	keys := append([]*SigningKey(nil), s.ksks...)
+	for _, key := range s.zsks {
+		if !s.isKSK(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *zoneSigner) isKSK(key *SigningKey) bool {
+	for _, ksk := range s.ksks {
+		if ksk == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ownKey reports whether rec is the DNSKEY of one of our keys.
+func (s *zoneSigner) ownKey(rec DnsRecord) bool {
+	dnskey, ok := rec.(*DNSKEYRecord)
+	if !ok {
+		return false
+	}
+	for _, key := range s.keys() {
+		if anchoredBy(dnskey, key.DNSKEY) && dnskey.Flags == key.DNSKEY.Flags {
+			return true
+		}
+	}
+	return false
+}
+
+// unsigned drops the records the signer generates, leaving the zone as
+// it would be written to its master file.
+func (s *zoneSigner) unsigned(records []DnsRecord) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range records {
+		if !isSignerType(recordType(rec)) && !s.ownKey(rec) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// Sign signs records, which may already carry DNSSEC records from an
+// earlier run. current is the version of the zone being served, if any:
+// a change that doesn't come with a newer serial increments it, and no
+// change at all leaves current as it is.
+func (s *zoneSigner) Sign(records []DnsRecord, current []DnsRecord) ([]DnsRecord, error) {
+	now := time.Now()
+	unsigned := s.unsigned(records)
+	signed, err := s.signRecords(unsigned, now)
+	if err != nil || current == nil {
+		return signed, err
+	}
+
+	oldSOA := filterRecords(current, SOA)[0].(*SOARecord)
+	newSOA := filterRecords(signed, SOA)[0].(*SOARecord)
+	if serialLess(oldSOA.Serial, newSOA.Serial) {
+		return signed, nil
+	}
+	deleted, added := diffRecords(withoutSOASignatures(current), withoutSOASignatures(signed))
+	if len(deleted) == 0 && len(added) == 0 {
+		// Nothing changed but maybe an older serial from the master
+		// file, which doesn't know about earlier re-signing.
+		return current, nil
+	}
+
+	bumped := *newSOA
+	bumped.Serial = oldSOA.Serial + 1
+	for i, rec := range unsigned {
+		if recordType(rec) == SOA {
+			unsigned[i] = &bumped
+		}
+	}
+	return s.signRecords(unsigned, now)
+}
+
+func withoutSOASignatures(records []DnsRecord) []DnsRecord {
+	result := []DnsRecord{}
+	for _, rec := range records {
+		if sig, ok := rec.(*RRSIGRecord); !ok || sig.TypeCovered != SOA {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+// signRecords builds the signed zone from records without any DNSSEC
+// records of our own.
+func (s *zoneSigner) signRecords(records []DnsRecord, now time.Time) ([]DnsRecord, error) {
+	byName := map[string][]DnsRecord{}
+	for _, rec := range records {
+		owner := normalizeName(recordDomain(rec))
+		byName[owner] = append(byName[owner], rec)
+	}
+	soas := filterRecords(byName[s.origin], SOA)
+	if len(soas) != 1 {
+		return nil, fmt.Errorf("Zone %s needs exactly one SOA record, found %d", fqdn(s.origin), len(soas))
+	}
+	soa := soas[0].(*SOARecord)
+	// Negative answers are cached for the smaller of the two (RFC 9077).
+	negativeTTL := min(soa.TTL, soa.Minimum)
+
+	for _, key := range s.keys() {
+		key.DNSKEY.TTL = soa.TTL
+		dnskey := *key.DNSKEY
+		byName[s.origin] = append(byName[s.origin], &dnskey)
+	}
+	if s.nsec3 != nil {
+		byName[s.origin] = append(byName[s.origin], &NSEC3PARAMRecord{
+			Domain:        s.origin,
+			HashAlgorithm: nsec3HashSHA1,
+			Iterations:    s.nsec3.Iterations,
+			Salt:          s.salt,
+		})
+	}
+
+	// Delegations and the glue below them aren't signed, except for the
+	// DS records at the cut.
+	cuts := map[string]bool{}
+	for name, recs := range byName {
+		if name != s.origin && len(filterRecords(recs, NS)) > 0 {
+			cuts[name] = true
+		}
+	}
+	names := []string{}
+	for name := range byName {
+		glue := false
+		for ancestor := parentName(name); isSubdomain(ancestor, s.origin) && ancestor != name; ancestor = parentName(ancestor) {
+			if cuts[ancestor] {
+				glue = true
+			}
+			if ancestor == s.origin || ancestor == "" {
+				break
+			}
+		}
+		if !glue {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalNameLess(names[i], names[j]) })
+
+	var chain []DnsRecord
+	if s.nsec3 != nil {
+		chain = s.nsec3Chain(names, byName, cuts, negativeTTL)
+	} else {
+		chain = s.nsecChain(names, byName, cuts, negativeTTL)
+	}
+	for _, rec := range chain {
+		owner := normalizeName(recordDomain(rec))
+		byName[owner] = append(byName[owner], rec)
+	}
+	if s.nsec3 != nil {
+		for _, rec := range chain {
+			names = append(names, normalizeName(recordDomain(rec)))
+		}
+	}
+
+	signatures := map[string]signedRRset{}
+	next := time.Time{}
+	for _, name := range names {
+		for _, rrset := range groupRRsets(byName[name]) {
+			if qtype := recordType(rrset[0]); cuts[name] && qtype != DS && qtype != NSEC {
+				continue
+			}
+			entry, err := s.signRRset(rrset, now)
+			if err != nil {
+				return nil, err
+			}
+			signatures[fmt.Sprintf("%s/%d", name, recordType(rrset[0]))] = entry
+			byName[name] = append(byName[name], entry.sigs...)
+			for _, rec := range entry.sigs {
+				renew := time.Unix(int64(rec.(*RRSIGRecord).Expiration), 0).Add(-s.validity / 4)
+				if next.IsZero() || renew.Before(next) {
+					next = renew
+				}
+			}
+		}
+	}
+	s.signatures = signatures
+	s.next = next
+	return listRecords(s.origin, byName), nil
+}
+
+// signRRset signs an RRset, or returns the signatures from the last run
+// if the RRset hasn't changed and they are still fresh.
+func (s *zoneSigner) signRRset(rrset []DnsRecord, now time.Time) (signedRRset, error) {
+	owner := normalizeName(recordDomain(rrset[0]))
+	qtype := recordType(rrset[0])
+	keys := make([]string, 0, len(rrset))
+	for _, rec := range rrset {
+		keys = append(keys, recordKey(rec))
+	}
+	sort.Strings(keys)
+	data := fmt.Sprintf("%d %s", recordTTL(rrset[0]), strings.Join(keys, " "))
+
+	if last, ok := s.signatures[fmt.Sprintf("%s/%d", owner, qtype)]; ok && last.data == data && s.fresh(last.sigs, now) {
+		return last, nil
+	}
+
+	signers := s.zsks
+	if qtype == DNSKEY {
+		signers = s.ksks
+	}
+	inception := uint32(now.Add(-signatureInceptionOffset).Unix())
+	expiration := uint32(now.Add(s.validity).Unix())
+	entry := signedRRset{data: data}
+	for _, key := range signers {
+		sig, err := key.Sign(rrset, inception, expiration)
+		if err != nil {
+			return signedRRset{}, fmt.Errorf("Signing %s %s: %v", fqdn(owner), QueryTypeFromNum(qtype), err)
+		}
+		entry.sigs = append(entry.sigs, sig)
+	}
+	return entry, nil
+}
+
+func (s *zoneSigner) fresh(sigs []DnsRecord, now time.Time) bool {
+	for _, rec := range sigs {
+		expiration := time.Unix(int64(rec.(*RRSIGRecord).Expiration), 0)
+		if expiration.Sub(now) < s.validity/4 {
+			return false
+		}
+	}
+	return len(sigs) > 0
+}
+
+// typesAt lists the types an NSEC or NSEC3 record at name has to show.
+// Only the NS and DS records at a delegation belong to this zone.
+func typesAt(records []DnsRecord, cut bool) []uint16 {
+	types := []uint16{}
+	for _, rec := range records {
+		qtype := recordType(rec)
+		if cut && qtype != NS && qtype != DS {
+			continue
+		}
+		if !hasType(types, qtype) {
+			types = append(types, qtype)
+		}
+	}
+	return types
+}
+
+// nsecChain links the names of the zone in canonical order, the last one
+// pointing back to the apex (RFC 4034 section 4).
+func (s *zoneSigner) nsecChain(names []string, byName map[string][]DnsRecord, cuts map[string]bool, ttl uint32) []DnsRecord {
+	chain := []DnsRecord{}
+	for i, name := range names {
+		types := append(typesAt(byName[name], cuts[name]), NSEC, RRSIG)
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		chain = append(chain, &NSECRecord{
+			Domain:     name,
+			NextDomain: names[(i+1)%len(names)],
+			Types:      types,
+			TTL:        ttl,
+		})
+	}
+	return chain
+}
+
+// nsec3Chain links the hashes of the names of the zone, including empty
+// non-terminals (RFC 5155 section 7.1). With opt-out, delegations without
+// DS records are left out.
+func (s *zoneSigner) nsec3Chain(names []string, byName map[string][]DnsRecord, cuts map[string]bool, ttl uint32) []DnsRecord {
+	var flags uint8
+	if s.nsec3.OptOut {
+		flags = NSEC3OptOut
+	}
+
+	hashed := map[string][]byte{}
+	for _, name := range names {
+		if s.nsec3.OptOut && cuts[name] && len(filterRecords(byName[name], DS)) == 0 {
+			continue
+		}
+		for ancestor := name; hashed[ancestor] == nil; ancestor = parentName(ancestor) {
+			hash, err := nsec3Hash(ancestor, s.salt, s.nsec3.Iterations)
+			if err != nil {
+				break
+			}
+			hashed[ancestor] = hash
+			if ancestor == s.origin || ancestor == "" {
+				break
+			}
+		}
+	}
+	ordered := make([]string, 0, len(hashed))
+	for name := range hashed {
+		ordered = append(ordered, name)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return string(hashed[ordered[i]]) < string(hashed[ordered[j]]) })
+
+	chain := []DnsRecord{}
+	for i, name := range ordered {
+		types := typesAt(byName[name], cuts[name])
+		if len(types) > 0 && (!cuts[name] || hasType(types, DS)) {
+			types = append(types, RRSIG)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		chain = append(chain, &NSEC3Record{
+			Domain:        nsec3Owner(hashed[name], s.origin),
+			HashAlgorithm: nsec3HashSHA1,
+			Flags:         flags,
+			Iterations:    s.nsec3.Iterations,
+			Salt:          s.salt,
+			NextHashed:    hashed[ordered[(i+1)%len(ordered)]],
+			Types:         types,
+			TTL:           ttl,
+		})
+	}
+	return chain
+}
+
+// nsec3Owner is the name of the NSEC3 record for a hash in zone.
+func nsec3Owner(hash []byte, zone string) string {
+	label := strings.ToLower(nsec3Encoding.EncodeToString(hash))
+	if zone == "" {
+		return label
+	}
+	return label + "." + zone
+}
+
+// maintainSignatures renews signatures before they expire, for the
+// lifetime of a signed zone.
+func (z *Zone) maintainSignatures() {
+	for {
+		z.mu.RLock()
+		wait := time.Until(z.signer.next)
+		z.mu.RUnlock()
+		time.Sleep(max(wait, minResignInterval))
+
+		if err := z.resign(); err != nil {
+			fmt.Printf("Failed to sign zone %s: %v\n", fqdn(z.Origin), err)
+		}
+	}
+}
+
+func (z *Zone) resign() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	current := z.allRecords()
+	records, err := z.signer.Sign(current, current)
+	if err != nil {
+		return err
+	}
+	byName, nodes, err := indexRecords(z.Origin, records)
+	if err != nil {
+		return err
+	}
+	z.replace(records, byName, nodes)
+	return nil
+}
+
+// isSignerType reports whether records of qtype are maintained by the
+// signer rather than the zone's owner.
+func isSignerType(qtype uint16) bool {
+	switch qtype {
+	case RRSIG, NSEC, NSEC3, NSEC3PARAM:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigner(t *testing.T, nsec3 *NSEC3Config) *zoneSigner {
+	t.Helper()
+	signer, err := newZoneSigner("example.com", &SigningConfig{
+		Keys: []SigningKeyConfig{
+			{File: testKeyFile(t, AlgECDSAP256SHA256), KSK: true},
+			{File: testKeyFile(t, AlgED25519)},
+		},
+		NSEC3: nsec3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// checkSignatures verifies every RRset of a signed zone with the key its
+// RRSIG names, and returns the RRsets that have no signature.
+func checkSignatures(t *testing.T, signer *zoneSigner, records []DnsRecord) []string {
+	t.Helper()
+	keys := map[uint16]*SigningKey{}
+	for _, key := range signer.keys() {
+		keys[key.DNSKEY.KeyTag()] = key
+	}
+	unsigned := []string{}
+	for _, rrset := range groupRRsets(records) {
+		owner := normalizeName(recordDomain(rrset[0]))
+		qtype := recordType(rrset[0])
+		sigs := signaturesFor(records, owner, qtype)
+		if len(sigs) == 0 {
+			unsigned = append(unsigned, fqdn(owner)+" "+QueryTypeFromNum(qtype).String())
+		}
+		for _, sig := range sigs {
+			key := keys[sig.KeyTag]
+			if err := verifyRRSIG(sig, key.DNSKEY, rrset, time.Now()); err != nil {
+				t.Errorf("%s %v: %v", fqdn(owner), QueryTypeFromNum(qtype), err)
+			}
+			if ksk := signer.isKSK(key); ksk != (qtype == DNSKEY) {
+				t.Errorf("%s %v signed with the KSK: %v", fqdn(owner), QueryTypeFromNum(qtype), ksk)
+			}
+		}
+	}
+	return unsigned
+}
+
+func TestSignZone(t *testing.T) {
+	signer := testSigner(t, nil)
+	records, err := signer.Sign(exampleZone(t).Records(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The delegation's NS and glue are left unsigned; everything else,
+	// including the DS at the cut, is signed.
+	unsigned := checkSignatures(t, signer, records)
+	if got := strings.Join(unsigned, ", "); got != "ns.sub.example.com. A, sub.example.com. NS" {
+		t.Errorf("unsigned RRsets: %s", got)
+	}
+	if n := len(filterRecords(records, DNSKEY)); n != 2 {
+		t.Errorf("%d DNSKEY records at the apex", n)
+	}
+
+	// The NSEC chain runs through the names in canonical order, skips the
+	// glue and the empty non-terminal, and leads back to the apex.
+	want := []string{
+		"example.com. 300 IN NSEC alias.example.com. NS SOA MX RRSIG NSEC DNSKEY",
+		"alias.example.com. 300 IN NSEC a.b.example.com. CNAME RRSIG NSEC",
+		"a.b.example.com. 300 IN NSEC chain.example.com. A RRSIG NSEC",
+		"chain.example.com. 300 IN NSEC mail.example.com. CNAME RRSIG NSEC",
+		"mail.example.com. 300 IN NSEC ns1.example.com. A RRSIG NSEC",
+		"ns1.example.com. 300 IN NSEC outside.example.com. A RRSIG NSEC",
+		"outside.example.com. 300 IN NSEC sub.example.com. CNAME RRSIG NSEC",
+		"sub.example.com. 300 IN NSEC www.example.com. NS DS RRSIG NSEC",
+		"www.example.com. 300 IN NSEC example.com. A RRSIG NSEC",
+	}
+	if got := sortedStrings(filterRecords(records, NSEC)); got != sortedStrings(testRecords(t, want...)) {
+		t.Errorf("NSEC chain:\n%s", got)
+	}
+
+	// Without the records the signer made, the zone is what it started
+	// out as.
+	if got, want := sortedStrings(signer.unsigned(records)), sortedStrings(exampleZone(t).Records()); got != want {
+		t.Errorf("unsigned zone:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestResign(t *testing.T) {
+	signer := testSigner(t, nil)
+	first, err := signer.Sign(exampleZone(t).Records(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigOf := func(records []DnsRecord, owner string, qtype uint16) []byte {
+		sigs := signaturesFor(records, owner, qtype)
+		if len(sigs) != 1 {
+			t.Fatalf("%s %v has %d signatures", owner, QueryTypeFromNum(qtype), len(sigs))
+		}
+		return sigs[0].Signature
+	}
+
+	// Signing an unchanged zone again changes nothing.
+	again, err := signer.Sign(first, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(recordStrings(again), "\n") != strings.Join(recordStrings(first), "\n") {
+		t.Error("re-signing an unchanged zone changed it")
+	}
+
+	// A change without a new serial gets one. Only the changed RRset and
+	// the records that depend on it are signed again.
+	changed := signer.unsigned(first)
+	for i, rec := range changed {
+		if a, ok := rec.(*ARecord); ok && a.Domain == "www.example.com" {
+			updated := *a
+			updated.TTL = 60
+			changed[i] = &updated
+		}
+	}
+	second, err := signer.Sign(changed, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := filterRecords(second, SOA)[0].(*SOARecord).Serial; serial != 2 {
+		t.Errorf("serial after a change: %d", serial)
+	}
+	if bytes.Equal(sigOf(first, "www.example.com", A), sigOf(second, "www.example.com", A)) {
+		t.Error("changed RRset kept its signature")
+	}
+	if bytes.Equal(sigOf(first, "example.com", SOA), sigOf(second, "example.com", SOA)) {
+		t.Error("SOA with a new serial kept its signature")
+	}
+	if !bytes.Equal(sigOf(first, "mail.example.com", A), sigOf(second, "mail.example.com", A)) {
+		t.Error("unchanged RRset was signed again")
+	}
+
+	// Signatures with less than a quarter of their validity left are
+	// renewed.
+	later := time.Now().Add(signer.validity * 4 / 5)
+	if !signer.next.Before(later) {
+		t.Errorf("next re-signing at %v, after %v", signer.next, later)
+	}
+	renewed, err := signer.signRecords(signer.unsigned(second), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sigOf(second, "mail.example.com", A), sigOf(renewed, "mail.example.com", A)) {
+		t.Error("old signature wasn't renewed")
+	}
+}
+
+func TestNSEC3Chain(t *testing.T) {
+	signer := testSigner(t, &NSEC3Config{Iterations: 2, Salt: "beef", OptOut: true})
+	records := append(exampleZone(t).Records(), testRecords(t,
+		"unsigned.example.com. 3600 IN NS ns.unsigned.example.com.",
+		"ns.unsigned.example.com. 3600 IN A 192.0.2.54",
+	)...)
+	signed, err := signer.Sign(records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSignatures(t, signer, signed)
+	if params := filterRecords(signed, NSEC3PARAM); len(params) != 1 || params[0].String() != "example.com. 0 IN NSEC3PARAM 1 0 2 BEEF" {
+		t.Errorf("NSEC3PARAM: %v", params)
+	}
+
+	chain := map[string]*NSEC3Record{}
+	for _, rec := range filterRecords(signed, NSEC3) {
+		nsec3 := rec.(*NSEC3Record)
+		chain[normalizeName(nsec3.Domain)] = nsec3
+		if nsec3.Flags != NSEC3OptOut || nsec3.Iterations != 2 || nsec3.TTL != 300 {
+			t.Errorf("unexpected NSEC3 parameters: %v", nsec3)
+		}
+	}
+	owner := func(name string) string {
+		hash, err := nsec3Hash(name, []byte{0xbe, 0xef}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nsec3Owner(hash, "example.com")
+	}
+
+	// Every name has a record, including the empty non-terminal, but not
+	// the glue or the delegation without DS, which is opted out.
+	for name, types := range map[string]string{
+		"example.com":     "NS SOA MX RRSIG DNSKEY NSEC3PARAM",
+		"b.example.com":   "",
+		"a.b.example.com": "A RRSIG",
+		"sub.example.com": "NS DS RRSIG",
+		"www.example.com": "A RRSIG",
+	} {
+		nsec3, ok := chain[owner(name)]
+		if !ok {
+			t.Errorf("no NSEC3 record for %s", name)
+			continue
+		}
+		if got := formatTypes(nsec3.Types); got != types {
+			t.Errorf("NSEC3 record for %s has types %q, want %q", name, got, types)
+		}
+	}
+	for _, name := range []string{"ns.sub.example.com", "unsigned.example.com", "ns.unsigned.example.com"} {
+		if _, ok := chain[owner(name)]; ok {
+			t.Errorf("NSEC3 record for %s", name)
+		}
+	}
+
+	// The records form a single loop.
+	start := owner("example.com")
+	name := start
+	for i := 0; i < len(chain); i++ {
+		name = nsec3Owner(chain[name].NextHashed, "example.com")
+	}
+	if name != start || len(chain) != 10 {
+		t.Errorf("%d NSEC3 records don't form a loop", len(chain))
+	}
+}
+
+func TestSignedZoneChainFollowsUpdates(t *testing.T) {
+	zone := loadTestZone(t, "example.com", testKeyFile(t, AlgECDSAP256SHA256), &NSEC3Config{}, exampleZone(t).Records())
+	hasNSEC3 := func(name string) bool {
+		hash, _ := nsec3Hash(name, nil, 0)
+		return len(zone.records[nsec3Owner(hash, "example.com")]) > 0
+	}
+	if hasNSEC3("new.example.com") {
+		t.Fatal("NSEC3 record for a name that doesn't exist yet")
+	}
+
+	if rcode := zone.Update(nil, testRecords(t, "new.example.com. 300 IN A 192.0.2.9")); rcode != NOERROR {
+		t.Fatal(rcode)
+	}
+	if !hasNSEC3("new.example.com") || len(signaturesFor(zone.Records(), "new.example.com", A)) != 1 {
+		t.Error("added name isn't in the NSEC3 chain or isn't signed")
+	}
+
+	if rcode := zone.Update(nil, testRecords(t, "www.example.com. 0 ANY ANY \\# 0")); rcode != NOERROR {
+		t.Fatal(rcode)
+	}
+	if hasNSEC3("www.example.com") {
+		t.Error("deleted name is still in the NSEC3 chain")
+	}
+	if response := answer(zone, "www.example.com", A); response.Header.ResCode != NXDOMAIN || len(filterRecords(response.Authorities, NSEC3)) == 0 {
+		t.Errorf("deleted name isn't denied:\n%v", response)
+	}
+}
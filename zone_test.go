@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testZone(t *testing.T, origin string, lines ...string) *Zone {
+	t.Helper()
+	zone, err := NewZone(origin, testRecords(t, lines...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zone
+}
+
+func exampleZone(t *testing.T) *Zone {
+	return testZone(t, "example.com",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"example.com. 300 IN MX 10 mail.example.com.",
+		"ns1.example.com. 3600 IN A 192.0.2.1",
+		"mail.example.com. 300 IN A 192.0.2.25",
+		"www.example.com. 300 IN A 192.0.2.2",
+		"alias.example.com. 300 IN CNAME www.example.com.",
+		"chain.example.com. 300 IN CNAME alias.example.com.",
+		"outside.example.com. 300 IN CNAME www.example.net.",
+		"a.b.example.com. 300 IN A 192.0.2.3",
+		"sub.example.com. 3600 IN NS ns.sub.example.com.",
+		"sub.example.com. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF",
+		"ns.sub.example.com. 3600 IN A 192.0.2.53",
+	)
+}
+
+func answer(zone *Zone, qname string, qtype uint16) *DnsPacket {
+	response := NewDnsPacket()
+	zone.Answer(NewDnsQuestion(qname, QueryTypeFromNum(qtype)), response)
+	return response
+}
+
+// sections prints the records of a response, one section per line.
+func sections(response *DnsPacket) string {
+	return strings.Join([]string{
+		strings.Join(recordStrings(response.Answers), " | "),
+		strings.Join(recordStrings(response.Authorities), " | "),
+		strings.Join(recordStrings(response.Resources), " | "),
+	}, "\n")
+}
+
+func TestZoneAnswer(t *testing.T) {
+	zone := exampleZone(t)
+	soa := "example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+
+	cases := []struct {
+		qname    string
+		qtype    uint16
+		rcode    ResultCode
+		aa       bool
+		sections string
+	}{
+		{"www.example.com", A, NOERROR, true, "www.example.com. 300 IN A 192.0.2.2\n\n"},
+		{"WWW.Example.COM.", A, NOERROR, true, "www.example.com. 300 IN A 192.0.2.2\n\n"},
+		{"example.com", MX, NOERROR, true, "example.com. 300 IN MX 10 mail.example.com.\n\nmail.example.com. 300 IN A 192.0.2.25"},
+		// The negative TTL is capped by the SOA minimum (RFC 2308).
+		{"missing.example.com", A, NXDOMAIN, true, "\n" + soa + "\n"},
+		{"www.example.com", AAAA, NOERROR, true, "\n" + soa + "\n"},
+		// b.example.com is an empty non-terminal, which exists.
+		{"b.example.com", A, NOERROR, true, "\n" + soa + "\n"},
+		{"chain.example.com", A, NOERROR, true, "chain.example.com. 300 IN CNAME alias.example.com. | alias.example.com. 300 IN CNAME www.example.com. | www.example.com. 300 IN A 192.0.2.2\n\n"},
+		{"alias.example.com", CNAME, NOERROR, true, "alias.example.com. 300 IN CNAME www.example.com.\n\n"},
+		{"outside.example.com", A, NOERROR, true, "outside.example.com. 300 IN CNAME www.example.net.\n\n"},
+		{"www.sub.example.com", A, NOERROR, false, "\nsub.example.com. 3600 IN NS ns.sub.example.com.\nns.sub.example.com. 3600 IN A 192.0.2.53"},
+		{"sub.example.com", NS, NOERROR, false, "\nsub.example.com. 3600 IN NS ns.sub.example.com.\nns.sub.example.com. 3600 IN A 192.0.2.53"},
+		// The parent is authoritative for the DS records of a cut.
+		{"sub.example.com", DS, NOERROR, true, "sub.example.com. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF\n\n"},
+	}
+	for _, c := range cases {
+		response := answer(zone, c.qname, c.qtype)
+		if response.Header.ResCode != c.rcode || response.Header.AuthoritativeAnswer != c.aa {
+			t.Errorf("%s %v: rcode %v and AA %v, want %v and %v", c.qname, QueryTypeFromNum(c.qtype),
+				response.Header.ResCode, response.Header.AuthoritativeAnswer, c.rcode, c.aa)
+		}
+		if got := sections(response); got != c.sections {
+			t.Errorf("%s %v:\n%s\nwant:\n%s", c.qname, QueryTypeFromNum(c.qtype), got, c.sections)
+		}
+	}
+}
+
+func TestNewZoneRejectsForeignRecords(t *testing.T) {
+	_, err := NewZone("example.com", testRecords(t,
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"www.example.net. 300 IN A 192.0.2.1",
+	))
+	if err == nil {
+		t.Error("NewZone accepted a record outside the zone")
+	}
+	if _, err := NewZone("example.com", testRecords(t, "www.example.com. 300 IN A 192.0.2.1")); err == nil {
+		t.Error("NewZone accepted a zone without SOA")
+	}
+}
+
+func TestZoneStoreFind(t *testing.T) {
+	store := NewZoneStore()
+	parent := testZone(t, "example.com", "example.com. 3600 IN SOA ns1.example.com. h.example.com. 1 7200 3600 1209600 300")
+	child := testZone(t, "sub.example.com", "sub.example.com. 3600 IN SOA ns1.example.com. h.example.com. 1 7200 3600 1209600 300")
+	for _, zone := range []*Zone{parent, child} {
+		if err := store.Add(zone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Add(parent); err == nil {
+		t.Error("the same zone was added twice")
+	}
+
+	cases := map[string]*Zone{
+		"example.com":              parent,
+		"www.Example.com.":         parent,
+		"sub.example.com":          child,
+		"deep.www.sub.example.com": child,
+		"example.net":              nil,
+		"com":                      nil,
+	}
+	for qname, want := range cases {
+		if got := store.Find(qname); got != want {
+			t.Errorf("Find(%q) = %v, want %v", qname, got, want)
+		}
+	}
+}
+
+func TestZoneWildcards(t *testing.T) {
+	zone := testZone(t, "example.com",
+		"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300",
+		"example.com. 3600 IN NS ns1.example.com.",
+		"ns1.example.com. 3600 IN A 192.0.2.1",
+		"*.example.com. 300 IN TXT \"wild\"",
+		"*.example.com. 300 IN MX 10 ns1.example.com.",
+		"host1.example.com. 300 IN A 192.0.2.10",
+		"sub.*.example.com. 300 IN TXT \"below the wildcard\"",
+		"_ssh._tcp.host1.example.com. 300 IN TXT \"service\"",
+		"*.cname.example.com. 300 IN CNAME host1.example.com.",
+	)
+	soa := "example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 3600 1209600 300"
+
+	// The examples of RFC 4592 section 2.2.1, and CNAMEs.
+	cases := []struct {
+		qname    string
+		qtype    uint16
+		rcode    ResultCode
+		sections string
+	}{
+		{"host3.example.com", MX, NOERROR, "host3.example.com. 300 IN MX 10 ns1.example.com.\n\nns1.example.com. 3600 IN A 192.0.2.1"},
+		{"host3.example.com", A, NOERROR, "\n" + soa + "\n"},
+		{"foo.bar.example.com", TXT, NOERROR, "foo.bar.example.com. 300 IN TXT \"wild\"\n\n"},
+		// Existing names aren't matched by the wildcard.
+		{"host1.example.com", MX, NOERROR, "\n" + soa + "\n"},
+		// _tcp.host1.example.com is an empty non-terminal, which stops
+		// the wildcard from covering names below host1.
+		{"_tcp.host1.example.com", TXT, NOERROR, "\n" + soa + "\n"},
+		{"sub.host1.example.com", TXT, NXDOMAIN, "\n" + soa + "\n"},
+		{"_telnet._tcp.host1.example.com", TXT, NXDOMAIN, "\n" + soa + "\n"},
+		// A query for the wildcard itself gets its records.
+		{"*.example.com", TXT, NOERROR, "*.example.com. 300 IN TXT \"wild\"\n\n"},
+		{"sub.*.example.com", TXT, NOERROR, "sub.*.example.com. 300 IN TXT \"below the wildcard\"\n\n"},
+		{"x.cname.example.com", A, NOERROR, "x.cname.example.com. 300 IN CNAME host1.example.com. | host1.example.com. 300 IN A 192.0.2.10\n\n"},
+	}
+	for _, c := range cases {
+		response := answer(zone, c.qname, c.qtype)
+		if response.Header.ResCode != c.rcode || !response.Header.AuthoritativeAnswer {
+			t.Errorf("%s %v: rcode %v and AA %v, want %v", c.qname, QueryTypeFromNum(c.qtype),
+				response.Header.ResCode, response.Header.AuthoritativeAnswer, c.rcode)
+		}
+		if got := sections(response); got != c.sections {
+			t.Errorf("%s %v:\n%s\nwant:\n%s", c.qname, QueryTypeFromNum(c.qtype), got, c.sections)
+		}
+	}
+
+	// Synthesizing answers leaves the wildcard records alone.
+	answer(zone, "host9.example.com", TXT)
+	if got := recordStrings(zone.records["*.example.com"]); !strings.Contains(strings.Join(got, " "), "*.example.com. 300 IN TXT") {
+		t.Errorf("wildcard records changed: %v", got)
+	}
+
+	// The wildcard at the apex of the root zone is "*".
+	root := testZone(t, ".",
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 300",
+		". 3600 IN NS ns.root.",
+		"ns.root. 3600 IN A 192.0.2.1",
+		"*. 300 IN TXT \"wild\"",
+	)
+	if got := sections(answer(root, "anything", TXT)); got != "anything. 300 IN TXT \"wild\"\n\n" {
+		t.Errorf("anything. TXT in the root zone:\n%s", got)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Zone transfers over TCP: full transfers (AXFR, RFC 5936) and
+// incremental ones (IXFR, RFC 1995) served from the zone's journal. Both
+// are sent as a stream of DnsPackets starting and ending with the SOA.
+
+// Messages are kept well below the 65535 byte limit of the TCP framing.
+const transferMessageSize = 16384
+
+const transferTimeout = 30 * time.Second
+
+func isZoneTransfer(request *DnsPacket) bool {
+	if len(request.Questions) == 0 {
+		return false
+	}
+	qtype := request.Questions[0].QType.ToNum()
+	return qtype == AXFR || qtype == IXFR
+}
+
+// clientSerial returns the serial an IXFR client has, taken from the SOA
+// in the authority section of its request.
+func clientSerial(request *DnsPacket) (uint32, bool) {
+	for _, rec := range request.Authorities {
+		if soa, ok := rec.(*SOARecord); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// serveTransfer answers a zone transfer request on a stream connection.
+// key is the TSIG key the request was signed with, if any, and write sends
+// a single message to the client.
+func serveTransfer(remote net.Addr, key string, request *DnsPacket, write func(*DnsPacket) error) error {
+	question := request.Questions[0]
+
+	newResponse := func() *DnsPacket {
+		response := NewDnsPacket()
+		response.Header.ID = request.Header.ID
+		response.Header.Response = true
+		response.Header.Opcode = request.Header.Opcode
+		return response
+	}
+
+	zone := authZones.Get(question.Name)
+	if zone == nil || !zone.AllowTransfer.Allows(remote, key) || zone.Expired() {
+		fmt.Printf("Refusing transfer of %s to %s\n", fqdn(question.Name), remote)
+		response := newResponse()
+		response.Questions = append(response.Questions, question)
+		response.Header.ResCode = REFUSED
+		return write(response)
+	}
+
+	var records []DnsRecord
+	serial, hasSerial := clientSerial(request)
+	if question.QType.ToNum() == IXFR && hasSerial {
+		records = zone.incrementalRecords(serial)
+	} else {
+		records = zone.Records()
+		records = append(records, records[0])
+	}
+	fmt.Printf("Transferring %s (%s, %d records) to %s\n", fqdn(zone.Origin), question.QType, len(records), remote)
+
+	return writeTransfer(records, newResponse, question, write)
+}
+
+// incrementalRecords returns the answer to an IXFR from serial: just the
+// current SOA if the client is up to date, the journalled differences if
+// the journal reaches back far enough, or else the whole zone.
+func (z *Zone) incrementalRecords(serial uint32) []DnsRecord {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	current := z.soa()
+	if !serialLess(serial, current.Serial) {
+		return []DnsRecord{current}
+	}
+
+	diffs, ok := z.journal.Since(serial)
+	if !ok {
+		records := z.allRecords()
+		return append(records, current)
+	}
+
+	records := []DnsRecord{current}
+	for _, diff := range diffs {
+		records = append(records, diff.OldSOA)
+		records = append(records, diff.Deleted...)
+		records = append(records, diff.NewSOA)
+		records = append(records, diff.Added...)
+	}
+	return append(records, current)
+}
+
+// writeTransfer packs records into as few messages as possible. Only the
+// first message carries the question.
+func writeTransfer(records []DnsRecord, newResponse func() *DnsPacket, question *DnsQuestion, write func(*DnsPacket) error) error {
+	response := newResponse()
+	response.Header.AuthoritativeAnswer = true
+	response.Questions = append(response.Questions, question)
+	size := 12 + len(question.Name) + 6
+
+	for _, rec := range records {
+		recSize, err := rec.Write(NewBytePacketBufferWithSize(MaxStreamMessageSize))
+		if err != nil {
+			return err
+		}
+		if size+recSize > transferMessageSize && len(response.Answers) > 0 {
+			if err := write(response); err != nil {
+				return err
+			}
+			response = newResponse()
+			response.Header.AuthoritativeAnswer = true
+			size = 12
+		}
+		response.Answers = append(response.Answers, rec)
+		size += recSize
+	}
+
+	return write(response)
+}
+
+// transferReader hands out the answer records of a multi-message zone
+// transfer one at a time, verifying the TSIG of each message if the
+// request was signed.
+type transferReader struct {
+	conn    net.Conn
+	id      uint16
+	session *tsigSession
+	pending []DnsRecord
+}
+
+func (t *transferReader) next() (DnsRecord, error) {
+	for len(t.pending) == 0 {
+		msg, err := readTCPMessage(t.conn)
+		if err != nil {
+			return nil, err
+		}
+		response, err := ReadDnsPacket(NewBytePacketBufferFromBytes(msg))
+		if err != nil {
+			return nil, err
+		}
+		if response.Header.ID != t.id {
+			return nil, errors.New("Response ID does not match the query")
+		}
+		if err := t.session.Verify(msg, response); err != nil {
+			return nil, err
+		}
+		if response.Header.ResCode != NOERROR {
+			return nil, fmt.Errorf("Zone transfer failed: %s", response.Header.ResCode)
+		}
+		t.pending = response.Answers
+	}
+
+	rec := t.pending[0]
+	t.pending = t.pending[1:]
+	return rec, nil
+}
+
+// dialTransfer sends a transfer request to the primary, signed if a key is
+// given, and returns a reader for the response.
+func dialTransfer(origin string, primary string, qtype uint16, current *SOARecord, key *TSIGKey) (*transferReader, error) {
+	conn, err := net.DialTimeout("tcp", withDefaultPort(primary, "53"), lookupTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+
+	request := NewDnsPacket()
+	request.Header.ID = uint16(rand.Intn(0x10000))
+	request.Questions = append(request.Questions, NewDnsQuestion(origin, QueryTypeFromNum(qtype)))
+	if current != nil {
+		request.Authorities = append(request.Authorities, current)
+	}
+	session := newTSIGSession(key)
+	if err := session.Sign(request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeTCPMessage(conn, request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &transferReader{conn: conn, id: request.Header.ID, session: session}, nil
+}
+
+// TransferZone pulls a full copy of a zone from primary with AXFR.
+func TransferZone(origin string, primary string, key *TSIGKey) ([]DnsRecord, error) {
+	reader, err := dialTransfer(origin, primary, AXFR, nil, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.conn.Close()
+
+	first, err := reader.next()
+	if err != nil {
+		return nil, err
+	}
+	soa, ok := first.(*SOARecord)
+	if !ok {
+		return nil, errors.New("Zone transfer does not start with an SOA record")
+	}
+	return readFullTransfer(reader, soa)
+}
+
+// readFullTransfer collects records until the closing SOA arrives.
+func readFullTransfer(reader *transferReader, soa *SOARecord) ([]DnsRecord, error) {
+	records := []DnsRecord{soa}
+	for {
+		rec, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		if last, ok := rec.(*SOARecord); ok && last.Serial == soa.Serial {
+			return records, reader.session.Finish()
+		}
+		records = append(records, rec)
+	}
+}
+
+// RefreshZone brings a secondary zone up to date with IXFR. The primary
+// may answer with the whole zone instead, which replaces the contents.
+// It reports whether the zone changed.
+func RefreshZone(zone *Zone, primary string) (bool, error) {
+	current := zone.SOA()
+	reader, err := dialTransfer(zone.Origin, primary, IXFR, current, zone.key)
+	if err != nil {
+		return false, err
+	}
+	defer reader.conn.Close()
+
+	first, err := reader.next()
+	if err != nil {
+		return false, err
+	}
+	newSOA, ok := first.(*SOARecord)
+	if !ok {
+		return false, errors.New("Zone transfer does not start with an SOA record")
+	}
+	if !serialLess(current.Serial, newSOA.Serial) {
+		return false, reader.session.Finish()
+	}
+
+	second, err := reader.next()
+	if err != nil {
+		return false, err
+	}
+	oldSOA, ok := second.(*SOARecord)
+	if !ok || oldSOA.Serial == newSOA.Serial {
+		// AXFR style response: the second record is zone content.
+		reader.pending = append([]DnsRecord{second}, reader.pending...)
+		records, err := readFullTransfer(reader, newSOA)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("Received full copy of %s at serial %d\n", fqdn(zone.Origin), newSOA.Serial)
+		return true, zone.Replace(records)
+	}
+
+	diffs, err := readIncrementalTransfer(reader, oldSOA, newSOA.Serial)
+	if err != nil {
+		return false, err
+	}
+	for _, diff := range diffs {
+		if err := zone.ApplyDiff(diff); err != nil {
+			return false, err
+		}
+	}
+	fmt.Printf("Applied %d incremental changes to %s, now at serial %d\n", len(diffs), fqdn(zone.Origin), newSOA.Serial)
+	return true, nil
+}
+
+// readIncrementalTransfer parses the difference sequences of an IXFR
+// response: old SOA, deleted records, new SOA, added records, repeated
+// until the final SOA with the newest serial.
+func readIncrementalTransfer(reader *transferReader, oldSOA *SOARecord, finalSerial uint32) ([]ZoneDiff, error) {
+	diffs := []ZoneDiff{}
+	diff := ZoneDiff{OldSOA: oldSOA}
+	adding := false
+
+	for {
+		rec, err := reader.next()
+		if err != nil {
+			return nil, err
+		}
+		soa, isSOA := rec.(*SOARecord)
+
+		switch {
+		case !isSOA && adding:
+			diff.Added = append(diff.Added, rec)
+		case !isSOA:
+			diff.Deleted = append(diff.Deleted, rec)
+		case !adding:
+			diff.NewSOA = soa
+			adding = true
+		case soa.Serial == finalSerial:
+			return append(diffs, diff), reader.session.Finish()
+		default:
+			diffs = append(diffs, diff)
+			diff = ZoneDiff{OldSOA: soa}
+			adding = false
+		}
+	}
+}
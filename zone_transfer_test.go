@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serveTestTCP serves DNS over TCP on a local port and returns the
+// address.
+func serveTestTCP(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveStreamListener(listener)
+	return listener.Addr().String()
+}
+
+func transferTestZone(t *testing.T, origin string, hosts int) *Zone {
+	t.Helper()
+	lines := []string{
+		origin + ". 3600 IN SOA ns." + origin + ". admin." + origin + ". 1 3600 600 86400 300",
+		origin + ". 3600 IN NS ns." + origin + ".",
+		"ns." + origin + ". 3600 IN A 192.0.2.53",
+	}
+	for i := 0; i < hosts; i++ {
+		lines = append(lines, fmt.Sprintf("host%d.%s. 300 IN A 192.0.2.%d", i, origin, i%250+1))
+	}
+	zone := addTestZone(t, origin, lines...)
+	acl, err := ParseACL([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone.AllowTransfer = acl
+	return zone
+}
+
+func transferRequest(origin string, qtype uint16) *DnsPacket {
+	request := NewDnsPacket()
+	request.Header.ID = 99
+	request.Questions = append(request.Questions, NewDnsQuestion(origin, QueryTypeFromNum(qtype)))
+	return request
+}
+
+func TestServeTransfer(t *testing.T) {
+	zone := transferTestZone(t, "axfr.test", 2000)
+
+	var messages []*DnsPacket
+	collect := func(response *DnsPacket) error {
+		messages = append(messages, response)
+		return nil
+	}
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	if err := serveTransfer(local, "", transferRequest("axfr.test", AXFR), collect); err != nil {
+		t.Fatal(err)
+	}
+
+	// The zone doesn't fit in one message; every message fits the
+	// framing, only the first has the question, and the records start
+	// and end with the SOA.
+	if len(messages) < 2 {
+		t.Fatalf("%d records sent in %d messages", len(zone.Records())+1, len(messages))
+	}
+	records := []DnsRecord{}
+	for i, msg := range messages {
+		if msg.Header.ID != 99 || !msg.Header.AuthoritativeAnswer || msg.Header.ResCode != NOERROR {
+			t.Errorf("message %d has header %+v", i, msg.Header)
+		}
+		if (i == 0) != (len(msg.Questions) == 1) {
+			t.Errorf("message %d has %d questions", i, len(msg.Questions))
+		}
+		buffer := NewBytePacketBufferWithSize(MaxStreamMessageSize)
+		if err := msg.Write(buffer); err != nil || buffer.Pos() > transferMessageSize {
+			t.Errorf("message %d is %d bytes: %v", i, buffer.Pos(), err)
+		}
+		records = append(records, msg.Answers...)
+	}
+	if len(records) != len(zone.Records())+1 || recordType(records[0]) != SOA || recordType(records[len(records)-1]) != SOA {
+		t.Errorf("transfer has %d records, from %v to %v", len(records), records[0], records[len(records)-1])
+	}
+
+	// Clients outside the ACL, and unknown zones, are refused.
+	for _, c := range []struct {
+		remote net.Addr
+		origin string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}, "axfr.test"},
+		{local, "unknown.test"},
+	} {
+		messages = nil
+		if err := serveTransfer(c.remote, "", transferRequest(c.origin, AXFR), collect); err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 1 || messages[0].Header.ResCode != REFUSED || len(messages[0].Answers) != 0 {
+			t.Errorf("transfer of %s to %v: %v", c.origin, c.remote, messages)
+		}
+	}
+}
+
+func TestTransferZone(t *testing.T) {
+	zone := transferTestZone(t, "pull.test", 1000)
+	primary := serveTestTCP(t)
+
+	records, err := TransferZone("pull.test", primary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(recordStrings(records), "\n"), strings.Join(recordStrings(zone.Records()), "\n"); got != want {
+		t.Errorf("transferred zone differs:\n%s\nwant:\n%s", got, want)
+	}
+
+	zone.AllowTransfer = ACL{}
+	if _, err := TransferZone("pull.test", primary, nil); err == nil || !strings.Contains(err.Error(), "REFUSED") {
+		t.Errorf("transfer outside the ACL: %v", err)
+	}
+}
+
+func TestSecondaryWithoutPrimary(t *testing.T) {
+	// Nothing listens on port 1, so the secondary starts out empty.
+	zone, err := LoadZone(ZoneConfig{Origin: "secondary.test", Primary: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !zone.Expired() || zone.SOA() != nil {
+		t.Errorf("secondary without a copy: expired %v, SOA %v", zone.Expired(), zone.SOA())
+	}
+	if response := answer(zone, "www.secondary.test", A); response.Header.ResCode != SERVFAIL {
+		t.Errorf("expired zone answered:\n%v", response)
+	}
+}